@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3control"
+)
+
+// IsAccessPointARN reports whether the bucket is given as the ARN of an
+// access point rather than by its name.
+func IsAccessPointARN(bucket string) bool {
+	return arn.IsARN(bucket)
+}
+
+// IsOutpostARN reports whether the bucket is given as the ARN of an access
+// point of S3 on Outposts.
+func IsOutpostARN(bucket string) bool {
+	a, err := arn.Parse(bucket)
+	return err == nil && a.Service == "s3-outposts"
+}
+
+// IsAccessPointAlias reports whether the bucket is given as the alias of an
+// access point, which S3 accepts in place of a bucket name.
+func IsAccessPointAlias(bucket string) bool {
+	return strings.HasSuffix(bucket, "-s3alias") || strings.HasSuffix(bucket, "--op-s3")
+}
+
+// accessPointRegion checks an access point ARN given as the bucket, and
+// returns its region, where its requests have to be sent. Requests to
+// multi-region access points must be signed with SigV4A, which the SDK
+// doesn't support.
+func accessPointRegion(bucket string) (string, error) {
+	a, err := arn.Parse(bucket)
+	if err != nil {
+		return "", err
+	}
+	resource := strings.FieldsFunc(a.Resource, func(r rune) bool { return r == '/' || r == ':' })
+	switch {
+	case a.Service == "s3" && len(resource) == 2 && resource[0] == "accesspoint":
+	// arn:aws:s3-outposts:region:account:outpost/op-id/accesspoint/name
+	case a.Service == "s3-outposts" && len(resource) == 4 && resource[0] == "outpost" && resource[2] == "accesspoint":
+	default:
+		return "", fmt.Errorf("%s is not the ARN of an S3 or S3 on Outposts access point", bucket)
+	}
+	if a.Region == "" {
+		return "", fmt.Errorf("%s is a multi-region access point, which isn't supported; use the ARN of one of its regional access points", bucket)
+	}
+	return a.Region, nil
+}
+
+// accessPointBucket returns the name of the bucket of an access point given
+// by its ARN, as S3 Control reports it.
+func accessPointBucket(sess *session.Session, accessPoint string) (string, error) {
+	a, err := arn.Parse(accessPoint)
+	if err != nil {
+		return "", err
+	}
+	// access points on Outposts are named by their ARN
+	name := accessPoint
+	if a.Service == "s3" {
+		name = strings.TrimPrefix(strings.TrimPrefix(a.Resource, "accesspoint/"), "accesspoint:")
+	}
+	var resp *s3control.GetAccessPointOutput
+	err = withCredentials(func() (err error) {
+		resp, err = s3control.New(sess).GetAccessPoint(&s3control.GetAccessPointInput{
+			AccountId: aws.String(a.AccountID),
+			Name:      aws.String(name),
+		})
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	return aws.StringValue(resp.Bucket), nil
+}
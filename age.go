@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const day = 24 * time.Hour
+
+// Age is a flag holding how old objects are, as a duration such as 36h, or
+// in days, such as 90d.
+type Age time.Duration
+
+func (a *Age) String() string {
+	d := time.Duration(*a)
+	if d > 0 && d%day == 0 {
+		return fmt.Sprintf("%dd", d/day)
+	}
+	return d.String()
+}
+
+func (a *Age) Set(value string) error {
+	if days := strings.TrimSuffix(value, "d"); days != value {
+		n, err := strconv.Atoi(days)
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid age %q", value)
+		}
+		*a = Age(time.Duration(n) * day)
+		return nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		return fmt.Errorf("invalid age %q", value)
+	}
+	*a = Age(d)
+	return nil
+}
+
+// olderThanFilter spares objects last modified after the cutoff.
+func olderThanFilter(cutoff time.Time) Filter {
+	return DetailFilterFunc(func(detail *s3.Object) bool {
+		return detail.LastModified == nil || aws.TimeValue(detail.LastModified).After(cutoff)
+	})
+}
+
+// newerThanFilter spares objects last modified at or before the cutoff.
+func newerThanFilter(cutoff time.Time) Filter {
+	return DetailFilterFunc(func(detail *s3.Object) bool {
+		return detail.LastModified == nil || !aws.TimeValue(detail.LastModified).After(cutoff)
+	})
+}
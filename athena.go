@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/athena"
+)
+
+// AthenaResultLocation returns the s3:// URI of the CSV result set of a
+// query that succeeded.
+func AthenaResultLocation(client *athena.Athena, queryID string) (string, error) {
+	resp, err := client.GetQueryExecution(&athena.GetQueryExecutionInput{
+		QueryExecutionId: aws.String(queryID),
+	})
+	if err != nil {
+		return "", fmt.Errorf("athena query %s: %s", queryID, err)
+	}
+	execution := resp.QueryExecution
+	if state := aws.StringValue(execution.Status.State); state != athena.QueryExecutionStateSucceeded {
+		return "", fmt.Errorf("athena query %s is %s, not %s", queryID, state, athena.QueryExecutionStateSucceeded)
+	}
+	if aws.StringValue(execution.StatementType) != athena.StatementTypeDml {
+		return "", fmt.Errorf("athena query %s is not a SELECT query", queryID)
+	}
+	return aws.StringValue(execution.ResultConfiguration.OutputLocation), nil
+}
+
+func init() {
+	RegisterSource(&Source{
+		Name:     "athena",
+		KeyList:  true,
+		Selected: func(*SourceEnv) bool { return flagAthena != "" },
+		New: func(env *SourceEnv) (Scanner, error) {
+			if flagAthena == "" {
+				return nil, UsageError("Please provide the -athena-query-id to read the keys from")
+			}
+			client := athena.New(env.Session)
+			uncounted(&client.Handlers)
+			location, err := AthenaResultLocation(client, flagAthena)
+			if err != nil {
+				return nil, err
+			}
+			fs, err := NewS3FileScanner(location, env.Client)
+			if err != nil {
+				return nil, err
+			}
+			return NewCSVScanner(fs, flagColumn)
+		},
+	})
+}
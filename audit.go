@@ -0,0 +1,103 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// WriteAuditBundle packages the output file, with its metadata file if any,
+// and a JSON summary of the run into a gzipped tar file, along with a
+// SHA256SUMS manifest of them. The output file is streamed, never read in
+// memory as a whole.
+func WriteAuditBundle(path string, outputPath string, summary []byte) error {
+	// the metadata file of a CSV output goes along with it
+	files := []string{outputPath}
+	if _, err := os.Stat(outputPath + metadataFileSuffix); err == nil {
+		files = append(files, outputPath+metadataFileSuffix)
+	}
+	var manifest string
+	for _, file := range files {
+		sum, err := hashFile(file)
+		if err != nil {
+			return err
+		}
+		manifest += fmt.Sprintf("%s  %s\n", sum, filepath.Base(file))
+	}
+	summarySum := sha256.Sum256(summary)
+	manifest += fmt.Sprintf("%s  %s\n", hex.EncodeToString(summarySum[:]), "summary.json")
+
+	fd, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	gz := gzip.NewWriter(fd)
+	tw := tar.NewWriter(gz)
+	now := time.Now()
+
+	for _, file := range files {
+		if err := addTarFile(tw, filepath.Base(file), file); err != nil {
+			return err
+		}
+	}
+	if err := addTarBytes(tw, "summary.json", summary, now); err != nil {
+		return err
+	}
+	if err := addTarBytes(tw, "SHA256SUMS", []byte(manifest), now); err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	return fd.Close()
+}
+
+func hashFile(path string) (string, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer fd.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, fd); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func addTarFile(tw *tar.Writer, name string, path string) error {
+	fd, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	info, err := fd.Stat()
+	if err != nil {
+		return err
+	}
+	header := &tar.Header{Name: name, Mode: 0644, Size: info.Size(), ModTime: info.ModTime()}
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err = io.CopyN(tw, fd, info.Size())
+	return err
+}
+
+func addTarBytes(tw *tar.Writer, name string, data []byte, modTime time.Time) error {
+	header := &tar.Header{Name: name, Mode: 0644, Size: int64(len(data)), ModTime: modTime}
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err := tw.Write(data)
+	return err
+}
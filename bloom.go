@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"hash/fnv"
+	"io"
+	"math"
+	"os"
+)
+
+// DefaultBloomFPRate is the false positive rate of built Bloom filters.
+const DefaultBloomFPRate float64 = 0.001
+
+// bloomMagic starts every Bloom filter file. The file format is:
+//
+//	magic   8 bytes  "S3RMBLM1"
+//	bits    uint64   number of bits in the filter, a multiple of 64
+//	hashes  uint32   number of hash functions
+//	words   bits/64 uint64 words of the bit array
+//
+// All integers are little endian. Bit i is set in word i/64 at position
+// i%64. The hash functions derive from the two 64 bit halves h1, h2 of the
+// FNV-1a 128 bit hash of the key, each passed through the splitmix64
+// finalizer: hash n is (h1 + n*h2) mod bits.
+var bloomMagic = []byte("S3RMBLM1")
+
+// BloomFilter is a set of keys that may report false positives, but never
+// false negatives.
+type BloomFilter struct {
+	bits   uint64
+	hashes uint32
+	words  []uint64
+}
+
+// NewBloomFilter sizes a filter for n keys at the given false positive rate.
+func NewBloomFilter(n int64, fpRate float64) *BloomFilter {
+	if n < 1 {
+		n = 1
+	}
+	bits := uint64(math.Ceil(-float64(n) * math.Log(fpRate) / (math.Ln2 * math.Ln2)))
+	bits = (bits + 63) / 64 * 64
+	hashes := uint32(math.Round(float64(bits) / float64(n) * math.Ln2))
+	if hashes < 1 {
+		hashes = 1
+	}
+	return &BloomFilter{bits: bits, hashes: hashes, words: make([]uint64, bits/64)}
+}
+
+func (f *BloomFilter) locations(key string) (uint64, uint64) {
+	h := fnv.New128a()
+	h.Write([]byte(key))
+	sum := h.Sum(nil)
+	return mix(binary.BigEndian.Uint64(sum[:8])), mix(binary.BigEndian.Uint64(sum[8:]))
+}
+
+// mix is the splitmix64 finalizer, which makes up for the weak avalanche of
+// FNV on keys that only differ in their last bytes.
+func mix(h uint64) uint64 {
+	h ^= h >> 30
+	h *= 0xbf58476d1ce4e5b9
+	h ^= h >> 27
+	h *= 0x94d049bb133111eb
+	h ^= h >> 31
+	return h
+}
+
+func (f *BloomFilter) Add(key string) {
+	h1, h2 := f.locations(key)
+	for n := uint64(0); n < uint64(f.hashes); n++ {
+		bit := (h1 + n*h2) % f.bits
+		f.words[bit/64] |= 1 << (bit % 64)
+	}
+}
+
+// Contains reports whether the key may be in the set.
+func (f *BloomFilter) Contains(key string) bool {
+	h1, h2 := f.locations(key)
+	for n := uint64(0); n < uint64(f.hashes); n++ {
+		bit := (h1 + n*h2) % f.bits
+		if f.words[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (f *BloomFilter) WriteTo(w io.Writer) (int64, error) {
+	buf := bufio.NewWriter(w)
+	buf.Write(bloomMagic)
+	binary.Write(buf, binary.LittleEndian, f.bits)
+	binary.Write(buf, binary.LittleEndian, f.hashes)
+	if err := binary.Write(buf, binary.LittleEndian, f.words); err != nil {
+		return 0, err
+	}
+	return int64(len(bloomMagic) + 12 + len(f.words)*8), buf.Flush()
+}
+
+// LoadBloomFilter reads a filter file in the format described at bloomMagic.
+func LoadBloomFilter(file string) (*BloomFilter, error) {
+	fd, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+	r := bufio.NewReader(fd)
+
+	magic := make([]byte, len(bloomMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != string(bloomMagic) {
+		return nil, errors.New(file + " is not an s3rm Bloom filter")
+	}
+	f := &BloomFilter{}
+	if err := binary.Read(r, binary.LittleEndian, &f.bits); err != nil {
+		return nil, err
+	}
+	if err := binary.Read(r, binary.LittleEndian, &f.hashes); err != nil {
+		return nil, err
+	}
+	if f.bits == 0 || f.bits%64 != 0 || f.hashes == 0 {
+		return nil, errors.New(file + " has an invalid Bloom filter header")
+	}
+	f.words = make([]uint64, f.bits/64)
+	if err := binary.Read(r, binary.LittleEndian, f.words); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// BuildBloomFilter creates a Bloom filter file from a key file, compressed
+// as compression says. The key file is read twice, once to size the filter
+// and once to fill it.
+func BuildBloomFilter(keyFile string, compression string, out string, fpRate float64) error {
+	var n int64
+	scanner, err := NewCompressedFileScanner(keyFile, compression)
+	if err != nil {
+		return err
+	}
+	for scanner.Scan(DefaultBatchSize) {
+		n += int64(len(scanner.Objects()))
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	filter := NewBloomFilter(n, fpRate)
+	scanner, err = NewCompressedFileScanner(keyFile, compression)
+	if err != nil {
+		return err
+	}
+	for scanner.Scan(DefaultBatchSize) {
+		for _, obj := range scanner.Objects() {
+			filter.Add(*obj.Key)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	fd, err := os.Create(out)
+	if err != nil {
+		return err
+	}
+	if _, err := filter.WriteTo(fd); err != nil {
+		fd.Close()
+		return err
+	}
+	return fd.Close()
+}
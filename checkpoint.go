@@ -0,0 +1,251 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+// CompletionTracker follows batches that are dispatched in listing order but
+// complete in any order, and maintains a high-water mark: the last key of
+// the longest run of completed batches starting with the first one. Every
+// key listed up to and including the mark has been dealt with, which makes
+// it a safe point to restart a listing from. A failed batch holds the mark
+// back for the rest of the run.
+//
+// Alongside the mark, the tracker keeps the offset of the mark: how many
+// keys the source had read up to the end of the batch, which is where a
+// key list that isn't sorted can be resumed from.
+type CompletionTracker struct {
+	mu         sync.Mutex
+	next       uint64
+	done       uint64
+	lastKeys   map[uint64]string
+	offsets    map[uint64]int64
+	complete   map[uint64]bool
+	failed     int64
+	mark       string
+	markOffset int64
+}
+
+func NewCompletionTracker() *CompletionTracker {
+	return &CompletionTracker{
+		lastKeys: make(map[uint64]string),
+		offsets:  make(map[uint64]int64),
+		complete: make(map[uint64]bool),
+	}
+}
+
+// Dispatch registers the next batch by its last key and the offset of the
+// source after it, and returns the sequence number to complete it with.
+func (t *CompletionTracker) Dispatch(lastKey string, offset int64) uint64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	seq := t.next
+	t.next++
+	t.lastKeys[seq] = lastKey
+	t.offsets[seq] = offset
+	return seq
+}
+
+// Complete marks a batch as done and advances the mark past every batch
+// that is now part of the completed run.
+func (t *CompletionTracker) Complete(seq uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.complete[seq] = true
+	for t.complete[t.done] {
+		t.mark = t.lastKeys[t.done]
+		if offset := t.offsets[t.done]; offset > t.markOffset {
+			t.markOffset = offset
+		}
+		delete(t.complete, t.done)
+		delete(t.lastKeys, t.done)
+		delete(t.offsets, t.done)
+		t.done++
+	}
+}
+
+// Fail records a batch that didn't complete. It is never removed, so the
+// mark can't advance past it.
+func (t *CompletionTracker) Fail(seq uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.failed++
+}
+
+// HighWaterMark returns the mark, or an empty string if the first batch
+// hasn't completed yet.
+func (t *CompletionTracker) HighWaterMark() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.mark
+}
+
+// Offset returns the offset of the mark.
+func (t *CompletionTracker) Offset() int64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.markOffset
+}
+
+// Failed returns the number of failed batches.
+func (t *CompletionTracker) Failed() int64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.failed
+}
+
+// ShardMark is where the listing of a shard, a prefix a version listing is
+// split into, resumes from: after version VersionIdMarker of key KeyMarker.
+// Done is set once the shard was listed in full and all of it dealt with.
+type ShardMark struct {
+	KeyMarker       string `json:"key_marker,omitempty"`
+	VersionIdMarker string `json:"version_id_marker,omitempty"`
+	Done            bool   `json:"done,omitempty"`
+}
+
+// ShardCheckpoint keeps a mark per shard of a version listing, as the
+// CompletionTracker does for the whole of a listing read in order. Shards
+// are listed concurrently, but the batches of each shard are dispatched in
+// the order the shard was listed in, so each mark is where the shard
+// resumes from after the longest run of completed batches of its shard. A
+// failed batch holds the mark of its shard back for the rest of the run.
+type ShardCheckpoint struct {
+	mu      sync.Mutex
+	shards  map[string]*shardProgress
+	batches map[uint64]*shardBatchEnd
+}
+
+// shardProgress is the mark of a shard and the batches dispatched past it.
+type shardProgress struct {
+	mark     ShardMark
+	pending  []uint64
+	complete map[uint64]bool
+	listed   bool
+}
+
+// shardBatchEnd is the shard of a batch and where it resumes from after
+// the batch, if the batch moves its mark.
+type shardBatchEnd struct {
+	shard string
+	mark  *ShardMark
+}
+
+// NewShardCheckpoint returns a checkpoint starting from the marks of an
+// earlier run, if any.
+func NewShardCheckpoint(marks map[string]*ShardMark) *ShardCheckpoint {
+	c := &ShardCheckpoint{
+		shards:  make(map[string]*shardProgress),
+		batches: make(map[uint64]*shardBatchEnd),
+	}
+	for shard, mark := range marks {
+		c.shards[shard] = &shardProgress{mark: *mark, complete: make(map[uint64]bool)}
+	}
+	return c
+}
+
+// Copy returns a checkpoint starting from the current marks.
+func (c *ShardCheckpoint) Copy() *ShardCheckpoint {
+	return NewShardCheckpoint(c.Marks())
+}
+
+// progress returns the progress of a shard, adding it if it is new.
+func (c *ShardCheckpoint) progress(shard string) (*shardProgress, bool) {
+	p, ok := c.shards[shard]
+	if !ok {
+		p = &shardProgress{complete: make(map[uint64]bool)}
+		c.shards[shard] = p
+	}
+	return p, !ok
+}
+
+// Found records a shard found by a listing, and returns false if it was
+// known already.
+func (c *ShardCheckpoint) Found(shard string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, found := c.progress(shard)
+	return found
+}
+
+// Resume sets the scanner up to list its prefix from the mark of the
+// shard, and returns false if the shard is done with.
+func (c *ShardCheckpoint) Resume(s *VersionScanner) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	p, _ := c.progress(s.Prefix)
+	s.ResumeAfter(p.mark.KeyMarker, p.mark.VersionIdMarker)
+	return !p.mark.Done
+}
+
+// Pending returns the shards under prefix, other than prefix itself, that
+// are not done with, in order.
+func (c *ShardCheckpoint) Pending(prefix string) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var shards []string
+	for shard, p := range c.shards {
+		if shard != prefix && strings.HasPrefix(shard, prefix) && !p.mark.Done {
+			shards = append(shards, shard)
+		}
+	}
+	sort.Strings(shards)
+	return shards
+}
+
+// Dispatch registers the next batch of a shard by its sequence number and
+// where the shard resumes from once it is dealt with. The mark is nil for
+// batches that don't move it: those split from the same page of a listing
+// as a later batch, and those of its last page.
+func (c *ShardCheckpoint) Dispatch(seq uint64, shard string, mark *ShardMark) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	p, _ := c.progress(shard)
+	p.pending = append(p.pending, seq)
+	c.batches[seq] = &shardBatchEnd{shard: shard, mark: mark}
+}
+
+// Complete marks a batch as done and advances the mark of its shard past
+// every batch that is now part of the completed run. Batches that weren't
+// dispatched by shard are ignored.
+func (c *ShardCheckpoint) Complete(seq uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	end, ok := c.batches[seq]
+	if !ok {
+		return
+	}
+	p := c.shards[end.shard]
+	p.complete[seq] = true
+	for len(p.pending) > 0 && p.complete[p.pending[0]] {
+		if done := c.batches[p.pending[0]]; done.mark != nil {
+			p.mark.KeyMarker, p.mark.VersionIdMarker = done.mark.KeyMarker, done.mark.VersionIdMarker
+		}
+		delete(p.complete, p.pending[0])
+		delete(c.batches, p.pending[0])
+		p.pending = p.pending[1:]
+	}
+	p.mark.Done = p.listed && len(p.pending) == 0
+}
+
+// Listed records that every batch of a shard was dispatched.
+func (c *ShardCheckpoint) Listed(shard string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	p, _ := c.progress(shard)
+	p.listed = true
+	p.mark.Done = len(p.pending) == 0
+}
+
+// Marks returns the mark of each shard.
+func (c *ShardCheckpoint) Marks() map[string]*ShardMark {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	marks := make(map[string]*ShardMark, len(c.shards))
+	for shard, p := range c.shards {
+		mark := p.mark
+		marks[shard] = &mark
+	}
+	return marks
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+func TestCompletionTracker(t *testing.T) {
+	// batches are dispatched in listing order, with the offset of the source
+	// after each
+	batches := []struct {
+		lastKey string
+		offset  int64
+	}{
+		{"a", 10}, {"b", 20}, {"c", 30}, {"d", 40}, {"e", 50},
+	}
+	tests := []struct {
+		name       string
+		complete   []uint64
+		fail       []uint64
+		wantMark   string
+		wantOffset int64
+		wantFailed int64
+	}{
+		{
+			name: "nothing completed",
+		},
+		{
+			name:       "in order",
+			complete:   []uint64{0, 1, 2, 3, 4},
+			wantMark:   "e",
+			wantOffset: 50,
+		},
+		{
+			name:       "out of order",
+			complete:   []uint64{3, 1, 0, 4, 2},
+			wantMark:   "e",
+			wantOffset: 50,
+		},
+		{
+			name:     "first batch still in flight",
+			complete: []uint64{1, 2, 3, 4},
+		},
+		{
+			name:       "gap in flight",
+			complete:   []uint64{0, 1, 3, 4},
+			wantMark:   "b",
+			wantOffset: 20,
+		},
+		{
+			name:       "failed batch",
+			complete:   []uint64{0, 1, 3, 4},
+			fail:       []uint64{2},
+			wantMark:   "b",
+			wantOffset: 20,
+			wantFailed: 1,
+		},
+		{
+			name:       "first batch failed",
+			complete:   []uint64{1, 2, 3, 4},
+			fail:       []uint64{0},
+			wantFailed: 1,
+		},
+		{
+			name:       "failed batches",
+			complete:   []uint64{0, 2},
+			fail:       []uint64{1, 3, 4},
+			wantMark:   "a",
+			wantOffset: 10,
+			wantFailed: 3,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tracker := NewCompletionTracker()
+			for i, batch := range batches {
+				if seq := tracker.Dispatch(batch.lastKey, batch.offset); seq != uint64(i) {
+					t.Fatalf("batch %d dispatched as %d", i, seq)
+				}
+			}
+			for _, seq := range tt.fail {
+				tracker.Fail(seq)
+			}
+			var mark string
+			for _, seq := range tt.complete {
+				tracker.Complete(seq)
+				// the mark only moves forward
+				if next := tracker.HighWaterMark(); next < mark {
+					t.Fatalf("mark went back from %q to %q", mark, next)
+				} else {
+					mark = next
+				}
+			}
+			if mark := tracker.HighWaterMark(); mark != tt.wantMark {
+				t.Errorf("got mark %q, want %q", mark, tt.wantMark)
+			}
+			if offset := tracker.Offset(); offset != tt.wantOffset {
+				t.Errorf("got offset %d, want %d", offset, tt.wantOffset)
+			}
+			if failed := tracker.Failed(); failed != tt.wantFailed {
+				t.Errorf("got %d failed batches, want %d", failed, tt.wantFailed)
+			}
+		})
+	}
+}
+
+func TestShardCheckpoint(t *testing.T) {
+	// batches of two shards, dispatched interleaved, by where their shard
+	// resumes from after them
+	batches := []struct {
+		shard string
+		mark  *ShardMark
+	}{
+		{"a/", &ShardMark{KeyMarker: "a/1", VersionIdMarker: "v2"}},
+		{"b/", &ShardMark{KeyMarker: "b/1", VersionIdMarker: "v1"}},
+		// split from the page of the next batch
+		{"a/", nil},
+		{"a/", &ShardMark{KeyMarker: "a/2", VersionIdMarker: "v1"}},
+		// the last page of the shard
+		{"b/", nil},
+	}
+	tests := []struct {
+		name     string
+		complete []uint64
+		listed   []string
+		want     map[string]ShardMark
+	}{
+		{
+			name: "nothing completed",
+			want: map[string]ShardMark{"a/": {}, "b/": {}},
+		},
+		{
+			name:     "in order",
+			complete: []uint64{0, 1, 2},
+			want:     map[string]ShardMark{"a/": {KeyMarker: "a/1", VersionIdMarker: "v2"}, "b/": {KeyMarker: "b/1", VersionIdMarker: "v1"}},
+		},
+		{
+			name:     "gap in one shard",
+			complete: []uint64{0, 3, 4, 1},
+			want:     map[string]ShardMark{"a/": {KeyMarker: "a/1", VersionIdMarker: "v2"}, "b/": {KeyMarker: "b/1", VersionIdMarker: "v1"}},
+		},
+		{
+			name:     "listed with a batch in flight",
+			complete: []uint64{0, 2, 1},
+			listed:   []string{"a/", "b/"},
+			want:     map[string]ShardMark{"a/": {KeyMarker: "a/1", VersionIdMarker: "v2"}, "b/": {KeyMarker: "b/1", VersionIdMarker: "v1"}},
+		},
+		{
+			name:     "listed and completed",
+			complete: []uint64{4, 3, 2, 1, 0},
+			listed:   []string{"a/"},
+			want:     map[string]ShardMark{"a/": {KeyMarker: "a/2", VersionIdMarker: "v1", Done: true}, "b/": {KeyMarker: "b/1", VersionIdMarker: "v1"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewShardCheckpoint(nil)
+			for seq, batch := range batches {
+				c.Dispatch(uint64(seq), batch.shard, batch.mark)
+			}
+			for _, shard := range tt.listed {
+				c.Listed(shard)
+			}
+			for _, seq := range tt.complete {
+				c.Complete(seq)
+			}
+			marks := c.Marks()
+			for shard, want := range tt.want {
+				if got := marks[shard]; got == nil || *got != want {
+					t.Errorf("shard %s: got mark %+v, want %+v", shard, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestShardCheckpointResumes(t *testing.T) {
+	c := NewShardCheckpoint(map[string]*ShardMark{
+		"p/a/": {KeyMarker: "p/a/1", VersionIdMarker: "v1"},
+		"p/b/": {Done: true},
+		"p/c/": {},
+		"q/a/": {},
+	})
+	if pending := c.Pending("p/"); strings.Join(pending, ",") != "p/a/,p/c/" {
+		t.Errorf("got pending shards %q, want p/a/ and p/c/", pending)
+	}
+	if c.Found("p/a/") || c.Found("p/b/") {
+		t.Error("shards of the run resumed found as new")
+	}
+	if !c.Found("p/d/") {
+		t.Error("new shard not found as new")
+	}
+
+	vs := &VersionScanner{Prefix: "p/a/"}
+	if !c.Resume(vs) {
+		t.Error("shard in progress is done with")
+	}
+	if key, id := aws.StringValue(vs.keyMarker), aws.StringValue(vs.versionIDMarker); key != "p/a/1" || id != "v1" {
+		t.Errorf("resumed after %s %s, want p/a/1 v1", key, id)
+	}
+	if c.Resume(&VersionScanner{Prefix: "p/b/"}) {
+		t.Error("shard done with is listed again")
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+// ConfigFile holds the settings an organization applies to every run, which
+// no flag overrides. It is set at build time with
+// -ldflags "-X main.ConfigFile=...". A missing file applies no settings.
+var ConfigFile = "/etc/s3rm.conf"
+
+// Config is the content of the ConfigFile.
+type Config struct {
+	// protected holds the prefixes nothing is deleted under, by bucket, or
+	// for every bucket under the empty name. An empty prefix protects the
+	// whole bucket.
+	protected map[string][]string
+}
+
+// ReadConfig reads a configuration file of one "setting value" per line.
+// Empty lines and lines starting with # are skipped. The only setting is
+// protected-prefix, either a prefix protected in every bucket, or an
+// s3://bucket/prefix URI for a single bucket.
+func ReadConfig(path string) (*Config, error) {
+	config := &Config{protected: make(map[string][]string)}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return config, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 || fields[0] != "protected-prefix" {
+			return nil, fmt.Errorf("%s:%d: expected a protected-prefix setting, got %q", path, n, line)
+		}
+		bucket, prefix := "", fields[1]
+		if strings.HasPrefix(prefix, "s3://") {
+			if bucket, prefix, err = ParseS3Prefix(prefix); err != nil {
+				return nil, fmt.Errorf("%s:%d: %s", path, n, err)
+			}
+		}
+		config.protected[bucket] = append(config.protected[bucket], prefix)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// ProtectedPrefixes returns the prefixes protected in the bucket.
+func (c *Config) ProtectedPrefixes(bucket string) []string {
+	var prefixes []string
+	prefixes = append(prefixes, c.protected[""]...)
+	return append(prefixes, c.protected[bucket]...)
+}
+
+// BucketScoped reports whether prefixes are protected in single buckets.
+func (c *Config) BucketScoped() bool {
+	for bucket := range c.protected {
+		if bucket != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// ProtectedBucket returns the name of the bucket whose protected prefixes
+// apply to a run on bucket: the bucket of an access point given by its ARN.
+// The bucket of an alias can't be looked up, which refuses the run.
+func ProtectedBucket(sess *session.Session, bucket string) (string, error) {
+	switch {
+	case IsAccessPointARN(bucket):
+		name, err := accessPointBucket(sess, bucket)
+		if err != nil {
+			return "", fmt.Errorf("refusing to run: can't find the bucket of access point %s to check the prefixes protected by %s: %s", bucket, ConfigFile, err)
+		}
+		return name, nil
+	case IsAccessPointAlias(bucket):
+		return "", fmt.Errorf("refusing to run: the bucket of access point alias %s can't be checked against the prefixes protected by %s, use the access point ARN or the bucket name", bucket, ConfigFile)
+	}
+	return bucket, nil
+}
+
+// CheckProtectedPrefixes returns an error if the bucket is protected as a
+// whole, or if any of the prefixes is under a protected prefix. Prefixes
+// above a protected one are allowed, the keys under it are spared.
+func CheckProtectedPrefixes(bucket string, prefixes []string, protected []string) error {
+	for _, p := range protected {
+		if p == "" {
+			return fmt.Errorf("refusing to run: bucket %s is protected by %s", bucket, ConfigFile)
+		}
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(prefix, p) {
+				return fmt.Errorf("refusing to run: prefix %q is under %q, which is protected by %s", prefix, p, ConfigFile)
+			}
+		}
+	}
+	return nil
+}
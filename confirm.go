@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// ConfirmEmptyBucket shows what emptying the bucket means and asks for its
+// name to be typed back on the terminal. The estimate may be nil.
+func ConfirmEmptyBucket(bucket string, estimate *BucketEstimate) error {
+	if !isTerminal() {
+		return errors.New("refusing to empty the bucket without confirmation; pass -yes when not running in a terminal")
+	}
+	size := "an unknown number of objects"
+	if estimate != nil {
+		size = fmt.Sprintf("about %d objects, %s", estimate.Objects, formatBytes(estimate.Bytes))
+	}
+	fmt.Fprintln(os.Stderr, strings.Repeat("=", 72))
+	fmt.Fprintf(os.Stderr, "  EVERY OBJECT in bucket %s will be deleted\n", bucket)
+	fmt.Fprintf(os.Stderr, "  The bucket holds %s\n", size)
+	fmt.Fprintln(os.Stderr, strings.Repeat("=", 72))
+	return confirmBucketName(bucket)
+}
+
+// confirmBucketName asks for the bucket name to be typed back.
+func confirmBucketName(bucket string) error {
+	fmt.Fprint(os.Stderr, "Type the bucket name to continue: ")
+
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(line) != bucket {
+		return errors.New("the bucket name doesn't match, nothing was deleted")
+	}
+	return nil
+}
+
+// ConfirmBuckets lists the buckets a run is going to delete from and asks
+// for yes to be typed on the terminal.
+func ConfirmBuckets(jobs []*BucketJob) error {
+	if !isTerminal() {
+		return errors.New("refusing to delete from matching buckets without confirmation; pass -yes when not running in a terminal")
+	}
+	fmt.Fprintf(os.Stderr, "Objects will be deleted from %d buckets:\n", len(jobs))
+	for _, job := range jobs {
+		fmt.Fprintf(os.Stderr, "  %s (%s)\n", job.Bucket, job.Region)
+	}
+	fmt.Fprint(os.Stderr, "Type yes to continue: ")
+
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(line) != "yes" {
+		return errors.New("not confirmed, nothing was deleted")
+	}
+	return nil
+}
+
+// PreviewKeys is how many of the matching keys are shown before a run
+// starts deleting, and previewListLimit how many keys are listed at most to
+// find them.
+const (
+	PreviewKeys      = 20
+	previewListLimit = 10 * DefaultBatchSize
+)
+
+// RunPreview is the start of what a run is about to delete.
+type RunPreview struct {
+	// Keys are the first matching keys
+	Keys []string
+	// Listed keys were read from the source, Matched of them weren't spared
+	// by the filters, not counting the lookups
+	Listed  int64
+	Matched int64
+	// Done is set when the whole source was read
+	Done bool
+	// Total is the estimated number of keys of the source, if known
+	Total      int64
+	TotalKnown bool
+}
+
+// NewRunPreview reads the first keys of a scanner of its own, until it found
+// PreviewKeys matching ones. At least two batches are read, so sources that
+// fit in one are counted in full.
+func NewRunPreview(scanner Scanner, filters *FilterChain) (*RunPreview, error) {
+	p := &RunPreview{}
+	for batches := 0; ; batches++ {
+		if p.Listed >= int64(previewListLimit) || (len(p.Keys) >= PreviewKeys && batches > 1) {
+			break
+		}
+		if !scanner.Scan(DefaultBatchSize) {
+			if err := scanner.Err(); err != nil {
+				return nil, err
+			}
+			p.Done = true
+			break
+		}
+		p.add(scanner, filters)
+	}
+	if ps, ok := scanner.(ProgressScanner); ok {
+		p.Total, p.TotalKnown = ps.EstimatedTotal()
+	}
+	return p, nil
+}
+
+// add counts the keys of the last batch of the scanner, keeping the first
+// matching ones.
+func (p *RunPreview) add(scanner Scanner, filters *FilterChain) {
+	var details map[*s3.ObjectIdentifier]*s3.Object
+	if ds, ok := scanner.(DetailScanner); ok {
+		details = ds.Details()
+	}
+	for _, object := range scanner.Objects() {
+		p.Listed++
+		if filters.SparesListed(object, details[object]) {
+			continue
+		}
+		p.Matched++
+		if len(p.Keys) < PreviewKeys {
+			key := aws.StringValue(object.Key)
+			if object.VersionId != nil {
+				key += " (version " + aws.StringValue(object.VersionId) + ")"
+			}
+			p.Keys = append(p.Keys, key)
+		}
+	}
+}
+
+// Estimate describes how many objects the run is expected to delete.
+func (p *RunPreview) Estimate() string {
+	switch {
+	case p.Done:
+		return fmt.Sprintf("%d of the %d keys listed match", p.Matched, p.Listed)
+	case p.TotalKnown && p.Listed > 0:
+		return fmt.Sprintf("%d of the first %d keys listed match, about %d of %d in total", p.Matched, p.Listed, p.Expected(), p.Total)
+	default:
+		return fmt.Sprintf("%d of the first %d keys listed match, the total is unknown", p.Matched, p.Listed)
+	}
+}
+
+// Expected is the number of objects the run is expected to delete: the
+// estimate when there is one, or else the number matched so far.
+func (p *RunPreview) Expected() int64 {
+	if !p.Done && p.TotalKnown && p.Listed > 0 {
+		return p.Total * p.Matched / p.Listed
+	}
+	return p.Matched
+}
+
+// ConfirmRun shows the bucket, where the keys come from, the filters and
+// the preview of a run, and asks for yes to be typed on the terminal, or
+// with typeName, for the bucket name.
+func ConfirmRun(bucket string, from string, filters []string, preview *RunPreview, typeName bool) error {
+	fmt.Fprintln(os.Stderr, strings.Repeat("=", 72))
+	fmt.Fprintf(os.Stderr, "  Objects will be deleted from bucket %s\n", bucket)
+	fmt.Fprintf(os.Stderr, "  Keys: %s\n", from)
+	if len(filters) > 0 {
+		fmt.Fprintf(os.Stderr, "  Filters: %s\n", strings.Join(filters, ", "))
+	}
+	if len(preview.Keys) > 0 {
+		fmt.Fprintf(os.Stderr, "  First matching keys:\n")
+		for _, key := range preview.Keys {
+			fmt.Fprintf(os.Stderr, "    %s\n", key)
+		}
+	}
+	fmt.Fprintf(os.Stderr, "  %s\n", preview.Estimate())
+	fmt.Fprintln(os.Stderr, strings.Repeat("=", 72))
+	if typeName {
+		return confirmBucketName(bucket)
+	}
+	fmt.Fprint(os.Stderr, "Type yes to continue: ")
+
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(line) != "yes" {
+		return errors.New("not confirmed, nothing was deleted")
+	}
+	return nil
+}
+
+// formatBytes formats a size with binary units.
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
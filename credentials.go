@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"golang.org/x/term"
+)
+
+// renewableProvider serves the session's credentials until they are
+// replaced by credentials entered interactively.
+type renewableProvider struct {
+	mu       sync.Mutex
+	base     *credentials.Credentials
+	override *credentials.Value
+}
+
+func (p *renewableProvider) Retrieve() (credentials.Value, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.override != nil {
+		return *p.override, nil
+	}
+	return p.base.Get()
+}
+
+func (p *renewableProvider) IsExpired() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.override == nil && p.base.IsExpired()
+}
+
+func (p *renewableProvider) set(value credentials.Value) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.override = &value
+}
+
+// CredentialGate renews expired credentials mid-run. The first task to find
+// its credentials expired renews them while the others wait, which pauses
+// the pipeline; tasks then retry the request that failed, so batches aren't
+// failed because of the expiry. Credentials are first refreshed through the
+// session's provider, then, on a terminal, asked for. Once they can't be
+// renewed, every task is given the same error.
+type CredentialGate struct {
+	mu          sync.Mutex
+	generation  uint64
+	failed      error
+	provider    *renewableProvider
+	credentials *credentials.Credentials
+	client      *s3.S3
+	bucket      string
+}
+
+// NewCredentialGate replaces the session's credentials with renewable ones.
+// It must be called before clients are created from the config.
+func NewCredentialGate(config *aws.Config) *CredentialGate {
+	provider := &renewableProvider{base: config.Credentials}
+	config.Credentials = credentials.NewCredentials(provider)
+	return &CredentialGate{provider: provider, credentials: config.Credentials}
+}
+
+// Probe sets the client and bucket used to check renewed credentials.
+func (g *CredentialGate) Probe(client *s3.S3, bucket string) {
+	g.client = client
+	g.bucket = bucket
+}
+
+// Generation identifies the current credentials. It must be read before
+// sending the request whose failure may be passed to Renew.
+func (g *CredentialGate) Generation() uint64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.generation
+}
+
+// Renew renews the credentials of the given generation. If they were already
+// renewed by another task, it returns right away.
+func (g *CredentialGate) Renew(generation uint64) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.failed != nil {
+		return g.failed
+	}
+	if generation != g.generation {
+		return nil
+	}
+
+	fmt.Fprintln(os.Stderr, "\ncredentials expired, pausing to renew them")
+	g.provider.base.Expire()
+	g.credentials.Expire()
+	err := g.probe()
+	for isExpiredToken(err) && isTerminal() {
+		var value credentials.Value
+		value, err = promptCredentials()
+		if err != nil {
+			break
+		}
+		g.provider.set(value)
+		g.credentials.Expire()
+		err = g.probe()
+	}
+	if err != nil {
+		g.failed = err
+		return err
+	}
+	g.generation++
+	fmt.Fprintln(os.Stderr, "credentials renewed, resuming")
+	return nil
+}
+
+func (g *CredentialGate) probe() error {
+	_, err := g.client.ListObjectsV2(&s3.ListObjectsV2Input{
+		Bucket:  aws.String(g.bucket),
+		MaxKeys: aws.Int64(1),
+	})
+	return err
+}
+
+// renewFailed is set to 1 once expired credentials couldn't be renewed.
+var renewFailed int32
+
+// withCredentials runs the operation, renewing the credentials and running
+// it again as long as they are found expired. If they can't be renewed, the
+// run is aborted and the expired token error returned, so the run shuts
+// down like any other aborted run.
+func withCredentials(operation func() error) error {
+	for {
+		generation := credentialGate.Generation()
+		err := operation()
+		if !isExpiredToken(err) {
+			return err
+		}
+		if rerr := credentialGate.Renew(generation); rerr != nil {
+			abortRenewal(rerr)
+			return err
+		}
+	}
+}
+
+// abortRenewal aborts the run after expired credentials couldn't be renewed,
+// unless it was already aborted.
+func abortRenewal(err error) {
+	if !atomic.CompareAndSwapInt32(&renewFailed, 0, 1) {
+		return
+	}
+	abort(fmt.Sprintf("failed to renew expired credentials: %s", err))
+}
+
+func isExpiredToken(err error) bool {
+	if aerr, ok := err.(awserr.Error); ok {
+		switch aerr.Code() {
+		case "ExpiredToken", "ExpiredTokenException":
+			return true
+		}
+	}
+	return false
+}
+
+func isTerminal() bool {
+	info, err := os.Stdin.Stat()
+	if err != nil || info.Mode()&os.ModeCharDevice == 0 {
+		return false
+	}
+	// unattended runs often read from /dev/null, a character device too
+	null, err := os.Stat(os.DevNull)
+	return err != nil || !os.SameFile(info, null)
+}
+
+// promptCredentials asks for new credentials on the terminal. The secret
+// key and the session token aren't echoed, so they don't stay on screen.
+func promptCredentials() (credentials.Value, error) {
+	r := bufio.NewReader(os.Stdin)
+	ask := func(prompt string) (string, error) {
+		fmt.Fprint(os.Stderr, prompt)
+		line, err := r.ReadString('\n')
+		return strings.TrimSpace(line), err
+	}
+	askSecret := func(prompt string) (string, error) {
+		fmt.Fprint(os.Stderr, prompt)
+		secret, err := term.ReadPassword(int(os.Stdin.Fd()))
+		fmt.Fprintln(os.Stderr)
+		return strings.TrimSpace(string(secret)), err
+	}
+	value := credentials.Value{ProviderName: "PromptProvider"}
+	var err error
+	if value.AccessKeyID, err = ask("AWS access key ID: "); err != nil {
+		return value, err
+	}
+	if value.SecretAccessKey, err = askSecret("AWS secret access key: "); err != nil {
+		return value, err
+	}
+	if value.SessionToken, err = askSecret("AWS session token (optional): "); err != nil {
+		return value, err
+	}
+	return value, nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// DecodedScanner URL-decodes the keys of another scanner, for lists of keys
+// percent-encoded as in RFC 3986, such as exports of inventory reports.
+// Unlike in query strings, "+" is kept as is rather than decoded to a space.
+// A key that isn't validly encoded stops the scan, rather than risking the
+// deletion of the wrong key.
+type DecodedScanner struct {
+	Scanner Scanner
+	err     error
+}
+
+func NewDecodedScanner(scanner Scanner) *DecodedScanner {
+	return &DecodedScanner{Scanner: scanner}
+}
+
+func (s *DecodedScanner) Scan(count int) bool {
+	if s.err != nil || !s.Scanner.Scan(count) {
+		return false
+	}
+	// the identifiers are updated in place, so details still match them
+	for _, object := range s.Scanner.Objects() {
+		key, err := url.PathUnescape(aws.StringValue(object.Key))
+		if err != nil {
+			s.err = fmt.Errorf("key %q can't be decoded: %s", aws.StringValue(object.Key), err)
+			return false
+		}
+		object.Key = aws.String(key)
+	}
+	return true
+}
+
+func (s *DecodedScanner) Err() error {
+	if s.err != nil {
+		return s.err
+	}
+	return s.Scanner.Err()
+}
+
+func (s *DecodedScanner) Objects() []*s3.ObjectIdentifier {
+	return s.Scanner.Objects()
+}
+
+// Unwrap returns the scanner the keys are read from.
+func (s *DecodedScanner) Unwrap() Scanner {
+	return s.Scanner
+}
+
+func (s *DecodedScanner) Details() map[*s3.ObjectIdentifier]*s3.Object {
+	if ds, ok := s.Scanner.(DetailScanner); ok {
+		return ds.Details()
+	}
+	return nil
+}
+
+func (s *DecodedScanner) EmittedKeys() int64 {
+	if ps, ok := s.Scanner.(ProgressScanner); ok {
+		return ps.EmittedKeys()
+	}
+	return 0
+}
+
+func (s *DecodedScanner) EstimatedTotal() (int64, bool) {
+	if ps, ok := s.Scanner.(ProgressScanner); ok {
+		return ps.EstimatedTotal()
+	}
+	return 0, false
+}
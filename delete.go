@@ -0,0 +1,617 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/cenkalti/backoff"
+)
+
+// Delete modes select how objects are deleted. Batch mode uses
+// DeleteObjects, single mode uses one DeleteObject request per key for S3
+// compatible stores without multi-object delete, and auto mode starts in
+// batch mode and switches to single mode for the rest of the run if
+// DeleteObjects isn't supported.
+const (
+	DeleteModeBatch  = "batch"
+	DeleteModeSingle = "single"
+	DeleteModeAuto   = "auto"
+
+	// SingleDeleteConcurrency is the number of DeleteObject requests each
+	// task has in flight in single mode.
+	SingleDeleteConcurrency = 8
+
+	// DefaultMaxBatchBytes caps the approximate size of a DeleteObjects
+	// request body, well under what S3 accepts.
+	DefaultMaxBatchBytes int = 512 * 1024
+
+	// batchObjectOverhead is the size of the XML around each key, and
+	// batchVersionOverhead around each version ID.
+	batchObjectOverhead  = len("<Object><Key></Key></Object>")
+	batchVersionOverhead = len("<VersionId></VersionId>")
+
+	// batchRequestOverhead is the size of the XML around the objects.
+	batchRequestOverhead = len(`<Delete xmlns="http://s3.amazonaws.com/doc/2006-03-01/"><Quiet>true</Quiet></Delete>`)
+
+	// ConcurrentModificationThreshold is the share of keys in a batch that
+	// can be reported missing before a concurrent purge is suspected.
+	ConcurrentModificationThreshold = 0.1
+)
+
+var (
+	// singleFallback is set once auto mode found DeleteObjects unsupported.
+	singleFallback int32
+
+	// concurrentWarning is set once concurrent modification was reported.
+	concurrentWarning int32
+)
+
+type DeleteTask struct {
+	client    *s3.S3
+	dryrun    bool
+	mode      string
+	bypass    bool
+	release   bool
+	seq       uint64
+	details   map[*s3.ObjectIdentifier]*s3.Object
+	markers   map[*s3.ObjectIdentifier]bool
+	Bucket    string
+	Partition string
+	Objects   []*s3.ObjectIdentifier
+}
+
+// KeyError is the failure to delete a single key.
+type KeyError struct {
+	Object *s3.ObjectIdentifier
+	Err    error
+}
+
+func (e *KeyError) Error() string {
+	return fmt.Sprintf("delete %q: %s", aws.StringValue(e.Object.Key), e.Err)
+}
+
+// KeyErrors collects the errors of keys that were deleted one at a time.
+type KeyErrors []*KeyError
+
+func (e KeyErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// Objects returns the objects that failed to delete.
+func (e KeyErrors) Objects() []*s3.ObjectIdentifier {
+	objects := make([]*s3.ObjectIdentifier, len(e))
+	for i, err := range e {
+		objects[i] = err.Object
+	}
+	return objects
+}
+
+func (t *DeleteTask) Execute() error {
+	// batches still queued when the run is aborted are left for a later run
+	if aborted() {
+		tracker.Fail(t.seq)
+		if queue != nil {
+			queue.Nack(t.Objects)
+		}
+		atomic.AddInt64(&notAttempted, int64(len(t.Objects)))
+		if err := retries.AddFailed(t.Objects, errNotAttempted); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		return nil
+	}
+	err := t.checkLegalHolds(t.execute())
+	if err != nil {
+		tracker.Fail(t.seq)
+		failed := t.Objects
+		if errs, ok := err.(KeyErrors); ok {
+			failed = errs.Objects()
+			if hook != nil && len(failed) < len(t.Objects) {
+				hook.Run(t.Bucket, t.dryrun, "partial", without(t.Objects, failed))
+			}
+			if queue != nil {
+				queue.Ack(without(t.Objects, failed))
+			}
+		}
+		if queue != nil {
+			queue.Nack(failed)
+		}
+		atomic.AddInt64(&totalFailedObjects, int64(len(failed)))
+		failureCodes.Add(err, len(failed))
+		checkErrorLimits(err)
+		if rerr := retries.AddFailed(failed, err); rerr != nil {
+			fmt.Fprintln(os.Stderr, rerr)
+		}
+	} else {
+		tracker.Complete(t.seq)
+		if shardCheckpoint != nil {
+			shardCheckpoint.Complete(t.seq)
+		}
+		if hook != nil {
+			hook.Run(t.Bucket, t.dryrun, "ok", t.Objects)
+		}
+		// dry runs leave the messages in the queue
+		if queue != nil && t.dryrun {
+			queue.Nack(t.Objects)
+		} else if queue != nil {
+			queue.Ack(t.Objects)
+		}
+	}
+	return err
+}
+
+// without returns the objects that aren't in exclude.
+func without(objects, exclude []*s3.ObjectIdentifier) []*s3.ObjectIdentifier {
+	skip := make(map[*s3.ObjectIdentifier]bool, len(exclude))
+	for _, object := range exclude {
+		skip[object] = true
+	}
+	var kept []*s3.ObjectIdentifier
+	for _, object := range objects {
+		if !skip[object] {
+			kept = append(kept, object)
+		}
+	}
+	return kept
+}
+
+func (t *DeleteTask) execute() error {
+	if t.dryrun {
+		t.deleted(t.Objects)
+		return nil
+	}
+
+	if t.mode == DeleteModeSingle || (t.mode == DeleteModeAuto && atomic.LoadInt32(&singleFallback) == 1) {
+		return t.deleteSingle(t.Objects)
+	}
+
+	// the SDK silently replaces characters XML can't represent, so such keys
+	// must never be sent in a batch
+	for _, object := range t.Objects {
+		if !xmlSafe(aws.StringValue(object.Key)) {
+			return t.deleteWithFallback()
+		}
+	}
+
+	err := t.deleteBisect(t.Objects)
+	if isMalformedXML(err) {
+		return t.deleteWithFallback()
+	}
+	if t.mode == DeleteModeAuto && isNotImplemented(err) {
+		if atomic.CompareAndSwapInt32(&singleFallback, 0, 1) {
+			fmt.Fprintf(os.Stderr, "\nDeleteObjects is not supported (%s), switching to single object deletes\n", err)
+		}
+		return t.deleteSingle(t.Objects)
+	}
+	return err
+}
+
+// deleteBatch deletes objects with DeleteObjects. In quiet mode, the
+// response only lists the keys that failed to delete, returned as KeyErrors;
+// keys reported missing are already gone, which counts as deleted.
+func (t *DeleteTask) deleteBatch(objects []*s3.ObjectIdentifier) error {
+	return t.retry(func() error {
+		input := &s3.DeleteObjectsInput{
+			Bucket: aws.String(t.Bucket),
+			Delete: &s3.Delete{
+				Objects: objects,
+				Quiet:   aws.Bool(true),
+			},
+		}
+		if t.bypass {
+			input.BypassGovernanceRetention = aws.Bool(true)
+		}
+		resp, err := t.client.DeleteObjects(input)
+		if err != nil {
+			return err
+		}
+		checkConcurrentModification(resp.Errors, len(objects))
+		errs := batchKeyErrors(objects, resp.Errors)
+		t.deleted(without(objects, errs.Objects()))
+		if len(errs) > 0 {
+			return errs
+		}
+		return nil
+	})
+}
+
+// batchKeyErrors matches the errors of a DeleteObjects response with the
+// objects of the batch, by key and version.
+func batchKeyErrors(objects []*s3.ObjectIdentifier, errs []*s3.Error) KeyErrors {
+	if len(errs) == 0 {
+		return nil
+	}
+	type id struct{ key, version string }
+	byID := make(map[id]*s3.Error, len(errs))
+	for _, e := range errs {
+		if aws.StringValue(e.Code) == s3.ErrCodeNoSuchKey {
+			continue
+		}
+		byID[id{aws.StringValue(e.Key), aws.StringValue(e.VersionId)}] = e
+	}
+	var keyErrs KeyErrors
+	for _, object := range objects {
+		if e, ok := byID[id{aws.StringValue(object.Key), aws.StringValue(object.VersionId)}]; ok {
+			keyErrs = append(keyErrs, &KeyError{
+				Object: object,
+				Err:    objectLockError(awserr.New(aws.StringValue(e.Code), aws.StringValue(e.Message), nil)),
+			})
+		}
+	}
+	return keyErrs
+}
+
+// deleteBisect deletes a batch, splitting it in halves for as long as S3
+// rejects it as too large. The key errors of both halves are returned.
+func (t *DeleteTask) deleteBisect(objects []*s3.ObjectIdentifier) error {
+	err := t.deleteBatch(objects)
+	if !isTooLarge(err) || len(objects) < 2 {
+		return err
+	}
+	half := len(objects) / 2
+	first := t.deleteBisect(objects[:half])
+	if _, ok := first.(KeyErrors); first != nil && !ok {
+		return first
+	}
+	second := t.deleteBisect(objects[half:])
+	return joinKeyErrors(first, second, objects[half:])
+}
+
+// joinKeyErrors merges the key errors of a part of a batch with the error
+// of the rest, which are the objects of rest if it isn't a KeyErrors.
+func joinKeyErrors(part error, err error, rest []*s3.ObjectIdentifier) error {
+	errs, _ := part.(KeyErrors)
+	switch e := err.(type) {
+	case nil:
+	case KeyErrors:
+		errs = append(errs, e...)
+	default:
+		if len(errs) == 0 {
+			return err
+		}
+		for _, object := range rest {
+			errs = append(errs, &KeyError{Object: object, Err: err})
+		}
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+// checkConcurrentModification warns once when a batch has many keys that
+// were already gone, as some S3 compatible stores report. Someone else is
+// probably deleting under the same prefix.
+func checkConcurrentModification(errs []*s3.Error, batch int) {
+	missing := 0
+	for _, e := range errs {
+		if aws.StringValue(e.Code) == s3.ErrCodeNoSuchKey {
+			missing++
+		}
+	}
+	if float64(missing) > float64(batch)*ConcurrentModificationThreshold &&
+		atomic.CompareAndSwapInt32(&concurrentWarning, 0, 1) {
+		fmt.Fprintf(os.Stderr, "\nwarning: concurrent modification suspected, %d of %d keys in a batch were already gone\n", missing, batch)
+	}
+}
+
+func (t *DeleteTask) deleteObject(object *s3.ObjectIdentifier) error {
+	return t.retry(func() error {
+		input := &s3.DeleteObjectInput{
+			Bucket:    aws.String(t.Bucket),
+			Key:       object.Key,
+			VersionId: object.VersionId,
+		}
+		if t.bypass {
+			input.BypassGovernanceRetention = aws.Bool(true)
+		}
+		_, err := t.client.DeleteObject(input)
+		if err != nil {
+			return err
+		}
+		t.deleted([]*s3.ObjectIdentifier{object})
+		return nil
+	})
+}
+
+// deleteSingle deletes objects one at a time, with up to
+// SingleDeleteConcurrency requests in flight.
+func (t *DeleteTask) deleteSingle(objects []*s3.ObjectIdentifier) error {
+	var (
+		mu   sync.Mutex
+		wg   sync.WaitGroup
+		errs KeyErrors
+	)
+	sem := make(chan struct{}, SingleDeleteConcurrency)
+	for _, object := range objects {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(object *s3.ObjectIdentifier) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			if err := t.deleteObject(object); err != nil {
+				mu.Lock()
+				errs = append(errs, &KeyError{Object: object, Err: objectLockError(err)})
+				mu.Unlock()
+			}
+		}(object)
+	}
+	wg.Wait()
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// deleteWithFallback handles a batch S3 couldn't parse or that contains keys
+// the SDK can't encode. Keys that can't be represented in an XML document
+// are deleted one at a time with DeleteObject, which takes the key in the
+// URL, and the rest of the batch is retried. If no key looks suspicious, or
+// the retried batch is rejected too, every key is deleted individually.
+func (t *DeleteTask) deleteWithFallback() error {
+	var batch, suspects []*s3.ObjectIdentifier
+	for _, object := range t.Objects {
+		if xmlSafe(aws.StringValue(object.Key)) {
+			batch = append(batch, object)
+		} else {
+			suspects = append(suspects, object)
+		}
+	}
+	if len(suspects) == 0 {
+		batch, suspects = nil, batch
+	}
+
+	var batchErr error
+	if len(batch) > 0 {
+		if err := t.deleteBatch(batch); isMalformedXML(err) {
+			suspects = append(suspects, batch...)
+		} else if _, ok := err.(KeyErrors); err != nil && !ok {
+			return err
+		} else {
+			batchErr = err
+		}
+	}
+
+	return joinKeyErrors(batchErr, t.deleteSingle(suspects), suspects)
+}
+
+// ErrorCodes counts the keys that failed to delete by error code.
+type ErrorCodes struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+// Add counts the failed keys of a task's error, by the error code of each
+// key for KeyErrors.
+func (c *ErrorCodes) Add(err error, failed int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.counts == nil {
+		c.counts = make(map[string]int)
+	}
+	if errs, ok := err.(KeyErrors); ok {
+		for _, e := range errs {
+			c.counts[errorCode(e.Err)]++
+		}
+		return
+	}
+	c.counts[errorCode(err)] += failed
+}
+
+// Count returns the number of keys that failed with the error code.
+func (c *ErrorCodes) Count(code string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.counts[code]
+}
+
+// WriteSummary writes the number of keys that failed with each error code.
+func (c *ErrorCodes) WriteSummary(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.counts) == 0 {
+		return
+	}
+	codes := make([]string, 0, len(c.counts))
+	for code := range c.counts {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	fmt.Fprintln(w, "errors:")
+	for _, code := range codes {
+		fmt.Fprintf(w, "  %-20s %d\n", code, c.counts[code])
+	}
+}
+
+// errNotAttempted marks the keys of batches that were still queued when the
+// run was aborted.
+var errNotAttempted = awserr.New("NotAttempted", "the run was aborted before deleting the key", nil)
+
+// isTransient reports whether an error may go away when the request is
+// retried, unlike denied access or locked objects.
+func isTransient(err error) bool {
+	switch errorCode(err) {
+	case "InternalError", "ServiceUnavailable", "SlowDown", "RequestTimeout", request.ErrCodeRequestError, request.ErrCodeResponseTimeout:
+		return true
+	}
+	return false
+}
+
+// ErrCodeObjectLocked replaces the AccessDenied code of the errors S3
+// returns for object versions under object lock retention or a legal hold,
+// to tell them from missing permissions.
+const ErrCodeObjectLocked = "ObjectLocked"
+
+// objectLockError returns the error of a key with the ErrCodeObjectLocked
+// code if S3 denied the delete because of object lock.
+func objectLockError(err error) error {
+	aerr, ok := err.(awserr.Error)
+	if !ok || aerr.Code() != "AccessDenied" || !strings.Contains(strings.ToLower(aerr.Message()), "object lock") {
+		return err
+	}
+	return awserr.New(ErrCodeObjectLocked, aerr.Message(), aerr.OrigErr())
+}
+
+// errorCode returns the S3 error code of an error, or Error for errors
+// that don't come from S3.
+func errorCode(err error) string {
+	if aerr, ok := err.(awserr.Error); ok {
+		return aerr.Code()
+	}
+	return "Error"
+}
+
+// deleted records objects as deleted as soon as they are, so progress is
+// reported once per batch in batch mode and once per key in single mode.
+// Only counters are updated here, the output file is written in the
+// background.
+func (t *DeleteTask) deleted(objects []*s3.ObjectIdentifier) {
+	atomic.AddInt64(&totalDeletedObjects, int64(len(objects)))
+	recentDeletes.Add(int64(len(objects)))
+	if t.details != nil {
+		var size int64
+		for _, object := range objects {
+			if detail, ok := t.details[object]; ok {
+				size += aws.Int64Value(detail.Size)
+				deletedClasses.Add(detail)
+			}
+		}
+		atomic.AddInt64(&totalDeletedBytes, size)
+	}
+	if deletedVersions != nil {
+		deletedVersions.Add(objects, t.markers)
+	}
+	pool.Deleted(t.Partition, len(objects))
+	if output != nil {
+		output.Write(objects)
+	}
+	if deletedSample != nil {
+		deletedSample.Add(objects)
+	}
+}
+
+// retry runs the operation until it succeeds, backing off while S3 asks us
+// to slow down, which throttles the task's partition, and renewing expired
+// credentials. Any other error is returned immediately.
+func (t *DeleteTask) retry(operation func() error) error {
+	return backoff.RetryNotify(func() error {
+		err := withCredentials(operation)
+		// check for slow down error
+		if err != nil {
+			if reqerr, ok := err.(awserr.RequestFailure); ok {
+				if reqerr.Code() == "SlowDown" {
+					return err
+				}
+			}
+			return &backoff.PermanentError{Err: err}
+		}
+		return nil
+	}, backoff.NewExponentialBackOff(), func(error, time.Duration) {
+		slowDown <- t.Partition
+	})
+}
+
+func isNotImplemented(err error) bool {
+	if aerr, ok := err.(awserr.Error); ok {
+		return aerr.Code() == "NotImplemented" || aerr.Code() == "MethodNotAllowed"
+	}
+	return false
+}
+
+func isTooLarge(err error) bool {
+	if reqerr, ok := err.(awserr.RequestFailure); ok {
+		switch reqerr.Code() {
+		case "EntityTooLarge", "MaxMessageLengthExceeded", "RequestEntityTooLarge":
+			return true
+		}
+		return reqerr.StatusCode() == http.StatusRequestEntityTooLarge
+	}
+	return false
+}
+
+func isMalformedXML(err error) bool {
+	if aerr, ok := err.(awserr.Error); ok {
+		return aerr.Code() == "MalformedXML"
+	}
+	return false
+}
+
+// SplitBatch splits a batch so the DeleteObjects request of each part stays
+// under maxBytes, estimating the size of each key and version ID once
+// escaped in XML.
+func SplitBatch(objects []*s3.ObjectIdentifier, maxBytes int) [][]*s3.ObjectIdentifier {
+	var (
+		batches [][]*s3.ObjectIdentifier
+		start   int
+		size    = batchRequestOverhead
+	)
+	for i, object := range objects {
+		n := batchObjectSize(object)
+		if i > start && size+n > maxBytes {
+			batches = append(batches, objects[start:i:i])
+			start, size = i, batchRequestOverhead
+		}
+		size += n
+	}
+	return append(batches, objects[start:])
+}
+
+// batchObjectSize returns the size of an object in a DeleteObjects request.
+func batchObjectSize(object *s3.ObjectIdentifier) int {
+	n := xmlSize(aws.StringValue(object.Key)) + batchObjectOverhead
+	if object.VersionId != nil {
+		n += xmlSize(*object.VersionId) + batchVersionOverhead
+	}
+	return n
+}
+
+// xmlSize returns the length of s once escaped in XML.
+func xmlSize(s string) int {
+	n := len(s)
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '&':
+			n += len("&amp;") - 1
+		case '<', '>':
+			n += len("&lt;") - 1
+		case '"', '\'':
+			n += len("&#34;") - 1
+		case '\t', '\n', '\r':
+			n += len("&#x9;") - 1
+		}
+	}
+	return n
+}
+
+// xmlSafe reports whether s only contains characters allowed in XML 1.0.
+// Other characters can't be sent in a DeleteObjects request body.
+func xmlSafe(s string) bool {
+	if !utf8.ValidString(s) {
+		return false
+	}
+	for _, r := range s {
+		switch {
+		case r == '\t', r == '\n', r == '\r':
+		case r < 0x20, r == 0xFFFE, r == 0xFFFF:
+			return false
+		}
+	}
+	return true
+}
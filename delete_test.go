@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// deleteObjectsBodySize returns the size of the body of the DeleteObjects
+// request the SDK sends for the objects.
+func deleteObjectsBodySize(t *testing.T, objects []*s3.ObjectIdentifier) int {
+	t.Helper()
+	svc := s3.New(session.Must(session.NewSession(&aws.Config{
+		Region:      aws.String("us-east-1"),
+		Credentials: credentials.NewStaticCredentials("id", "secret", ""),
+	})))
+	req, _ := svc.DeleteObjectsRequest(&s3.DeleteObjectsInput{
+		Bucket: aws.String("bucket"),
+		Delete: &s3.Delete{Objects: objects, Quiet: aws.Bool(true)},
+	})
+	if err := req.Build(); err != nil {
+		t.Fatal(err)
+	}
+	n, err := io.Copy(ioutil.Discard, req.GetBody())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return int(n)
+}
+
+func TestSplitBatchStaysUnderMaxBytes(t *testing.T) {
+	const maxBytes = 64 * 1024
+	tests := []struct {
+		name    string
+		key     func(i int) string
+		version func(i int) string
+	}{
+		{
+			name: "long keys",
+			key:  func(i int) string { return longKey(i, "k") },
+		},
+		{
+			name: "long keys escaped in XML",
+			key:  func(i int) string { return longKey(i, "&<'\t") },
+		},
+		{
+			name:    "long keys with version IDs",
+			key:     func(i int) string { return longKey(i, "k") },
+			version: func(i int) string { return strings.Repeat("v", 32) },
+		},
+		{
+			name:    "escaped keys with escaped version IDs",
+			key:     func(i int) string { return longKey(i, "\"") },
+			version: func(i int) string { return strings.Repeat("&", 64) },
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var objects []*s3.ObjectIdentifier
+			for i := 0; i < DefaultBatchSize; i++ {
+				object := &s3.ObjectIdentifier{Key: aws.String(tt.key(i))}
+				if tt.version != nil {
+					object.VersionId = aws.String(tt.version(i))
+				}
+				objects = append(objects, object)
+			}
+			batches := SplitBatch(objects, maxBytes)
+			if len(batches) < 2 {
+				t.Fatalf("got %d batch, want the batch split", len(batches))
+			}
+			var n int
+			for i, batch := range batches {
+				if size := deleteObjectsBodySize(t, batch); size > maxBytes {
+					t.Errorf("batch %d of %d keys is %d bytes, over %d", i, len(batch), size, maxBytes)
+				}
+				for _, object := range batch {
+					if object != objects[n] {
+						t.Fatalf("batch %d: object %d is out of order", i, n)
+					}
+					n++
+				}
+			}
+			if n != len(objects) {
+				t.Errorf("got %d objects in the batches, want %d", n, len(objects))
+			}
+		})
+	}
+}
+
+// longKey returns a 1024 byte key made of a number and the repeated filler.
+func longKey(i int, filler string) string {
+	return (fmt.Sprintf("%04d/", i) + strings.Repeat(filler, 1024))[:1024]
+}
+
+func TestDeleteFallsBackToSingleDeletes(t *testing.T) {
+	const poison = "poison"
+	tests := []struct {
+		name string
+		keys []string
+		// reject lists the keys whose batches the mock S3 rejects
+		reject []string
+		want   []string
+	}{
+		{
+			name: "batch accepted",
+			keys: []string{"a", "b", "c"},
+			want: []string{"DeleteObjects 3"},
+		},
+		{
+			name:   "rejected batch without suspect keys",
+			keys:   []string{"a", poison, "c"},
+			reject: []string{poison},
+			want:   []string{"DeleteObjects 3", "DeleteObject a", "DeleteObject c", "DeleteObject " + poison},
+		},
+		{
+			name: "key XML can't represent",
+			keys: []string{"a", "b\x01", "c"},
+			want: []string{"DeleteObjects 2", "DeleteObject b\x01"},
+		},
+		{
+			name:   "rest of the batch rejected too",
+			keys:   []string{"a", "b\x01", poison},
+			reject: []string{poison},
+			want:   []string{"DeleteObjects 2", "DeleteObject a", "DeleteObject b\x01", "DeleteObject " + poison},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, svc := newMockS3(t, tt.keys...)
+			m.rejectBatch = func(keys []string) string {
+				for _, key := range keys {
+					for _, rejected := range tt.reject {
+						if key == rejected {
+							return "MalformedXML"
+						}
+					}
+				}
+				return ""
+			}
+			var objects []*s3.ObjectIdentifier
+			for _, key := range tt.keys {
+				objects = append(objects, &s3.ObjectIdentifier{Key: aws.String(key)})
+			}
+			task := &DeleteTask{client: svc, Bucket: mockBucket, Objects: objects}
+			before := atomic.LoadInt64(&totalDeletedObjects)
+			if err := task.Execute(); err != nil {
+				t.Fatal(err)
+			}
+			if deleted := atomic.LoadInt64(&totalDeletedObjects) - before; deleted != int64(len(tt.keys)) {
+				t.Errorf("counted %d keys as deleted, want %d", deleted, len(tt.keys))
+			}
+			for _, key := range tt.keys {
+				if m.has(key) {
+					t.Errorf("%q is still there", key)
+				}
+			}
+			got := m.requested()
+			sort.Strings(got[1:])
+			sort.Strings(tt.want[1:])
+			if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("got requests %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
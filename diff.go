@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+// DiffSuffixes name the result files written next to the -diff file.
+const (
+	DiffSuffixPresent = ".present"
+	DiffSuffixGone    = ".gone"
+	DiffSuffixNew     = ".new"
+)
+
+// Diff is the comparison of a sorted key file with a listing.
+type Diff struct {
+	Present int64
+	Gone    int64
+	New     int64
+	Outside int64
+}
+
+// keyStream reads the keys of a scanner one at a time, checking they come
+// in ascending order, which is the order S3 lists keys in.
+type keyStream struct {
+	name    string
+	scanner Scanner
+	buf     []string
+	last    string
+	started bool
+}
+
+func (k *keyStream) next() (string, bool, error) {
+	for len(k.buf) == 0 {
+		if !k.scanner.Scan(DefaultBatchSize) {
+			return "", false, k.scanner.Err()
+		}
+		for _, object := range k.scanner.Objects() {
+			k.buf = append(k.buf, aws.StringValue(object.Key))
+		}
+	}
+	key := k.buf[0]
+	k.buf = k.buf[1:]
+	if k.started && key < k.last {
+		return "", false, fmt.Errorf("%s is not sorted: %q comes after %q (sort it with LC_ALL=C sort)", k.name, key, k.last)
+	}
+	k.last, k.started = key, true
+	return key, true, nil
+}
+
+// DiffKeys compares the keys of file, such as the output of a previous run,
+// with the listing of the prefixes, merging both sorted streams so neither
+// is held in memory. Keys in both are still present, keys only in the file
+// are already gone, and keys only in the listing are new. Keys of the file
+// outside the prefixes are ignored.
+func DiffKeys(file string, listing Scanner, prefixes []string) (*Diff, error) {
+	fs, err := NewFileScanner(file)
+	if err != nil {
+		return nil, err
+	}
+	var outputs [3]*bufio.Writer
+	for i, suffix := range []string{DiffSuffixPresent, DiffSuffixGone, DiffSuffixNew} {
+		fd, err := os.Create(file + suffix)
+		if err != nil {
+			return nil, err
+		}
+		defer fd.Close()
+		outputs[i] = bufio.NewWriter(fd)
+	}
+	present, gone, created := outputs[0], outputs[1], outputs[2]
+
+	d := &Diff{}
+	keys := &keyStream{name: file, scanner: fs}
+	listed := &keyStream{name: "the listing", scanner: listing}
+	key, keyOK, err := d.nextKey(keys, prefixes)
+	if err != nil {
+		return nil, err
+	}
+	object, objectOK, err := listed.next()
+	if err != nil {
+		return nil, err
+	}
+	for keyOK || objectOK {
+		switch {
+		case keyOK && objectOK && key == object:
+			d.Present++
+			fmt.Fprintln(present, key)
+			key, keyOK, err = d.nextKey(keys, prefixes)
+			if err == nil {
+				object, objectOK, err = listed.next()
+			}
+		case keyOK && (!objectOK || key < object):
+			d.Gone++
+			fmt.Fprintln(gone, key)
+			key, keyOK, err = d.nextKey(keys, prefixes)
+		default:
+			d.New++
+			fmt.Fprintln(created, object)
+			object, objectOK, err = listed.next()
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, w := range outputs {
+		if err := w.Flush(); err != nil {
+			return nil, err
+		}
+	}
+	return d, nil
+}
+
+// nextKey returns the next key of the file under one of the prefixes.
+func (d *Diff) nextKey(keys *keyStream, prefixes []string) (string, bool, error) {
+	for {
+		key, ok, err := keys.next()
+		if !ok || err != nil || underPrefixes(key, prefixes) {
+			return key, ok, err
+		}
+		d.Outside++
+	}
+}
+
+func underPrefixes(key string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *Diff) WriteSummary(w io.Writer, file string) {
+	fmt.Fprintf(w, "diff: %d still present, %d already gone, %d new\n", d.Present, d.Gone, d.New)
+	if d.Outside > 0 {
+		fmt.Fprintf(w, "  %d keys of %s are outside the prefixes and were ignored\n", d.Outside, file)
+	}
+	fmt.Fprintf(w, "  keys are listed in %s{%s,%s,%s}\n", file, DiffSuffixPresent, DiffSuffixGone, DiffSuffixNew)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync/atomic"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// DefaultDynamoDBAttribute is the attribute holding object keys.
+const DefaultDynamoDBAttribute = "key"
+
+// TableScanner reads keys from a string attribute of the items of a
+// DynamoDB table. Items without the attribute are skipped.
+type TableScanner struct {
+	Table     string
+	Attribute string
+	client    *dynamodb.DynamoDB
+	buf       []*s3.ObjectIdentifier
+	err       error
+	start     map[string]*dynamodb.AttributeValue
+	started   bool
+	emitted   int64
+	skipped   int64
+	// items is the approximate item count of the table, which DynamoDB
+	// updates every few hours
+	items int64
+}
+
+func NewTableScanner(table string, attribute string, client *dynamodb.DynamoDB) (*TableScanner, error) {
+	resp, err := client.DescribeTable(&dynamodb.DescribeTableInput{
+		TableName: aws.String(table),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", table, err)
+	}
+	return &TableScanner{
+		Table:     table,
+		Attribute: attribute,
+		client:    client,
+		items:     aws.Int64Value(resp.Table.ItemCount),
+	}, nil
+}
+
+func (s *TableScanner) Scan(count int) bool {
+	s.buf = nil
+	// pages can be empty without being the last one
+	for len(s.buf) == 0 && (!s.started || s.start != nil) {
+		s.started = true
+		resp, err := s.client.Scan(&dynamodb.ScanInput{
+			TableName:                aws.String(s.Table),
+			ExclusiveStartKey:        s.start,
+			Limit:                    aws.Int64(int64(count)),
+			ProjectionExpression:     aws.String("#key"),
+			ExpressionAttributeNames: map[string]*string{"#key": aws.String(s.Attribute)},
+		})
+		if err != nil {
+			s.err = err
+			return false
+		}
+		s.start = resp.LastEvaluatedKey
+		for _, item := range resp.Items {
+			value, ok := item[s.Attribute]
+			if !ok || value.S == nil {
+				atomic.AddInt64(&s.skipped, 1)
+				continue
+			}
+			s.buf = append(s.buf, &s3.ObjectIdentifier{Key: value.S})
+		}
+	}
+	if len(s.buf) == 0 {
+		return false
+	}
+	atomic.AddInt64(&s.emitted, int64(len(s.buf)))
+	return true
+}
+
+func (s *TableScanner) Err() error {
+	return s.err
+}
+
+func (s *TableScanner) Objects() []*s3.ObjectIdentifier {
+	return s.buf
+}
+
+func (s *TableScanner) EmittedKeys() int64 {
+	return atomic.LoadInt64(&s.emitted)
+}
+
+// EstimatedTotal is the item count DynamoDB reported when the scan started.
+func (s *TableScanner) EstimatedTotal() (int64, bool) {
+	return s.items, s.items > 0
+}
+
+// WriteSummary writes the number of items skipped for lack of a key.
+func (s *TableScanner) WriteSummary(w io.Writer) {
+	fmt.Fprintf(w, "dynamodb: %d items without a %s string attribute skipped\n", atomic.LoadInt64(&s.skipped), s.Attribute)
+}
+
+func init() {
+	RegisterSource(&Source{
+		Name:     "dynamodb",
+		KeyList:  true,
+		Selected: func(*SourceEnv) bool { return flagTable != "" },
+		New: func(env *SourceEnv) (Scanner, error) {
+			if flagTable == "" {
+				return nil, UsageError("Please provide the -dynamodb-table to read the keys from")
+			}
+			client := dynamodb.New(env.Session)
+			uncounted(&client.Handlers)
+			return NewTableScanner(flagTable, flagTableAttr, client)
+		},
+	})
+}
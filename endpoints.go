@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+)
+
+// checkEndpointVariant makes sure an S3 endpoint exists for the requested
+// FIPS/dualstack combination in the region, so a bad combination fails at
+// startup rather than with DNS errors on the first request.
+func checkEndpointVariant(region string, fips, dualstack bool) error {
+	if !fips && !dualstack {
+		return nil
+	}
+	_, err := endpoints.DefaultResolver().EndpointFor(endpoints.S3ServiceID, region, func(o *endpoints.Options) {
+		o.StrictMatching = true
+		if fips {
+			o.UseFIPSEndpoint = endpoints.FIPSEndpointStateEnabled
+		}
+		if dualstack {
+			o.UseDualStackEndpoint = endpoints.DualStackEndpointStateEnabled
+		}
+	})
+	if err != nil {
+		return fmt.Errorf("no %s S3 endpoint exists in region %s", endpointVariantName(fips, dualstack), region)
+	}
+	return nil
+}
+
+func endpointVariantName(fips, dualstack bool) string {
+	switch {
+	case fips && dualstack:
+		return "FIPS dualstack"
+	case fips:
+		return "FIPS"
+	default:
+		return "dualstack"
+	}
+}
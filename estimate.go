@@ -0,0 +1,68 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+)
+
+// BucketEstimate is the approximate size of a bucket according to the daily
+// S3 storage metrics in CloudWatch. The metrics lag by about a day, so the
+// numbers are only suitable for progress reporting.
+type BucketEstimate struct {
+	Objects int64
+	Bytes   int64
+}
+
+// EstimateBucket reads the latest NumberOfObjects and BucketSizeBytes
+// datapoints for the bucket. An error is returned if either metric can't be
+// read.
+func EstimateBucket(sess *session.Session, bucket string) (*BucketEstimate, error) {
+	svc := cloudwatch.New(sess)
+
+	objects, err := latestBucketMetric(svc, bucket, "NumberOfObjects", "AllStorageTypes")
+	if err != nil {
+		return nil, err
+	}
+	size, err := latestBucketMetric(svc, bucket, "BucketSizeBytes", "StandardStorage")
+	if err != nil {
+		return nil, err
+	}
+	return &BucketEstimate{Objects: int64(objects), Bytes: int64(size)}, nil
+}
+
+func latestBucketMetric(svc *cloudwatch.CloudWatch, bucket, metric, storageType string) (float64, error) {
+	now := time.Now()
+	resp, err := svc.GetMetricStatistics(&cloudwatch.GetMetricStatisticsInput{
+		Namespace:  aws.String("AWS/S3"),
+		MetricName: aws.String(metric),
+		Dimensions: []*cloudwatch.Dimension{
+			{Name: aws.String("BucketName"), Value: aws.String(bucket)},
+			{Name: aws.String("StorageType"), Value: aws.String(storageType)},
+		},
+		StartTime:  aws.Time(now.Add(-3 * 24 * time.Hour)),
+		EndTime:    aws.Time(now),
+		Period:     aws.Int64(86400),
+		Statistics: []*string{aws.String(cloudwatch.StatisticAverage)},
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	var latest *cloudwatch.Datapoint
+	for _, point := range resp.Datapoints {
+		if point.Average == nil || point.Timestamp == nil {
+			continue
+		}
+		if latest == nil || point.Timestamp.After(*latest.Timestamp) {
+			latest = point
+		}
+	}
+	if latest == nil {
+		return 0, errors.New("no " + metric + " datapoints for bucket " + bucket)
+	}
+	return *latest.Average, nil
+}
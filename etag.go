@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// normalizeETag removes the quotes around an ETag, and lower-cases it.
+func normalizeETag(etag string) string {
+	return strings.ToLower(strings.Trim(strings.TrimSpace(etag), `"`))
+}
+
+// ReadETagFile reads a file of ETags, one per line, with or without their
+// quotes. Empty lines and lines starting with # are skipped.
+func ReadETagFile(path string) (map[string]bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	etags := make(map[string]bool)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		etags[normalizeETag(line)] = true
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(etags) == 0 {
+		return nil, fmt.Errorf("%s lists no ETags", path)
+	}
+	return etags, nil
+}
+
+// etagFilter spares objects whose ETag isn't one of etags, or with except,
+// those whose ETag is. Objects whose ETag isn't known are spared either way.
+func etagFilter(etags map[string]bool, except bool) Filter {
+	return DetailFilterFunc(func(detail *s3.Object) bool {
+		if detail.ETag == nil {
+			return true
+		}
+		return etags[normalizeETag(aws.StringValue(detail.ETag))] == except
+	})
+}
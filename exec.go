@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Hook failure policies select what happens when a batch hook fails.
+const (
+	HookPolicyIgnore = "ignore"
+	HookPolicyWarn   = "warn"
+	HookPolicyAbort  = "abort"
+
+	DefaultHookConcurrency int           = 4
+	DefaultHookTimeout     time.Duration = time.Minute
+)
+
+// BatchHook runs a command for each deleted batch, with the deleted keys on
+// its stdin, one per line. The command runs through sh, with S3RM_BUCKET,
+// S3RM_DRYRUN and S3RM_STATUS set in its environment. The status is "ok" if
+// the whole batch was deleted, or "partial" if only the keys given were.
+type BatchHook struct {
+	Command string
+	Timeout time.Duration
+	Policy  string
+	limit   chan struct{}
+	runs    int64
+	failed  int64
+}
+
+func NewBatchHook(command string, concurrency int, timeout time.Duration, policy string) *BatchHook {
+	return &BatchHook{
+		Command: command,
+		Timeout: timeout,
+		Policy:  policy,
+		limit:   make(chan struct{}, concurrency),
+	}
+}
+
+// Run runs the command for a batch, waiting for a free slot if Concurrency
+// invocations are already running. A failure is handled according to Policy.
+func (h *BatchHook) Run(bucket string, dryrun bool, status string, objects []*s3.ObjectIdentifier) {
+	h.limit <- struct{}{}
+	err := h.run(bucket, dryrun, status, objects)
+	<-h.limit
+
+	atomic.AddInt64(&h.runs, 1)
+	if err == nil {
+		return
+	}
+	atomic.AddInt64(&h.failed, 1)
+	switch h.Policy {
+	case HookPolicyWarn:
+		fmt.Fprintf(os.Stderr, "\nwarning: batch hook failed: %s\n", err)
+	case HookPolicyAbort:
+		fmt.Fprintf(os.Stderr, "\nbatch hook failed, aborting: %s\n", err)
+		os.Exit(ExitCodeError)
+	}
+}
+
+func (h *BatchHook) run(bucket string, dryrun bool, status string, objects []*s3.ObjectIdentifier) error {
+	var stdin bytes.Buffer
+	for _, object := range objects {
+		stdin.WriteString(aws.StringValue(object.Key))
+		stdin.WriteByte('\n')
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), h.Timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "sh", "-c", h.Command)
+	cmd.Stdin = &stdin
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(),
+		"S3RM_BUCKET="+bucket,
+		"S3RM_DRYRUN="+strconv.FormatBool(dryrun),
+		"S3RM_STATUS="+status,
+	)
+	err := cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("timed out after %s", h.Timeout)
+	}
+	return err
+}
+
+// WriteSummary writes the number of hook invocations and failures.
+func (h *BatchHook) WriteSummary(w io.Writer) {
+	fmt.Fprintf(w, "exec: %d batches, %d failed\n", atomic.LoadInt64(&h.runs), atomic.LoadInt64(&h.failed))
+}
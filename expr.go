@@ -0,0 +1,536 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// exprType is the type of a filter expression, checked when it is parsed.
+type exprType int
+
+const (
+	typeBool exprType = iota
+	typeInt
+	typeString
+	typeDuration
+	typeList
+)
+
+func (t exprType) String() string {
+	return [...]string{"bool", "int", "string", "duration", "list"}[t]
+}
+
+// exprValue holds the value of an expression of any type. Durations are
+// held in i, as nanoseconds.
+type exprValue struct {
+	b bool
+	i int64
+	s string
+	l []string
+}
+
+// exprObject is what an expression is evaluated against.
+type exprObject struct {
+	key    string
+	detail *s3.Object
+	now    time.Time
+}
+
+// exprNode is a typed, compiled expression. eval returns false when a value
+// the expression needs isn't known.
+type exprNode struct {
+	typ  exprType
+	eval func(o *exprObject) (exprValue, bool)
+}
+
+// exprFields are the fields of objects expressions can use. All but key
+// need the details of a listing.
+var exprFields = map[string]exprNode{
+	"key": {typeString, func(o *exprObject) (exprValue, bool) {
+		return exprValue{s: o.key}, true
+	}},
+	"size": {typeInt, func(o *exprObject) (exprValue, bool) {
+		if o.detail == nil || o.detail.Size == nil {
+			return exprValue{}, false
+		}
+		return exprValue{i: *o.detail.Size}, true
+	}},
+	"age": {typeDuration, func(o *exprObject) (exprValue, bool) {
+		if o.detail == nil || o.detail.LastModified == nil {
+			return exprValue{}, false
+		}
+		return exprValue{i: int64(o.now.Sub(*o.detail.LastModified))}, true
+	}},
+	"storage_class": {typeString, func(o *exprObject) (exprValue, bool) {
+		if o.detail == nil || o.detail.StorageClass == nil {
+			return exprValue{}, false
+		}
+		return exprValue{s: *o.detail.StorageClass}, true
+	}},
+	"etag": {typeString, func(o *exprObject) (exprValue, bool) {
+		if o.detail == nil || o.detail.ETag == nil {
+			return exprValue{}, false
+		}
+		return exprValue{s: normalizeETag(*o.detail.ETag)}, true
+	}},
+}
+
+// ExprFilter spares objects for which a -filter expression isn't true, or
+// can't be evaluated because it needs details of the object that aren't
+// known. Expressions are made of:
+//
+//   - the fields key, size (in bytes), age (since last modified),
+//     storage_class and etag;
+//   - string and integer literals, duration("720h") or duration("30d"),
+//     bytes("1GiB"), and lists of strings such as ["GLACIER", "DEEP_ARCHIVE"];
+//   - the methods startsWith, endsWith, contains and matches (a regular
+//     expression) of strings;
+//   - the operators ==, !=, <, <=, >, >=, in, !, && and ||, and parentheses.
+type ExprFilter struct {
+	// NeedsDetails is set when the expression uses other fields than key
+	NeedsDetails bool
+	root         exprNode
+	now          time.Time
+}
+
+// ParseFilterExpr parses a -filter expression, which must be a bool.
+func ParseFilterExpr(source string) (*ExprFilter, error) {
+	p := &exprParser{source: source}
+	if err := p.tokenize(); err != nil {
+		return nil, err
+	}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, p.errorf("unexpected %q", p.tokens[p.pos].text)
+	}
+	if root.typ != typeBool {
+		return nil, fmt.Errorf("filter expression is of type %s, not bool", root.typ)
+	}
+	return &ExprFilter{NeedsDetails: p.details, root: root, now: time.Now()}, nil
+}
+
+// Spare evaluates the expression with the key of an object alone.
+func (f *ExprFilter) Spare(object *s3.ObjectIdentifier) bool {
+	return f.spare(&exprObject{key: aws.StringValue(object.Key), now: f.now})
+}
+
+func (f *ExprFilter) SpareDetail(detail *s3.Object) bool {
+	return f.spare(&exprObject{key: aws.StringValue(detail.Key), detail: detail, now: f.now})
+}
+
+func (f *ExprFilter) spare(o *exprObject) bool {
+	v, ok := f.root.eval(o)
+	return !ok || !v.b
+}
+
+type exprToken struct {
+	// kind is one of ident, number, string, or the operator itself
+	kind string
+	text string
+	pos  int
+}
+
+type exprParser struct {
+	source  string
+	tokens  []exprToken
+	pos     int
+	details bool
+}
+
+func (p *exprParser) errorf(format string, args ...interface{}) error {
+	at := len(p.source)
+	if p.pos < len(p.tokens) {
+		at = p.tokens[p.pos].pos
+	}
+	return fmt.Errorf("filter expression, at %d: %s", at+1, fmt.Sprintf(format, args...))
+}
+
+var exprOperators = []string{"&&", "||", "==", "!=", "<=", ">=", "<", ">", "!", "(", ")", "[", "]", ".", ","}
+
+func (p *exprParser) tokenize() error {
+	s := p.source
+	for i := 0; i < len(s); {
+		c := rune(s[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '"' || c == '\'':
+			j := i + 1
+			for j < len(s) && rune(s[j]) != c {
+				if s[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j >= len(s) {
+				return fmt.Errorf("filter expression, at %d: unterminated string", i+1)
+			}
+			text := s[i : j+1]
+			if c == '\'' {
+				text = `"` + strings.Replace(s[i+1:j], `"`, `\"`, -1) + `"`
+			}
+			value, err := strconv.Unquote(text)
+			if err != nil {
+				return fmt.Errorf("filter expression, at %d: invalid string %s", i+1, s[i:j+1])
+			}
+			p.tokens = append(p.tokens, exprToken{"string", value, i})
+			i = j + 1
+		case unicode.IsDigit(c):
+			j := i
+			for j < len(s) && (unicode.IsDigit(rune(s[j])) || s[j] == '_') {
+				j++
+			}
+			p.tokens = append(p.tokens, exprToken{"number", strings.Replace(s[i:j], "_", "", -1), i})
+			i = j
+		case unicode.IsLetter(c) || c == '_':
+			j := i
+			for j < len(s) && (unicode.IsLetter(rune(s[j])) || unicode.IsDigit(rune(s[j])) || s[j] == '_') {
+				j++
+			}
+			p.tokens = append(p.tokens, exprToken{"ident", s[i:j], i})
+			i = j
+		default:
+			found := false
+			for _, op := range exprOperators {
+				if strings.HasPrefix(s[i:], op) {
+					p.tokens = append(p.tokens, exprToken{op, op, i})
+					i += len(op)
+					found = true
+					break
+				}
+			}
+			if !found {
+				return fmt.Errorf("filter expression, at %d: unexpected %q", i+1, c)
+			}
+		}
+	}
+	return nil
+}
+
+// accept consumes the next token if it is of the kind.
+func (p *exprParser) accept(kind string) (exprToken, bool) {
+	if p.pos < len(p.tokens) && p.tokens[p.pos].kind == kind {
+		p.pos++
+		return p.tokens[p.pos-1], true
+	}
+	return exprToken{}, false
+}
+
+func (p *exprParser) expect(kind string) (exprToken, error) {
+	if t, ok := p.accept(kind); ok {
+		return t, nil
+	}
+	if p.pos < len(p.tokens) {
+		return exprToken{}, p.errorf("expected %s, not %q", kind, p.tokens[p.pos].text)
+	}
+	return exprToken{}, p.errorf("expected %s", kind)
+}
+
+func (p *exprParser) parseOr() (exprNode, error) {
+	left, err := p.parseAnd()
+	for err == nil {
+		if _, ok := p.accept("||"); !ok {
+			break
+		}
+		var right exprNode
+		if right, err = p.parseAnd(); err == nil {
+			left, err = p.logical("||", left, right)
+		}
+	}
+	return left, err
+}
+
+func (p *exprParser) parseAnd() (exprNode, error) {
+	left, err := p.parseNot()
+	for err == nil {
+		if _, ok := p.accept("&&"); !ok {
+			break
+		}
+		var right exprNode
+		if right, err = p.parseNot(); err == nil {
+			left, err = p.logical("&&", left, right)
+		}
+	}
+	return left, err
+}
+
+// logical combines two bools. An unknown operand only makes the result
+// unknown when the other operand doesn't decide it.
+func (p *exprParser) logical(op string, left, right exprNode) (exprNode, error) {
+	if left.typ != typeBool || right.typ != typeBool {
+		return exprNode{}, p.errorf("%s needs bools, not %s and %s", op, left.typ, right.typ)
+	}
+	decisive := op == "||"
+	return exprNode{typeBool, func(o *exprObject) (exprValue, bool) {
+		l, lok := left.eval(o)
+		if lok && l.b == decisive {
+			return l, true
+		}
+		r, rok := right.eval(o)
+		if rok && r.b == decisive {
+			return r, true
+		}
+		return exprValue{b: !decisive}, lok && rok
+	}}, nil
+}
+
+func (p *exprParser) parseNot() (exprNode, error) {
+	if _, ok := p.accept("!"); !ok {
+		return p.parseComparison()
+	}
+	operand, err := p.parseNot()
+	if err != nil {
+		return operand, err
+	}
+	if operand.typ != typeBool {
+		return exprNode{}, p.errorf("! needs a bool, not %s", operand.typ)
+	}
+	return exprNode{typeBool, func(o *exprObject) (exprValue, bool) {
+		v, ok := operand.eval(o)
+		return exprValue{b: !v.b}, ok
+	}}, nil
+}
+
+func (p *exprParser) parseComparison() (exprNode, error) {
+	left, err := p.parsePrimary()
+	if err != nil {
+		return left, err
+	}
+	if t, ok := p.accept("ident"); ok {
+		if t.text != "in" {
+			p.pos--
+			return exprNode{}, p.errorf("unexpected %q", t.text)
+		}
+		right, err := p.parsePrimary()
+		if err != nil {
+			return right, err
+		}
+		if left.typ != typeString || right.typ != typeList {
+			return exprNode{}, p.errorf("in needs a string and a list, not %s and %s", left.typ, right.typ)
+		}
+		return exprNode{typeBool, func(o *exprObject) (exprValue, bool) {
+			l, lok := left.eval(o)
+			r, rok := right.eval(o)
+			for _, s := range r.l {
+				if s == l.s {
+					return exprValue{b: true}, lok && rok
+				}
+			}
+			return exprValue{}, lok && rok
+		}}, nil
+	}
+	for _, op := range []string{"==", "!=", "<", "<=", ">", ">="} {
+		if _, ok := p.accept(op); !ok {
+			continue
+		}
+		right, err := p.parsePrimary()
+		if err != nil {
+			return right, err
+		}
+		if left.typ != right.typ || left.typ == typeList || (left.typ == typeBool && op != "==" && op != "!=") {
+			return exprNode{}, p.errorf("can't compare %s and %s with %s", left.typ, right.typ, op)
+		}
+		return compare(op, left, right), nil
+	}
+	return left, nil
+}
+
+func compare(op string, left, right exprNode) exprNode {
+	return exprNode{typeBool, func(o *exprObject) (exprValue, bool) {
+		l, lok := left.eval(o)
+		r, rok := right.eval(o)
+		c := 0
+		switch left.typ {
+		case typeString:
+			c = strings.Compare(l.s, r.s)
+		case typeBool:
+			if l.b != r.b {
+				c = 1
+			}
+		default:
+			if l.i < r.i {
+				c = -1
+			} else if l.i > r.i {
+				c = 1
+			}
+		}
+		var b bool
+		switch op {
+		case "==":
+			b = c == 0
+		case "!=":
+			b = c != 0
+		case "<":
+			b = c < 0
+		case "<=":
+			b = c <= 0
+		case ">":
+			b = c > 0
+		case ">=":
+			b = c >= 0
+		}
+		return exprValue{b: b}, lok && rok
+	}}
+}
+
+func constant(typ exprType, v exprValue) exprNode {
+	return exprNode{typ, func(*exprObject) (exprValue, bool) { return v, true }}
+}
+
+func (p *exprParser) parsePrimary() (exprNode, error) {
+	var node exprNode
+	switch {
+	case p.pos >= len(p.tokens):
+		return node, p.errorf("unexpected end")
+	case p.tokens[p.pos].kind == "(":
+		p.pos++
+		inner, err := p.parseOr()
+		if err != nil {
+			return inner, err
+		}
+		if _, err := p.expect(")"); err != nil {
+			return inner, err
+		}
+		node = inner
+	case p.tokens[p.pos].kind == "[":
+		p.pos++
+		var list []string
+		for {
+			if _, ok := p.accept("]"); ok {
+				break
+			}
+			if len(list) > 0 {
+				if _, err := p.expect(","); err != nil {
+					return node, err
+				}
+			}
+			t, err := p.expect("string")
+			if err != nil {
+				return node, err
+			}
+			list = append(list, t.text)
+		}
+		node = constant(typeList, exprValue{l: list})
+	case p.tokens[p.pos].kind == "string":
+		node = constant(typeString, exprValue{s: p.tokens[p.pos].text})
+		p.pos++
+	case p.tokens[p.pos].kind == "number":
+		n, err := strconv.ParseInt(p.tokens[p.pos].text, 10, 64)
+		if err != nil {
+			return node, p.errorf("invalid number %s", p.tokens[p.pos].text)
+		}
+		node = constant(typeInt, exprValue{i: n})
+		p.pos++
+	case p.tokens[p.pos].kind == "ident":
+		t := p.tokens[p.pos]
+		p.pos++
+		var err error
+		switch t.text {
+		case "true", "false":
+			node = constant(typeBool, exprValue{b: t.text == "true"})
+		case "duration", "bytes":
+			node, err = p.parseConversion(t.text)
+		default:
+			field, ok := exprFields[t.text]
+			if !ok {
+				p.pos--
+				return node, p.errorf("unknown field %q", t.text)
+			}
+			p.details = p.details || t.text != "key"
+			node = field
+		}
+		if err != nil {
+			return node, err
+		}
+	default:
+		return node, p.errorf("unexpected %q", p.tokens[p.pos].text)
+	}
+	for {
+		if _, ok := p.accept("."); !ok {
+			return node, nil
+		}
+		var err error
+		if node, err = p.parseMethod(node); err != nil {
+			return node, err
+		}
+	}
+}
+
+// parseConversion parses duration("...") and bytes("..."), with the
+// syntax of -older-than and -min-size.
+func (p *exprParser) parseConversion(name string) (exprNode, error) {
+	if _, err := p.expect("("); err != nil {
+		return exprNode{}, err
+	}
+	t, err := p.expect("string")
+	if err != nil {
+		return exprNode{}, err
+	}
+	if _, err := p.expect(")"); err != nil {
+		return exprNode{}, err
+	}
+	if name == "duration" {
+		var age Age
+		if err := age.Set(t.text); err != nil {
+			return exprNode{}, p.errorf("%s", err)
+		}
+		return constant(typeDuration, exprValue{i: int64(age)}), nil
+	}
+	var size ByteSize
+	if err := size.Set(t.text); err != nil {
+		return exprNode{}, p.errorf("%s", err)
+	}
+	return constant(typeInt, exprValue{i: int64(size)}), nil
+}
+
+// parseMethod parses the string method called on node.
+func (p *exprParser) parseMethod(node exprNode) (exprNode, error) {
+	t, err := p.expect("ident")
+	if err != nil {
+		return node, err
+	}
+	if node.typ != typeString {
+		return node, p.errorf("%s has no method %s", node.typ, t.text)
+	}
+	if _, err := p.expect("("); err != nil {
+		return node, err
+	}
+	arg, err := p.expect("string")
+	if err != nil {
+		return node, err
+	}
+	if _, err := p.expect(")"); err != nil {
+		return node, err
+	}
+	var test func(s string) bool
+	switch t.text {
+	case "startsWith":
+		test = func(s string) bool { return strings.HasPrefix(s, arg.text) }
+	case "endsWith":
+		test = func(s string) bool { return strings.HasSuffix(s, arg.text) }
+	case "contains":
+		test = func(s string) bool { return strings.Contains(s, arg.text) }
+	case "matches":
+		re, err := regexp.Compile(arg.text)
+		if err != nil {
+			return node, p.errorf("invalid regular expression: %s", err)
+		}
+		test = re.MatchString
+	default:
+		return node, p.errorf("unknown method %q", t.text)
+	}
+	return exprNode{typeBool, func(o *exprObject) (exprValue, bool) {
+		v, ok := node.eval(o)
+		return exprValue{b: ok && test(v.s)}, ok
+	}}, nil
+}
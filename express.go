@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const (
+	directoryBucketSuffix = "--x-s3"
+	expressSigningName    = "s3express"
+	expressTokenHeader    = "x-amz-s3session-token"
+)
+
+// IsDirectoryBucket reports whether the bucket name follows the S3 Express
+// One Zone naming scheme, bucket-base-name--azid--x-s3.
+func IsDirectoryBucket(bucket string) bool {
+	return strings.HasSuffix(bucket, directoryBucketSuffix)
+}
+
+// directoryBucketZone extracts the availability zone id from a directory
+// bucket name.
+func directoryBucketZone(bucket string) (string, error) {
+	name := strings.TrimSuffix(bucket, directoryBucketSuffix)
+	i := strings.LastIndex(name, "--")
+	if name == bucket || i < 1 || i+2 == len(name) {
+		return "", fmt.Errorf("%s is not a valid directory bucket name (bucket-base-name--azid--x-s3)", bucket)
+	}
+	return name[i+2:], nil
+}
+
+// NewDirectoryBucketClient returns an S3 client for the zonal endpoint of a
+// directory bucket. Requests are signed with session credentials obtained
+// through CreateSession, which are refreshed shortly before they expire.
+func NewDirectoryBucketClient(sess *session.Session, bucket string) (*s3.S3, error) {
+	zone, err := directoryBucketZone(bucket)
+	if err != nil {
+		return nil, err
+	}
+	region := aws.StringValue(sess.Config.Region)
+	endpoint := fmt.Sprintf("https://s3express-%s.%s.amazonaws.com", zone, region)
+
+	// CreateSession itself is signed with the regular credentials
+	sessionClient := s3.New(sess, &aws.Config{Endpoint: aws.String(endpoint)})
+	sessionClient.ClientInfo.SigningName = expressSigningName
+
+	provider := &expressProvider{bucket: bucket, client: sessionClient}
+	svc := s3.New(sess, &aws.Config{
+		Endpoint:    aws.String(endpoint),
+		Credentials: credentials.NewCredentials(provider),
+	})
+	svc.ClientInfo.SigningName = expressSigningName
+	svc.Handlers.Sign.PushFrontNamed(request.NamedHandler{
+		Name: "s3rm.ExpressSessionToken",
+		Fn:   provider.setToken,
+	})
+	return svc, nil
+}
+
+// expressProvider is a credentials.Provider backed by CreateSession. The
+// session token is kept out of the returned credentials because directory
+// buckets expect it in the x-amz-s3session-token header rather than the
+// usual X-Amz-Security-Token.
+type expressProvider struct {
+	mu      sync.Mutex
+	bucket  string
+	client  *s3.S3
+	token   string
+	expires time.Time
+}
+
+func (p *expressProvider) Retrieve() (credentials.Value, error) {
+	resp, err := p.client.CreateSession(&s3.CreateSessionInput{
+		Bucket: aws.String(p.bucket),
+	})
+	if err != nil {
+		return credentials.Value{}, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.token = aws.StringValue(resp.Credentials.SessionToken)
+	p.expires = aws.TimeValue(resp.Credentials.Expiration)
+	return credentials.Value{
+		AccessKeyID:     aws.StringValue(resp.Credentials.AccessKeyId),
+		SecretAccessKey: aws.StringValue(resp.Credentials.SecretAccessKey),
+		ProviderName:    "S3ExpressProvider",
+	}, nil
+}
+
+func (p *expressProvider) IsExpired() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return time.Now().Add(time.Minute).After(p.expires)
+}
+
+// setToken adds the session token header before the request is signed.
+func (p *expressProvider) setToken(r *request.Request) {
+	// make sure the session has been created or refreshed
+	if _, err := r.Config.Credentials.Get(); err != nil {
+		r.Error = err
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	r.HTTPRequest.Header.Set(expressTokenHeader, p.token)
+}
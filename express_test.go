@@ -0,0 +1,108 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// expressTransport answers the CreateSession and DeleteObjects requests of
+// a directory bucket client, recording the requests it gets.
+type expressTransport struct {
+	mu       sync.Mutex
+	token    string
+	requests []*http.Request
+}
+
+func (e *expressTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	e.mu.Lock()
+	e.requests = append(e.requests, r)
+	e.mu.Unlock()
+	var body string
+	if _, ok := r.URL.Query()["session"]; ok {
+		body = `<CreateSessionResult><Credentials>` +
+			`<AccessKeyId>session-id</AccessKeyId><SecretAccessKey>session-secret</SecretAccessKey>` +
+			`<SessionToken>` + e.token + `</SessionToken>` +
+			`<Expiration>` + time.Now().Add(5*time.Minute).UTC().Format(time.RFC3339) + `</Expiration>` +
+			`</Credentials></CreateSessionResult>`
+	} else {
+		body = `<DeleteResult></DeleteResult>`
+	}
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": {"application/xml"}},
+		Body:       ioutil.NopCloser(strings.NewReader(body)),
+		Request:    r,
+	}, nil
+}
+
+func TestDirectoryBucketDeleteObjects(t *testing.T) {
+	const (
+		bucket = "logs--use1-az4--x-s3"
+		host   = "s3express-use1-az4.us-east-1.amazonaws.com"
+	)
+	// a custom CA bundle only works with an *http.Transport
+	t.Setenv("AWS_CA_BUNDLE", "")
+	transport := &expressTransport{token: "session-token"}
+	sess := session.Must(session.NewSession(&aws.Config{
+		Region:      aws.String("us-east-1"),
+		Credentials: credentials.NewStaticCredentials("id", "secret", ""),
+		HTTPClient:  &http.Client{Transport: transport},
+		MaxRetries:  aws.Int(0),
+	}))
+	credentialGate = NewCredentialGate(sess.Config)
+	if pool == nil {
+		pool = NewPartitionPool(1, 1)
+	}
+	svc, err := NewDirectoryBucketClient(sess, bucket)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	objects := []*s3.ObjectIdentifier{{Key: aws.String("a")}, {Key: aws.String("b")}}
+	task := &DeleteTask{client: svc, Bucket: bucket, Objects: objects}
+	if err := task.Execute(); err != nil {
+		t.Fatal(err)
+	}
+
+	var deletes int
+	for _, r := range transport.requests {
+		if r.URL.Host != host && !strings.HasSuffix(r.URL.Host, "."+host) {
+			t.Errorf("request sent to %s, want the zonal endpoint %s", r.URL.Host, host)
+		}
+		auth := r.Header.Get("Authorization")
+		if !strings.Contains(auth, "/us-east-1/"+expressSigningName+"/aws4_request") {
+			t.Errorf("request signed as %q, want the %s signing name", auth, expressSigningName)
+		}
+		if _, ok := r.URL.Query()["delete"]; !ok {
+			continue
+		}
+		deletes++
+		if r.Method != http.MethodPost {
+			t.Errorf("DeleteObjects sent as %s", r.Method)
+		}
+		if token := r.Header.Get(expressTokenHeader); token != transport.token {
+			t.Errorf("DeleteObjects has %s %q, want %q", expressTokenHeader, token, transport.token)
+		}
+		if token := r.Header.Get("X-Amz-Security-Token"); token != "" {
+			t.Errorf("DeleteObjects has X-Amz-Security-Token %q, want none", token)
+		}
+		if !strings.Contains(auth, "Credential=session-id/") {
+			t.Errorf("DeleteObjects signed with %q, want the session credentials", auth)
+		}
+		if !strings.Contains(auth, expressTokenHeader) {
+			t.Errorf("%s isn't signed: %q", expressTokenHeader, auth)
+		}
+	}
+	if deletes != 1 {
+		t.Errorf("got %d DeleteObjects requests, want 1", deletes)
+	}
+}
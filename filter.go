@@ -0,0 +1,214 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync/atomic"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Filter spares objects from deletion.
+type Filter interface {
+	// Spare returns true for objects that must not be deleted.
+	Spare(object *s3.ObjectIdentifier) bool
+}
+
+// FilterFunc adapts a function to the Filter interface.
+type FilterFunc func(object *s3.ObjectIdentifier) bool
+
+func (f FilterFunc) Spare(object *s3.ObjectIdentifier) bool {
+	return f(object)
+}
+
+// DetailFilter is implemented by filters that spare objects by what their
+// listing says about them, rather than by their key. Objects listed without
+// details are always spared by these filters, as they can't be checked.
+type DetailFilter interface {
+	SpareDetail(detail *s3.Object) bool
+}
+
+// DetailFilterFunc adapts a function to the Filter and DetailFilter
+// interfaces.
+type DetailFilterFunc func(detail *s3.Object) bool
+
+// Spare spares objects whose details aren't known.
+func (f DetailFilterFunc) Spare(object *s3.ObjectIdentifier) bool {
+	return true
+}
+
+func (f DetailFilterFunc) SpareDetail(detail *s3.Object) bool {
+	return f(detail)
+}
+
+// BatchFilter is implemented by filters that look objects up before they
+// can tell which to spare. Prepare is called with the objects of each batch
+// left by the filters before it, so they can be looked up concurrently.
+type BatchFilter interface {
+	Prepare(objects []*s3.ObjectIdentifier)
+}
+
+// FilterChain applies filters in order and counts the objects each of them
+// spared.
+type FilterChain struct {
+	names   []string
+	filters []Filter
+	spared  []int64
+}
+
+func (c *FilterChain) Add(name string, filter Filter) {
+	c.names = append(c.names, name)
+	c.filters = append(c.filters, filter)
+	c.spared = append(c.spared, 0)
+}
+
+func (c *FilterChain) Len() int {
+	return len(c.filters)
+}
+
+// Apply returns the objects no filter spared. details maps objects to their
+// listing, for the filters that need it; it may be nil. Filters are applied
+// in turn to the whole batch, so batch filters only look up the objects the
+// filters before them kept.
+func (c *FilterChain) Apply(objects []*s3.ObjectIdentifier, details map[*s3.ObjectIdentifier]*s3.Object) []*s3.ObjectIdentifier {
+	kept := objects
+	for i, filter := range c.filters {
+		if len(kept) == 0 {
+			break
+		}
+		if bf, ok := filter.(BatchFilter); ok {
+			bf.Prepare(kept)
+		}
+		remaining := kept[:0:0]
+		for _, object := range kept {
+			if spares(filter, object, details[object]) {
+				atomic.AddInt64(&c.spared[i], 1)
+			} else {
+				remaining = append(remaining, object)
+			}
+		}
+		kept = remaining
+	}
+	return kept
+}
+
+// Spares reports whether any filter spares the object, without counting it.
+// The detail of the object may be nil.
+func (c *FilterChain) Spares(object *s3.ObjectIdentifier, detail *s3.Object) bool {
+	for _, filter := range c.filters {
+		if spares(filter, object, detail) {
+			return true
+		}
+	}
+	return false
+}
+
+// SparesListed is Spares without the batch filters, which would look the
+// object up.
+func (c *FilterChain) SparesListed(object *s3.ObjectIdentifier, detail *s3.Object) bool {
+	for _, filter := range c.filters {
+		if _, ok := filter.(BatchFilter); ok {
+			continue
+		}
+		if spares(filter, object, detail) {
+			return true
+		}
+	}
+	return false
+}
+
+// Names returns the names of the filters, in the order they are applied.
+func (c *FilterChain) Names() []string {
+	return c.names
+}
+
+func spares(filter Filter, object *s3.ObjectIdentifier, detail *s3.Object) bool {
+	if df, ok := filter.(DetailFilter); ok && detail != nil {
+		return df.SpareDetail(detail)
+	}
+	return filter.Spare(object)
+}
+
+// Spared returns the number of objects spared by all filters.
+func (c *FilterChain) Spared() int64 {
+	var total int64
+	for i := range c.spared {
+		total += atomic.LoadInt64(&c.spared[i])
+	}
+	return total
+}
+
+// WriteSummary writes the number of objects spared by each filter.
+func (c *FilterChain) WriteSummary(w io.Writer) {
+	if len(c.filters) == 0 {
+		return
+	}
+	fmt.Fprintln(w, "spared:")
+	for i, name := range c.names {
+		fmt.Fprintf(w, "  %-20s %d\n", name, atomic.LoadInt64(&c.spared[i]))
+	}
+}
+
+// bloomFilter spares keys the Bloom filter of keys to keep may contain.
+func bloomFilter(filter *BloomFilter) Filter {
+	return FilterFunc(func(object *s3.ObjectIdentifier) bool {
+		return filter.Contains(aws.StringValue(object.Key))
+	})
+}
+
+// archivedClasses are the storage classes objects have to be restored from
+// before they can be read, and which charge for early deletes.
+var archivedClasses = []string{s3.ObjectStorageClassGlacier, s3.ObjectStorageClassDeepArchive}
+
+// storageClassFilter spares objects in none of the storage classes, or with
+// except, those in one of them. Objects of an unknown class, such as
+// inventory rows without one, are spared either way.
+func storageClassFilter(classes []string, except bool) Filter {
+	return DetailFilterFunc(func(detail *s3.Object) bool {
+		if detail.StorageClass == nil {
+			return true
+		}
+		for _, class := range classes {
+			if class == *detail.StorageClass {
+				return except
+			}
+		}
+		return !except
+	})
+}
+
+// ownerFilter spares objects owned by none of the owners, given by ID or
+// display name, or with except, those owned by one of them. Objects whose
+// owner isn't known are spared either way.
+func ownerFilter(owners []string, except bool) Filter {
+	return DetailFilterFunc(func(detail *s3.Object) bool {
+		if detail.Owner == nil {
+			return true
+		}
+		id, name := aws.StringValue(detail.Owner.ID), aws.StringValue(detail.Owner.DisplayName)
+		for _, owner := range owners {
+			if owner == id || (name != "" && owner == name) {
+				return except
+			}
+		}
+		return !except
+	})
+}
+
+// checkStorageClasses upper-cases storage class names, and makes sure they
+// exist.
+func checkStorageClasses(classes []string) error {
+	for i, class := range classes {
+		classes[i] = strings.ToUpper(class)
+		known := false
+		for _, c := range s3.ObjectStorageClass_Values() {
+			known = known || c == classes[i]
+		}
+		if !known {
+			return fmt.Errorf("unknown storage class %q, use one of %s", class, strings.Join(s3.ObjectStorageClass_Values(), ", "))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// InventoryManifest is the manifest.json of an S3 Inventory report.
+type InventoryManifest struct {
+	SourceBucket      string `json:"sourceBucket"`
+	DestinationBucket string `json:"destinationBucket"`
+	FileFormat        string `json:"fileFormat"`
+	FileSchema        string `json:"fileSchema"`
+	Files             []struct {
+		Key  string `json:"key"`
+		Size int64  `json:"size"`
+	} `json:"files"`
+}
+
+// InventoryScanner reads the keys, and version IDs if the report has them,
+// of an S3 Inventory report in CSV, Parquet or ORC format. CSV data files are
+// streamed from S3 one at a time and decompressed as they are read. Parquet
+// and ORC files can only be read with random access, so each is downloaded
+// to a temporary file in Dir first.
+type InventoryScanner struct {
+	Manifest *InventoryManifest
+	Dir      string
+	bucket   string
+	client   *s3.S3
+	columns  map[string]int
+	current  int
+	rows     inventoryRows
+	buf      []*s3.ObjectIdentifier
+	details  map[*s3.ObjectIdentifier]*s3.Object
+	emitted  int64
+	err      error
+}
+
+// NewInventoryScanner reads the manifest at an s3:// URI.
+func NewInventoryScanner(uri string, client *s3.S3) (*InventoryScanner, error) {
+	bucket, key, err := ParseS3URI(uri)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	manifest := &InventoryManifest{}
+	if err := json.NewDecoder(resp.Body).Decode(manifest); err != nil {
+		return nil, fmt.Errorf("%s: %s", uri, err)
+	}
+	switch manifest.FileFormat {
+	case "CSV", "Parquet", "ORC":
+	default:
+		return nil, fmt.Errorf("%s: unsupported inventory format %s", uri, manifest.FileFormat)
+	}
+
+	s := &InventoryScanner{
+		Manifest: manifest,
+		bucket:   strings.TrimPrefix(manifest.DestinationBucket, "arn:aws:s3:::"),
+		client:   client,
+		columns:  make(map[string]int),
+	}
+	if manifest.FileFormat == "CSV" {
+		for i, column := range strings.Split(manifest.FileSchema, ",") {
+			s.columns[strings.TrimSpace(column)] = i
+		}
+		if _, ok := s.columns["Key"]; !ok {
+			return nil, fmt.Errorf("%s: the inventory has no Key column", uri)
+		}
+	}
+	return s, nil
+}
+
+func (s *InventoryScanner) Scan(count int) bool {
+	s.buf = nil
+	s.details = make(map[*s3.ObjectIdentifier]*s3.Object)
+	for len(s.buf) < count {
+		if s.rows == nil && !s.open() {
+			break
+		}
+		record, err := s.rows.Next()
+		if err == io.EOF {
+			s.rows.Close()
+			s.rows = nil
+			s.current++
+			continue
+		}
+		if err != nil {
+			s.err = fmt.Errorf("%s: %s", s.Manifest.Files[s.current].Key, err)
+			return false
+		}
+		if err := s.add(record); err != nil {
+			s.err = fmt.Errorf("%s: %s", s.Manifest.Files[s.current].Key, err)
+			return false
+		}
+	}
+	if len(s.buf) == 0 {
+		return false
+	}
+	atomic.AddInt64(&s.emitted, int64(len(s.buf)))
+	return true
+}
+
+// open starts reading the next data file, if any is left.
+func (s *InventoryScanner) open() bool {
+	if s.err != nil || s.current >= len(s.Manifest.Files) {
+		return false
+	}
+	key := s.Manifest.Files[s.current].Key
+	resp, err := s.client.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		s.err = fmt.Errorf("%s: %s", key, err)
+		return false
+	}
+	switch s.Manifest.FileFormat {
+	case "Parquet":
+		s.rows, err = openParquetRows(resp.Body, s.Dir)
+	case "ORC":
+		s.rows, err = openORCRows(resp.Body, s.Dir)
+	default:
+		s.rows, err = openCSVRows(resp.Body, s.columns)
+	}
+	if err != nil {
+		s.err = fmt.Errorf("%s: %s", key, err)
+		return false
+	}
+	return true
+}
+
+// add adds an inventory row. Keys in CSV reports are URL encoded.
+func (s *InventoryScanner) add(row map[string]string) error {
+	key := row["Key"]
+	if s.Manifest.FileFormat == "CSV" {
+		var err error
+		if key, err = url.QueryUnescape(key); err != nil {
+			return err
+		}
+	}
+	id := &s3.ObjectIdentifier{Key: aws.String(key)}
+	if version := row["VersionId"]; version != "" {
+		id.VersionId = aws.String(version)
+	}
+	detail := &s3.Object{Key: id.Key}
+	if size, err := strconv.ParseInt(row["Size"], 10, 64); err == nil {
+		detail.Size = aws.Int64(size)
+	}
+	if modified, err := time.Parse(time.RFC3339, row["LastModifiedDate"]); err == nil {
+		detail.LastModified = aws.Time(modified)
+	}
+	if class := row["StorageClass"]; class != "" {
+		detail.StorageClass = aws.String(class)
+	}
+	if etag := row["ETag"]; etag != "" {
+		detail.ETag = aws.String(etag)
+	}
+	s.buf = append(s.buf, id)
+	s.details[id] = detail
+	return nil
+}
+
+func (s *InventoryScanner) Err() error {
+	return s.err
+}
+
+func (s *InventoryScanner) Objects() []*s3.ObjectIdentifier {
+	return s.buf
+}
+
+func (s *InventoryScanner) Details() map[*s3.ObjectIdentifier]*s3.Object {
+	return s.details
+}
+
+func (s *InventoryScanner) EmittedKeys() int64 {
+	return atomic.LoadInt64(&s.emitted)
+}
+
+// EstimatedTotal always returns false, data files don't record their
+// number of rows.
+func (s *InventoryScanner) EstimatedTotal() (int64, bool) {
+	return 0, false
+}
+
+// ParseS3URI splits an s3://bucket/key URI.
+func ParseS3URI(uri string) (string, string, error) {
+	if !strings.HasPrefix(uri, "s3://") {
+		return "", "", fmt.Errorf("%s is not an s3:// URI", uri)
+	}
+	parts := strings.SplitN(strings.TrimPrefix(uri, "s3://"), "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", fmt.Errorf("%s is not an s3://bucket/key URI", uri)
+	}
+	return parts[0], parts[1], nil
+}
+
+func init() {
+	RegisterSource(&Source{
+		Name:     "inventory",
+		KeyList:  true,
+		Details:  true,
+		Selected: func(*SourceEnv) bool { return flagInventory != "" },
+		New: func(env *SourceEnv) (Scanner, error) {
+			if flagInventory == "" {
+				return nil, UsageError("Please provide the -inventory manifest to read the keys from")
+			}
+			is, err := NewInventoryScanner(flagInventory, env.Client)
+			if err != nil {
+				return nil, err
+			}
+			if is.Manifest.SourceBucket != env.Bucket {
+				return nil, UsageError(fmt.Sprintf("The inventory lists bucket %s, not %s", is.Manifest.SourceBucket, env.Bucket))
+			}
+			is.Dir = flagTmpDir
+			return is, nil
+		},
+	})
+}
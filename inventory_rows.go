@@ -0,0 +1,232 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+	"github.com/scritchley/orc"
+)
+
+// inventoryColumns maps the column names of Parquet and ORC inventory
+// reports to those of CSV reports.
+var inventoryColumns = map[string]string{
+	"key":                "Key",
+	"version_id":         "VersionId",
+	"size":               "Size",
+	"last_modified_date": "LastModifiedDate",
+	"storage_class":      "StorageClass",
+	"e_tag":              "ETag",
+}
+
+// inventoryRows reads the rows of an inventory data file, with values named
+// after the CSV columns.
+type inventoryRows interface {
+	// Next returns the next row, or io.EOF after the last one.
+	Next() (map[string]string, error)
+	Close() error
+}
+
+type csvRows struct {
+	body    io.ReadCloser
+	reader  *csv.Reader
+	columns map[string]int
+}
+
+// openCSVRows reads a gzipped CSV data file, whose columns are described
+// by the manifest.
+func openCSVRows(body io.ReadCloser, columns map[string]int) (inventoryRows, error) {
+	gz, err := gzip.NewReader(body)
+	if err != nil {
+		body.Close()
+		return nil, err
+	}
+	reader := csv.NewReader(gz)
+	reader.FieldsPerRecord = -1
+	return &csvRows{body: body, reader: reader, columns: columns}, nil
+}
+
+func (r *csvRows) Next() (map[string]string, error) {
+	record, err := r.reader.Read()
+	if err != nil {
+		return nil, err
+	}
+	row := make(map[string]string, len(r.columns))
+	for name, i := range r.columns {
+		if i < len(record) {
+			row[name] = record[i]
+		}
+	}
+	return row, nil
+}
+
+func (r *csvRows) Close() error {
+	return r.body.Close()
+}
+
+// download copies a data file to a temporary file, for formats that need
+// random access.
+func download(body io.ReadCloser, dir string) (*os.File, error) {
+	defer body.Close()
+	f, err := ioutil.TempFile(dir, "s3rm-inventory-")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(f, body); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return f, nil
+}
+
+// removeFile closes and deletes a temporary file.
+func removeFile(f *os.File) error {
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+type parquetRows struct {
+	file    *os.File
+	reader  *parquet.Reader
+	columns []string
+	buf     []parquet.Row
+}
+
+func openParquetRows(body io.ReadCloser, dir string) (inventoryRows, error) {
+	f, err := download(body, dir)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		removeFile(f)
+		return nil, err
+	}
+	pf, err := parquet.OpenFile(f, info.Size())
+	if err != nil {
+		removeFile(f)
+		return nil, err
+	}
+	r := &parquetRows{file: f, reader: parquet.NewReader(pf), buf: make([]parquet.Row, 1)}
+	for _, field := range pf.Schema().Fields() {
+		r.columns = append(r.columns, inventoryColumns[field.Name()])
+	}
+	return r, nil
+}
+
+func (r *parquetRows) Next() (map[string]string, error) {
+	n, err := r.reader.ReadRows(r.buf)
+	if n == 0 {
+		if err == nil {
+			err = io.EOF
+		}
+		return nil, err
+	}
+	row := make(map[string]string)
+	for _, value := range r.buf[0] {
+		i := value.Column()
+		if i >= len(r.columns) || r.columns[i] == "" || value.IsNull() {
+			continue
+		}
+		switch value.Kind() {
+		case parquet.ByteArray, parquet.FixedLenByteArray:
+			row[r.columns[i]] = string(value.ByteArray())
+		case parquet.Int64:
+			// timestamps are stored in milliseconds
+			if r.columns[i] == "LastModifiedDate" {
+				row[r.columns[i]] = time.Unix(0, value.Int64()*int64(time.Millisecond)).UTC().Format(time.RFC3339)
+			} else {
+				row[r.columns[i]] = strconv.FormatInt(value.Int64(), 10)
+			}
+		case parquet.Int32:
+			row[r.columns[i]] = strconv.FormatInt(int64(value.Int32()), 10)
+		}
+	}
+	return row, nil
+}
+
+func (r *parquetRows) Close() error {
+	r.reader.Close()
+	return removeFile(r.file)
+}
+
+type orcRows struct {
+	file    *os.File
+	cursor  *orc.Cursor
+	columns []string
+	started bool
+}
+
+// orcFile adds the Size method the ORC reader needs to a file.
+type orcFile struct {
+	*os.File
+	size int64
+}
+
+func (f orcFile) Size() int64 {
+	return f.size
+}
+
+func openORCRows(body io.ReadCloser, dir string) (inventoryRows, error) {
+	f, err := download(body, dir)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		removeFile(f)
+		return nil, err
+	}
+	reader, err := orc.NewReader(orcFile{f, info.Size()})
+	if err != nil {
+		removeFile(f)
+		return nil, err
+	}
+	r := &orcRows{file: f}
+	var fields []string
+	for _, field := range reader.Schema().Columns() {
+		if name, ok := inventoryColumns[field]; ok {
+			fields = append(fields, field)
+			r.columns = append(r.columns, name)
+		}
+	}
+	r.cursor = reader.Select(fields...)
+	return r, nil
+}
+
+func (r *orcRows) Next() (map[string]string, error) {
+	for !r.started || !r.cursor.Next() {
+		if err := r.cursor.Err(); err != nil {
+			return nil, err
+		}
+		if !r.cursor.Stripes() {
+			if err := r.cursor.Err(); err != nil {
+				return nil, err
+			}
+			return nil, io.EOF
+		}
+		r.started = true
+	}
+	row := make(map[string]string, len(r.columns))
+	for i, value := range r.cursor.Row() {
+		switch v := value.(type) {
+		case nil:
+		case time.Time:
+			row[r.columns[i]] = v.UTC().Format(time.RFC3339)
+		default:
+			row[r.columns[i]] = fmt.Sprint(v)
+		}
+	}
+	return row, nil
+}
+
+func (r *orcRows) Close() error {
+	return removeFile(r.file)
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/segmentio/kafka-go"
+)
+
+// DefaultKafkaGroup is the consumer group offsets are committed for.
+const DefaultKafkaGroup = "s3rm"
+
+// kafkaLinger is how long a batch waits for more messages once it has some.
+const kafkaLinger = 100 * time.Millisecond
+
+var (
+	flagKafkaBrokers string
+	flagKafkaTopic   string
+	flagKafkaGroup   string
+	flagKafkaIdle    time.Duration
+)
+
+// KafkaScanner reads keys from the messages of a Kafka topic, as a member of
+// a consumer group. Message values are read like SQS message bodies: S3
+// event notifications, or a list of keys, one per line. The offset of a
+// partition is only committed past a message once every key of the message,
+// and of the messages before it, was deleted or spared by a filter. Keys
+// that failed to delete hold the offset back, so their messages are read
+// again by the next consumer of the partition.
+type KafkaScanner struct {
+	Topic  string
+	Group  string
+	Bucket string
+	// Idle stops the scanner once the topic had no new messages for this
+	// long. When zero, the topic is read until the run is stopped.
+	Idle      time.Duration
+	reader    *kafka.Reader
+	ctx       context.Context
+	stop      context.CancelFunc
+	buf       []*s3.ObjectIdentifier
+	err       error
+	emitted   int64
+	ignored   int64
+	committed int64
+	lastSeen  time.Time
+
+	mu sync.Mutex
+	// pending maps each key to the messages waiting for it to be deleted
+	pending map[string][]*kafkaMessage
+	// partitions holds the messages of each partition not committed yet, in
+	// offset order
+	partitions map[int][]*kafkaMessage
+}
+
+type kafkaMessage struct {
+	message kafka.Message
+	keys    int
+}
+
+func NewKafkaScanner(brokers []string, topic string, group string, bucket string) *KafkaScanner {
+	ctx, stop := context.WithCancel(context.Background())
+	return &KafkaScanner{
+		Topic:  topic,
+		Group:  group,
+		Bucket: bucket,
+		reader: kafka.NewReader(kafka.ReaderConfig{
+			Brokers: brokers,
+			GroupID: group,
+			Topic:   topic,
+			// the reader retries on its own, errors would go unnoticed
+			ErrorLogger: kafka.LoggerFunc(func(format string, args ...interface{}) {
+				fmt.Fprintf(os.Stderr, "\nkafka: "+format+"\n", args...)
+			}),
+		}),
+		ctx:        ctx,
+		stop:       stop,
+		lastSeen:   time.Now(),
+		pending:    make(map[string][]*kafkaMessage),
+		partitions: make(map[int][]*kafkaMessage),
+	}
+}
+
+func (s *KafkaScanner) Scan(count int) bool {
+	s.buf = nil
+	for len(s.buf) < count && s.ctx.Err() == nil {
+		// don't hold back a batch waiting for it to fill up
+		ctx, cancel := s.ctx, context.CancelFunc(func() {})
+		if len(s.buf) > 0 {
+			ctx, cancel = context.WithTimeout(s.ctx, kafkaLinger)
+		} else if s.Idle > 0 {
+			ctx, cancel = context.WithDeadline(s.ctx, s.lastSeen.Add(s.Idle))
+		}
+		message, err := s.reader.FetchMessage(ctx)
+		cancel()
+		if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+			break
+		}
+		if err != nil {
+			s.err = err
+			return false
+		}
+		s.lastSeen = time.Now()
+		s.add(message)
+	}
+	if len(s.buf) == 0 {
+		return false
+	}
+	atomic.AddInt64(&s.emitted, int64(len(s.buf)))
+	return true
+}
+
+// add reads the keys of a message. Messages without keys to delete are
+// done with right away.
+func (s *KafkaScanner) add(message kafka.Message) {
+	keys, _, err := parseMessage(string(message.Value), s.Bucket)
+	if _, ok := err.(recordErrors); ok && len(keys) > 0 {
+		fmt.Fprintf(os.Stderr, "\nkafka: skipping records of the message at offset %d of partition %d: %s\n", message.Offset, message.Partition, err)
+	} else if err != nil {
+		fmt.Fprintf(os.Stderr, "\nkafka: ignoring message at offset %d of partition %d: %s\n", message.Offset, message.Partition, err)
+		atomic.AddInt64(&s.ignored, 1)
+	}
+
+	m := &kafkaMessage{message: message, keys: len(keys)}
+	s.mu.Lock()
+	s.partitions[message.Partition] = append(s.partitions[message.Partition], m)
+	for _, key := range keys {
+		if len(s.pending[key]) == 0 {
+			s.buf = append(s.buf, &s3.ObjectIdentifier{Key: aws.String(key)})
+		}
+		s.pending[key] = append(s.pending[key], m)
+	}
+	s.mu.Unlock()
+	if len(keys) == 0 {
+		s.commit()
+	}
+}
+
+// Ack marks keys as deleted, and commits the offsets their messages allow.
+func (s *KafkaScanner) Ack(objects []*s3.ObjectIdentifier) {
+	s.mu.Lock()
+	for _, object := range objects {
+		key := aws.StringValue(object.Key)
+		for _, m := range s.pending[key] {
+			m.keys--
+		}
+		delete(s.pending, key)
+	}
+	s.mu.Unlock()
+	s.commit()
+}
+
+// Nack forgets keys that failed to delete. Their messages are never done
+// with, and hold back the offset of their partition.
+func (s *KafkaScanner) Nack(objects []*s3.ObjectIdentifier) {
+	s.mu.Lock()
+	for _, object := range objects {
+		delete(s.pending, aws.StringValue(object.Key))
+	}
+	s.mu.Unlock()
+}
+
+// commit commits, for each partition, the offset past the messages done with
+// that follow the last committed one. Errors are only reported, as the
+// messages will be read again and their keys deleted again.
+func (s *KafkaScanner) commit() {
+	var done []kafka.Message
+	s.mu.Lock()
+	for partition, messages := range s.partitions {
+		n := 0
+		for n < len(messages) && messages[n].keys == 0 {
+			n++
+		}
+		if n > 0 {
+			done = append(done, messages[n-1].message)
+			s.partitions[partition] = messages[n:]
+			atomic.AddInt64(&s.committed, int64(n))
+		}
+	}
+	s.mu.Unlock()
+	if len(done) == 0 {
+		return
+	}
+	if err := s.reader.CommitMessages(context.Background(), done...); err != nil {
+		fmt.Fprintf(os.Stderr, "\nkafka: %s\n", err)
+	}
+}
+
+// Stop makes the scanner stop reading the topic, ending the scan once the
+// keys already received are returned. Offsets are still committed as the
+// keys received are deleted.
+func (s *KafkaScanner) Stop() {
+	s.stop()
+}
+
+func (s *KafkaScanner) Err() error {
+	return s.err
+}
+
+func (s *KafkaScanner) Objects() []*s3.ObjectIdentifier {
+	return s.buf
+}
+
+func (s *KafkaScanner) EmittedKeys() int64 {
+	return atomic.LoadInt64(&s.emitted)
+}
+
+// EstimatedTotal is never known, as messages keep arriving.
+func (s *KafkaScanner) EstimatedTotal() (int64, bool) {
+	return 0, false
+}
+
+// WriteSummary writes the number of messages committed, ignored and left
+// uncommitted.
+func (s *KafkaScanner) WriteSummary(w io.Writer) {
+	s.mu.Lock()
+	uncommitted := 0
+	for _, messages := range s.partitions {
+		uncommitted += len(messages)
+	}
+	s.mu.Unlock()
+	fmt.Fprintf(w, "kafka: %d messages committed, %d ignored, %d left uncommitted\n", atomic.LoadInt64(&s.committed), atomic.LoadInt64(&s.ignored), uncommitted)
+}
+
+func init() {
+	RegisterSource(&Source{
+		Name:     "kafka",
+		KeyList:  true,
+		Selected: func(*SourceEnv) bool { return flagKafkaTopic != "" },
+		Flags: func(flags *flag.FlagSet) {
+			flags.StringVar(&flagKafkaBrokers, "kafka-brokers", "", "")
+			flags.StringVar(&flagKafkaGroup, "kafka-group", DefaultKafkaGroup, "")
+			flags.DurationVar(&flagKafkaIdle, "kafka-idle", 0, "")
+			flags.StringVar(&flagKafkaTopic, "kafka-topic", "", "")
+		},
+		New: func(env *SourceEnv) (Scanner, error) {
+			if flagKafkaTopic == "" || flagKafkaBrokers == "" {
+				return nil, UsageError("Please provide both the -kafka-brokers and the -kafka-topic to read the keys from")
+			}
+			ks := NewKafkaScanner(strings.Split(flagKafkaBrokers, ","), flagKafkaTopic, flagKafkaGroup, env.Bucket)
+			ks.Idle = flagKafkaIdle
+			queue = ks
+			return ks, nil
+		},
+	})
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"sync/atomic"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// ErrCodeLegalHold replaces the ObjectLocked code of the object versions
+// found to be under a legal hold, rather than retention.
+const ErrCodeLegalHold = "LegalHold"
+
+var errLegalHold = awserr.New(ErrCodeLegalHold, "the object version is under a legal hold", nil)
+
+// releasedHolds counts the legal holds released with -release-legal-holds.
+var releasedHolds int64
+
+// checkLegalHolds looks up whether the keys of err denied by object lock are
+// under a legal hold, and returns the errors left. Held keys fail with
+// errLegalHold, unless the task releases holds: the hold is then released,
+// and the key deleted again.
+func (t *DeleteTask) checkLegalHolds(err error) error {
+	errs, ok := err.(KeyErrors)
+	if !ok {
+		return err
+	}
+	var left KeyErrors
+	for _, e := range errs {
+		if errorCode(e.Err) != ErrCodeObjectLocked {
+			left = append(left, e)
+			continue
+		}
+		// without permission to read the hold, the key stays ObjectLocked
+		held, herr := t.legalHold(e.Object)
+		if herr != nil || !held {
+			left = append(left, e)
+			continue
+		}
+		if !t.release {
+			left = append(left, &KeyError{Object: e.Object, Err: errLegalHold})
+			continue
+		}
+		if rerr := t.releaseLegalHold(e.Object); rerr != nil {
+			left = append(left, &KeyError{Object: e.Object, Err: rerr})
+			continue
+		}
+		atomic.AddInt64(&releasedHolds, 1)
+		// retention may still protect the version once the hold is released
+		if derr := t.deleteObject(e.Object); derr != nil {
+			left = append(left, &KeyError{Object: e.Object, Err: objectLockError(derr)})
+		}
+	}
+	if len(left) == 0 {
+		return nil
+	}
+	return left
+}
+
+// legalHold reports whether an object version is under a legal hold.
+func (t *DeleteTask) legalHold(object *s3.ObjectIdentifier) (bool, error) {
+	var resp *s3.GetObjectLegalHoldOutput
+	err := t.retry(func() (err error) {
+		resp, err = t.client.GetObjectLegalHold(&s3.GetObjectLegalHoldInput{
+			Bucket:    aws.String(t.Bucket),
+			Key:       object.Key,
+			VersionId: object.VersionId,
+		})
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+	return resp.LegalHold != nil && aws.StringValue(resp.LegalHold.Status) == s3.ObjectLockLegalHoldStatusOn, nil
+}
+
+// releaseLegalHold turns off the legal hold of an object version.
+func (t *DeleteTask) releaseLegalHold(object *s3.ObjectIdentifier) error {
+	return t.retry(func() error {
+		_, err := t.client.PutObjectLegalHold(&s3.PutObjectLegalHoldInput{
+			Bucket:    aws.String(t.Bucket),
+			Key:       object.Key,
+			VersionId: object.VersionId,
+			LegalHold: &s3.ObjectLockLegalHold{Status: aws.String(s3.ObjectLockLegalHoldStatusOff)},
+		})
+		return err
+	})
+}
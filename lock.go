@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const (
+	// LockKeyPrefix is where lock objects are written in the lock bucket.
+	LockKeyPrefix = "s3rm/.lock/"
+
+	// DefaultLockTTL is how long a lock that isn't refreshed stays valid.
+	DefaultLockTTL time.Duration = 10 * time.Minute
+)
+
+// LockInfo is the content of a lock object.
+type LockInfo struct {
+	Owner       string    `json:"owner"`
+	Target      string    `json:"target"`
+	StartedAt   time.Time `json:"started_at"`
+	RefreshedAt time.Time `json:"refreshed_at"`
+}
+
+// Lock keeps other s3rm runs from working on the same target, by holding a
+// lock object in a bucket. Creating it is conditional, so two runs starting
+// at once can't both get the lock. The lock is refreshed every third of its
+// TTL; a lock that wasn't refreshed within the TTL is considered stale and
+// can be stolen.
+//
+// Refreshes are conditional on the ETag of the last write, so a run whose
+// lock was stolen finds out at the next refresh, and aborts rather than
+// take the lock back.
+type Lock struct {
+	Bucket string
+	Key    string
+	TTL    time.Duration
+	client *s3.S3
+	info   LockInfo
+	stop   chan struct{}
+	once   sync.Once
+	// mu guards the lock object's ETag, from the last write, and lost, set
+	// once a refresh found the lock taken by another run.
+	mu   sync.Mutex
+	etag string
+	lost bool
+}
+
+// NewLock returns the lock of a target, which identifies what a run
+// deletes, such as a bucket and prefix.
+func NewLock(bucket string, target string, ttl time.Duration, client *s3.S3) *Lock {
+	sum := sha256.Sum256([]byte(target))
+	owner := fmt.Sprintf("pid %d", os.Getpid())
+	if host, err := os.Hostname(); err == nil {
+		owner = fmt.Sprintf("%s on %s", owner, host)
+	}
+	if u, err := user.Current(); err == nil {
+		owner = fmt.Sprintf("%s, %s", u.Username, owner)
+	}
+	return &Lock{
+		Bucket: bucket,
+		Key:    LockKeyPrefix + hex.EncodeToString(sum[:]),
+		TTL:    ttl,
+		client: client,
+		info:   LockInfo{Owner: owner, Target: target},
+		stop:   make(chan struct{}),
+	}
+}
+
+// Acquire takes the lock, or returns an error naming its holder. Once
+// acquired, the lock is refreshed in the background and released if the
+// process is interrupted.
+func (l *Lock) Acquire() error {
+	l.info.StartedAt = time.Now().UTC()
+	err := l.put("If-None-Match", "*")
+	if isPreconditionFailed(err) {
+		var held *LockInfo
+		var etag string
+		held, etag, err = l.get()
+		if err != nil {
+			return err
+		}
+		if age := time.Since(held.RefreshedAt); age < l.TTL {
+			return fmt.Errorf("%s is already running on %s since %s (lock s3://%s/%s)",
+				held.Owner, held.Target, held.StartedAt.Format(time.RFC3339), l.Bucket, l.Key)
+		}
+		fmt.Fprintf(os.Stderr, "warning: stealing the stale lock of %s, last refreshed %s ago\n",
+			held.Owner, time.Since(held.RefreshedAt).Round(time.Second))
+		err = l.put("If-Match", etag)
+		if isPreconditionFailed(err) {
+			return fmt.Errorf("lost the race for the stale lock s3://%s/%s", l.Bucket, l.Key)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	go l.refresh()
+	OnInterrupt(func() { l.Release() })
+	return nil
+}
+
+// Release stops refreshing the lock and deletes it, as long as it is still
+// ours: a lock stolen by another run, with another ETag and owner, is left
+// in place.
+func (l *Lock) Release() error {
+	var err error
+	l.once.Do(func() {
+		close(l.stop)
+		// a refresh in flight finishes first
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if l.lost {
+			return
+		}
+		held, etag, gerr := l.get()
+		if gerr != nil {
+			err = gerr
+			return
+		}
+		if etag != l.etag && held.Owner != l.info.Owner {
+			err = fmt.Errorf("the lock is now held by %s, leaving it in place", held.Owner)
+			return
+		}
+		req, _ := l.client.DeleteObjectRequest(&s3.DeleteObjectInput{
+			Bucket: aws.String(l.Bucket),
+			Key:    aws.String(l.Key),
+		})
+		req.HTTPRequest.Header.Set("If-Match", etag)
+		err = req.Send()
+	})
+	return err
+}
+
+// refresh rewrites the lock every third of its TTL until released, or until
+// a refresh finds that another run took the lock, which aborts the run.
+func (l *Lock) refresh() {
+	ticker := time.NewTicker(l.TTL / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			l.mu.Lock()
+			err := l.put("If-Match", l.etag)
+			if isPreconditionFailed(err) {
+				l.lost = true
+				l.mu.Unlock()
+				holder := "another run"
+				if held, _, gerr := l.get(); gerr == nil {
+					holder = held.Owner
+				}
+				fmt.Fprintf(os.Stderr, "\nerror: the lock s3://%s/%s was taken over by %s, stopping\n", l.Bucket, l.Key, holder)
+				abort(fmt.Sprintf("lost the lock s3://%s/%s to %s", l.Bucket, l.Key, holder))
+				return
+			}
+			l.mu.Unlock()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "\nwarning: failed to refresh the lock: %s\n", err)
+			}
+		case <-l.stop:
+			return
+		}
+	}
+}
+
+// put writes the lock object, with an optional conditional header, and
+// keeps the ETag of the object written.
+func (l *Lock) put(header string, value string) error {
+	l.info.RefreshedAt = time.Now().UTC()
+	data, err := json.Marshal(l.info)
+	if err != nil {
+		return err
+	}
+	req, resp := l.client.PutObjectRequest(&s3.PutObjectInput{
+		Bucket:      aws.String(l.Bucket),
+		Key:         aws.String(l.Key),
+		Body:        bytes.NewReader(data),
+		ContentType: aws.String("application/json"),
+	})
+	if header != "" {
+		req.HTTPRequest.Header.Set(header, value)
+	}
+	if err := req.Send(); err != nil {
+		return err
+	}
+	l.etag = aws.StringValue(resp.ETag)
+	return nil
+}
+
+// get reads the lock object and its ETag.
+func (l *Lock) get() (*LockInfo, string, error) {
+	resp, err := l.client.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(l.Bucket),
+		Key:    aws.String(l.Key),
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", err
+	}
+	info := &LockInfo{}
+	if err := json.Unmarshal(data, info); err != nil {
+		return nil, "", fmt.Errorf("s3://%s/%s is not an s3rm lock: %s", l.Bucket, l.Key, err)
+	}
+	return info, aws.StringValue(resp.ETag), nil
+}
+
+// isPreconditionFailed reports whether a conditional write failed because
+// of an existing object, or of a concurrent conditional write.
+func isPreconditionFailed(err error) bool {
+	if reqerr, ok := err.(awserr.RequestFailure); ok {
+		return reqerr.StatusCode() == 412 || reqerr.StatusCode() == 409
+	}
+	return false
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// DefaultLookupWorkers is how many objects a lookup filter looks up at once.
+const DefaultLookupWorkers = 20
+
+// metaHeaderPrefix starts the headers of user metadata.
+const metaHeaderPrefix = "x-amz-meta-"
+
+// LookupFilter spares objects that don't have all of the wanted attributes,
+// such as tags or metadata, which aren't listed and have to be looked up
+// with an extra request per object. Objects that can't be looked up are
+// spared.
+type LookupFilter struct {
+	// Name is the name of the filter in the summary
+	Name string
+	// Want maps the attributes to their wanted value. Values ending with /*
+	// match any value starting with what comes before the *.
+	Want    map[string]string
+	Workers int
+	lookup  func(object *s3.ObjectIdentifier) (map[string]string, error)
+	fetched int64
+	failed  int64
+
+	mu sync.Mutex
+	// batch holds the attributes of the objects of the batch being
+	// filtered, nil for the objects that couldn't be looked up
+	batch map[*s3.ObjectIdentifier]map[string]string
+}
+
+// parseWanted reads attributes given as key=value.
+func parseWanted(values []string) (map[string]string, error) {
+	want := make(map[string]string)
+	for _, value := range values {
+		i := strings.IndexByte(value, '=')
+		if i < 1 {
+			return nil, fmt.Errorf("invalid %q, expected key=value", value)
+		}
+		want[value[:i]] = value[i+1:]
+	}
+	return want, nil
+}
+
+// NewTagFilter returns a filter for tags given as key=value, fetched with
+// GetObjectTagging.
+func NewTagFilter(client *s3.S3, bucket string, tags []string) (*LookupFilter, error) {
+	want, err := parseWanted(tags)
+	if err != nil {
+		return nil, err
+	}
+	return &LookupFilter{
+		Name:    "tags",
+		Want:    want,
+		Workers: DefaultLookupWorkers,
+		lookup: func(object *s3.ObjectIdentifier) (map[string]string, error) {
+			resp, err := client.GetObjectTagging(&s3.GetObjectTaggingInput{
+				Bucket:    aws.String(bucket),
+				Key:       object.Key,
+				VersionId: object.VersionId,
+			})
+			if err != nil {
+				return nil, err
+			}
+			tags := make(map[string]string, len(resp.TagSet))
+			for _, tag := range resp.TagSet {
+				tags[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+			}
+			return tags, nil
+		},
+	}, nil
+}
+
+// NewHeadFilter returns a filter for user metadata given as key=value, with
+// or without the x-amz-meta- prefix, and for a content type, fetched with
+// HeadObject. Metadata keys and content types are compared without case,
+// and content types without their parameters.
+func NewHeadFilter(client *s3.S3, bucket string, meta []string, contentType string) (*LookupFilter, error) {
+	values, err := parseWanted(meta)
+	if err != nil {
+		return nil, err
+	}
+	want := make(map[string]string, len(values)+1)
+	for key, value := range values {
+		key = strings.ToLower(key)
+		if !strings.HasPrefix(key, metaHeaderPrefix) {
+			key = metaHeaderPrefix + key
+		}
+		want[key] = value
+	}
+	if contentType != "" {
+		want["content-type"] = strings.ToLower(contentType)
+	}
+	return &LookupFilter{
+		Name:    "head",
+		Want:    want,
+		Workers: DefaultLookupWorkers,
+		lookup: func(object *s3.ObjectIdentifier) (map[string]string, error) {
+			resp, err := client.HeadObject(&s3.HeadObjectInput{
+				Bucket:    aws.String(bucket),
+				Key:       object.Key,
+				VersionId: object.VersionId,
+			})
+			if err != nil {
+				return nil, err
+			}
+			attributes := make(map[string]string, len(resp.Metadata)+1)
+			for key, value := range resp.Metadata {
+				attributes[metaHeaderPrefix+strings.ToLower(key)] = aws.StringValue(value)
+			}
+			if mediaType, _, err := mime.ParseMediaType(aws.StringValue(resp.ContentType)); err == nil {
+				attributes["content-type"] = mediaType
+			}
+			return attributes, nil
+		},
+	}, nil
+}
+
+// Prepare looks up the objects of a batch, Workers at a time.
+func (f *LookupFilter) Prepare(objects []*s3.ObjectIdentifier) {
+	batch := make(map[*s3.ObjectIdentifier]map[string]string, len(objects))
+	sem := make(chan struct{}, f.Workers)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, object := range objects {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(object *s3.ObjectIdentifier) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			attributes := f.fetch(object)
+			mu.Lock()
+			batch[object] = attributes
+			mu.Unlock()
+		}(object)
+	}
+	wg.Wait()
+	f.mu.Lock()
+	f.batch = batch
+	f.mu.Unlock()
+}
+
+func (f *LookupFilter) Spare(object *s3.ObjectIdentifier) bool {
+	f.mu.Lock()
+	attributes, ok := f.batch[object]
+	f.mu.Unlock()
+	if !ok {
+		attributes = f.fetch(object)
+	}
+	if attributes == nil {
+		return true
+	}
+	for key, want := range f.Want {
+		value, ok := attributes[key]
+		if !ok {
+			return true
+		}
+		if prefix := strings.TrimSuffix(want, "*"); strings.HasSuffix(want, "/*") {
+			if !strings.HasPrefix(value, prefix) {
+				return true
+			}
+		} else if value != want {
+			return true
+		}
+	}
+	return false
+}
+
+// fetch looks up an object, returning nil if it couldn't be. Only the first
+// failure is reported, the others are counted.
+func (f *LookupFilter) fetch(object *s3.ObjectIdentifier) map[string]string {
+	var attributes map[string]string
+	err := withCredentials(func() (err error) {
+		attributes, err = f.lookup(object)
+		return err
+	})
+	atomic.AddInt64(&f.fetched, 1)
+	if err != nil {
+		if atomic.AddInt64(&f.failed, 1) == 1 {
+			fmt.Fprintf(os.Stderr, "\nwarning: sparing objects whose %s can't be looked up: %s: %s\n", f.Name, aws.StringValue(object.Key), err)
+		}
+		return nil
+	}
+	return attributes
+}
+
+// WriteSummary writes the number of objects looked up, and of those that
+// couldn't be.
+func (f *LookupFilter) WriteSummary(w io.Writer) {
+	fmt.Fprintf(w, "%s: looked up %d objects, %d failed\n", f.Name, atomic.LoadInt64(&f.fetched), atomic.LoadInt64(&f.failed))
+}
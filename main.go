@@ -1,18 +1,20 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
 	"os"
+	"path"
+	"regexp"
 	"strings"
 	"sync/atomic"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
-	"github.com/cenkalti/backoff"
 )
 
 const (
@@ -20,121 +22,669 @@ const (
 	ExitCodeError          int = 1
 	ExitCodeFlagParseError     = 10 + iota
 	ExitCodeAWSError
+	ExitCodeNoObjects
+	ExitCodeBudgetExhausted
+	ExitCodeStillPresent
+	ExitCodeAborted
+	ExitCodeInterrupted
+	ExitCodeOutputError
 
 	DefaultBatchSize        int           = 1000
+	DefaultQueueSize        int           = 128
+	DefaultConfirmThreshold int64         = 100000
 	ProgressRefreshInterval time.Duration = 100 * time.Millisecond
 )
 
 const helpText string = `Usage: s3rm [options]
 
-Options:
-  -bucket      The target S3 bucket name
+Bucket:
+  -bucket      The target S3 bucket name, or the ARN of an access point,
+               including S3 on Outposts access points
+  -bucket-concurrency
+               How many buckets of -bucket-file or -bucket-pattern to delete
+               from at once (default: 1)
+  -bucket-file A file listing buckets to run against, one bucket[,region]
+               per line, instead of -bucket
+  -bucket-pattern
+               Run against the buckets whose name matches this shell
+               pattern, such as logs-*, once the list is confirmed
+  -directory-bucket
+               Treat the bucket as an S3 Express One Zone directory bucket
+               (detected automatically for names ending in --x-s3)
+  -region      The AWS region of the target bucket
+  -use-dualstack
+               Use dualstack (IPv4 and IPv6) endpoints
+  -use-fips    Use FIPS 140-2 endpoints
+
+Keys to delete:
+  -0, -null    Keys in -file are separated by NUL bytes instead of newlines,
+               as written by find -print0, so they can contain newlines
+  -all         Delete every object in the bucket, after typing its name
+               to confirm
+  -athena-query-id
+               The ID of a successful Athena query whose result set lists the
+               keys to be deleted
+  -column      Read -file as CSV with a header row, and the keys from this
+               column; with -sqlite or -athena-query-id, the column of the
+               query result to read the keys from (default: the first one)
+  -compression Compression of the -file: auto detects gzip and zstd from
+               the .gz or .zst extension or the first bytes of the file,
+               gzip, zstd or none read it as such (default: auto)
+  -daemon      Keep reading -sqs-queue, -kafka-topic or a Redis stream and
+               deleting the objects its messages name, until interrupted or
+               terminated, when the deletes in flight are finished first
+  -decode-keys URL-decode the keys of a key list, for keys percent-encoded
+               as in RFC 3986
+  -dynamodb-attribute
+               The string attribute of -dynamodb-table items holding the
+               object keys (default: key)
+  -dynamodb-table
+               A DynamoDB table whose items reference the objects to be
+               deleted
+  -file        A file containing the object keys to be deleted, optionally
+               gzip or zstd compressed, an s3:// URI to stream them from S3,
+               or - to read them from stdin
+  -file-versions
+               Each line of -file holds a key and the ID of the version to
+               delete, separated by a tab
+  -glob        Delete all objects whose keys match this shell-style
+               pattern, where * stops at slashes and ** doesn't
+  -inventory   The s3:// URI of the manifest.json of an S3 Inventory report
+               in CSV, Parquet or ORC format, listing the objects to be
+               deleted
+  -kafka-brokers
+               Comma-separated addresses of the Kafka brokers to read
+               -kafka-topic from
+  -kafka-group The Kafka consumer group to commit offsets for
+               (default: s3rm)
+  -kafka-idle  Stop reading -kafka-topic once it had no new messages for
+               this long (default: 0, never)
+  -kafka-topic A Kafka topic to read keys from, as S3 event notifications
+               or one key per line, committing offsets once deleted
+  -keep-newest Under each immediate sub-prefix of -prefix, keep this many of
+               the newest objects and delete the rest
+  -prefix      List and delete all objects with this prefix, repeat to
+               delete under several prefixes in one run
+  -prefix-file A file listing prefixes to delete all objects under, one per
+               line
+  -prefix-template
+               List and delete all objects under the prefixes described by a
+               template with {YYYY-MM-DD..YYYY-MM-DD} or {00..99} ranges,
+               and dates optionally followed by a strftime-like format
+  -redis-field The field of Redis stream entries holding the key
+               (default: key)
+  -redis-group The consumer group Redis streams are read as (default: s3rm)
+  -redis-idle  Stop reading a Redis stream once it had no new entries for
+               this long (default: 0, never)
+  -redis-key   A Redis set or stream to read keys from, removing them once
+               deleted
+  -redis-url   The Redis server to read -redis-key from
+               (default: redis://localhost:6379/0)
+  -retain      Delete the objects under the prefix older than this window,
+               such as 30d, leaving newer ones, to be run from cron as a
+               lifecycle policy
+  -sort-keys   Dedupe and sort the keys of a key list before deleting them,
+               spilling to -tmp-dir when they don't fit in memory
+  -source      Where to read the keys from: athena, dynamodb, file,
+               inventory, kafka, keep-newest, prefix, redis, sqlite or sqs
+               (default: the one the other flags ask for)
+  -sqlite      A SQLite database to read the keys to be deleted from
+  -sqlite-query
+               The query returning the keys from the -sqlite database
+  -sqs-idle    Stop reading -sqs-queue once it stayed empty this long
+               (default: 0, never)
+  -sqs-queue   The URL of an SQS queue to read keys from, as S3 event
+               notifications or one key per line, until interrupted
+  -start-after Only delete keys after this one
+  -stop-at     Only delete keys up to this one, included
+
+Filters:
+  -content-type
+               Only delete objects of this content type, such as text/csv,
+               or image/* for any image, fetched with a HeadObject request
+               per object
+  -directory-markers
+               Only delete directory markers, empty objects with a key
+               ending in / created as folder placeholders
+  -etag-file   Only delete objects whose ETag is listed in this file, one
+               per line, such as known bad uploads
+  -except-bloom
+               A Bloom filter file of keys to never delete
+  -except-etag-file
+               Don't delete objects whose ETag is listed in this file, one
+               per line
+  -except-owner
+               Don't delete objects owned by this account, given by its
+               canonical ID or display name, such as the bucket owner
+  -exclude     Never delete keys matching this glob, or this regular
+               expression if it starts with re:, repeat to add patterns
+  -filter      Only delete objects for which this expression is true, such
+               as size > bytes("1MiB") && age > duration("30d") &&
+               key.endsWith(".log"), see the README
+  -match       Only delete keys matching this regular expression
+  -max-size    Only delete objects of at most this size, such as 0 for
+               empty objects, or 512KiB
+  -meta        Only delete objects with this user metadata, given as
+               key=value, repeat to require several; metadata is fetched
+               with a HeadObject request per object
+  -min-age     Only delete the objects of -sqs-queue once they are this old,
+               holding their messages back until then
+  -min-size    Only delete objects of at least this size, such as 1GiB
+  -newer-than  Only delete objects last modified less than this long ago,
+               such as 12h or 7d
+  -older-than  Only delete objects last modified more than this long ago,
+               such as 36h or 90d
+  -only-archived
+               Only delete objects in the GLACIER or DEEP_ARCHIVE storage
+               classes
+  -orphans-manifest
+               With -orphans-of, a file or s3:// URI listing the keys of the
+               sources, checked instead of a HeadObject request per object
+  -orphans-of  Only delete objects whose source is missing from this
+               s3://bucket/prefix, the -prefix of each key being replaced
+               by the prefix of its source
+  -owner       Only delete objects owned by this account, given by its
+               canonical ID or display name, repeat to allow several
+  -protect-file
+               A file of keys that must never be deleted, one per line, and
+               of prefixes, ending with / or *, whose keys must never be
+               deleted either
+  -sample      Only delete a random subset of this percentage of the
+               matching objects, such as 10, to thin them out in stages
+  -skip-archived
+               Don't delete objects in the GLACIER or DEEP_ARCHIVE storage
+               classes, which charge for early deletes
+  -skip-from   The -output of an earlier run, whose deleted keys are skipped
+  -storage-class
+               Only delete objects in this storage class, such as STANDARD
+               or GLACIER, repeat to allow several classes
+  -suffix      Only delete keys ending with this suffix, repeat to allow
+               several
+  -tag         Only delete objects with this tag, given as key=value,
+               repeat to require several tags; tags are fetched with a
+               GetObjectTagging request per object
+
+Versions:
+  -bypass-governance-retention
+               Delete object versions under governance mode Object Lock
+               retention, which needs the s3:BypassGovernanceRetention
+               permission
+  -delete-markers
+               Delete only the delete markers under the prefix, which
+               restores the objects they hide in a versioned bucket
+  -keep-versions
+               Delete all but this many of the newest versions of each
+               object under the prefix, leaving delete markers in place
+  -noncurrent  Delete only the noncurrent versions of the objects under the
+               prefix, keeping the current ones
+  -noncurrent-for
+               With -noncurrent or -keep-versions, only delete versions
+               that have been noncurrent for this long (default: 0)
+  -release-legal-holds
+               Release the legal hold of the object versions it keeps from
+               being deleted, and delete them
+  -versions    Delete every version and delete marker of the objects under
+               the prefix, in a versioned bucket
+
+Safety:
+  -allow-empty Exit successfully when no objects match the prefix
+  -confirm-threshold
+               Ask for the bucket name to be typed back, rather than yes,
+               when the preview estimates more than this many matching
+               objects (default: 100000)
   -dryrun      Run through object list without actually deleting anything
-  -file        A file containing the object keys to be deleted
-  -help        Print this message and exit
-  -output      A file to write deleted object keys to
+  -fail-fast   Abort the run at the first key that fails to delete with an
+               error retrying won't fix, such as AccessDenied
+  -force       Same as -yes
+  -limit       Stop after this many objects were queued for deletion, to
+               try a run on a small slice first (default: 0, no limit)
+  -lock        Hold a lock object while running, so no other s3rm run
+               with -lock works on the same bucket and prefix at once
+  -lock-bucket The bucket to hold the lock object in (default: -bucket)
+  -lock-ttl    How long a lock stays valid without being refreshed, after
+               which another run can steal it (default: 10m)
+  -max-errors  Abort the run once this many keys failed to delete
+               (default: 0, no limit)
+  -max-requests
+               Stop listing and deleting once this many API requests were
+               made, and exit once in-flight batches are done (default: 0,
+               no limit)
+  -min-prefix-len
+               Refuse to run with a prefix shorter than this, unless
+               -unsafe-allow-bucket-root is given (default: 1)
+  -no-estimate Don't query CloudWatch for the bucket size when deleting
+               everything in a bucket
+  -preview     Print a uniform random sample of this many of the keys
+               queued for deletion in the summary (default: 0)
+  -unsafe-allow-bucket-root
+               Allow deleting with an empty or short prefix, up to the whole
+               bucket
+  -yes         Don't ask for confirmation, nor show the preview of the keys
+               about to be deleted
+
+Checks:
+  -diff        Compare a sorted key file, such as a previous -output, with
+               the objects under the prefix, write the keys still present,
+               already gone and new to files next to it, and exit
+  -reconcile   List the prefixes again after deleting and report what is left
+  -reverify-after
+               With -reconcile, wait this long before checking the objects
+               left, to let deletes settle (default: 0)
+  -verify      Once deleting is done, list the prefixes again, or check a
+               sample of the deleted keys with HeadObject for other key
+               lists, and exit with status 16 if any object is left
+  -verify-sample
+               How many deleted keys -verify checks (default: 1000)
+
+Performance:
+  -delete-mode How to delete objects: batch uses multi-object deletes, single
+               deletes one object per request, auto switches from batch to
+               single if multi-object deletes aren't supported (default: batch)
+  -list-workers
+               List the sub-prefixes up to the next / of each prefix, or of
+               their versions when deleting versions, with this many
+               concurrent listings (default: 1)
+  -lookup-concurrency
+               How many objects to fetch the tags or metadata of at once
+               for -tag, -meta and -content-type (default: 20)
+  -max-batch-bytes
+               Split batches so each delete request body stays under this
+               many bytes (default: 524288)
   -pool        Max worker pool size (default: 10)
-  -prefix      List and delete all objects with this prefix
-  -region      The AWS region of the target bucket
+  -queue-size  Max number of batches waiting for a worker (default: 128)
+  -tmp-dir     Directory for temporary files (default: the system default)
+
+Output and monitoring:
+  -audit-bundle
+               At the end of the run, package the -output file and a JSON
+               summary with their SHA-256 sums into this tar.gz file
+  -cloudwatch-namespace
+               Publish run metrics to CloudWatch under this namespace every
+               minute
+  -failed      A file to write the keys that could not be deleted to, with
+               their error code, which -file reads back as they are
+  -metrics-addr
+               Serve the run metrics on /metrics at this address, such as
+               :9090, in the Prometheus text format
+  -output      A file to write deleted object keys to
+  -output-format
+               Format of the -output file: text lists keys, csv lists keys
+               and the time they were deleted (default: text)
+  -price-delete
+               Price per 1000 DELETE requests (default: 0)
+  -price-tier1
+               Price per 1000 PUT, COPY, POST, LIST requests (default: 0.005)
+  -price-tier2
+               Price per 1000 GET and all other requests (default: 0.0004)
+  -progress-file
+               A file to periodically write JSON progress snapshots to
+  -resume      Continue the unfinished run recorded in the -state-file
+  -run-id      An identifier of the run, added to published metrics
+  -state-file  A file recording how far the run got, to -resume it from
+
+Hooks:
+  -exec-concurrency
+               Max number of -exec-per-batch commands running at once
+               (default: 4)
+  -exec-on-dryrun
+               Run -exec-per-batch commands during dry runs too
+  -exec-on-failure
+               What to do when an -exec-per-batch command fails: ignore,
+               warn or abort (default: warn)
+  -exec-per-batch
+               A shell command to run after each batch is deleted, with the
+               deleted keys on its stdin
+  -exec-timeout
+               Max run time of each -exec-per-batch command (default: 1m)
+
+Other:
+  -bloom-fp-rate
+               False positive rate of Bloom filters built with -build-bloom
+               (default: 0.001)
+  -build-bloom Build a Bloom filter of the keys in -file, write it to this
+               file and exit
+  -help        Print this message and exit
 `
 
 var (
-	pool                *Pool
+	pool                *PartitionPool
+	scanner             Scanner
 	jobStart            time.Time
 	totalObjects        int64
 	totalDeletedObjects int64
+	totalDeletedBytes   int64
+	deletedClasses      = NewStorageClasses()
+	deletedVersions     *VersionCounts
+	totalFailedObjects  int64
+	failureCodes        = &ErrorCodes{}
+	recentDeletes       = NewRateWindow(DefaultRateWindow)
+	requestCounter      *RequestCounter
+	filters             = &FilterChain{}
+	tracker             = NewCompletionTracker()
+	shardCheckpoint     *ShardCheckpoint
+	retries             *RetryQueue
+	hook                *BatchHook
+	lock                *Lock
+	preview             *Preview
+	queue               Queue
+	sortedKeys          *SortedScanner
+	deletedSample       *KeySample
+	lookups             []*LookupFilter
+	credentialGate      *CredentialGate
 
-	// file descriptors
+	// outputs
 	outputFile *os.File
+	output     *OutputWriter
 
 	// channels
-	slowDown       chan int
-	taskErrors     chan error
-	deletedObjects chan []*s3.ObjectIdentifier
+	slowDown   chan string
+	taskErrors chan error
 
 	// flags
-	flagBucket string
-	flagDryrun bool
-	flagFile   string
-	flagHelp   bool
-	flagOutput string
-	flagPool   int
-	flagPrefix string
-	flagRegion string
-)
+	flagBucket         string
+	flagDryrun         bool
+	flagFile           string
+	flagHelp           bool
+	flagOutput         string
+	flagPool           int
+	flagPrefix         StringList
+	flagQueue          int
+	flagRegion         string
+	flagBucketFile     string
+	flagBucketWorkers  int
+	flagBucketPattern  string
+	flagOlderThan      Age
+	flagNewerThan      Age
+	flagRetain         Age
+	flagSample         Percent
+	flagMinSize        = ByteSize(-1)
+	flagMaxSize        = ByteSize(-1)
+	flagDirMarkers     bool
+	flagStorageClass   StringList
+	flagSkipArchived   bool
+	flagOnlyArchived   bool
+	flagOwner          StringList
+	flagExceptOwner    StringList
+	flagETagFile       string
+	flagFilter         string
+	flagExceptETagFile string
+	flagTag            StringList
+	flagMeta           StringList
+	flagContentType    string
+	flagOrphansOf      string
+	flagOrphanManifest string
+	flagLookupWorkers  int
 
-type DeleteTask struct {
-	client  *s3.S3
-	dryrun  bool
-	Bucket  string
-	Objects []*s3.ObjectIdentifier
-}
+	flagDirectory     bool
+	flagNoEstimate    bool
+	flagProgressFile  string
+	flagStateFile     string
+	flagResume        bool
+	flagTemplate      string
+	flagPrefixFile    string
+	flagBloomFPRate   float64
+	flagBuildBloom    string
+	flagExceptBloom   string
+	flagTmpDir        string
+	flagDeleteMode    string
+	flagKeepNewest    int
+	flagKeepVersions  int
+	flagReconcile     bool
+	flagVerify        bool
+	flagVerifySample  int
+	flagAllowEmpty    bool
+	flagReverify      time.Duration
+	flagMaxRequests   int64
+	flagLimit         int64
+	flagFailed        string
+	flagBypassGov     bool
+	flagReleaseHolds  bool
+	flagSkipFrom      string
+	flagMaxErrors     int64
+	flagFailFast      bool
+	flagDiff          string
+	flagMinPrefixLen  int
+	flagUnsafeRoot    bool
+	flagMetricsNS     string
+	flagRunID         string
+	flagPreview       int
+	flagBatchBytes    int
+	flagOutputFormat  string
+	flagAuditBundle   string
+	flagVersions      bool
+	flagListWorkers   int
+	flagNull          bool
+	flagCompression   string
+	flagFileVersions  bool
+	flagExclude       StringList
+	flagProtectFile   string
+	flagMatch         string
+	flagGlob          string
+	flagSQS           string
+	flagSQSIdle       time.Duration
+	flagTable         string
+	flagTableAttr     string
+	flagColumn        string
+	flagSource        string
+	flagSortKeys      bool
+	flagDecodeKeys    bool
+	flagDaemon        bool
+	flagSuffix        StringList
+	flagMinAge        time.Duration
+	flagMetricsAddr   string
+	flagSQLite        string
+	flagSQLiteQuery   string
+	flagAthena        string
+	flagStartAfter    string
+	flagStopAt        string
+	flagAll           bool
+	flagYes           bool
+	flagForce         bool
+	flagConfirmOver   int64
+	flagMarkers       bool
+	flagNoncurrent    bool
+	flagInventory     string
+	flagNoncurrentFor time.Duration
+	flagLock          bool
+	flagLockBucket    string
+	flagLockTTL       time.Duration
+	flagExec          string
+	flagExecDryrun    bool
+	flagExecLimit     int
+	flagExecPolicy    string
+	flagExecTimeout   time.Duration
+	flagPriceDelete   float64
+	flagPriceTier1    float64
+	flagPriceTier2    float64
+	flagDualstack     bool
+	flagFIPS          bool
+)
 
-func (t *DeleteTask) Execute() error {
-	if t.dryrun {
-		deletedObjects <- t.Objects
-		return nil
+func printProgress() {
+	var (
+		prefix string
+		detail string
+	)
+	if flagDryrun {
+		prefix = "[dryrun] "
 	}
-
-	operation := func() error {
-		_, err := t.client.DeleteObjects(&s3.DeleteObjectsInput{
-			Bucket: aws.String(t.Bucket),
-			Delete: &s3.Delete{
-				Objects: t.Objects,
-				Quiet:   aws.Bool(true),
-			},
-		})
-
-		// check for slow down error
-		if err != nil {
-			if reqerr, ok := err.(awserr.RequestFailure); ok {
-				if reqerr.Code() == "SlowDown" {
-					return err
-				}
+	stats := Snapshot()
+	detail = fmt.Sprintf("%d workers, queue %d/%d", stats.Workers, stats.QueueDepth, stats.QueueSize)
+	if stats.Paused {
+		detail = fmt.Sprintf("paused, queue %d/%d", stats.QueueDepth, stats.QueueSize)
+	}
+	if rate := stats.RecentRate; stats.Deleted > 0 && rate > 0 {
+		detail = fmt.Sprintf("%s, %d obj/s", detail, rate)
+	}
+	if stats.Stalled > 0 {
+		detail = fmt.Sprintf("%s, no deletes for %s", detail, stats.Stalled.Round(time.Second))
+	}
+	listed := ""
+	if _, ok := scanner.(ProgressScanner); ok {
+		listed = fmt.Sprintf(", listed %d", stats.Listed)
+		if stats.EstimatedTotal > 0 {
+			listed = fmt.Sprintf("%s of ~%d", listed, stats.EstimatedTotal)
+			detail = fmt.Sprintf("%s, ~%d%%", detail, stats.Deleted*100/stats.EstimatedTotal)
+			if eta, ok := stats.ETA(); ok {
+				detail = fmt.Sprintf("%s, ETA %s", detail, eta)
 			}
-			return &backoff.PermanentError{Err: err}
 		}
-		deletedObjects <- t.Objects
-		return nil
 	}
-	return backoff.RetryNotify(operation, backoff.NewExponentialBackOff(), backoffNotify)
+	if len(stats.Partitions) > 1 {
+		for _, rate := range stats.Partitions {
+			detail = fmt.Sprintf("%s; %s: %d workers, %d obj/s", detail, rate.Name, rate.Workers, rate.Rate)
+		}
+	}
+	fmt.Printf("\r%sdelete: %d of %d objects%s (%s)", prefix, stats.Deleted, stats.Queued, listed, detail)
 }
 
-func backoffNotify(e error, t time.Duration) {
-	slowDown <- 1
+func pricing() Pricing {
+	return Pricing{
+		Tier1:  flagPriceTier1,
+		Tier2:  flagPriceTier2,
+		Delete: flagPriceDelete,
+	}
 }
 
-func printProgress() {
-	var (
-		prefix string
-		detail string
-	)
-	if flagDryrun {
-		prefix = "[dryrun] "
+// updateProgressFile writes a progress snapshot if -progress-file is set.
+func updateProgressFile() {
+	if flagProgressFile == "" {
+		return
 	}
-	detail = fmt.Sprintf("%d workers", pool.Size)
-	seconds := int64(time.Since(jobStart).Seconds())
-	if totalDeletedObjects > 0 && seconds > 0 {
-		detail = fmt.Sprintf("%s, %d obj/s", detail, totalDeletedObjects/seconds)
+	if err := writeProgressFile(flagProgressFile); err != nil {
+		fmt.Fprintln(os.Stderr, err)
 	}
-	fmt.Printf("\r%sdelete: %d of %d objects (%s)", prefix, totalDeletedObjects, totalObjects, detail)
 }
 
 func main() {
 	// initialize channels
-	slowDown = make(chan int)
+	slowDown = make(chan string)
 	taskErrors = make(chan error, 128)
-	deletedObjects = make(chan []*s3.ObjectIdentifier, 128)
 
 	flags := flag.NewFlagSet("flags", flag.ContinueOnError)
+	flags.StringVar(&flagGlob, "glob", "", "")
 	flags.BoolVar(&flagHelp, "help", false, "")
+	flags.BoolVar(&flagAll, "all", false, "")
+	flags.StringVar(&flagAthena, "athena-query-id", "", "")
+	flags.BoolVar(&flagAllowEmpty, "allow-empty", false, "")
+	flags.StringVar(&flagAuditBundle, "audit-bundle", "", "")
+	flags.Float64Var(&flagBloomFPRate, "bloom-fp-rate", DefaultBloomFPRate, "")
 	flags.StringVar(&flagBucket, "bucket", "", "")
+	flags.StringVar(&flagColumn, "column", "", "")
+	flags.StringVar(&flagBuildBloom, "build-bloom", "", "")
+	flags.StringVar(&flagMetricsNS, "cloudwatch-namespace", "", "")
+	flags.StringVar(&flagCompression, "compression", CompressionAuto, "")
+	flags.BoolVar(&flagMarkers, "delete-markers", false, "")
+	flags.StringVar(&flagDeleteMode, "delete-mode", DeleteModeBatch, "")
+	flags.BoolVar(&flagDaemon, "daemon", false, "")
+	flags.BoolVar(&flagDecodeKeys, "decode-keys", false, "")
+	flags.StringVar(&flagDiff, "diff", "", "")
+	flags.BoolVar(&flagDirectory, "directory-bucket", false, "")
 	flags.BoolVar(&flagDryrun, "dryrun", false, "")
+	flags.StringVar(&flagTable, "dynamodb-table", "", "")
+	flags.StringVar(&flagTableAttr, "dynamodb-attribute", DefaultDynamoDBAttribute, "")
+	flags.StringVar(&flagExceptBloom, "except-bloom", "", "")
+	flags.Var(&flagExclude, "exclude", "")
+	flags.StringVar(&flagProtectFile, "protect-file", "", "")
+	flags.IntVar(&flagExecLimit, "exec-concurrency", DefaultHookConcurrency, "")
+	flags.BoolVar(&flagExecDryrun, "exec-on-dryrun", false, "")
+	flags.StringVar(&flagExecPolicy, "exec-on-failure", HookPolicyWarn, "")
+	flags.StringVar(&flagExec, "exec-per-batch", "", "")
+	flags.DurationVar(&flagExecTimeout, "exec-timeout", DefaultHookTimeout, "")
 	flags.StringVar(&flagFile, "file", "", "")
+	flags.BoolVar(&flagFileVersions, "file-versions", false, "")
+	flags.StringVar(&flagInventory, "inventory", "", "")
+	flags.IntVar(&flagKeepNewest, "keep-newest", 0, "")
+	flags.IntVar(&flagKeepVersions, "keep-versions", 0, "")
+	flags.IntVar(&flagListWorkers, "list-workers", 1, "")
+	flags.BoolVar(&flagLock, "lock", false, "")
+	flags.StringVar(&flagLockBucket, "lock-bucket", "", "")
+	flags.DurationVar(&flagLockTTL, "lock-ttl", DefaultLockTTL, "")
+	flags.StringVar(&flagMatch, "match", "", "")
+	flags.StringVar(&flagMetricsAddr, "metrics-addr", "", "")
+	flags.DurationVar(&flagMinAge, "min-age", 0, "")
+	flags.IntVar(&flagBatchBytes, "max-batch-bytes", DefaultMaxBatchBytes, "")
+	flags.Int64Var(&flagMaxRequests, "max-requests", 0, "")
+	flags.Int64Var(&flagLimit, "limit", 0, "")
+	flags.StringVar(&flagFailed, "failed", "", "")
+	flags.BoolVar(&flagBypassGov, "bypass-governance-retention", false, "")
+	flags.BoolVar(&flagReleaseHolds, "release-legal-holds", false, "")
+	flags.StringVar(&flagSkipFrom, "skip-from", "", "")
+	flags.Int64Var(&flagMaxErrors, "max-errors", 0, "")
+	flags.BoolVar(&flagFailFast, "fail-fast", false, "")
+	flags.IntVar(&flagMinPrefixLen, "min-prefix-len", DefaultMinPrefixLen, "")
+	flags.BoolVar(&flagNoEstimate, "no-estimate", false, "")
+	flags.BoolVar(&flagNoncurrent, "noncurrent", false, "")
+	flags.DurationVar(&flagNoncurrentFor, "noncurrent-for", 0, "")
+	flags.Var(&flagMaxSize, "max-size", "")
+	flags.BoolVar(&flagDirMarkers, "directory-markers", false, "")
+	flags.Var(&flagMinSize, "min-size", "")
+	flags.Var(&flagNewerThan, "newer-than", "")
+	flags.Var(&flagOlderThan, "older-than", "")
+	flags.Var(&flagRetain, "retain", "")
+	flags.Var(&flagSample, "sample", "")
 	flags.StringVar(&flagOutput, "output", "", "")
+	flags.StringVar(&flagOutputFormat, "output-format", OutputFormatText, "")
 	flags.IntVar(&flagPool, "pool", 10, "")
-	flags.StringVar(&flagPrefix, "prefix", "", "")
+	flags.Var(&flagPrefix, "prefix", "")
+	flags.StringVar(&flagPrefixFile, "prefix-file", "", "")
+	flags.StringVar(&flagTemplate, "prefix-template", "", "")
+	flags.IntVar(&flagPreview, "preview", 0, "")
+	flags.StringVar(&flagProgressFile, "progress-file", "", "")
+	flags.StringVar(&flagStateFile, "state-file", "", "")
+	flags.BoolVar(&flagResume, "resume", false, "")
+	flags.IntVar(&flagQueue, "queue-size", DefaultQueueSize, "")
+	flags.BoolVar(&flagSortKeys, "sort-keys", false, "")
+	flags.StringVar(&flagSource, "source", "", "")
+	flags.Var(&flagSuffix, "suffix", "")
+	flags.StringVar(&flagSQLite, "sqlite", "", "")
+	flags.StringVar(&flagStartAfter, "start-after", "", "")
+	flags.StringVar(&flagStopAt, "stop-at", "", "")
+	flags.Var(&flagStorageClass, "storage-class", "")
+	flags.BoolVar(&flagSkipArchived, "skip-archived", false, "")
+	flags.BoolVar(&flagOnlyArchived, "only-archived", false, "")
+	flags.Var(&flagOwner, "owner", "")
+	flags.Var(&flagExceptOwner, "except-owner", "")
+	flags.StringVar(&flagETagFile, "etag-file", "", "")
+	flags.StringVar(&flagFilter, "filter", "", "")
+	flags.StringVar(&flagExceptETagFile, "except-etag-file", "", "")
+	flags.Var(&flagTag, "tag", "")
+	flags.Var(&flagMeta, "meta", "")
+	flags.StringVar(&flagContentType, "content-type", "", "")
+	flags.StringVar(&flagOrphansOf, "orphans-of", "", "")
+	flags.StringVar(&flagOrphanManifest, "orphans-manifest", "", "")
+	flags.IntVar(&flagLookupWorkers, "lookup-concurrency", DefaultLookupWorkers, "")
+	flags.StringVar(&flagSQLiteQuery, "sqlite-query", "", "")
+	flags.StringVar(&flagSQS, "sqs-queue", "", "")
+	flags.DurationVar(&flagSQSIdle, "sqs-idle", 0, "")
+	flags.BoolVar(&flagReconcile, "reconcile", false, "")
+	flags.BoolVar(&flagVerify, "verify", false, "")
+	flags.IntVar(&flagVerifySample, "verify-sample", DefaultVerifySample, "")
+	flags.DurationVar(&flagReverify, "reverify-after", 0, "")
 	flags.StringVar(&flagRegion, "region", "us-east-1", "")
+	flags.StringVar(&flagBucketFile, "bucket-file", "", "")
+	flags.IntVar(&flagBucketWorkers, "bucket-concurrency", 1, "")
+	flags.StringVar(&flagBucketPattern, "bucket-pattern", "", "")
+	flags.StringVar(&flagRunID, "run-id", "", "")
+	flags.StringVar(&flagTmpDir, "tmp-dir", os.TempDir(), "")
+	flags.BoolVar(&flagUnsafeRoot, "unsafe-allow-bucket-root", false, "")
+	flags.BoolVar(&flagYes, "yes", false, "")
+	flags.BoolVar(&flagForce, "force", false, "")
+	flags.Int64Var(&flagConfirmOver, "confirm-threshold", DefaultConfirmThreshold, "")
+	flags.BoolVar(&flagVersions, "versions", false, "")
+	flags.BoolVar(&flagNull, "0", false, "")
+	flags.BoolVar(&flagNull, "null", false, "")
+	flags.BoolVar(&flagDualstack, "use-dualstack", false, "")
+	flags.BoolVar(&flagFIPS, "use-fips", false, "")
+	flags.Float64Var(&flagPriceDelete, "price-delete", DefaultPriceDelete, "")
+	flags.Float64Var(&flagPriceTier1, "price-tier1", DefaultPriceTier1, "")
+	flags.Float64Var(&flagPriceTier2, "price-tier2", DefaultPriceTier2, "")
+	// sources may have flags of their own
+	for _, name := range SourceNames() {
+		if source := sources[name]; source.Flags != nil {
+			source.Flags(flags)
+		}
+	}
 
 	// check flag values
 	if err := flags.Parse(os.Args[1:]); err != nil {
@@ -146,14 +696,194 @@ func main() {
 		fmt.Printf(helpText)
 		os.Exit(ExitCodeOK)
 	}
+	flagYes = flagYes || flagForce
+
+	switch flagCompression {
+	case CompressionAuto, CompressionGzip, CompressionZstd, CompressionNone:
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown compression %q\n", flagCompression)
+		os.Exit(ExitCodeFlagParseError)
+	}
+
+	if flagBuildBloom != "" {
+		if flagFile == "" {
+			fmt.Fprintln(os.Stderr, "Please provide a key file to build the Bloom filter from")
+			os.Exit(ExitCodeFlagParseError)
+		}
+		if flagFile == StdinFile || strings.HasPrefix(flagFile, "s3://") {
+			fmt.Fprintln(os.Stderr, "Bloom filters are built by reading the key file twice, it must be a local file")
+			os.Exit(ExitCodeFlagParseError)
+		}
+		if flagBloomFPRate <= 0 || flagBloomFPRate >= 1 {
+			fmt.Fprintln(os.Stderr, "Bloom filter false positive rate must be between 0 and 1")
+			os.Exit(ExitCodeFlagParseError)
+		}
+		if err := BuildBloomFilter(flagFile, flagCompression, flagBuildBloom, flagBloomFPRate); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(ExitCodeError)
+		}
+		os.Exit(ExitCodeOK)
+	}
+
+	// each bucket of a list gets a run of its own
+	if flagBucketFile != "" || flagBucketPattern != "" {
+		if flagBucketFile != "" && flagBucketPattern != "" {
+			fmt.Fprintln(os.Stderr, "Please provide either a bucket file or a bucket pattern")
+			os.Exit(ExitCodeFlagParseError)
+		}
+		if flagBucket != "" {
+			fmt.Fprintln(os.Stderr, "Please provide either a bucket or a list of buckets")
+			os.Exit(ExitCodeFlagParseError)
+		}
+		if flagBucketWorkers < 1 {
+			fmt.Fprintln(os.Stderr, "Bucket concurrency must be at least 1")
+			os.Exit(ExitCodeFlagParseError)
+		}
+		if flagFile == StdinFile {
+			fmt.Fprintln(os.Stderr, "Keys can't be read from stdin for several buckets")
+			os.Exit(ExitCodeFlagParseError)
+		}
+		if flagAll && !flagYes && !flagDryrun {
+			fmt.Fprintln(os.Stderr, "-all can't ask for confirmation for each bucket of a list, please provide -yes")
+			os.Exit(ExitCodeFlagParseError)
+		}
+		var (
+			jobs []*BucketJob
+			err  error
+		)
+		if flagBucketFile != "" {
+			if jobs, err = ReadBucketFile(flagBucketFile, flagRegion); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(ExitCodeFlagParseError)
+			}
+		} else {
+			if _, err := path.Match(flagBucketPattern, ""); err != nil {
+				fmt.Fprintf(os.Stderr, "Bad bucket pattern %q: %s\n", flagBucketPattern, err)
+				os.Exit(ExitCodeFlagParseError)
+			}
+			if jobs, err = MatchBuckets(flagBucketPattern, flagRegion); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(ExitCodeAWSError)
+			}
+			if len(jobs) == 0 {
+				fmt.Fprintf(os.Stderr, "No bucket matches %s\n", flagBucketPattern)
+				os.Exit(ExitCodeNoObjects)
+			}
+			if !flagYes && !flagDryrun {
+				if err := ConfirmBuckets(jobs); err != nil {
+					fmt.Fprintln(os.Stderr, err)
+					os.Exit(ExitCodeError)
+				}
+			}
+		}
+		os.Exit(RunBuckets(flags, jobs, flagBucketWorkers, flagTmpDir))
+	}
 
 	if flagBucket == "" {
 		fmt.Fprintln(os.Stderr, "Please provide a bucket name")
 		os.Exit(ExitCodeFlagParseError)
 	}
 
-	var compl int
+	switch flagDeleteMode {
+	case DeleteModeBatch, DeleteModeSingle, DeleteModeAuto:
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown delete mode %q\n", flagDeleteMode)
+		os.Exit(ExitCodeFlagParseError)
+	}
+
+	if flagExec != "" {
+		switch flagExecPolicy {
+		case HookPolicyIgnore, HookPolicyWarn, HookPolicyAbort:
+		default:
+			fmt.Fprintf(os.Stderr, "Unknown exec failure policy %q\n", flagExecPolicy)
+			os.Exit(ExitCodeFlagParseError)
+		}
+		if flagExecLimit < 1 || flagExecTimeout <= 0 {
+			fmt.Fprintln(os.Stderr, "Exec concurrency and timeout must be positive")
+			os.Exit(ExitCodeFlagParseError)
+		}
+		if !flagDryrun || flagExecDryrun {
+			hook = NewBatchHook(flagExec, flagExecLimit, flagExecTimeout, flagExecPolicy)
+		}
+	}
+
+	if flagPreview < 0 {
+		fmt.Fprintln(os.Stderr, "Preview size can't be negative")
+		os.Exit(ExitCodeFlagParseError)
+	} else if flagPreview > 0 {
+		preview = NewPreview(flagPreview)
+	}
+
+	switch flagOutputFormat {
+	case OutputFormatText, OutputFormatCSV:
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown output format %q\n", flagOutputFormat)
+		os.Exit(ExitCodeFlagParseError)
+	}
+	if flagAuditBundle != "" && flagOutput == "" {
+		fmt.Fprintln(os.Stderr, "An audit bundle needs an -output file")
+		os.Exit(ExitCodeFlagParseError)
+	}
+
+	if flagBatchBytes < 1 {
+		fmt.Fprintln(os.Stderr, "Max batch size must be positive")
+		os.Exit(ExitCodeFlagParseError)
+	}
+
+	if flagQueue < 1 {
+		fmt.Fprintln(os.Stderr, "Queue size must be at least 1")
+		os.Exit(ExitCodeFlagParseError)
+	}
+
 	batchSize := DefaultBatchSize
+	retries = NewRetryQueue(flagTmpDir)
+	retries.Header = runHeader
+	retries.Versions = flagVersions || flagMarkers || flagNoncurrent || flagKeepVersions > 0 || flagFileVersions
+
+	// keys deleted by an earlier run are dropped before any other filter
+	if flagSkipFrom != "" {
+		if retries.Versions {
+			fmt.Fprintln(os.Stderr, "-skip-from skips keys, it can't be combined with deleting versions")
+			os.Exit(ExitCodeFlagParseError)
+		}
+		deleted, err := ReadDeletedKeys(flagSkipFrom, flagBucket)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(ExitCodeError)
+		}
+		filters.Add("skip-from", skipFromFilter(deleted))
+	}
+	if flagExceptBloom != "" {
+		filter, err := LoadBloomFilter(flagExceptBloom)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(ExitCodeError)
+		}
+		filters.Add("except-bloom", bloomFilter(filter))
+	}
+	if len(flagExclude) > 0 {
+		var patterns []*regexp.Regexp
+		for _, exclude := range flagExclude {
+			pattern, err := CompilePattern(exclude)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(ExitCodeFlagParseError)
+			}
+			patterns = append(patterns, pattern)
+		}
+		filters.Add("exclude", excludeFilter(patterns))
+	}
+	if flagMatch != "" {
+		pattern, err := regexp.Compile(flagMatch)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(ExitCodeFlagParseError)
+		}
+		filters.Add("match", matchFilter(pattern))
+	}
+	if len(flagSuffix) > 0 {
+		filters.Add("suffix", suffixFilter(flagSuffix))
+	}
 
 	// setup output file
 	if flagOutput != "" {
@@ -165,98 +895,1251 @@ func main() {
 		outputFile = f
 	}
 
-	// create elastic worker pool
-	pool = NewPool(flagPool)
+	// create elastic worker pools, one per partition
+	pool = NewPartitionPool(flagPool, flagQueue)
 
 	// make sure we don't go too fast
 	go func() {
-		for {
-			<-slowDown
-			if pool.Size > 1 {
-				pool.Resize(pool.Size - 1)
-			}
-			time.Sleep(time.Second)
+		for partition := range slowDown {
+			pool.Throttle(partition)
 		}
 	}()
 
-	sess := session.Must(session.NewSession(
-		&aws.Config{Region: &flagRegion},
-	))
+	// requests to an access point go to its region
+	if IsAccessPointARN(flagBucket) {
+		region, err := accessPointRegion(flagBucket)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(ExitCodeFlagParseError)
+		}
+		if flagDirectory {
+			fmt.Fprintln(os.Stderr, "Access points can't be directory buckets")
+			os.Exit(ExitCodeFlagParseError)
+		}
+		if IsOutpostARN(flagBucket) && (flagFIPS || flagDualstack) {
+			fmt.Fprintln(os.Stderr, "FIPS and dualstack endpoints are not available for S3 on Outposts")
+			os.Exit(ExitCodeFlagParseError)
+		}
+		regionSet := false
+		flags.Visit(func(f *flag.Flag) { regionSet = regionSet || f.Name == "region" })
+		if regionSet && region != flagRegion {
+			fmt.Fprintf(os.Stderr, "The access point is in region %s, not %s\n", region, flagRegion)
+			os.Exit(ExitCodeFlagParseError)
+		}
+		flagRegion = region
+	}
+
+	if err := checkEndpointVariant(flagRegion, flagFIPS, flagDualstack); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(ExitCodeFlagParseError)
+	}
+
+	config := &aws.Config{Region: &flagRegion}
+	if flagFIPS {
+		config.UseFIPSEndpoint = endpoints.FIPSEndpointStateEnabled
+	}
+	if flagDualstack {
+		config.UseDualStackEndpoint = endpoints.DualStackEndpointStateEnabled
+	}
+	sess := session.Must(session.NewSession(config))
+	credentialGate = NewCredentialGate(sess.Config)
+
+	// count every request attempt for the summary
+	requestCounter = NewRequestCounter()
+	sess.Handlers.Send.PushFrontNamed(requestCounter.Handler())
 	svc := s3.New(sess)
 
+	// directory buckets are served from a zonal endpoint with session auth
+	directory := flagDirectory || IsDirectoryBucket(flagBucket)
+	if directory {
+		if flagFIPS || flagDualstack {
+			fmt.Fprintln(os.Stderr, "FIPS and dualstack endpoints are not available for directory buckets")
+			os.Exit(ExitCodeFlagParseError)
+		}
+		var err error
+		svc, err = NewDirectoryBucketClient(sess, flagBucket)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(ExitCodeFlagParseError)
+		}
+	}
+
+	credentialGate.Probe(svc, flagBucket)
+
 	var (
-		err     error
-		scanner Scanner
+		err      error
+		prefixes []string
 	)
 
-	if flagFile != "" {
-		scanner, err = NewFileScanner(flagFile)
-		if err != nil {
-			fmt.Println(err.Error())
-			os.Exit(ExitCodeError)
+	if flagTemplate != "" {
+		if len(flagPrefix) > 0 || flagPrefixFile != "" {
+			fmt.Fprintln(os.Stderr, "Please provide either a prefix or a prefix template")
+			os.Exit(ExitCodeFlagParseError)
 		}
-	} else if flagPrefix != "" {
-		scanner, err = NewBucketScanner(flagBucket, flagPrefix, svc)
+		prefixes, err = ExpandPrefixTemplate(flagTemplate)
 		if err != nil {
-			fmt.Println(err.Error())
-			os.Exit(ExitCodeError)
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(ExitCodeFlagParseError)
 		}
 	} else {
-		fmt.Fprintln(os.Stderr, "Please provide an s3 prefix or an objects file")
+		prefixes = flagPrefix
+	}
+	if flagPrefixFile != "" {
+		listed, err := ReadPrefixFile(flagPrefixFile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(ExitCodeFlagParseError)
+		}
+		prefixes = append(prefixes, listed...)
+	}
+	// globs are listed from their literal prefix, and the keys filtered
+	if flagGlob != "" {
+		if len(prefixes) > 0 {
+			fmt.Fprintln(os.Stderr, "Please provide either a prefix or a glob")
+			os.Exit(ExitCodeFlagParseError)
+		}
+		pattern, err := CompilePathGlob(flagGlob)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(ExitCodeFlagParseError)
+		}
+		prefixes = []string{GlobPrefix(flagGlob)}
+		filters.Add("glob", matchFilter(pattern))
+	}
+	if flagNull && flagFile == "" {
+		fmt.Fprintln(os.Stderr, "-0 only applies to keys read from a -file")
+		os.Exit(ExitCodeFlagParseError)
+	}
+	if flagFileVersions && flagFile == "" {
+		fmt.Fprintln(os.Stderr, "-file-versions only applies to keys read from a -file")
+		os.Exit(ExitCodeFlagParseError)
+	}
+	if flagColumn != "" && (flagFile == "" || flagNull || flagFileVersions) && flagSQLite == "" && flagAthena == "" {
+		fmt.Fprintln(os.Stderr, "-column only applies to a CSV -file, a -sqlite query or an Athena query")
+		os.Exit(ExitCodeFlagParseError)
+	}
+	if (flagSQLite == "") != (flagSQLiteQuery == "") {
+		fmt.Fprintln(os.Stderr, "Please provide both a SQLite database and a query")
 		os.Exit(ExitCodeFlagParseError)
 	}
 
-	go func() {
-		for {
-			select {
-			case objects := <-deletedObjects:
-				atomic.AddInt64(&totalDeletedObjects, int64(len(objects)))
-				if flagOutput != "" {
-					var output []string
-					for _, obj := range objects {
-						output = append(output, fmt.Sprintf("delete: %s", *obj.Key))
-					}
-					_, err := outputFile.WriteString(fmt.Sprintln(strings.Join(output, "\n")))
-					if err != nil {
-						fmt.Fprintln(os.Stderr, err)
-						os.Exit(1)
-					}
-				}
-			case err := <-pool.errors:
-				fmt.Fprintln(os.Stderr, err)
-			}
+	// the whole bucket is never deleted by accident
+	if flagAll {
+		if len(prefixes) > 0 || flagGlob != "" || (flagSource != "" && flagSource != "prefix") {
+			fmt.Fprintln(os.Stderr, "-all deletes every object of the bucket, it can't be combined with prefixes or key lists")
+			os.Exit(ExitCodeFlagParseError)
 		}
-	}()
-
-	// track time for calculating delete rate
-	jobStart = time.Now()
+		prefixes = []string{""}
+	}
 
-	// start progress bar
-	go func() {
-		for {
-			printProgress()
-			time.Sleep(ProgressRefreshInterval)
+	for i, prefix := range prefixes {
+		prefixes[i], err = NormalizePrefix(prefix)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(ExitCodeFlagParseError)
 		}
-	}()
+	}
+	prefixes = DedupePrefixes(prefixes)
+	if !flagUnsafeRoot && !flagAll {
+		if err := CheckPrefixScope(prefixes, flagMinPrefixLen); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(ExitCodeFlagParseError)
+		}
+	}
+	// the prefixes of the configuration are protected whatever the flags
+	settings, err := ReadConfig(ConfigFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(ExitCodeError)
+	}
+	// access points are protected like their bucket
+	protectedBucket := flagBucket
+	if settings.BucketScoped() {
+		if protectedBucket, err = ProtectedBucket(sess, flagBucket); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(ExitCodeFlagParseError)
+		}
+	}
+	protectedPrefixes := settings.ProtectedPrefixes(protectedBucket)
+	if err := CheckProtectedPrefixes(flagBucket, prefixes, protectedPrefixes); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(ExitCodeFlagParseError)
+	}
 
-	for scanner.Scan(batchSize) {
-		totalObjects = totalObjects + int64(len(scanner.Objects()))
-		pool.Exec(&DeleteTask{
-			dryrun:  flagDryrun,
-			client:  svc,
-			Bucket:  flagBucket,
-			Objects: scanner.Objects(),
-		})
-		compl = compl + batchSize
+	env := &SourceEnv{Bucket: flagBucket, Prefixes: prefixes}
+	source, err := SelectSource(flagSource, env)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(ExitCodeFlagParseError)
+	}
+	// keys can come from a list rather than from listing the prefixes
+	keyList := source.KeyList
+	if flagAll && source.Name != "prefix" {
+		fmt.Fprintln(os.Stderr, "-all deletes every object of the bucket, it can't be combined with prefixes or key lists")
+		os.Exit(ExitCodeFlagParseError)
+	}
+	if flagKeepNewest > 0 && source.Name != "keep-newest" {
+		fmt.Fprintln(os.Stderr, "Please provide a single s3 prefix to keep the newest objects under")
+		os.Exit(ExitCodeFlagParseError)
+	}
+	if flagDecodeKeys && (!keyList || source.Name == "inventory" || source.Name == "sqs" || source.Name == "kafka") {
+		fmt.Fprintln(os.Stderr, "-decode-keys only applies to key lists that aren't already decoded, inventory and event notification keys are")
+		os.Exit(ExitCodeFlagParseError)
+	}
+	if flagMinAge < 0 {
+		fmt.Fprintln(os.Stderr, "Minimum age can't be negative")
+		os.Exit(ExitCodeFlagParseError)
+	}
+	if flagMinAge > 0 && source.Name != "sqs" {
+		fmt.Fprintln(os.Stderr, "-min-age only applies to keys read from an -sqs-queue")
+		os.Exit(ExitCodeFlagParseError)
+	}
+	// queues are read until stopped, unless they stay idle this long
+	queueIdle, isQueue := map[string]time.Duration{
+		"kafka": flagKafkaIdle,
+		"redis": flagRedisIdle,
+		"sqs":   flagSQSIdle,
+	}[source.Name]
+	if flagDaemon && (!isQueue || queueIdle > 0 || flagSortKeys) {
+		fmt.Fprintln(os.Stderr, "-daemon reads an -sqs-queue, a -kafka-topic or a Redis stream until stopped, without an idle timeout or -sort-keys")
+		os.Exit(ExitCodeFlagParseError)
+	}
+	if flagSortKeys && !keyList {
+		fmt.Fprintln(os.Stderr, "-sort-keys only applies to keys read from a list, listings are already sorted")
+		os.Exit(ExitCodeFlagParseError)
+	}
+	// Redis sets are read to the end, and checked once it is known
+	if flagSortKeys && isQueue && queueIdle == 0 && source.Name != "redis" {
+		fmt.Fprintln(os.Stderr, "-sort-keys needs every key, please provide -sqs-idle or -kafka-idle to stop reading the queue")
+		os.Exit(ExitCodeFlagParseError)
+	}
+	// keys of a file outside the given prefixes are out of scope
+	if keyList && len(prefixes) > 0 {
+		filters.Add("outside-prefix", outsidePrefixFilter(prefixes))
 	}
 
-	if scanner.Err() != nil {
-		fmt.Fprintln(os.Stderr, scanner.Err())
-		os.Exit(1)
+	if flagStopAt != "" && flagStopAt <= flagStartAfter {
+		fmt.Fprintln(os.Stderr, "The key range is empty, -stop-at must come after -start-after")
+		os.Exit(ExitCodeFlagParseError)
+	}
+	// listings stop early, other sources are filtered
+	if flagStartAfter != "" || flagStopAt != "" {
+		filters.Add("key-range", keyRangeFilter(flagStartAfter, flagStopAt))
 	}
 
-	pool.Close()
-	pool.Wait()
-	printProgress()
-	fmt.Println("")
+	if flagRetain > 0 && (flagOlderThan > 0 || flagNewerThan > 0) {
+		fmt.Fprintln(os.Stderr, "-retain can't be combined with -older-than or -newer-than")
+		os.Exit(ExitCodeFlagParseError)
+	}
+	if flagRetain > 0 && source.Name != "prefix" {
+		fmt.Fprintln(os.Stderr, "-retain deletes under a prefix, please provide -prefix")
+		os.Exit(ExitCodeFlagParseError)
+	}
+	if (flagOlderThan > 0 || flagNewerThan > 0) && !source.Details {
+		fmt.Fprintln(os.Stderr, "-older-than and -newer-than need the age of the objects, only listings and inventory reports have it")
+		os.Exit(ExitCodeFlagParseError)
+	}
+	if flagOlderThan > 0 && flagNewerThan > 0 && flagNewerThan <= flagOlderThan {
+		fmt.Fprintln(os.Stderr, "No object can be both older than -older-than and newer than -newer-than")
+		os.Exit(ExitCodeFlagParseError)
+	}
+	if (flagMinSize >= 0 || flagMaxSize >= 0) && !source.Details {
+		fmt.Fprintln(os.Stderr, "-min-size and -max-size need the size of the objects, only listings and inventory reports have it")
+		os.Exit(ExitCodeFlagParseError)
+	}
+	if flagMaxSize >= 0 && flagMaxSize < flagMinSize {
+		fmt.Fprintln(os.Stderr, "No object can be both larger than -min-size and smaller than -max-size")
+		os.Exit(ExitCodeFlagParseError)
+	}
+	if flagMinSize >= 0 {
+		filters.Add("min-size", minSizeFilter(int64(flagMinSize)))
+	}
+	if flagMaxSize >= 0 {
+		filters.Add("max-size", maxSizeFilter(int64(flagMaxSize)))
+	}
+	if flagDirMarkers {
+		if !source.Details {
+			fmt.Fprintln(os.Stderr, "-directory-markers needs the size of the objects, only listings and inventory reports have it")
+			os.Exit(ExitCodeFlagParseError)
+		}
+		filters.Add("directory-markers", directoryMarkerFilter())
+	}
+	if len(flagStorageClass) > 0 {
+		if !source.Details {
+			fmt.Fprintln(os.Stderr, "-storage-class needs the storage class of the objects, only listings and inventory reports have it")
+			os.Exit(ExitCodeFlagParseError)
+		}
+		if err := checkStorageClasses(flagStorageClass); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(ExitCodeFlagParseError)
+		}
+		filters.Add("storage-class", storageClassFilter(flagStorageClass, false))
+	}
+	if flagSkipArchived || flagOnlyArchived {
+		if !source.Details {
+			fmt.Fprintln(os.Stderr, "-skip-archived and -only-archived need the storage class of the objects, only listings and inventory reports have it")
+			os.Exit(ExitCodeFlagParseError)
+		}
+		if flagSkipArchived && flagOnlyArchived {
+			fmt.Fprintln(os.Stderr, "Please provide either -skip-archived or -only-archived")
+			os.Exit(ExitCodeFlagParseError)
+		}
+		if flagSkipArchived {
+			filters.Add("skip-archived", storageClassFilter(archivedClasses, true))
+		} else {
+			filters.Add("only-archived", storageClassFilter(archivedClasses, false))
+		}
+	}
+	if len(flagOwner) > 0 || len(flagExceptOwner) > 0 {
+		// inventory reports don't list owners
+		if source.Name != "prefix" && source.Name != "keep-newest" {
+			fmt.Fprintln(os.Stderr, "-owner and -except-owner need the owner of the objects, only listings have it")
+			os.Exit(ExitCodeFlagParseError)
+		}
+		fetchOwner = true
+		if len(flagOwner) > 0 {
+			filters.Add("owner", ownerFilter(flagOwner, false))
+		}
+		if len(flagExceptOwner) > 0 {
+			filters.Add("except-owner", ownerFilter(flagExceptOwner, true))
+		}
+	}
+	if flagETagFile != "" || flagExceptETagFile != "" {
+		if !source.Details {
+			fmt.Fprintln(os.Stderr, "-etag-file and -except-etag-file need the ETag of the objects, only listings and inventory reports have it")
+			os.Exit(ExitCodeFlagParseError)
+		}
+		for _, f := range []struct {
+			name   string
+			path   string
+			except bool
+		}{{"etag", flagETagFile, false}, {"except-etag", flagExceptETagFile, true}} {
+			if f.path == "" {
+				continue
+			}
+			etags, err := ReadETagFile(f.path)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(ExitCodeFlagParseError)
+			}
+			filters.Add(f.name, etagFilter(etags, f.except))
+		}
+	}
+	if flagOlderThan > 0 {
+		filters.Add("older-than", olderThanFilter(time.Now().Add(-time.Duration(flagOlderThan))))
+	}
+	if flagRetain > 0 {
+		filters.Add("retain", olderThanFilter(time.Now().Add(-time.Duration(flagRetain))))
+	}
+	if flagNewerThan > 0 {
+		filters.Add("newer-than", newerThanFilter(time.Now().Add(-time.Duration(flagNewerThan))))
+	}
+	if flagFilter != "" {
+		expr, err := ParseFilterExpr(flagFilter)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(ExitCodeFlagParseError)
+		}
+		if expr.NeedsDetails && !source.Details {
+			fmt.Fprintln(os.Stderr, "Only key can be used in a -filter expression on a key list, listings and inventory reports have the other fields")
+			os.Exit(ExitCodeFlagParseError)
+		}
+		filters.Add("filter", expr)
+	}
+	// a sample of what the other filters matched, before paying for lookups
+	if flagSample > 0 {
+		filters.Add("sample", sampleFilter(float64(flagSample)))
+	}
+	var orphans *LookupFilter
+	if flagOrphanManifest != "" && flagOrphansOf == "" {
+		fmt.Fprintln(os.Stderr, "-orphans-manifest lists the sources of -orphans-of, please provide it too")
+		os.Exit(ExitCodeFlagParseError)
+	}
+	if flagOrphansOf != "" {
+		sourceBucket, sourcePrefix, err := ParseS3Prefix(flagOrphansOf)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(ExitCodeFlagParseError)
+		}
+		sourceKey := sourceKeyMapper(prefixes, sourcePrefix)
+		if flagOrphanManifest != "" {
+			manifest, err := ReadManifest(flagOrphanManifest, svc)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(ExitCodeError)
+			}
+			filters.Add("orphans-manifest", manifestFilter(manifest, sourceKey))
+		} else {
+			client, err := regionClient(sess, svc, sourceBucket, flagRegion)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(ExitCodeAWSError)
+			}
+			orphans = NewOrphanFilter(client, sourceBucket, sourceKey)
+		}
+	}
+	// lookups cost a request per object, so they are checked last
+	if len(flagTag) > 0 || len(flagMeta) > 0 || flagContentType != "" || orphans != nil {
+		if flagLookupWorkers < 1 {
+			fmt.Fprintln(os.Stderr, "Lookup concurrency must be at least 1")
+			os.Exit(ExitCodeFlagParseError)
+		}
+		if len(flagTag) > 0 {
+			tags, err := NewTagFilter(svc, flagBucket, flagTag)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(ExitCodeFlagParseError)
+			}
+			lookups = append(lookups, tags)
+			filters.Add("tag", tags)
+		}
+		if len(flagMeta) > 0 || flagContentType != "" {
+			head, err := NewHeadFilter(svc, flagBucket, flagMeta, flagContentType)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(ExitCodeFlagParseError)
+			}
+			fmt.Fprintln(os.Stderr, "warning: -meta and -content-type make a HeadObject request per object, at least doubling the requests of the run")
+			lookups = append(lookups, head)
+			filters.Add("head", head)
+		}
+		if orphans != nil {
+			lookups = append(lookups, orphans)
+			filters.Add("orphans", orphans)
+		}
+		for _, lookup := range lookups {
+			lookup.Workers = flagLookupWorkers
+		}
+	}
+	// the safety net comes last, counting the objects it saved
+	if flagProtectFile != "" {
+		protected, err := ReadProtectFile(flagProtectFile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(ExitCodeError)
+		}
+		filters.Add("protected", protectFilter(protected))
+	}
+	if len(protectedPrefixes) > 0 {
+		filters.Add("protected-prefix", protectFilter(ProtectedPrefixes(protectedPrefixes)))
+	}
+
+	if flagListWorkers < 1 {
+		fmt.Fprintln(os.Stderr, "Number of list workers must be at least 1")
+		os.Exit(ExitCodeFlagParseError)
+	}
+
+	if flagMaxErrors < 0 {
+		fmt.Fprintln(os.Stderr, "Max errors can't be negative")
+		os.Exit(ExitCodeFlagParseError)
+	}
+	if flagLimit < 0 {
+		fmt.Fprintln(os.Stderr, "Limit can't be negative")
+		os.Exit(ExitCodeFlagParseError)
+	}
+	if flagKeepNewest < 0 {
+		fmt.Fprintln(os.Stderr, "Number of objects to keep can't be negative")
+		os.Exit(ExitCodeFlagParseError)
+	}
+
+	if flagReconcile && (flagDryrun || keyList || flagKeepNewest > 0) {
+		fmt.Fprintln(os.Stderr, "Reconciling is only possible when deleting everything under a prefix")
+		os.Exit(ExitCodeFlagParseError)
+	}
+
+	modes, versionMode := 0, ""
+	if flagKeepVersions < 0 {
+		fmt.Fprintln(os.Stderr, "Number of versions to keep can't be negative")
+		os.Exit(ExitCodeFlagParseError)
+	}
+	for _, mode := range []struct {
+		flag string
+		set  bool
+	}{
+		{"-versions", flagVersions},
+		{"-delete-markers", flagMarkers},
+		{"-noncurrent", flagNoncurrent},
+		{"-keep-versions", flagKeepVersions > 0},
+	} {
+		if mode.set {
+			modes++
+			versionMode = mode.flag
+		}
+	}
+	if modes > 1 {
+		fmt.Fprintln(os.Stderr, "Please provide only one of -versions, -delete-markers, -noncurrent and -keep-versions")
+		os.Exit(ExitCodeFlagParseError)
+	}
+	if flagNoncurrentFor < 0 {
+		fmt.Fprintln(os.Stderr, "Noncurrent duration can't be negative")
+		os.Exit(ExitCodeFlagParseError)
+	}
+	if modes > 0 && (keyList || flagKeepNewest > 0 || flagDiff != "" || directory) {
+		fmt.Fprintln(os.Stderr, "Versions can only be listed under a prefix of a general purpose bucket")
+		os.Exit(ExitCodeFlagParseError)
+	}
+	if modes > 0 {
+		deletedVersions = &VersionCounts{}
+	}
+
+	// listings are checked in full, other runs by a sample of what they deleted
+	verifyListing := source.Name == "prefix" && modes == 0 && flagSample == 0
+	if flagVerify && flagDryrun {
+		fmt.Fprintln(os.Stderr, "-verify checks that the objects deleted are gone, it can't be combined with -dryrun")
+		os.Exit(ExitCodeFlagParseError)
+	}
+	if flagVerifySample < 1 {
+		fmt.Fprintln(os.Stderr, "Verify sample must be at least 1")
+		os.Exit(ExitCodeFlagParseError)
+	}
+	if flagVerify && !verifyListing {
+		deletedSample = NewKeySample(flagVerifySample)
+	}
+
+	if flagStateFile != "" {
+		currentRun = &RunState{
+			Bucket:   flagBucket,
+			Source:   source.Name,
+			Prefixes: prefixes,
+			File:     flagFile,
+			Dryrun:   flagDryrun,
+			Versions: versionMode,
+			Sharded:  modes > 0 && flagListWorkers > 1,
+		}
+		// the mark only says what was dealt with for keys read in order,
+		// versions have a mark per shard
+		if (source.Name != "prefix" && source.Name != "file") || (modes == 0 && flagListWorkers > 1) || directory || flagDiff != "" {
+			fmt.Fprintln(os.Stderr, "-state-file only applies to listings under prefixes, of the current objects with a -list-workers of 1 or of versions, and to a -file")
+			os.Exit(ExitCodeFlagParseError)
+		}
+		if modes > 0 {
+			shardCheckpoint = NewShardCheckpoint(nil)
+		}
+		if source.Name == "file" && (flagFile == StdinFile || flagColumn != "" || flagSortKeys) {
+			fmt.Fprintln(os.Stderr, "-state-file only applies to a -file of keys read in order, not the standard input, a CSV -column or -sort-keys")
+			os.Exit(ExitCodeFlagParseError)
+		}
+		state, err := ReadRunState(flagStateFile)
+		switch {
+		case flagResume && err != nil:
+			fmt.Fprintf(os.Stderr, "Nothing to resume: %s\n", err)
+			os.Exit(ExitCodeFlagParseError)
+		case flagResume:
+			if err := state.CheckResume(currentRun); err != nil {
+				fmt.Fprintf(os.Stderr, "Can't resume from %s: %s\n", flagStateFile, err)
+				os.Exit(ExitCodeFlagParseError)
+			}
+			if state.Complete {
+				fmt.Printf("resume: the run of %s is complete, %d objects were deleted\n", flagStateFile, state.Deleted)
+				os.Exit(ExitCodeOK)
+			}
+			resumedState = state
+			if source.Name == "file" {
+				env.SkipKeys = state.Offset
+			} else if modes > 0 {
+				shardCheckpoint = NewShardCheckpoint(state.Shards)
+			} else if state.HighWaterMark != "" {
+				env.Prefixes = ResumePrefixes(prefixes, state.HighWaterMark)
+				env.ResumeAfter = state.HighWaterMark
+			}
+			fmt.Printf("resume: %d objects were deleted by %d earlier runs, resuming after %s\n", state.Deleted, state.Runs, state.resumePoint())
+		case err == nil && !state.Complete:
+			// an unfinished run is only started over on purpose
+			fmt.Fprintf(os.Stderr, "%s is the state of an unfinished run, please -resume it or remove the file to start over\n", flagStateFile)
+			os.Exit(ExitCodeFlagParseError)
+		case err != nil && !os.IsNotExist(err):
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(ExitCodeFlagParseError)
+		}
+	} else if flagResume {
+		fmt.Fprintln(os.Stderr, "Please provide the -state-file of the run to resume")
+		os.Exit(ExitCodeFlagParseError)
+	}
+
+	env.Session, env.Client, env.Directory = sess, svc, directory
+	env.Checkpoint = shardCheckpoint
+	scanner, err = source.New(env)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		if _, ok := err.(UsageError); ok {
+			os.Exit(ExitCodeFlagParseError)
+		}
+		os.Exit(ExitCodeError)
+	}
+	if rs, ok := scanner.(*RedisScanner); ok && rs.stream && rs.Idle == 0 && flagSortKeys {
+		fmt.Fprintln(os.Stderr, "-sort-keys needs every key, please provide -redis-idle to stop reading the stream")
+		os.Exit(ExitCodeFlagParseError)
+	}
+
+	// keys are decoded first, so the sort dedupes them as they are deleted
+	if flagDecodeKeys {
+		scanner = NewDecodedScanner(scanner)
+	}
+	if flagSortKeys {
+		sortedKeys = NewSortedScanner(scanner, flagTmpDir)
+		scanner = sortedKeys
+	}
+
+	if flagDiff != "" {
+		if keyList || flagKeepNewest > 0 {
+			fmt.Fprintln(os.Stderr, "Please provide an s3 prefix to compare the file with")
+			os.Exit(ExitCodeFlagParseError)
+		}
+		diff, err := DiffKeys(flagDiff, scanner, prefixes)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(ExitCodeError)
+		}
+		diff.WriteSummary(os.Stdout, flagDiff)
+		if diff.Present > 0 {
+			os.Exit(ExitCodeStillPresent)
+		}
+		os.Exit(ExitCodeOK)
+	}
+
+	if flagAll && !flagDryrun && !flagYes {
+		var estimate *BucketEstimate
+		if !flagNoEstimate {
+			estimate, _ = EstimateBucket(sess, flagBucket)
+		}
+		if err := ConfirmEmptyBucket(flagBucket, estimate); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(ExitCodeError)
+		}
+	}
+
+	// listing a whole bucket is confirmed with its name, as -all is
+	wholeBucket := !keyList && len(prefixes) == 1 && prefixes[0] == ""
+	if wholeBucket && !flagAll && !flagDryrun && !flagYes && !isTerminal() {
+		fmt.Fprintln(os.Stderr, "refusing to delete from the whole bucket without confirmation; pass -force when not running in a terminal")
+		os.Exit(ExitCodeError)
+	}
+
+	// a typo in the prefix shouldn't start deleting right away, so runs
+	// from a terminal show what they are about to delete first; queues
+	// can't be read twice
+	if !flagAll && !flagDryrun && !flagYes && queue == nil && isTerminal() {
+		// the preview lists from the same marks, without moving them
+		previewEnv := *env
+		if env.Checkpoint != nil {
+			previewEnv.Checkpoint = env.Checkpoint.Copy()
+		}
+		previewScanner, err := source.New(&previewEnv)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(ExitCodeError)
+		}
+		if flagDecodeKeys {
+			previewScanner = NewDecodedScanner(previewScanner)
+		}
+		preview, err := NewRunPreview(previewScanner, filters)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(ExitCodeError)
+		}
+		from := fmt.Sprintf("from the %s source", source.Name)
+		if !keyList {
+			from = fmt.Sprintf("under prefix %q", strings.Join(prefixes, `", "`))
+		}
+		typeName := wholeBucket || (flagConfirmOver > 0 && preview.Expected() > flagConfirmOver)
+		if err := ConfirmRun(flagBucket, from, filters.Names(), preview, typeName); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(ExitCodeError)
+		}
+	}
+
+	if flagLock {
+		if flagLockTTL <= 0 {
+			fmt.Fprintln(os.Stderr, "Lock TTL must be positive")
+			os.Exit(ExitCodeFlagParseError)
+		}
+		bucket := flagLockBucket
+		if bucket == "" {
+			bucket = flagBucket
+		}
+		target := "s3://" + flagBucket
+		if !keyList {
+			target += "/" + strings.Join(prefixes, ",")
+		}
+		lock = NewLock(bucket, target, flagLockTTL, svc)
+		if err := lock.Acquire(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(ExitCodeError)
+		}
+	}
+
+	errorsDone := make(chan struct{})
+	go func() {
+		defer close(errorsDone)
+		for err := range pool.errors {
+			setLastError(err)
+			fmt.Fprintln(os.Stderr, err)
+		}
+	}()
+
+	// track time for calculating delete rate
+	jobStart = time.Now()
+
+	var metrics *MetricsPublisher
+	if flagMetricsNS != "" {
+		metrics = NewMetricsPublisher(sess, flagMetricsNS, flagBucket, flagRunID, flagDryrun)
+		metrics.Start()
+	}
+	if flagMetricsAddr != "" {
+		if err := ServeMetrics(flagMetricsAddr); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			releaseLock()
+			os.Exit(ExitCodeFlagParseError)
+		}
+	}
+
+	if outputFile != nil {
+		output, err = NewOutputWriter(outputFile, flagOutputFormat, DefaultOutputQueueSize, runHeader(), flagTmpDir)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			releaseLock()
+			os.Exit(ExitCodeError)
+		}
+		// whatever was deleted before an interrupt still makes a bundle
+		if flagAuditBundle != "" {
+			OnInterrupt(func() {
+				output.Close([]string{metadataPrefix + "interrupted=" + time.Now().UTC().Format(time.RFC3339)})
+				writeAuditBundle()
+			})
+		}
+	}
+
+	// a stopped daemon finishes the deletes of the keys it received, other
+	// runs those in flight, leaving the batches still queued for a later run
+	OnShutdown(func(sig os.Signal) {
+		// queued tasks need workers, to be run or dropped
+		pool.Resume()
+		if flagDaemon {
+			fmt.Fprintln(os.Stderr, "\nstopping, waiting for the deletes in flight")
+			queue.Stop()
+			return
+		}
+		fmt.Fprintf(os.Stderr, "\n%s: stopping, waiting for the deletes in flight, interrupt again to exit now\n", signalName(sig))
+		interrupt(sig)
+	})
+	// operators can yield S3 capacity to other traffic for a while
+	OnPause(func() {
+		pool.Pause()
+		fmt.Fprintln(os.Stderr, "\nSIGUSR1: paused once the deletes in flight finish, SIGUSR2 resumes")
+	}, func() {
+		pool.Resume()
+		fmt.Fprintf(os.Stderr, "\nSIGUSR2: resumed with %d workers\n", flagPool)
+	})
+
+	// start progress bar
+	progressDone := make(chan struct{})
+	progressStopped := make(chan struct{})
+	go func() {
+		defer close(progressStopped)
+		ticker := time.NewTicker(ProgressRefreshInterval)
+		defer ticker.Stop()
+		var stateSaved time.Time
+		for {
+			printProgress()
+			updateProgressFile()
+			if time.Since(stateSaved) >= StateSaveInterval {
+				updateStateFile(false)
+				stateSaved = time.Now()
+			}
+			select {
+			case <-progressDone:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	dispatch(svc, scanner, batchSize, false)
+
+	// a scan stopped by the abort shuts down like the rest of the run
+	if scanner.Err() != nil && !aborted() {
+		setLastError(scanner.Err())
+		setPhase(PhaseFailed)
+		updateProgressFile()
+		fmt.Fprintln(os.Stderr, scanner.Err())
+		if mark := tracker.HighWaterMark(); mark != "" {
+			fmt.Fprintf(os.Stderr, "high-water mark: %s\n", mark)
+		}
+		if retries.Len() > 0 || flagFailed != "" {
+			if path, err := saveFailed(); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+			} else if retries.Len() > 0 {
+				fmt.Fprintf(os.Stderr, "keys that failed to delete are listed in %s\n", path)
+			}
+		}
+		updateStateFile(false)
+		if metrics != nil {
+			metrics.Stop()
+		}
+		releaseLock()
+		os.Exit(1)
+	}
+
+	setPhase(PhaseDraining)
+	pool.WaitIdle()
+
+	// keys from a file that were never dispatched can be picked up by the
+	// next run, listings are resumed from the high-water mark
+	var remaining *RetryQueue
+	if (overBudget() || aborted()) && flagFile != "" {
+		remaining = NewRetryQueue(flagTmpDir)
+		drain(scanner, remaining)
+	}
+
+	// give the keys that failed one more chance
+	if retries.Len() > 0 && !overBudget() && !aborted() {
+		setPhase(PhaseRetrying)
+		failed := retries.Take()
+		rs, err := failed.Scanner()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			releaseLock()
+			os.Exit(ExitCodeError)
+		}
+		dispatch(svc, rs, batchSize, true)
+		pool.WaitIdle()
+		if overBudget() {
+			drain(rs, retries)
+		}
+		if rs.Err() != nil {
+			fmt.Fprintln(os.Stderr, rs.Err())
+		} else {
+			failed.Remove()
+		}
+	}
+
+	pool.Close()
+	pool.Wait()
+	<-errorsDone
+	if output != nil {
+		if err := output.Close(runFooter()); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	}
+	close(progressDone)
+	<-progressStopped
+	if metrics != nil {
+		metrics.Stop()
+	}
+
+	var reconciliation *Reconciliation
+	if flagReconcile && !overBudget() && !aborted() {
+		reconciliation, err = Reconcile(svc, flagBucket, prefixes, jobStart, flagReverify)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	}
+
+	// objects left by a run that stopped early aren't survivors
+	var verification *Verification
+	var verifyErr error
+	switch {
+	case flagVerify && verifyListing && (overBudget() || aborted() || limitReached()):
+		fmt.Fprintln(os.Stderr, "verify: skipped, the run stopped before listing everything")
+	case flagVerify && verifyListing:
+		verification, verifyErr = VerifyListing(svc, flagBucket, prefixes, jobStart)
+	case deletedSample != nil:
+		verification, verifyErr = VerifySample(svc, flagBucket, deletedSample.Sample(), jobStart, flagLookupWorkers)
+	}
+	if verifyErr != nil {
+		fmt.Fprintf(os.Stderr, "verify: %s\n", verifyErr)
+	}
+
+	// an empty listing is more likely a wrong prefix than a job well done
+	empty := false
+	if !flagAllowEmpty && !keyList && flagKeepNewest == 0 {
+		if ps, ok := scanner.(ProgressScanner); ok && ps.EmittedKeys() == 0 {
+			empty = true
+		}
+	}
+	// the last snapshot says how the run ended
+	code := runExitCode(verification, empty)
+	setPhase(exitPhase(code))
+	updateProgressFile()
+	printProgress()
+	fmt.Println("")
+	if mark := tracker.HighWaterMark(); mark != "" {
+		fmt.Printf("high-water mark: %s\n", mark)
+	}
+	requestCounter.WriteSummary(os.Stdout, pricing())
+	if deletedVersions != nil {
+		deletedVersions.WriteSummary(os.Stdout, flagDryrun)
+	}
+	if sortedKeys != nil {
+		sortedKeys.WriteSummary(os.Stdout)
+	}
+	input := unwrapScanner(scanner)
+	if ms, ok := input.(*MultiScanner); ok {
+		ms.WriteSummary(os.Stdout)
+	}
+	if rs, ok := input.(*RetentionScanner); ok {
+		rs.WriteSummary(os.Stdout)
+	}
+	if qs, ok := input.(*QueueScanner); ok {
+		qs.WriteSummary(os.Stdout)
+	}
+	if ks, ok := input.(*KafkaScanner); ok {
+		ks.WriteSummary(os.Stdout)
+	}
+	if rs, ok := input.(*RedisScanner); ok {
+		rs.WriteSummary(os.Stdout)
+	}
+	if ts, ok := input.(*TableScanner); ok {
+		ts.WriteSummary(os.Stdout)
+	}
+	if ss, ok := input.(*ShardedScanner); ok {
+		ss.WriteSummary(os.Stdout)
+	}
+	filters.WriteSummary(os.Stdout)
+	for _, lookup := range lookups {
+		lookup.WriteSummary(os.Stdout)
+	}
+	if preview != nil {
+		preview.WriteSummary(os.Stdout)
+	}
+	if hook != nil {
+		hook.WriteSummary(os.Stdout)
+	}
+	if reconciliation != nil {
+		reconciliation.WriteSummary(os.Stdout)
+	}
+	if verification != nil {
+		verification.WriteSummary(os.Stdout)
+	}
+	if flagAuditBundle != "" {
+		writeAuditBundle()
+	}
+	if output != nil && output.Stalls() > 0 {
+		fmt.Printf("output: deletes waited on the output file %d times\n", output.Stalls())
+	}
+	if output != nil {
+		output.WriteSummary(os.Stdout)
+	}
+	deletedClasses.WriteSummary(os.Stdout, flagDryrun, atomic.LoadInt64(&totalDeletedObjects), atomic.LoadInt64(&totalDeletedBytes))
+	failureCodes.WriteSummary(os.Stdout)
+	if locked := failureCodes.Count(ErrCodeObjectLocked); locked > 0 {
+		fmt.Printf("object lock: %d object versions are under retention", locked)
+		if flagBypassGov {
+			fmt.Print(" in compliance mode, or in governance mode without s3:BypassGovernanceRetention")
+		} else {
+			fmt.Print(", -bypass-governance-retention deletes those in governance mode")
+		}
+		fmt.Println("")
+	}
+	if held := failureCodes.Count(ErrCodeLegalHold); held > 0 {
+		fmt.Printf("legal hold: %d object versions are under a legal hold, -release-legal-holds releases them before deleting\n", held)
+	}
+	if released := atomic.LoadInt64(&releasedHolds); released > 0 {
+		fmt.Printf("legal hold: released the legal hold of %d object versions\n", released)
+	}
+	if retries.Len() > 0 || flagFailed != "" {
+		path, err := saveFailed()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		if retries.Len() > 0 {
+			fmt.Printf("failed: %d keys could not be deleted, they are listed in %s\n", retries.Len(), path)
+		}
+	}
+	updateStateFile(retries.Len() == 0 && !limitReached() && !overBudget() && !aborted())
+
+	releaseLock()
+
+	if limitReached() {
+		fmt.Printf("limit: stopped after queuing %d objects (-limit %d)\n", atomic.LoadInt64(&totalObjects), flagLimit)
+	}
+
+	if remaining != nil && remaining.Len() > 0 {
+		if err := remaining.Close(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	}
+	if overBudget() {
+		fmt.Printf("budget: stopped after %d requests (-max-requests %d)\n", requestCounter.Total(), flagMaxRequests)
+		if remaining != nil && remaining.Len() > 0 {
+			fmt.Printf("remaining: %d keys were not attempted, they are listed in %s\n", remaining.Len(), remaining.Path())
+		}
+	} else if aborted() {
+		fmt.Printf("aborted: %s\n", abortReason.Load())
+		if n := atomic.LoadInt64(&notAttempted); n > 0 {
+			fmt.Printf("aborted: %d queued keys were not attempted, they are listed with the failed keys as NotAttempted\n", n)
+		}
+		if remaining != nil && remaining.Len() > 0 {
+			fmt.Printf("remaining: %d keys were not attempted, they are listed in %s\n", remaining.Len(), remaining.Path())
+		}
+		// where the next run picks up from
+		if flagStateFile != "" {
+			fmt.Println("resume: run the same command with -resume")
+		} else if mark := tracker.HighWaterMark(); mark != "" && source.Name == "prefix" && modes == 0 && flagListWorkers == 1 {
+			fmt.Printf("resume: run the same command with -start-after '%s'\n", strings.Replace(mark, "'", `'\''`, -1))
+		}
+		if code == ExitCodeAWSError {
+			fmt.Println("credentials: use credentials that can be refreshed, such as a profile assuming a role, for runs longer than their lifetime")
+		}
+	}
+	if code == ExitCodeNoObjects {
+		fmt.Fprintf(os.Stderr, "no objects matched prefix %q\n", strings.Join(prefixes, `", "`))
+	}
+	if code != ExitCodeOK {
+		os.Exit(code)
+	}
+}
+
+// runExitCode returns the exit code of a run that went through to its
+// summary: why it stopped early, if it did, then whether objects verified
+// are still present, or the listing was empty.
+func runExitCode(verification *Verification, empty bool) int {
+	switch {
+	case overBudget():
+		return ExitCodeBudgetExhausted
+	case aborted() && output != nil && output.Err() != nil:
+		return ExitCodeOutputError
+	case aborted() && atomic.LoadInt32(&renewFailed) == 1:
+		return ExitCodeAWSError
+	case aborted() && interrupted.Load() != nil:
+		return ExitCodeInterrupted
+	case aborted():
+		return ExitCodeAborted
+	case verification != nil && verification.Present > 0:
+		return ExitCodeStillPresent
+	case empty:
+		return ExitCodeNoObjects
+	}
+	return ExitCodeOK
+}
+
+// batchDetails copies the details of a batch's objects, as the scanner may
+// reuse its map for the next batch.
+func batchDetails(details map[*s3.ObjectIdentifier]*s3.Object, objects []*s3.ObjectIdentifier) map[*s3.ObjectIdentifier]*s3.Object {
+	if len(details) == 0 {
+		return nil
+	}
+	batch := make(map[*s3.ObjectIdentifier]*s3.Object, len(objects))
+	for _, object := range objects {
+		if detail, ok := details[object]; ok {
+			batch[object] = detail
+		}
+	}
+	return batch
+}
+
+// writeAuditBundle writes the -audit-bundle, with the latest snapshot as the
+// summary.
+func writeAuditBundle() {
+	summary, err := json.MarshalIndent(progressSnapshot(), "", "  ")
+	if err == nil {
+		err = WriteAuditBundle(flagAuditBundle, flagOutput, summary)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to write the audit bundle: %s\n", err)
+		return
+	}
+	fmt.Printf("audit bundle: %s\n", flagAuditBundle)
+}
+
+// saveFailed closes the queue of the keys that failed to delete, moving it to
+// the -failed file if one was given, and returns the path of the file.
+func saveFailed() (string, error) {
+	if flagFailed != "" {
+		return flagFailed, retries.SaveTo(flagFailed)
+	}
+	return retries.Path(), retries.Close()
+}
+
+// limitReached reports whether -limit objects were queued for deletion.
+func limitReached() bool {
+	return flagLimit > 0 && atomic.LoadInt64(&totalObjects) >= flagLimit
+}
+
+// abortReason says why -max-errors, -fail-fast or a signal aborted the run,
+// once they did. Objects of batches still queued count as notAttempted.
+var (
+	abortReason  atomic.Value
+	interrupted  atomic.Value
+	notAttempted int64
+)
+
+// aborted reports whether -max-errors, -fail-fast or a signal aborted the
+// run.
+func aborted() bool {
+	return abortReason.Load() != nil
+}
+
+// interrupt aborts the run after it received sig, unless it was already
+// aborted.
+func interrupt(sig os.Signal) {
+	interrupted.Store(time.Now())
+	abort(fmt.Sprintf("interrupted by %s, the deletes in flight finished", signalName(sig)))
+}
+
+// abort aborts the run for the given reason, unless it was already aborted.
+// The batches in flight finish, the scan and the batches still queued are
+// stopped.
+func abort(reason string) {
+	if !aborted() {
+		abortReason.Store(reason)
+	}
+	// the scan may be waiting for messages
+	if queue != nil {
+		queue.Stop()
+	}
+}
+
+// checkErrorLimits aborts the run, after a task failed with err, once
+// -max-errors keys failed to delete, or with -fail-fast, at the first error
+// retrying won't fix.
+func checkErrorLimits(err error) {
+	if aborted() {
+		return
+	}
+	if flagFailFast {
+		errs, ok := err.(KeyErrors)
+		if !ok {
+			errs = KeyErrors{{Err: err}}
+		}
+		for _, e := range errs {
+			if !isTransient(e.Err) {
+				abortReason.Store(fmt.Sprintf("stopped at the first error retrying won't fix (-fail-fast): %s", errorCode(e.Err)))
+				return
+			}
+		}
+	}
+	if failed := atomic.LoadInt64(&totalFailedObjects); flagMaxErrors > 0 && failed >= flagMaxErrors {
+		abortReason.Store(fmt.Sprintf("stopped after %d keys failed to delete (-max-errors %d)", failed, flagMaxErrors))
+	}
+}
+
+// overBudget reports whether the -max-requests budget is used up.
+func overBudget() bool {
+	return flagMaxRequests > 0 && requestCounter.Total() >= flagMaxRequests
+}
+
+// drain adds the keys the scanner has left to the queue, without filtering.
+func drain(scanner Scanner, queue *RetryQueue) {
+	for scanner.Scan(DefaultBatchSize) {
+		if err := queue.Add(scanner.Objects()); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return
+		}
+	}
+}
+
+// releaseLock releases the -lock, if held.
+func releaseLock() {
+	if lock == nil {
+		return
+	}
+	if err := lock.Release(); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to release the lock s3://%s/%s: %s\n", lock.Bucket, lock.Key, err)
+	}
+}
+
+// dispatch queues the objects listed by the scanner for deletion. Retried
+// objects were already counted as queued on the first pass.
+func dispatch(svc *s3.S3, scanner Scanner, batchSize int, retry bool) {
+	// the offsets of the keys read before and after the batch, for the
+	// high-water mark to resume a key file from, which only the last part
+	// of a whole batch reaches. Retries are read again from the start.
+	var read, offset int64
+	for !overBudget() && !aborted() && (retry || !limitReached()) && scanner.Scan(batchSize) {
+		if ps, ok := scanner.(ProgressScanner); ok && !retry {
+			read, offset = offset, ps.EmittedKeys()
+		}
+		var details map[*s3.ObjectIdentifier]*s3.Object
+		if ds, ok := scanner.(DetailScanner); ok {
+			details = ds.Details()
+		}
+		objects := filters.Apply(scanner.Objects(), details)
+		// spared keys are done with as far as the queue is concerned
+		if queue != nil && !retry {
+			if spared := without(scanner.Objects(), objects); flagDryrun {
+				queue.Nack(spared)
+			} else {
+				queue.Ack(spared)
+			}
+		}
+		whole := true
+		if flagLimit > 0 && !retry {
+			if left := flagLimit - atomic.LoadInt64(&totalObjects); int64(len(objects)) > left {
+				// keys past the limit are left for a later run
+				if queue != nil {
+					queue.Nack(objects[left:])
+				}
+				objects = objects[:left]
+				offset, whole = read, false
+			}
+		}
+		if len(objects) == 0 {
+			continue
+		}
+		if !retry {
+			atomic.AddInt64(&totalObjects, int64(len(objects)))
+		}
+		var partition string
+		if ms, ok := scanner.(*MultiScanner); ok {
+			partition = ms.Label()
+		}
+		var markers map[*s3.ObjectIdentifier]bool
+		if ms, ok := scanner.(MarkerScanner); ok {
+			markers = ms.Markers()
+		}
+		// only batches of the listing move the marks of its shards, up to
+		// the end of a whole page
+		var shards ShardScanner
+		var mark *ShardMark
+		if ss, ok := scanner.(ShardScanner); ok && shardCheckpoint != nil && !retry {
+			shards = ss
+			if whole {
+				mark = ss.Mark()
+			}
+		}
+		details = batchDetails(details, objects)
+		if preview != nil && !retry {
+			preview.Add(objects, details)
+		}
+		batches := SplitBatch(objects, flagBatchBytes)
+		for i, batch := range batches {
+			batchOffset := read
+			batchMark := mark
+			if i == len(batches)-1 {
+				batchOffset = offset
+			} else {
+				batchMark = nil
+			}
+			seq := tracker.Dispatch(*batch[len(batch)-1].Key, batchOffset)
+			if shards != nil {
+				shardCheckpoint.Dispatch(seq, shards.Shard(), batchMark)
+			}
+			pool.Exec(partition, &DeleteTask{
+				dryrun:    flagDryrun,
+				client:    svc,
+				mode:      flagDeleteMode,
+				bypass:    flagBypassGov,
+				release:   flagReleaseHolds,
+				seq:       seq,
+				details:   details,
+				markers:   markers,
+				Bucket:    flagBucket,
+				Partition: partition,
+				Objects:   batch,
+			})
+		}
+	}
+}
+
+// StringList collects the values of a repeated flag.
+type StringList []string
+
+func (l *StringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *StringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
 }
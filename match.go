@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// regexPatternPrefix marks an -exclude pattern as a regular expression
+// rather than a glob.
+const regexPatternPrefix = "re:"
+
+// CompileGlob compiles a shell-style wildcard pattern matching whole keys.
+// As in the AWS CLI, "*" matches any run of characters, slashes included,
+// "?" matches a single character and "[...]" a character class, which "!"
+// negates.
+func CompileGlob(pattern string) (*regexp.Regexp, error) {
+	return compileGlob(pattern, ".*")
+}
+
+// CompilePathGlob compiles a wildcard pattern like CompileGlob, except that,
+// as in a shell, "*" stops at slashes. "**" matches across them.
+func CompilePathGlob(pattern string) (*regexp.Regexp, error) {
+	return compileGlob(pattern, "[^/]*")
+}
+
+// compileGlob compiles a glob, where "*" is replaced by star.
+func compileGlob(pattern string, star string) (*regexp.Regexp, error) {
+	var re strings.Builder
+	re.WriteString("^")
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; c {
+		case '*':
+			if strings.HasPrefix(pattern[i:], "**") {
+				re.WriteString(".*")
+				i++
+			} else {
+				re.WriteString(star)
+			}
+		case '?':
+			re.WriteString(".")
+		case '[':
+			end := strings.IndexByte(pattern[i+1:], ']')
+			if end < 0 {
+				return nil, fmt.Errorf("glob %q has an unterminated [", pattern)
+			}
+			class := pattern[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			re.WriteString("[" + strings.Replace(class, `\`, `\\`, -1) + "]")
+			i += end + 1
+		default:
+			re.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	re.WriteString("$")
+	return regexp.Compile(re.String())
+}
+
+// GlobPrefix returns the literal part of a glob before its first wildcard,
+// the longest prefix every matching key starts with.
+func GlobPrefix(pattern string) string {
+	if i := strings.IndexAny(pattern, "*?["); i >= 0 {
+		return pattern[:i]
+	}
+	return pattern
+}
+
+// CompilePattern compiles an -exclude pattern: a glob, or a regular
+// expression when it starts with "re:".
+func CompilePattern(pattern string) (*regexp.Regexp, error) {
+	if strings.HasPrefix(pattern, regexPatternPrefix) {
+		return regexp.Compile(strings.TrimPrefix(pattern, regexPatternPrefix))
+	}
+	return CompileGlob(pattern)
+}
+
+// excludeFilter spares keys matching any of the patterns.
+func excludeFilter(patterns []*regexp.Regexp) Filter {
+	return FilterFunc(func(object *s3.ObjectIdentifier) bool {
+		key := aws.StringValue(object.Key)
+		for _, pattern := range patterns {
+			if pattern.MatchString(key) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// matchFilter spares keys the pattern doesn't match.
+func matchFilter(pattern *regexp.Regexp) Filter {
+	return FilterFunc(func(object *s3.ObjectIdentifier) bool {
+		return !pattern.MatchString(aws.StringValue(object.Key))
+	})
+}
+
+// suffixFilter spares keys that end with none of the suffixes.
+func suffixFilter(suffixes []string) Filter {
+	return FilterFunc(func(object *s3.ObjectIdentifier) bool {
+		key := aws.StringValue(object.Key)
+		for _, suffix := range suffixes {
+			if strings.HasSuffix(key, suffix) {
+				return false
+			}
+		}
+		return true
+	})
+}
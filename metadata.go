@@ -0,0 +1,245 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Version is set at build time with -ldflags "-X main.Version=...".
+var Version = "dev"
+
+// metadataPrefix starts the run metadata lines written to the head and tail
+// of output files. Scanners skip these lines, so outputs stay usable as
+// input.
+const metadataPrefix = "#s3rm "
+
+// metadataFileSuffix names the file next to a CSV output holding its run
+// metadata, which can't be mixed with the rows.
+const metadataFileSuffix = ".meta.json"
+
+func isMetadataLine(line string) bool {
+	return strings.HasPrefix(line, metadataPrefix)
+}
+
+// writeMetadataFile writes metadata lines to path as a JSON object, a key
+// given several times holding the list of its values.
+func writeMetadataFile(path string, lines []string) error {
+	meta := make(map[string]interface{})
+	for _, line := range lines {
+		parts := strings.SplitN(strings.TrimPrefix(line, metadataPrefix), "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		switch value := meta[parts[0]].(type) {
+		case nil:
+			meta[parts[0]] = parts[1]
+		case string:
+			meta[parts[0]] = []string{value, parts[1]}
+		case []string:
+			meta[parts[0]] = append(value, parts[1])
+		}
+	}
+	data, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(data, '\n'), 0644)
+}
+
+// readMetadataFile reads the metadata file written next to a CSV output back
+// as metadata lines. It returns no lines if there is no such file.
+func readMetadataFile(outputPath string) ([]string, error) {
+	data, err := ioutil.ReadFile(outputPath + metadataFileSuffix)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var meta map[string]interface{}
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return nil, fmt.Errorf("%s%s: %s", outputPath, metadataFileSuffix, err)
+	}
+	var lines []string
+	for key, value := range meta {
+		switch value := value.(type) {
+		case string:
+			lines = append(lines, metadataPrefix+key+"="+value)
+		case []interface{}:
+			for _, v := range value {
+				lines = append(lines, fmt.Sprintf("%s%s=%v", metadataPrefix, key, v))
+			}
+		}
+	}
+	return lines, nil
+}
+
+// runHeader describes the run: what was deleted, how, and when.
+func runHeader() []string {
+	header := []string{
+		metadataPrefix + "version=" + Version,
+		metadataPrefix + "started=" + jobStart.UTC().Format(time.RFC3339),
+		metadataPrefix + "bucket=" + flagBucket,
+	}
+	switch {
+	case flagFile != "":
+		header = append(header, metadataPrefix+"file="+flagFile)
+	case flagAthena != "":
+		header = append(header, metadataPrefix+"athena-query-id="+flagAthena)
+	case flagSQLite != "":
+		header = append(header, metadataPrefix+"sqlite="+flagSQLite)
+	case flagTable != "":
+		header = append(header, metadataPrefix+"dynamodb-table="+flagTable)
+	case flagSQS != "":
+		header = append(header, metadataPrefix+"sqs-queue="+flagSQS)
+	case flagKafkaTopic != "":
+		header = append(header, metadataPrefix+"kafka-topic="+flagKafkaTopic)
+	case flagRedisKey != "":
+		header = append(header, metadataPrefix+"redis-key="+flagRedisKey)
+	case flagInventory != "":
+		header = append(header, metadataPrefix+"inventory="+flagInventory)
+	case flagGlob != "":
+		header = append(header, metadataPrefix+"glob="+flagGlob)
+	case flagTemplate != "":
+		header = append(header, metadataPrefix+"prefix-template="+flagTemplate)
+	case len(flagPrefix) == 0 && flagPrefixFile == "":
+		header = append(header, metadataPrefix+"prefix=")
+	default:
+		for _, prefix := range flagPrefix {
+			header = append(header, metadataPrefix+"prefix="+prefix)
+		}
+		if flagPrefixFile != "" {
+			header = append(header, metadataPrefix+"prefix-file="+flagPrefixFile)
+		}
+	}
+	if flagStartAfter != "" {
+		header = append(header, metadataPrefix+"start-after="+flagStartAfter)
+	}
+	if flagStopAt != "" {
+		header = append(header, metadataPrefix+"stop-at="+flagStopAt)
+	}
+	if flagExceptBloom != "" {
+		header = append(header, metadataPrefix+"except-bloom="+flagExceptBloom)
+	}
+	if flagFileVersions {
+		header = append(header, metadataPrefix+"file-versions=true")
+	}
+	if flagDecodeKeys {
+		header = append(header, metadataPrefix+"decode-keys=true")
+	}
+	if flagSortKeys {
+		header = append(header, metadataPrefix+"sort-keys=true")
+	}
+	if flagVersions {
+		header = append(header, metadataPrefix+"versions=true")
+	}
+	if flagMarkers {
+		header = append(header, metadataPrefix+"delete-markers=true")
+	}
+	if flagNoncurrent {
+		header = append(header, metadataPrefix+"noncurrent-for="+flagNoncurrentFor.String())
+	}
+	if flagKeepVersions > 0 {
+		header = append(header, fmt.Sprintf("%skeep-versions=%d", metadataPrefix, flagKeepVersions))
+		header = append(header, metadataPrefix+"noncurrent-for="+flagNoncurrentFor.String())
+	}
+	if flagMinSize >= 0 {
+		header = append(header, metadataPrefix+"min-size="+flagMinSize.String())
+	}
+	if flagMaxSize >= 0 {
+		header = append(header, metadataPrefix+"max-size="+flagMaxSize.String())
+	}
+	if flagDirMarkers {
+		header = append(header, metadataPrefix+"directory-markers=true")
+	}
+	for _, class := range flagStorageClass {
+		header = append(header, metadataPrefix+"storage-class="+class)
+	}
+	if flagSkipArchived {
+		header = append(header, metadataPrefix+"skip-archived=true")
+	}
+	if flagOnlyArchived {
+		header = append(header, metadataPrefix+"only-archived=true")
+	}
+	for _, tag := range flagTag {
+		header = append(header, metadataPrefix+"tag="+tag)
+	}
+	for _, meta := range flagMeta {
+		header = append(header, metadataPrefix+"meta="+meta)
+	}
+	if flagContentType != "" {
+		header = append(header, metadataPrefix+"content-type="+flagContentType)
+	}
+	for _, owner := range flagOwner {
+		header = append(header, metadataPrefix+"owner="+owner)
+	}
+	for _, owner := range flagExceptOwner {
+		header = append(header, metadataPrefix+"except-owner="+owner)
+	}
+	if flagETagFile != "" {
+		header = append(header, metadataPrefix+"etag-file="+flagETagFile)
+	}
+	if flagExceptETagFile != "" {
+		header = append(header, metadataPrefix+"except-etag-file="+flagExceptETagFile)
+	}
+	if flagProtectFile != "" {
+		header = append(header, metadataPrefix+"protect-file="+flagProtectFile)
+	}
+	if flagOrphansOf != "" {
+		header = append(header, metadataPrefix+"orphans-of="+flagOrphansOf)
+	}
+	if flagOrphanManifest != "" {
+		header = append(header, metadataPrefix+"orphans-manifest="+flagOrphanManifest)
+	}
+	if flagFilter != "" {
+		header = append(header, metadataPrefix+"filter="+flagFilter)
+	}
+	if flagLimit > 0 {
+		header = append(header, fmt.Sprintf("%slimit=%d", metadataPrefix, flagLimit))
+	}
+	if flagBypassGov {
+		header = append(header, metadataPrefix+"bypass-governance-retention=true")
+	}
+	if flagReleaseHolds {
+		header = append(header, metadataPrefix+"release-legal-holds=true")
+	}
+	if flagSkipFrom != "" {
+		header = append(header, metadataPrefix+"skip-from="+flagSkipFrom)
+	}
+	if resumedState != nil {
+		header = append(header, metadataPrefix+"resumed-after="+resumedState.resumePoint())
+	}
+	if flagSample > 0 {
+		header = append(header, metadataPrefix+"sample="+flagSample.String())
+	}
+	if flagRetain > 0 {
+		header = append(header, metadataPrefix+"retain="+flagRetain.String())
+	}
+	if flagOlderThan > 0 {
+		header = append(header, metadataPrefix+"older-than="+flagOlderThan.String())
+	}
+	if flagNewerThan > 0 {
+		header = append(header, metadataPrefix+"newer-than="+flagNewerThan.String())
+	}
+	if flagKeepNewest > 0 {
+		header = append(header, fmt.Sprintf("%skeep-newest=%d", metadataPrefix, flagKeepNewest))
+	}
+	return append(header, fmt.Sprintf("%sdryrun=%t", metadataPrefix, flagDryrun))
+}
+
+// runFooter records the end of a run that completed cleanly.
+func runFooter() []string {
+	footer := []string{
+		metadataPrefix + "finished=" + time.Now().UTC().Format(time.RFC3339),
+		fmt.Sprintf("%squeued=%d", metadataPrefix, atomic.LoadInt64(&totalObjects)),
+		fmt.Sprintf("%sdeleted=%d", metadataPrefix, atomic.LoadInt64(&totalDeletedObjects)),
+	}
+	if at, ok := interrupted.Load().(time.Time); ok {
+		footer = append(footer, metadataPrefix+"interrupted="+at.UTC().Format(time.RFC3339))
+	}
+	return footer
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+)
+
+const (
+	// MetricsInterval is the time between two publications of run metrics.
+	MetricsInterval time.Duration = time.Minute
+
+	// MaxMetricDatums is the number of datapoints PutMetricData accepts in
+	// a single request.
+	MaxMetricDatums int = 1000
+)
+
+// MetricsPublisher puts the run's metrics to CloudWatch every
+// MetricsInterval and once more when stopped. Counters are published as the
+// change since the previous publication, so they can be summed over any
+// period. Failing to publish is reported, but never stops the run.
+type MetricsPublisher struct {
+	Namespace  string
+	client     *cloudwatch.CloudWatch
+	dimensions []*cloudwatch.Dimension
+	last       map[string]int64
+	stop       chan struct{}
+	done       chan struct{}
+}
+
+// NewMetricsPublisher publishes metrics with the bucket and run id, if any,
+// as dimensions. Dry runs are published with a DryRun dimension, so they
+// can't be mistaken for real ones.
+func NewMetricsPublisher(sess *session.Session, namespace string, bucket string, runID string, dryrun bool) *MetricsPublisher {
+	dimensions := []*cloudwatch.Dimension{
+		{Name: aws.String("Bucket"), Value: aws.String(bucket)},
+	}
+	if runID != "" {
+		dimensions = append(dimensions, &cloudwatch.Dimension{Name: aws.String("RunId"), Value: aws.String(runID)})
+	}
+	if dryrun {
+		dimensions = append(dimensions, &cloudwatch.Dimension{Name: aws.String("DryRun"), Value: aws.String("true")})
+	}
+	return &MetricsPublisher{
+		Namespace:  namespace,
+		client:     cloudwatch.New(sess),
+		dimensions: dimensions,
+		last:       make(map[string]int64),
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+}
+
+// Start publishes metrics in the background until Stop is called.
+func (m *MetricsPublisher) Start() {
+	go func() {
+		defer close(m.done)
+		ticker := time.NewTicker(MetricsInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				m.publish()
+			case <-m.stop:
+				m.publish()
+				return
+			}
+		}
+	}()
+}
+
+// Stop publishes the final metrics and waits for them to be sent.
+func (m *MetricsPublisher) Stop() {
+	close(m.stop)
+	<-m.done
+}
+
+func (m *MetricsPublisher) publish() {
+	stats := Snapshot()
+	now := time.Now()
+	datums := []*cloudwatch.MetricDatum{
+		m.counter("ObjectsDeleted", stats.Deleted, cloudwatch.StandardUnitCount, now),
+		m.counter("ObjectsFailed", atomic.LoadInt64(&totalFailedObjects), cloudwatch.StandardUnitCount, now),
+		m.counter("BytesFreed", stats.DeletedBytes, cloudwatch.StandardUnitBytes, now),
+		m.counter("ThrottleEvents", stats.Throttles, cloudwatch.StandardUnitCount, now),
+		m.datum("Workers", float64(stats.Workers), cloudwatch.StandardUnitCount, now),
+	}
+	for len(datums) > 0 {
+		n := len(datums)
+		if n > MaxMetricDatums {
+			n = MaxMetricDatums
+		}
+		_, err := m.client.PutMetricData(&cloudwatch.PutMetricDataInput{
+			Namespace:  aws.String(m.Namespace),
+			MetricData: datums[:n],
+		})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "\nwarning: failed to publish metrics: %s\n", err)
+		}
+		datums = datums[n:]
+	}
+}
+
+// counter returns the change of a counter since it was last published.
+func (m *MetricsPublisher) counter(name string, value int64, unit string, now time.Time) *cloudwatch.MetricDatum {
+	delta := value - m.last[name]
+	m.last[name] = value
+	return m.datum(name, float64(delta), unit, now)
+}
+
+func (m *MetricsPublisher) datum(name string, value float64, unit string, now time.Time) *cloudwatch.MetricDatum {
+	return &cloudwatch.MetricDatum{
+		MetricName: aws.String(name),
+		Dimensions: m.dimensions,
+		Timestamp:  aws.Time(now),
+		Unit:       aws.String(unit),
+		Value:      aws.Float64(value),
+	}
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const mockBucket = "bucket"
+
+// mockObject is an object stored by mockS3.
+type mockObject struct {
+	size         int64
+	lastModified time.Time
+	replication  string
+}
+
+// mockVersion is a version or delete marker stored by mockS3.
+type mockVersion struct {
+	key          string
+	id           string
+	marker       bool
+	lastModified time.Time
+}
+
+// mockS3 serves the S3 requests s3rm makes from objects held in memory,
+// recording each request it gets. Versions are listed apart from objects,
+// each key's newest first.
+type mockS3 struct {
+	mu       sync.Mutex
+	objects  map[string]*mockObject
+	versions []mockVersion
+	requests []string
+
+	// rejectBatch returns the error code a DeleteObjects request of the keys
+	// is rejected with, if any.
+	rejectBatch func(keys []string) string
+	// delay is how long each DeleteObjects or DeleteObject request takes.
+	delay time.Duration
+	// pageSize is the number of keys listed per page, 1000 if zero.
+	pageSize int
+	// gone lists keys that are listed, but reported missing by HeadObject.
+	gone map[string]bool
+	// directory rejects listings of prefixes not ending in a /, as
+	// directory buckets do.
+	directory bool
+}
+
+// newMockS3 starts serving a mock S3 holding the keys, and returns a client
+// sending its requests there. The globals a run sets up before using a
+// client are set up too.
+func newMockS3(t *testing.T, keys ...string) (*mockS3, *s3.S3) {
+	t.Helper()
+	m := &mockS3{objects: make(map[string]*mockObject)}
+	for _, key := range keys {
+		m.put(key, &mockObject{lastModified: time.Now().Add(-time.Hour)})
+	}
+	srv := httptest.NewServer(m)
+	t.Cleanup(srv.Close)
+
+	sess := session.Must(session.NewSession(&aws.Config{
+		Region:           aws.String("us-east-1"),
+		Endpoint:         aws.String(srv.URL),
+		S3ForcePathStyle: aws.Bool(true),
+		Credentials:      credentials.NewStaticCredentials("id", "secret", ""),
+		MaxRetries:       aws.Int(0),
+	}))
+	credentialGate = NewCredentialGate(sess.Config)
+	svc := s3.New(sess)
+	credentialGate.Probe(svc, mockBucket)
+	if pool == nil {
+		pool = NewPartitionPool(1, 1)
+	}
+	return m, svc
+}
+
+func (m *mockS3) put(key string, object *mockObject) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.objects[key] = object
+}
+
+// putVersions stores n versions of the key, under a delete marker if marker
+// is set.
+func (m *mockS3) putVersions(key string, n int, marker bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	created := time.Now().Add(-time.Hour)
+	if marker {
+		m.versions = append(m.versions, mockVersion{key: key, id: fmt.Sprintf("%s-m", key), marker: true, lastModified: created})
+	}
+	for i := n; i > 0; i-- {
+		created = created.Add(-time.Minute)
+		m.versions = append(m.versions, mockVersion{key: key, id: fmt.Sprintf("%s-v%d", key, i), lastModified: created})
+	}
+	sort.SliceStable(m.versions, func(i, j int) bool { return m.versions[i].key < m.versions[j].key })
+}
+
+// has reports whether the key is stored.
+func (m *mockS3) has(key string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, ok := m.objects[key]
+	return ok
+}
+
+// requested returns the requests received so far.
+func (m *mockS3) requested() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]string(nil), m.requests...)
+}
+
+func (m *mockS3) record(request string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.requests = append(m.requests, request)
+}
+
+func (m *mockS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/"+mockBucket), "/")
+	query := r.URL.Query()
+	switch {
+	case r.Method == http.MethodPost && query["delete"] != nil:
+		m.deleteObjects(w, r)
+	case r.Method == http.MethodDelete:
+		m.record("DeleteObject " + key)
+		time.Sleep(m.delay)
+		m.mu.Lock()
+		delete(m.objects, key)
+		m.mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodHead:
+		m.record("HeadObject " + key)
+		m.headObject(w, key)
+	case r.Method == http.MethodGet && query["versions"] != nil:
+		m.record("ListObjectVersions " + query.Get("prefix"))
+		m.listObjectVersions(w, query)
+	case r.Method == http.MethodGet && query.Get("list-type") == "2":
+		m.record("ListObjectsV2")
+		m.listObjects(w, query)
+	case r.Method == http.MethodGet:
+		m.record("ListObjects")
+		m.listObjects(w, query)
+	default:
+		mockError(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+func (m *mockS3) deleteObjects(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Objects []struct {
+			Key string `xml:"Key"`
+		} `xml:"Object"`
+	}
+	if err := xml.NewDecoder(r.Body).Decode(&body); err != nil {
+		mockError(w, http.StatusBadRequest, "MalformedXML")
+		return
+	}
+	keys := make([]string, len(body.Objects))
+	for i, object := range body.Objects {
+		keys[i] = object.Key
+	}
+	m.record(fmt.Sprintf("DeleteObjects %d", len(keys)))
+	time.Sleep(m.delay)
+	if m.rejectBatch != nil {
+		if code := m.rejectBatch(keys); code != "" {
+			mockError(w, http.StatusBadRequest, code)
+			return
+		}
+	}
+	m.mu.Lock()
+	for _, key := range keys {
+		delete(m.objects, key)
+	}
+	m.mu.Unlock()
+	fmt.Fprint(w, `<DeleteResult></DeleteResult>`)
+}
+
+func (m *mockS3) headObject(w http.ResponseWriter, key string) {
+	m.mu.Lock()
+	object, ok := m.objects[key]
+	gone := m.gone[key]
+	m.mu.Unlock()
+	if !ok || gone {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Last-Modified", object.lastModified.UTC().Format(http.TimeFormat))
+	w.Header().Set("Content-Length", strconv.FormatInt(object.size, 10))
+	if object.replication != "" {
+		w.Header().Set("x-amz-replication-status", object.replication)
+	}
+}
+
+// listObjects serves ListObjectsV2, and ListObjects which takes a marker
+// instead of a start-after key.
+func (m *mockS3) listObjects(w http.ResponseWriter, query url.Values) {
+	if prefix := query.Get("prefix"); m.directory && prefix != "" && !strings.HasSuffix(prefix, "/") {
+		mockError(w, http.StatusBadRequest, "InvalidRequest")
+		return
+	}
+	pageSize := m.pageSize
+	if pageSize == 0 {
+		pageSize = 1000
+	}
+	if max, err := strconv.Atoi(query.Get("max-keys")); err == nil && max < pageSize {
+		pageSize = max
+	}
+	after := query.Get("start-after") + query.Get("marker")
+	if token := query.Get("continuation-token"); token != "" {
+		after = token
+	}
+
+	m.mu.Lock()
+	var keys []string
+	for key := range m.objects {
+		if strings.HasPrefix(key, query.Get("prefix")) && key > after {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	truncated := len(keys) > pageSize
+	if truncated {
+		keys = keys[:pageSize]
+	}
+	var contents strings.Builder
+	for _, key := range keys {
+		object := m.objects[key]
+		contents.WriteString("<Contents><Key>")
+		xml.EscapeText(&contents, []byte(key))
+		fmt.Fprintf(&contents, "</Key><LastModified>%s</LastModified><Size>%d</Size><StorageClass>STANDARD</StorageClass></Contents>",
+			object.lastModified.UTC().Format(time.RFC3339), object.size)
+	}
+	m.mu.Unlock()
+
+	fmt.Fprintf(w, "<ListBucketResult><Name>%s</Name><IsTruncated>%t</IsTruncated>", mockBucket, truncated)
+	if truncated {
+		w.Write([]byte("<NextContinuationToken>"))
+		xml.EscapeText(w, []byte(keys[len(keys)-1]))
+		w.Write([]byte("</NextContinuationToken>"))
+	}
+	fmt.Fprintf(w, "%s</ListBucketResult>", contents.String())
+}
+
+// listObjectVersions lists the versions under the prefix after the key and
+// version markers. With a delimiter, the keys past it are rolled up into
+// common prefixes, which count towards the page like versions do.
+func (m *mockS3) listObjectVersions(w http.ResponseWriter, query url.Values) {
+	pageSize := m.pageSize
+	if pageSize == 0 {
+		pageSize = 1000
+	}
+	if max, err := strconv.Atoi(query.Get("max-keys")); err == nil && max < pageSize {
+		pageSize = max
+	}
+	prefix, delimiter := query.Get("prefix"), query.Get("delimiter")
+	keyMarker, versionIDMarker := query.Get("key-marker"), query.Get("version-id-marker")
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var (
+		entries                     strings.Builder
+		listed                      int
+		truncated                   bool
+		lastKey, lastID, lastPrefix string
+	)
+	past := keyMarker == ""
+	for i, v := range m.versions {
+		if !strings.HasPrefix(v.key, prefix) {
+			continue
+		}
+		if !past {
+			if v.key < keyMarker || (v.key == keyMarker && versionIDMarker == "") {
+				continue
+			}
+			if v.key == keyMarker {
+				past = v.id == versionIDMarker
+				continue
+			}
+			past = true
+		}
+		if j := strings.Index(v.key[len(prefix):], delimiter); delimiter != "" && j >= 0 {
+			common := v.key[:len(prefix)+j+len(delimiter)]
+			if common == lastPrefix || common == keyMarker {
+				continue
+			}
+			if listed == pageSize {
+				truncated = true
+				break
+			}
+			entries.WriteString("<CommonPrefixes><Prefix>")
+			xml.EscapeText(&entries, []byte(common))
+			entries.WriteString("</Prefix></CommonPrefixes>")
+			listed++
+			lastPrefix, lastKey, lastID = common, common, ""
+			continue
+		}
+		if listed == pageSize {
+			truncated = true
+			break
+		}
+		element := "Version"
+		if v.marker {
+			element = "DeleteMarker"
+		}
+		latest := i == 0 || m.versions[i-1].key != v.key
+		fmt.Fprintf(&entries, "<%s><Key>", element)
+		xml.EscapeText(&entries, []byte(v.key))
+		fmt.Fprintf(&entries, "</Key><VersionId>%s</VersionId><IsLatest>%t</IsLatest><LastModified>%s</LastModified>",
+			v.id, latest, v.lastModified.UTC().Format(time.RFC3339))
+		if !v.marker {
+			entries.WriteString(`<ETag>"etag"</ETag><Size>1</Size><StorageClass>STANDARD</StorageClass>`)
+		}
+		fmt.Fprintf(&entries, "</%s>", element)
+		listed++
+		lastKey, lastID = v.key, v.id
+	}
+
+	fmt.Fprintf(w, "<ListVersionsResult><Name>%s</Name><IsTruncated>%t</IsTruncated>", mockBucket, truncated)
+	if truncated {
+		w.Write([]byte("<NextKeyMarker>"))
+		xml.EscapeText(w, []byte(lastKey))
+		fmt.Fprintf(w, "</NextKeyMarker><NextVersionIdMarker>%s</NextVersionIdMarker>", lastID)
+	}
+	fmt.Fprintf(w, "%s</ListVersionsResult>", entries.String())
+}
+
+func mockError(w http.ResponseWriter, status int, code string) {
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, code)
+}
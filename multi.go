@@ -0,0 +1,366 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// BucketJob is the run of one bucket of a multi-bucket run.
+type BucketJob struct {
+	Bucket string
+	Region string
+	// Exit is the exit code of the run, once done
+	Exit int
+	// Err is set when the run couldn't be started
+	Err      error
+	progress string
+	done     bool
+}
+
+// ReadBucketFile reads a list of buckets, one bucket[,region] per line.
+// Empty lines and lines starting with # are skipped, and buckets without a
+// region are given region.
+func ReadBucketFile(path string, region string) ([]*BucketJob, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var jobs []*BucketJob
+	seen := make(map[string]bool)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		job := &BucketJob{Bucket: line, Region: region}
+		if i := strings.IndexByte(line, ','); i >= 0 {
+			job.Bucket = strings.TrimSpace(line[:i])
+			job.Region = strings.TrimSpace(line[i+1:])
+		}
+		if job.Bucket == "" || job.Region == "" {
+			return nil, fmt.Errorf("%s:%d: expected bucket[,region]", path, n)
+		}
+		if seen[job.Bucket] {
+			return nil, fmt.Errorf("%s:%d: bucket %s is listed twice", path, n, job.Bucket)
+		}
+		seen[job.Bucket] = true
+		jobs = append(jobs, job)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(jobs) == 0 {
+		return nil, fmt.Errorf("%s lists no buckets", path)
+	}
+	return jobs, nil
+}
+
+// MatchBuckets lists the buckets of the account whose name matches pattern,
+// a shell pattern such as logs-*, and finds the region of each. region is
+// the region buckets are listed from.
+func MatchBuckets(pattern string, region string) ([]*BucketJob, error) {
+	sess, err := session.NewSession(&aws.Config{Region: aws.String(region)})
+	if err != nil {
+		return nil, err
+	}
+	list, err := s3.New(sess).ListBuckets(&s3.ListBucketsInput{})
+	if err != nil {
+		return nil, err
+	}
+	var jobs []*BucketJob
+	for _, bucket := range list.Buckets {
+		name := aws.StringValue(bucket.Name)
+		if ok, _ := path.Match(pattern, name); !ok {
+			continue
+		}
+		bucketRegion, err := s3manager.GetBucketRegion(aws.BackgroundContext(), sess, name, region)
+		if err != nil {
+			return nil, fmt.Errorf("finding the region of %s: %s", name, err)
+		}
+		jobs = append(jobs, &BucketJob{Bucket: name, Region: bucketRegion})
+	}
+	return jobs, nil
+}
+
+// multiBucketFlags are the flags of the parent run, which children don't
+// get as they are.
+var multiBucketFlags = map[string]bool{
+	"bucket":             true,
+	"bucket-concurrency": true,
+	"bucket-file":        true,
+	"bucket-pattern":     true,
+	"progress-file":      true,
+	"region":             true,
+}
+
+// bucketArgs returns the arguments of the run of a bucket: the flags set on
+// the command line, with the bucket and region of the job, and the files of
+// the run, written or read back, named after the bucket.
+func bucketArgs(flags *flag.FlagSet, job *BucketJob) []string {
+	args := []string{"-bucket=" + job.Bucket, "-region=" + job.Region, "-progress-file=" + job.progress}
+	flags.Visit(func(f *flag.Flag) {
+		if multiBucketFlags[f.Name] {
+			return
+		}
+		if list, ok := f.Value.(*StringList); ok {
+			for _, value := range *list {
+				args = append(args, "-"+f.Name+"="+value)
+			}
+			return
+		}
+		value := f.Value.String()
+		if f.Name == "output" || f.Name == "audit-bundle" || f.Name == "failed" || f.Name == "state-file" || f.Name == "skip-from" {
+			value = bucketPath(value, job.Bucket)
+		}
+		args = append(args, "-"+f.Name+"="+value)
+	})
+	return args
+}
+
+// bucketPath adds the bucket to a file name, before its extension. The
+// slashes and colons of access point ARNs are replaced.
+func bucketPath(path string, bucket string) string {
+	ext := filepath.Ext(path)
+	bucket = strings.NewReplacer("/", "-", ":", "-").Replace(bucket)
+	return strings.TrimSuffix(path, ext) + "." + bucket + ext
+}
+
+// RunBuckets runs s3rm for each bucket, concurrency buckets at a time, and
+// returns the exit code of the whole run: zero when every run succeeded,
+// or the code of the first bucket whose run didn't. Output lines of the runs
+// are prefixed with their bucket, while their progress is combined into a
+// single progress line.
+func RunBuckets(flags *flag.FlagSet, jobs []*BucketJob, concurrency int, dir string) int {
+	self, err := os.Executable()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return ExitCodeError
+	}
+	tmp, err := ioutil.TempDir(dir, "s3rm-buckets-")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return ExitCodeError
+	}
+	defer os.RemoveAll(tmp)
+
+	var (
+		mu       sync.Mutex
+		running  = make(map[*BucketJob]*exec.Cmd)
+		stopping bool
+	)
+	// stopping lets the runs in progress stop gracefully, and starts no more
+	OnShutdown(func(os.Signal) {
+		mu.Lock()
+		defer mu.Unlock()
+		stopping = true
+		fmt.Fprintln(os.Stderr, "\nstopping, waiting for the buckets in progress")
+		for _, cmd := range running {
+			cmd.Process.Signal(syscall.SIGTERM)
+		}
+	})
+
+	out := &bucketOutput{}
+	progressDone := make(chan struct{})
+	progressStopped := make(chan struct{})
+	go func() {
+		defer close(progressStopped)
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			mu.Lock()
+			out.progress(jobs)
+			mu.Unlock()
+			select {
+			case <-progressDone:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i, job := range jobs {
+		sem <- struct{}{}
+		mu.Lock()
+		if stopping {
+			mu.Unlock()
+			break
+		}
+		job.progress = filepath.Join(tmp, fmt.Sprintf("%d.json", i))
+		cmd := exec.Command(self, bucketArgs(flags, job)...)
+		stdout, _ := cmd.StdoutPipe()
+		stderr, _ := cmd.StderrPipe()
+		if job.Err = cmd.Start(); job.Err != nil {
+			job.Exit, job.done = ExitCodeError, true
+			mu.Unlock()
+			<-sem
+			continue
+		}
+		running[job] = cmd
+		mu.Unlock()
+
+		wg.Add(1)
+		go func(job *BucketJob, cmd *exec.Cmd) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			var lines sync.WaitGroup
+			for _, r := range []io.Reader{stdout, stderr} {
+				lines.Add(1)
+				go func(r io.Reader) {
+					defer lines.Done()
+					out.prefixLines(r, job.Bucket)
+				}(r)
+			}
+			lines.Wait()
+			err := cmd.Wait()
+			mu.Lock()
+			delete(running, job)
+			job.Exit, job.done = cmd.ProcessState.ExitCode(), true
+			if job.Exit < 0 {
+				job.Err = err
+				job.Exit = ExitCodeError
+			}
+			mu.Unlock()
+		}(job, cmd)
+	}
+	wg.Wait()
+	close(progressDone)
+	<-progressStopped
+
+	out.progress(jobs)
+	fmt.Println("")
+	return writeBucketSummary(os.Stdout, jobs)
+}
+
+// bucketOutput prints the output lines of the runs between the updates of
+// the combined progress line.
+type bucketOutput struct {
+	mu sync.Mutex
+	// mid is set while the progress line is the current line
+	mid bool
+}
+
+// prefixLines prints the lines of the output of a run with its bucket.
+// Progress lines, ended by a carriage return or by the end of the output,
+// are left out.
+func (o *bucketOutput) prefixLines(r io.Reader, bucket string) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	scanner.Split(func(data []byte, atEOF bool) (int, []byte, error) {
+		if i := bytes.IndexAny(data, "\r\n"); i >= 0 {
+			if data[i] == '\r' {
+				return i + 1, nil, nil
+			}
+			return i + 1, data[:i], nil
+		}
+		if atEOF && len(data) > 0 {
+			return len(data), nil, nil
+		}
+		return 0, nil, nil
+	})
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+		o.mu.Lock()
+		if o.mid {
+			fmt.Println("")
+			o.mid = false
+		}
+		fmt.Printf("[%s] %s\n", bucket, line)
+		o.mu.Unlock()
+	}
+}
+
+// bucketSnapshot reads the last progress snapshot of the run of a bucket.
+func bucketSnapshot(job *BucketJob) *ProgressSnapshot {
+	data, err := ioutil.ReadFile(job.progress)
+	if err != nil {
+		return nil
+	}
+	var snapshot ProgressSnapshot
+	if json.Unmarshal(data, &snapshot) != nil {
+		return nil
+	}
+	return &snapshot
+}
+
+// progress prints the combined progress of the runs.
+func (o *bucketOutput) progress(jobs []*BucketJob) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.mid = true
+	var done, deleted, queued int64
+	var current []string
+	for _, job := range jobs {
+		if job.done {
+			done++
+		} else if job.progress != "" {
+			current = append(current, job.Bucket)
+		}
+		if snapshot := bucketSnapshot(job); snapshot != nil {
+			deleted += snapshot.Deleted
+			queued += snapshot.Queued
+		}
+	}
+	detail := ""
+	if len(current) > 0 {
+		detail = " (running: " + strings.Join(current, ", ") + ")"
+	}
+	fmt.Printf("\rbuckets: %d of %d done, deleted %d of %d objects%s", done, len(jobs), deleted, queued, detail)
+}
+
+// writeBucketSummary writes the outcome of the run of each bucket and the
+// totals, and returns the exit code of the whole run.
+func writeBucketSummary(w io.Writer, jobs []*BucketJob) int {
+	code := ExitCodeOK
+	var deleted, queued, failed int64
+	for _, job := range jobs {
+		switch {
+		case !job.done:
+			fmt.Fprintf(w, "%s (%s): not run\n", job.Bucket, job.Region)
+			job.Exit = ExitCodeError
+		case job.Err != nil:
+			fmt.Fprintf(w, "%s (%s): %s\n", job.Bucket, job.Region, job.Err)
+		default:
+			var d, q int64
+			if snapshot := bucketSnapshot(job); snapshot != nil {
+				d, q = snapshot.Deleted, snapshot.Queued
+			}
+			deleted += d
+			queued += q
+			fmt.Fprintf(w, "%s (%s): deleted %d of %d objects, exit code %d\n", job.Bucket, job.Region, d, q, job.Exit)
+		}
+		if job.Exit != ExitCodeOK {
+			failed++
+			if code == ExitCodeOK {
+				code = job.Exit
+			}
+		}
+	}
+	fmt.Fprintf(w, "total: deleted %d of %d objects in %d buckets, %d unsuccessful\n", deleted, queued, len(jobs), failed)
+	return code
+}
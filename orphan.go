@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// sourceKeyMapper returns how the key of an object maps to the key of its
+// source: the longest of the prefixes the key is under is replaced by the
+// prefix of the sources, so thumbs/a.jpg listed under thumbs/ is the
+// derivative of originals/a.jpg.
+func sourceKeyMapper(prefixes []string, sourcePrefix string) func(key string) string {
+	return func(key string) string {
+		var under string
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(key, prefix) && len(prefix) > len(under) {
+				under = prefix
+			}
+		}
+		return sourcePrefix + strings.TrimPrefix(key, under)
+	}
+}
+
+// regionClient returns a client for a bucket that may be in another region
+// than the client of the run.
+func regionClient(sess *session.Session, client *s3.S3, bucket string, region string) (*s3.S3, error) {
+	bucketRegion, err := s3manager.GetBucketRegion(aws.BackgroundContext(), sess, bucket, region)
+	if err != nil {
+		return nil, fmt.Errorf("finding the region of %s: %s", bucket, err)
+	}
+	if bucketRegion == region {
+		return client, nil
+	}
+	return s3.New(sess, &aws.Config{Region: aws.String(bucketRegion)}), nil
+}
+
+// NewOrphanFilter returns a filter sparing the objects whose source still
+// exists in the bucket, checked with HeadObject.
+func NewOrphanFilter(client *s3.S3, bucket string, sourceKey func(string) string) *LookupFilter {
+	return &LookupFilter{
+		Name:    "orphans",
+		Want:    map[string]string{"source": "missing"},
+		Workers: DefaultLookupWorkers,
+		lookup: func(object *s3.ObjectIdentifier) (map[string]string, error) {
+			_, err := client.HeadObject(&s3.HeadObjectInput{
+				Bucket: aws.String(bucket),
+				Key:    aws.String(sourceKey(aws.StringValue(object.Key))),
+			})
+			if isNotFound(err) {
+				return map[string]string{"source": "missing"}, nil
+			}
+			if err != nil {
+				return nil, err
+			}
+			return map[string]string{"source": "present"}, nil
+		},
+	}
+}
+
+// ReadManifest reads the keys of a manifest of the sources, a key file
+// such as an earlier -output, from a local path or an s3:// URI.
+func ReadManifest(file string, client *s3.S3) (map[string]bool, error) {
+	var scanner *FileScanner
+	var err error
+	if strings.HasPrefix(file, "s3://") {
+		scanner, err = NewS3FileScanner(file, client)
+	} else {
+		scanner, err = NewFileScanner(file)
+	}
+	if err != nil {
+		return nil, err
+	}
+	keys := make(map[string]bool)
+	for scanner.Scan(DefaultBatchSize) {
+		for _, object := range scanner.Objects() {
+			keys[aws.StringValue(object.Key)] = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%s lists no keys", file)
+	}
+	return keys, nil
+}
+
+// manifestFilter spares the objects whose source is listed in the manifest.
+func manifestFilter(manifest map[string]bool, sourceKey func(string) string) Filter {
+	return FilterFunc(func(object *s3.ObjectIdentifier) bool {
+		return manifest[sourceKey(aws.StringValue(object.Key))]
+	})
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/cenkalti/backoff"
+)
+
+const (
+	// outputKeyPrefix starts the line of each deleted key.
+	outputKeyPrefix = "delete: "
+
+	// failedKeyPrefix starts the line of each key of a -failed file, followed
+	// by the error code it failed with and a colon.
+	failedKeyPrefix = "failed "
+
+	// Output formats. Text lines hold the deleted key after outputKeyPrefix,
+	// CSV rows hold the key and the time its batch was deleted.
+	OutputFormatText = "text"
+	OutputFormatCSV  = "csv"
+
+	// DefaultOutputQueueSize is the number of deleted batches that can wait
+	// to be written to the output file.
+	DefaultOutputQueueSize int = 1024
+)
+
+// OutputRetryTimeout is how long a failing write to the output file is
+// retried before the run is aborted.
+var OutputRetryTimeout = time.Minute
+
+// OutputWriter records deleted keys in the background, so a slow output file
+// doesn't hold up deletes. Once its queue is full, Write blocks until the
+// writer catches up: this backpressure is deliberate, as deleting keys that
+// can't be recorded would make the output incomplete. A warning is printed
+// the first time it happens.
+//
+// If the file can't be written, the run is aborted, and the batches deleted
+// from then on, including those still queued, are recorded in a file of the
+// spill directory instead.
+type OutputWriter struct {
+	file     *os.File
+	format   string
+	header   []string
+	spillDir string
+	mu       sync.RWMutex
+	closed   bool
+	queue    chan deletedBatch
+	done     chan struct{}
+	stalls   int64
+
+	// err is the error writing the file failed with, unrecorded counts the
+	// keys written to the spill file, or lost if it couldn't be written either
+	err        error
+	spill      *os.File
+	unrecorded int64
+	lost       int64
+}
+
+// deletedBatch is a batch of objects and the time they were deleted.
+type deletedBatch struct {
+	objects []*s3.ObjectIdentifier
+	at      time.Time
+}
+
+// NewOutputWriter starts writing to file in the given format, beginning with
+// the header lines. Keys that can't be written to file are spilled to a file
+// in spillDir.
+func NewOutputWriter(file *os.File, format string, queueSize int, header []string, spillDir string) (*OutputWriter, error) {
+	o := &OutputWriter{
+		file:     file,
+		format:   format,
+		header:   header,
+		spillDir: spillDir,
+		queue:    make(chan deletedBatch, queueSize),
+		done:     make(chan struct{}),
+	}
+	if err := o.writeMetadata(o.file, header); err != nil {
+		return nil, err
+	}
+	go o.run()
+	return o, nil
+}
+
+// Write queues a batch of objects deleted just now to be written. Batches
+// written after Close are dropped.
+func (o *OutputWriter) Write(objects []*s3.ObjectIdentifier) {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	if o.closed {
+		return
+	}
+	batch := deletedBatch{objects: objects, at: time.Now().UTC()}
+	select {
+	case o.queue <- batch:
+		return
+	default:
+	}
+	if atomic.AddInt64(&o.stalls, 1) == 1 {
+		fmt.Fprintln(os.Stderr, "\nwarning: the output file can't keep up, deletes are slowed down to match")
+	}
+	o.queue <- batch
+}
+
+// Stalls returns the number of times Write blocked on a full queue.
+func (o *OutputWriter) Stalls() int64 {
+	return atomic.LoadInt64(&o.stalls)
+}
+
+func (o *OutputWriter) run() {
+	defer close(o.done)
+	for batch := range o.queue {
+		if o.err == nil {
+			err := o.write(o.file, batch)
+			if err == nil {
+				continue
+			}
+			o.err = err
+			abort(fmt.Sprintf("failed to write the output file: %s", err))
+		}
+		o.spillBatch(batch)
+	}
+}
+
+// spillBatch writes a batch that can't be written to the output file to the
+// spill file, created on first use with the same header, so -skip-from can
+// read it too.
+func (o *OutputWriter) spillBatch(batch deletedBatch) {
+	if o.spill == nil && o.lost == 0 {
+		spill, err := ioutil.TempFile(o.spillDir, "s3rm-unrecorded-")
+		if err == nil {
+			if err = o.writeMetadata(spill, o.header); err != nil {
+				spill.Close()
+				spill = nil
+			}
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		o.spill = spill
+	}
+	if o.spill != nil {
+		if err := o.write(o.spill, batch); err == nil {
+			o.unrecorded += int64(len(batch.objects))
+			return
+		}
+	}
+	o.lost += int64(len(batch.objects))
+}
+
+func (o *OutputWriter) write(file *os.File, batch deletedBatch) error {
+	if o.format == OutputFormatCSV {
+		var buf bytes.Buffer
+		w := csv.NewWriter(&buf)
+		at := batch.at.Format(time.RFC3339)
+		for _, obj := range batch.objects {
+			w.Write([]string{*obj.Key, at})
+		}
+		w.Flush()
+		return o.writeBytes(file, buf.Bytes())
+	}
+	lines := make([]string, len(batch.objects))
+	for i, obj := range batch.objects {
+		lines[i] = outputKeyPrefix + *obj.Key
+	}
+	return o.writeLines(file, lines)
+}
+
+// writeMetadata writes metadata lines at the head or tail of a text file. A
+// CSV file gets them all at once in its metadata file instead, rewritten
+// with the footer at the end of the run.
+func (o *OutputWriter) writeMetadata(file *os.File, lines []string) error {
+	if o.format == OutputFormatCSV {
+		return writeMetadataFile(file.Name()+metadataFileSuffix, lines)
+	}
+	return o.writeLines(file, lines)
+}
+
+// writeLines writes lines to the file.
+func (o *OutputWriter) writeLines(file *os.File, lines []string) error {
+	var buf bytes.Buffer
+	for _, line := range lines {
+		buf.WriteString(line)
+		buf.WriteByte('\n')
+	}
+	return o.writeBytes(file, buf.Bytes())
+}
+
+// writeBytes writes data to the file, retrying failed and partial writes
+// until OutputRetryTimeout has passed.
+func (o *OutputWriter) writeBytes(file *os.File, data []byte) error {
+	b := backoff.NewExponentialBackOff()
+	b.MaxElapsedTime = OutputRetryTimeout
+	return backoff.Retry(func() error {
+		n, err := file.Write(data)
+		data = data[n:]
+		return err
+	}, b)
+}
+
+// Close waits for all queued batches to be written, then writes the footer
+// lines and closes the file. Closing twice does nothing. Once writing the
+// file failed, the footer isn't written, see Err.
+func (o *OutputWriter) Close(footer []string) error {
+	o.mu.Lock()
+	if o.closed {
+		o.mu.Unlock()
+		return nil
+	}
+	o.closed = true
+	close(o.queue)
+	o.mu.Unlock()
+	<-o.done
+	if o.spill != nil {
+		if err := o.spill.Close(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	}
+	if o.err != nil {
+		o.file.Close()
+		return nil
+	}
+	if o.format == OutputFormatCSV {
+		footer = append(append([]string(nil), o.header...), footer...)
+	}
+	if err := o.writeMetadata(o.file, footer); err != nil {
+		o.file.Close()
+		return err
+	}
+	return o.file.Close()
+}
+
+// Err returns the error writing the output file failed with, if it did. It
+// must be called after Close.
+func (o *OutputWriter) Err() error {
+	return o.err
+}
+
+// WriteSummary writes where the keys that couldn't be written to the output
+// file went. It must be called after Close.
+func (o *OutputWriter) WriteSummary(w io.Writer) {
+	if o.err == nil {
+		return
+	}
+	fmt.Fprintf(w, "output: %s\n", o.err)
+	if o.unrecorded > 0 {
+		fmt.Fprintf(w, "output: %d deleted keys are listed in %s instead\n", o.unrecorded, o.spill.Name())
+	}
+	if o.lost > 0 {
+		fmt.Fprintf(w, "output: %d deleted keys couldn't be recorded anywhere\n", o.lost)
+	}
+}
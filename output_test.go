@@ -0,0 +1,222 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// outputBatch returns n objects named after the batch, with keys padded to
+// size bytes.
+func outputBatch(batch int, n int, size int) []*s3.ObjectIdentifier {
+	objects := make([]*s3.ObjectIdentifier, n)
+	for i := range objects {
+		key := fmt.Sprintf("b%03d/k%03d/", batch, i)
+		objects[i] = &s3.ObjectIdentifier{Key: aws.String(key + strings.Repeat("x", size-len(key)))}
+	}
+	return objects
+}
+
+// captureStderr redirects os.Stderr to a file until the test ends, and
+// returns a function reading what was written so far.
+func captureStderr(t *testing.T) func() string {
+	t.Helper()
+	f, err := ioutil.TempFile(t.TempDir(), "stderr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := os.Stderr
+	os.Stderr = f
+	t.Cleanup(func() {
+		os.Stderr = saved
+		f.Close()
+	})
+	return func() string {
+		data, _ := ioutil.ReadFile(f.Name())
+		return string(data)
+	}
+}
+
+// checkLines checks that the lines start with the header and hold every
+// key of the batches once, in order.
+func checkLines(t *testing.T, lines []string, header []string, batches [][]*s3.ObjectIdentifier) {
+	t.Helper()
+	if len(lines) < len(header) || strings.Join(lines[:len(header)], "\n") != strings.Join(header, "\n") {
+		t.Fatalf("file doesn't start with the header %q", header)
+	}
+	lines = lines[len(header):]
+	for _, batch := range batches {
+		for _, object := range batch {
+			if len(lines) == 0 {
+				t.Fatalf("%s is missing", aws.StringValue(object.Key))
+			}
+			if want := outputKeyPrefix + aws.StringValue(object.Key); lines[0] != want {
+				t.Fatalf("got line %.40q, want %.40q", lines[0], want)
+			}
+			lines = lines[1:]
+		}
+	}
+}
+
+func TestOutputWriterBlocksOnSlowFile(t *testing.T) {
+	stderr := captureStderr(t)
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	const queueSize = 3
+	header := []string{metadataPrefix + "bucket=" + mockBucket}
+	o, err := NewOutputWriter(w, OutputFormatText, queueSize, header, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the first batch fills the pipe nobody reads yet, so the writer is
+	// stuck on it, and the queue fills up behind it
+	batches := [][]*s3.ObjectIdentifier{outputBatch(0, 100, 1024)}
+	for i := 1; i <= queueSize+2; i++ {
+		batches = append(batches, outputBatch(i, 2, 16))
+	}
+	var written int64
+	go func() {
+		for _, batch := range batches {
+			o.Write(batch)
+			atomic.AddInt64(&written, 1)
+		}
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt64(&written) < queueSize+1 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := atomic.LoadInt64(&written); n != queueSize+1 {
+		t.Fatalf("%d writes returned with a queue of %d and the file stuck, want %d", n, queueSize, queueSize+1)
+	}
+	if o.Stalls() == 0 {
+		t.Error("no stall was counted")
+	}
+	if n := strings.Count(stderr(), "the output file can't keep up"); n != 1 {
+		t.Errorf("got %d warnings about the output file, want 1: %q", n, stderr())
+	}
+
+	// once the file is read, every write goes through
+	read := make(chan string)
+	go func() {
+		data, _ := ioutil.ReadAll(r)
+		read <- string(data)
+	}()
+	for atomic.LoadInt64(&written) < int64(len(batches)) && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if err := o.Close([]string{metadataPrefix + "complete"}); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(<-read, "\n"), "\n")
+	checkLines(t, lines[:len(lines)-1], header, batches)
+	if footer := lines[len(lines)-1]; footer != metadataPrefix+"complete" {
+		t.Errorf("got footer %q", footer)
+	}
+}
+
+func TestOutputWriterSpillsOnFailingFile(t *testing.T) {
+	captureStderr(t)
+	savedTimeout := OutputRetryTimeout
+	OutputRetryTimeout = 10 * time.Millisecond
+	t.Cleanup(func() {
+		OutputRetryTimeout = savedTimeout
+		abortReason = atomic.Value{}
+	})
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := []string{metadataPrefix + "bucket=" + mockBucket}
+	o, err := NewOutputWriter(w, OutputFormatText, 2, header, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// writes fail once nothing can read the pipe
+	r.Close()
+
+	var batches [][]*s3.ObjectIdentifier
+	for i := 0; i < 10; i++ {
+		batches = append(batches, outputBatch(i, 3, 16))
+		o.Write(batches[i])
+	}
+	if err := o.Close(nil); err != nil {
+		t.Fatal(err)
+	}
+	if o.Err() == nil {
+		t.Fatal("writing to a closed pipe succeeded")
+	}
+	if !aborted() {
+		t.Error("the run wasn't aborted")
+	}
+	if o.unrecorded != 30 || o.lost != 0 {
+		t.Errorf("got %d keys spilled and %d lost, want 30 spilled and none lost", o.unrecorded, o.lost)
+	}
+	data, err := ioutil.ReadFile(o.spill.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkLines(t, strings.Split(strings.TrimSuffix(string(data), "\n"), "\n"), header, batches)
+}
+
+func TestCSVOutputKeepsMetadataApart(t *testing.T) {
+	path := t.TempDir() + "/deleted.csv"
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := []string{metadataPrefix + "bucket=" + mockBucket, metadataPrefix + "prefix=a/", metadataPrefix + "prefix=b/"}
+	o, err := NewOutputWriter(f, OutputFormatCSV, 2, header, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	batch := outputBatch(0, 3, 16)
+	o.Write(batch)
+	if err := o.Close([]string{metadataPrefix + "deleted=3"}); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), metadataPrefix) {
+		t.Errorf("CSV output has metadata lines:\n%s", data)
+	}
+	meta, err := ioutil.ReadFile(path + metadataFileSuffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{`"bucket": "bucket"`, `"prefix": [`, `"deleted": "3"`} {
+		if !strings.Contains(string(meta), want) {
+			t.Errorf("metadata file lacks %s:\n%s", want, meta)
+		}
+	}
+
+	keys, err := ReadDeletedKeys(path, mockBucket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != len(batch) {
+		t.Errorf("read %d deleted keys, want %d", len(keys), len(batch))
+	}
+	for _, object := range batch {
+		if !keys[aws.StringValue(object.Key)] {
+			t.Errorf("%s isn't read as deleted", aws.StringValue(object.Key))
+		}
+	}
+	if _, err := ReadDeletedKeys(path, "other"); err == nil {
+		t.Error("the output of a run on another bucket was read")
+	}
+}
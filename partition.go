@@ -0,0 +1,234 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ThrottleCooldown is the minimum time between two shrinks of a partition.
+const ThrottleCooldown = time.Second
+
+// PartitionPool runs the tasks of each partition, usually a prefix, on a
+// Pool of its own. Throttling shrinks only the pool of the partition that
+// was throttled, while a shared limit caps the number of tasks executing at
+// once across all partitions.
+type PartitionPool struct {
+	mu         sync.Mutex
+	size       int
+	queueSize  int
+	limit      chan struct{}
+	errors     chan error
+	partitions map[string]*partition
+	order      []string
+	pending    sync.WaitGroup
+	throttles  int64
+	paused     bool
+}
+
+type partition struct {
+	pool      *Pool
+	deleted   int64
+	started   time.Time
+	throttled time.Time
+}
+
+// PartitionRate is the progress of a single partition.
+type PartitionRate struct {
+	Name    string
+	Workers int
+	Rate    int64
+}
+
+func NewPartitionPool(size int, queueSize int) *PartitionPool {
+	return &PartitionPool{
+		size:       size,
+		queueSize:  queueSize,
+		limit:      make(chan struct{}, size),
+		errors:     make(chan error, 10),
+		partitions: make(map[string]*partition),
+	}
+}
+
+// get returns the partition with the given name, creating it and its pool
+// on first use.
+func (pp *PartitionPool) get(name string) *partition {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	p, ok := pp.partitions[name]
+	if !ok {
+		size := pp.size
+		if pp.paused {
+			size = 0
+		}
+		p = &partition{
+			pool:    newPool(size, pp.queueSize, pp.errors, pp.limit),
+			started: time.Now(),
+		}
+		pp.partitions[name] = p
+		pp.order = append(pp.order, name)
+	}
+	return p
+}
+
+func (pp *PartitionPool) all() []*partition {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	partitions := make([]*partition, 0, len(pp.order))
+	for _, name := range pp.order {
+		partitions = append(partitions, pp.partitions[name])
+	}
+	return partitions
+}
+
+func (pp *PartitionPool) Exec(name string, task Task) {
+	pp.pending.Add(1)
+	pp.get(name).pool.Exec(&pendingTask{task: task, pending: &pp.pending})
+}
+
+// WaitIdle blocks until every task executed so far has completed, without
+// closing the pool.
+func (pp *PartitionPool) WaitIdle() {
+	pp.pending.Wait()
+}
+
+// pendingTask marks a task as done once it has executed.
+type pendingTask struct {
+	task    Task
+	pending *sync.WaitGroup
+}
+
+func (t *pendingTask) Execute() error {
+	defer t.pending.Done()
+	return t.task.Execute()
+}
+
+// Throttle removes a worker from the partition's pool, unless it was
+// already shrunk within the ThrottleCooldown or has a single worker left.
+func (pp *PartitionPool) Throttle(name string) {
+	atomic.AddInt64(&pp.throttles, 1)
+	p := pp.get(name)
+	pp.mu.Lock()
+	if time.Since(p.throttled) < ThrottleCooldown {
+		pp.mu.Unlock()
+		return
+	}
+	p.throttled = time.Now()
+	pp.mu.Unlock()
+
+	if size := p.pool.Workers(); size > 1 {
+		p.pool.Resize(size - 1)
+	}
+}
+
+// Pause stops the workers of every partition once their task is done, until
+// Resume is called. Tasks stay queued meanwhile.
+func (pp *PartitionPool) Pause() {
+	pp.mu.Lock()
+	pp.paused = true
+	pp.mu.Unlock()
+	for _, p := range pp.all() {
+		p.pool.Resize(0)
+	}
+}
+
+// Resume restarts the workers of every partition, at the full size of the
+// pool, which also scales back up the partitions that were throttled.
+func (pp *PartitionPool) Resume() {
+	pp.mu.Lock()
+	pp.paused = false
+	pp.mu.Unlock()
+	for _, p := range pp.all() {
+		p.pool.Resize(pp.size)
+	}
+}
+
+// Paused reports whether the pool is paused.
+func (pp *PartitionPool) Paused() bool {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	return pp.paused
+}
+
+// Throttles returns the number of times S3 asked to slow down.
+func (pp *PartitionPool) Throttles() int64 {
+	return atomic.LoadInt64(&pp.throttles)
+}
+
+// Deleted records the number of objects deleted in a partition.
+func (pp *PartitionPool) Deleted(name string, count int) {
+	atomic.AddInt64(&pp.get(name).deleted, int64(count))
+}
+
+// Workers returns the number of workers able to execute tasks, which is
+// bounded by the shared limit.
+func (pp *PartitionPool) Workers() int {
+	partitions := pp.all()
+	workers := 0
+	for _, p := range partitions {
+		workers += p.pool.Workers()
+	}
+	if workers > pp.size || len(partitions) == 0 {
+		return pp.size
+	}
+	return workers
+}
+
+// Queued returns the number of tasks waiting across all partitions.
+func (pp *PartitionPool) Queued() int {
+	queued := 0
+	for _, p := range pp.all() {
+		queued += p.pool.Queued()
+	}
+	return queued
+}
+
+// Executing returns the number of tasks executing across all partitions.
+func (pp *PartitionPool) Executing() int64 {
+	var executing int64
+	for _, p := range pp.all() {
+		executing += p.pool.Executing()
+	}
+	return executing
+}
+
+// QueueSize returns the task queue capacity of a single partition.
+func (pp *PartitionPool) QueueSize() int {
+	return pp.queueSize
+}
+
+// Rates returns the progress of partitions with queued or executing tasks.
+func (pp *PartitionPool) Rates() []PartitionRate {
+	pp.mu.Lock()
+	names := append([]string(nil), pp.order...)
+	pp.mu.Unlock()
+
+	var rates []PartitionRate
+	for _, name := range names {
+		p := pp.get(name)
+		if !p.pool.Active() {
+			continue
+		}
+		rate := PartitionRate{Name: name, Workers: p.pool.Workers()}
+		if seconds := int64(time.Since(p.started).Seconds()); seconds > 0 {
+			rate.Rate = atomic.LoadInt64(&p.deleted) / seconds
+		}
+		rates = append(rates, rate)
+	}
+	return rates
+}
+
+func (pp *PartitionPool) Close() {
+	for _, p := range pp.all() {
+		p.pool.Close()
+	}
+}
+
+// Wait waits for the tasks of all partitions, then closes the errors
+// channel.
+func (pp *PartitionPool) Wait() {
+	for _, p := range pp.all() {
+		p.pool.Wait()
+	}
+	close(pp.errors)
+}
@@ -2,26 +2,48 @@ package main
 
 import (
 	"sync"
+	"sync/atomic"
 )
 
 type Task interface {
 	Execute() error
 }
 
+// Pool runs tasks on a resizable number of workers. Shrinking the pool lets
+// surplus workers retire once they finish their current task; a task taken
+// from the queue is always executed.
+//
+// Resizing wakes the idle workers, so surplus ones retire right away. A
+// task taken from the queue by a worker of a pool resized to zero at the
+// same time is held back for the workers of a later resize, rather than
+// executed, so pausing takes effect at once.
 type Pool struct {
-	mu     sync.Mutex
-	Size   int
-	tasks  chan Task
-	errors chan error
-	kill   chan struct{}
-	wg     sync.WaitGroup
+	mu      sync.Mutex
+	Size    int
+	running int
+	busy    int64
+	closed  bool
+	held    []Task
+	wake    chan struct{}
+	tasks   chan Task
+	errors  chan error
+	limit   chan struct{}
+	wg      sync.WaitGroup
 }
 
-func NewPool(size int) *Pool {
+func NewPool(size int, queueSize int) *Pool {
+	return newPool(size, queueSize, make(chan error, 10), nil)
+}
+
+// newPool creates a pool reporting to the given errors channel. If limit is
+// not nil, a slot in it is held while a task executes, which caps the number
+// of tasks executing across all pools sharing it.
+func newPool(size int, queueSize int, errors chan error, limit chan struct{}) *Pool {
 	pool := &Pool{
-		errors: make(chan error, 10),
-		kill:   make(chan struct{}),
-		tasks:  make(chan Task, 128),
+		errors: errors,
+		limit:  limit,
+		wake:   make(chan struct{}),
+		tasks:  make(chan Task, queueSize),
 	}
 	pool.Resize(size)
 	return pool
@@ -30,44 +52,144 @@ func NewPool(size int) *Pool {
 func (p *Pool) worker() {
 	defer p.wg.Done()
 	for {
-		select {
-		case task, ok := <-p.tasks:
-			if !ok {
-				return
-			}
-			err := task.Execute()
-			if err != nil {
-				p.errors <- err
-			}
-		case <-p.kill:
+		task, wake, ok := p.next()
+		if !ok {
 			return
 		}
+		if task == nil {
+			select {
+			case task, ok = <-p.tasks:
+				if !ok {
+					p.mu.Lock()
+					p.running--
+					p.mu.Unlock()
+					return
+				}
+				if p.hold(task) {
+					return
+				}
+			case <-wake:
+				continue
+			}
+		}
+		p.run(task)
+	}
+}
+
+// next returns the oldest task held back, if any, and the channel closed on
+// the next resize. It reports false if the calling worker should exit
+// because the pool has more workers than its size.
+func (p *Pool) next() (Task, chan struct{}, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.running > p.Size {
+		p.running--
+		return nil, nil, false
+	}
+	if len(p.held) == 0 {
+		return nil, p.wake, true
+	}
+	task := p.held[0]
+	p.held = p.held[1:]
+	return task, p.wake, true
+}
+
+// hold holds back a task taken from the queue if the pool was resized to
+// zero meanwhile, and reports whether it did, in which case the calling
+// worker exits.
+func (p *Pool) hold(task Task) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.Size > 0 {
+		return false
+	}
+	p.running--
+	p.held = append(p.held, task)
+	return true
+}
+
+func (p *Pool) run(task Task) {
+	atomic.AddInt64(&p.busy, 1)
+	defer atomic.AddInt64(&p.busy, -1)
+	if p.limit != nil {
+		p.limit <- struct{}{}
+		defer func() { <-p.limit }()
+	}
+	err := task.Execute()
+	if err != nil {
+		p.errors <- err
 	}
 }
 
+// Resize sets the number of workers. A size of zero pauses the pool until
+// it is resized again; Wait still executes all queued tasks.
 func (p *Pool) Resize(size int) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
-	for p.Size < size {
-		p.Size++
+	p.Size = size
+	close(p.wake)
+	p.wake = make(chan struct{})
+	// no new workers once closed, Wait drains whatever is left
+	if p.closed {
+		return
+	}
+	for p.running < p.Size {
+		p.running++
 		p.wg.Add(1)
 		go p.worker()
 	}
-	for p.Size > size {
-		p.Size--
-		p.kill <- struct{}{}
-	}
+}
+
+// Workers returns the current size of the pool.
+func (p *Pool) Workers() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.Size
+}
+
+// Executing returns the number of tasks executing.
+func (p *Pool) Executing() int64 {
+	return atomic.LoadInt64(&p.busy)
+}
+
+// Active reports whether the pool has queued or executing tasks.
+func (p *Pool) Active() bool {
+	return p.Queued() > 0 || atomic.LoadInt64(&p.busy) > 0
 }
 
 func (p *Pool) Exec(task Task) {
 	p.tasks <- task
 }
 
+// Queued returns the number of tasks waiting for a worker.
+func (p *Pool) Queued() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.tasks) + len(p.held)
+}
+
+// QueueSize returns the capacity of the task queue.
+func (p *Pool) QueueSize() int {
+	return cap(p.tasks)
+}
+
 func (p *Pool) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
 	close(p.tasks)
 }
 
+// Wait blocks until every queued task has been executed. Tasks that are
+// still queued after all workers retired are executed by the caller.
 func (p *Pool) Wait() {
 	p.wg.Wait()
+	for _, task := range p.held {
+		p.run(task)
+	}
+	p.held = nil
+	for task := range p.tasks {
+		p.run(task)
+	}
 }
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countTask counts its executions.
+type countTask struct {
+	executed *int32
+	delay    time.Duration
+}
+
+func (t countTask) Execute() error {
+	time.Sleep(t.delay)
+	atomic.AddInt32(t.executed, 1)
+	return nil
+}
+
+func TestPoolExecutesEveryTaskWhileResized(t *testing.T) {
+	tests := []struct {
+		name  string
+		sizes []int
+	}{
+		{"down to zero", []int{0}},
+		{"down to one", []int{1}},
+		{"between zero and one", []int{0, 1}},
+		{"between zero and many", []int{0, 1, 8}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			const tasks = 2000
+			p := NewPool(4, tasks)
+			executed := make([]int32, tasks)
+
+			stop := make(chan struct{})
+			var resizes sync.WaitGroup
+			resizes.Add(1)
+			go func() {
+				defer resizes.Done()
+				r := rand.New(rand.NewSource(1))
+				for {
+					select {
+					case <-stop:
+						return
+					default:
+					}
+					p.Resize(tt.sizes[r.Intn(len(tt.sizes))])
+					time.Sleep(time.Duration(r.Intn(100)) * time.Microsecond)
+				}
+			}()
+
+			for i := 0; i < tasks; i++ {
+				p.Exec(countTask{executed: &executed[i], delay: time.Duration(i%3) * time.Microsecond})
+				if i%100 == 0 {
+					time.Sleep(time.Millisecond)
+				}
+			}
+			close(stop)
+			resizes.Wait()
+			p.Resize(tt.sizes[len(tt.sizes)-1])
+			p.Close()
+			p.Wait()
+
+			for i := range executed {
+				if n := atomic.LoadInt32(&executed[i]); n != 1 {
+					t.Errorf("task %d executed %d times", i, n)
+				}
+			}
+		})
+	}
+}
+
+func TestPoolResizedToZeroStopsAtOnce(t *testing.T) {
+	p := NewPool(4, 16)
+	var executed int32
+
+	// let the workers block waiting for tasks
+	time.Sleep(10 * time.Millisecond)
+	p.Resize(0)
+	for i := 0; i < 8; i++ {
+		p.Exec(countTask{executed: &executed})
+	}
+	time.Sleep(10 * time.Millisecond)
+	if n := atomic.LoadInt32(&executed); n != 0 {
+		t.Fatalf("%d tasks executed by a pool resized to zero", n)
+	}
+	if queued := p.Queued(); queued != 8 {
+		t.Errorf("got %d tasks queued, want 8", queued)
+	}
+
+	p.Resize(2)
+	deadline := time.Now().Add(time.Second)
+	for p.Active() && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if n := atomic.LoadInt32(&executed); n != 8 {
+		t.Errorf("%d tasks executed once resized again, want 8", n)
+	}
+	p.Close()
+	p.Wait()
+}
+
+func TestPoolRunsHeldTasks(t *testing.T) {
+	tests := []struct {
+		name   string
+		resume func(p *Pool)
+	}{
+		{"resized again", func(p *Pool) {
+			p.Resize(1)
+			deadline := time.Now().Add(time.Second)
+			for p.Active() && time.Now().Before(deadline) {
+				time.Sleep(time.Millisecond)
+			}
+		}},
+		{"waited for", func(p *Pool) {
+			p.Close()
+			p.Wait()
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewPool(0, 1)
+			var executed int32
+
+			// a worker took the task from the queue as the pool was resized
+			// to zero
+			p.mu.Lock()
+			p.running++
+			p.mu.Unlock()
+			if !p.hold(countTask{executed: &executed}) {
+				t.Fatal("task not held by a pool resized to zero")
+			}
+			if queued := p.Queued(); queued != 1 {
+				t.Fatalf("got %d tasks queued, want the held one", queued)
+			}
+
+			tt.resume(p)
+			if n := atomic.LoadInt32(&executed); n != 1 {
+				t.Errorf("held task executed %d times", n)
+			}
+		})
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// DefaultMinPrefixLen refuses the empty prefix, which is the whole bucket.
+const DefaultMinPrefixLen int = 1
+
+// ReadPrefixFile reads a list of prefixes, one per line. Blank lines are
+// skipped, as an empty prefix would be the whole bucket.
+func ReadPrefixFile(file string) ([]string, error) {
+	fd, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	var prefixes []string
+	scanner := bufio.NewScanner(fd)
+	for scanner.Scan() {
+		prefix := strings.TrimSuffix(scanner.Text(), "\r")
+		if strings.TrimSpace(prefix) == "" {
+			continue
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %s", file, err)
+	}
+	if len(prefixes) == 0 {
+		return nil, fmt.Errorf("%s: no prefixes in file", file)
+	}
+	return prefixes, nil
+}
+
+// NormalizePrefix fixes the common mistakes of passing a prefix as a path or
+// a glob. S3 keys rarely start with a slash, so a single leading slash is
+// removed, and a trailing "*" is removed as every prefix already matches
+// everything under it. Wildcards anywhere else can't be honored by a
+// prefix listing and are rejected.
+func NormalizePrefix(prefix string) (string, error) {
+	if strings.HasPrefix(prefix, "/") && !strings.HasPrefix(prefix, "//") {
+		fmt.Fprintf(os.Stderr, "warning: removing the leading slash of prefix %q\n", prefix)
+		prefix = prefix[1:]
+	}
+	if strings.HasSuffix(prefix, "*") && !strings.HasSuffix(prefix, "**") {
+		fmt.Fprintf(os.Stderr, "warning: removing the trailing * of prefix %q, prefixes always match everything under them\n", prefix)
+		prefix = prefix[:len(prefix)-1]
+	}
+	if strings.Contains(prefix, "*") {
+		return "", fmt.Errorf("prefix %q contains a wildcard, but prefixes are matched literally; list the keys to delete in a -file instead", prefix)
+	}
+	return prefix, nil
+}
+
+// ParseS3Prefix splits an s3://bucket/prefix URI. The prefix may be empty.
+func ParseS3Prefix(uri string) (string, string, error) {
+	if !strings.HasPrefix(uri, "s3://") {
+		return "", "", fmt.Errorf("%s is not an s3:// URI", uri)
+	}
+	parts := strings.SplitN(strings.TrimPrefix(uri, "s3://"), "/", 2)
+	if parts[0] == "" {
+		return "", "", fmt.Errorf("%s is not an s3://bucket/prefix URI", uri)
+	}
+	if len(parts) == 1 {
+		return parts[0], "", nil
+	}
+	return parts[0], parts[1], nil
+}
+
+// DedupePrefixes removes the prefixes that are repeated or under another
+// prefix, whose keys would otherwise be listed and deleted twice.
+func DedupePrefixes(prefixes []string) []string {
+	var kept []string
+	for i, prefix := range prefixes {
+		covered := false
+		for j, other := range prefixes {
+			// of two equal prefixes, the first is kept
+			if i != j && strings.HasPrefix(prefix, other) && (prefix != other || j < i) {
+				fmt.Fprintf(os.Stderr, "warning: ignoring prefix %q, it is under prefix %q\n", prefix, other)
+				covered = true
+				break
+			}
+		}
+		if !covered {
+			kept = append(kept, prefix)
+		}
+	}
+	return kept
+}
+
+// CheckPrefixScope returns an error if any of the prefixes is empty or
+// shorter than minLen, as a short prefix can match a large part of the
+// bucket.
+func CheckPrefixScope(prefixes []string, minLen int) error {
+	for _, prefix := range prefixes {
+		if prefix == "" || len(prefix) < minLen {
+			scope := fmt.Sprintf("prefix %q is shorter than %d characters", prefix, minLen)
+			if prefix == "" {
+				scope = "an empty prefix is the whole bucket"
+			}
+			return fmt.Errorf("refusing to run: %s; pass -unsafe-allow-bucket-root to run anyway", scope)
+		}
+	}
+	return nil
+}
+
+// outsidePrefixFilter spares keys that aren't under any of the prefixes.
+func outsidePrefixFilter(prefixes []string) Filter {
+	return FilterFunc(func(object *s3.ObjectIdentifier) bool {
+		return !underPrefixes(aws.StringValue(object.Key), prefixes)
+	})
+}
+
+// keyRangeFilter spares keys up to startAfter, included, and after stopAt.
+// Either bound may be empty.
+func keyRangeFilter(startAfter string, stopAt string) Filter {
+	return FilterFunc(func(object *s3.ObjectIdentifier) bool {
+		key := aws.StringValue(object.Key)
+		return key <= startAfter || (stopAt != "" && key > stopAt)
+	})
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func TestCheckPrefixScope(t *testing.T) {
+	tests := []struct {
+		name     string
+		prefixes []string
+		minLen   int
+		// refused is part of the error, empty if the run is allowed
+		refused string
+	}{
+		{
+			name:     "empty prefix",
+			prefixes: []string{""},
+			minLen:   DefaultMinPrefixLen,
+			refused:  "an empty prefix is the whole bucket",
+		},
+		{
+			name:     "leading slash only",
+			prefixes: []string{"/"},
+			minLen:   DefaultMinPrefixLen,
+			refused:  "an empty prefix is the whole bucket",
+		},
+		{
+			name:     "empty prefix without a minimum length",
+			prefixes: []string{""},
+			minLen:   0,
+			refused:  "an empty prefix is the whole bucket",
+		},
+		{
+			name:     "shorter than the minimum",
+			prefixes: []string{"lo"},
+			minLen:   3,
+			refused:  `prefix "lo" is shorter than 3 characters`,
+		},
+		{
+			name:     "as long as the minimum",
+			prefixes: []string{"log"},
+			minLen:   3,
+		},
+		{
+			name:     "one short prefix among several",
+			prefixes: []string{"logs/2024/", "l", "tmp/"},
+			minLen:   3,
+			refused:  `prefix "l" is shorter than 3 characters`,
+		},
+		{
+			name:     "empty prefix among several",
+			prefixes: []string{"logs/", "", "tmp/"},
+			minLen:   1,
+			refused:  "an empty prefix is the whole bucket",
+		},
+		{
+			name:     "short prefix covering longer ones",
+			prefixes: []string{"logs/2024/", "lo", "logs/2023/"},
+			minLen:   3,
+			refused:  `prefix "lo" is shorter than 3 characters`,
+		},
+		{
+			name:     "several long prefixes",
+			prefixes: []string{"logs/2024/", "logs/2023/", "tmp/"},
+			minLen:   3,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// the guard applies to the prefixes as the run lists them
+			prefixes := make([]string, len(tt.prefixes))
+			for i, prefix := range tt.prefixes {
+				var err error
+				if prefixes[i], err = NormalizePrefix(prefix); err != nil {
+					t.Fatal(err)
+				}
+			}
+			err := CheckPrefixScope(DedupePrefixes(prefixes), tt.minLen)
+			switch {
+			case tt.refused == "" && err != nil:
+				t.Errorf("refused: %s", err)
+			case tt.refused != "" && err == nil:
+				t.Errorf("allowed, want refused as %q", tt.refused)
+			case err != nil && !strings.Contains(err.Error(), tt.refused):
+				t.Errorf("got %q, want it to say %q", err, tt.refused)
+			case err != nil && !strings.Contains(err.Error(), "-unsafe-allow-bucket-root"):
+				t.Errorf("got %q, want it to mention -unsafe-allow-bucket-root", err)
+			}
+		})
+	}
+}
+
+func TestOutsidePrefixFilterRejectsFileKeys(t *testing.T) {
+	tests := []struct {
+		name     string
+		prefixes []string
+		keys     []string
+		kept     []string
+	}{
+		{
+			name:     "all under the prefix",
+			prefixes: []string{"logs/"},
+			keys:     []string{"logs/a", "logs/b/c"},
+			kept:     []string{"logs/a", "logs/b/c"},
+		},
+		{
+			name:     "some outside the prefix",
+			prefixes: []string{"logs/"},
+			keys:     []string{"logs/a", "log", "data/logs/b", "logs/c"},
+			kept:     []string{"logs/a", "logs/c"},
+		},
+		{
+			name:     "under any of several prefixes",
+			prefixes: []string{"logs/", "tmp/"},
+			keys:     []string{"logs/a", "tmp/b", "data/c"},
+			kept:     []string{"logs/a", "tmp/b"},
+		},
+		{
+			name:     "none under the prefix",
+			prefixes: []string{"logs/"},
+			keys:     []string{"a", "b"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chain := &FilterChain{}
+			chain.Add("outside-prefix", outsidePrefixFilter(tt.prefixes))
+			var objects []*s3.ObjectIdentifier
+			for _, key := range tt.keys {
+				objects = append(objects, &s3.ObjectIdentifier{Key: aws.String(key)})
+			}
+			var kept []string
+			for _, object := range chain.Apply(objects, nil) {
+				kept = append(kept, aws.StringValue(object.Key))
+			}
+			if strings.Join(kept, ",") != strings.Join(tt.kept, ",") {
+				t.Errorf("kept %q, want %q", kept, tt.kept)
+			}
+			// the rejected keys are reported in the summary
+			if rejected := int(chain.Spared()); rejected != len(tt.keys)-len(tt.kept) {
+				t.Errorf("reported %d keys rejected, want %d", rejected, len(tt.keys)-len(tt.kept))
+			}
+		})
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// PreviewKey is a key picked by the preview sample, with its size and last
+// modification time when it was listed.
+type PreviewKey struct {
+	Key          string     `json:"key"`
+	Size         *int64     `json:"size,omitempty"`
+	LastModified *time.Time `json:"last_modified,omitempty"`
+}
+
+// Preview keeps a uniform random sample of the keys queued for deletion,
+// using reservoir sampling so memory use doesn't depend on the number of
+// keys.
+type Preview struct {
+	mu     sync.Mutex
+	size   int
+	seen   int64
+	sample []PreviewKey
+	rand   *rand.Rand
+}
+
+func NewPreview(size int) *Preview {
+	return &Preview{size: size, rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+}
+
+// Add offers a batch of objects to the sample.
+func (p *Preview) Add(objects []*s3.ObjectIdentifier, details map[*s3.ObjectIdentifier]*s3.Object) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, object := range objects {
+		p.seen++
+		i := len(p.sample)
+		if i >= p.size {
+			i = int(p.rand.Int63n(p.seen))
+			if i >= p.size {
+				continue
+			}
+		}
+		key := PreviewKey{Key: aws.StringValue(object.Key)}
+		if detail, ok := details[object]; ok {
+			key.Size = detail.Size
+			key.LastModified = detail.LastModified
+		}
+		if i == len(p.sample) {
+			p.sample = append(p.sample, key)
+		} else {
+			p.sample[i] = key
+		}
+	}
+}
+
+// Sample returns a copy of the current sample.
+func (p *Preview) Sample() []PreviewKey {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]PreviewKey(nil), p.sample...)
+}
+
+func (p *Preview) WriteSummary(w io.Writer) {
+	sample := p.Sample()
+	p.mu.Lock()
+	seen := p.seen
+	p.mu.Unlock()
+	fmt.Fprintf(w, "preview: %d of %d keys\n", len(sample), seen)
+	for _, key := range sample {
+		fmt.Fprintf(w, "  %s", key.Key)
+		if key.Size != nil {
+			fmt.Fprintf(w, " (%d bytes, %s old)", *key.Size, time.Since(*key.LastModified).Round(time.Second))
+		}
+		fmt.Fprintln(w)
+	}
+}
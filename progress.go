@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Run phases reported in progress snapshots. A run ends in one of the last
+// five, matching its exit code.
+const (
+	PhaseRunning     = "running"
+	PhaseDraining    = "draining"
+	PhaseRetrying    = "retrying"
+	PhaseDone        = "done"
+	PhaseFailed      = "failed"
+	PhaseAborted     = "aborted"
+	PhaseInterrupted = "interrupted"
+	PhaseBudget      = "budget_exhausted"
+)
+
+var (
+	statusMu  sync.Mutex
+	phase     = PhaseRunning
+	lastError string
+)
+
+func setPhase(p string) {
+	statusMu.Lock()
+	defer statusMu.Unlock()
+	phase = p
+}
+
+// exitPhase returns the phase a run exiting with code ends in: done only
+// when it succeeded.
+func exitPhase(code int) string {
+	switch code {
+	case ExitCodeOK:
+		return PhaseDone
+	case ExitCodeAborted:
+		return PhaseAborted
+	case ExitCodeInterrupted:
+		return PhaseInterrupted
+	case ExitCodeBudgetExhausted:
+		return PhaseBudget
+	}
+	return PhaseFailed
+}
+
+func setLastError(err error) {
+	statusMu.Lock()
+	defer statusMu.Unlock()
+	lastError = err.Error()
+}
+
+// ProgressSnapshot is the JSON document written to the -progress-file.
+type ProgressSnapshot struct {
+	Phase          string           `json:"phase"`
+	Bucket         string           `json:"bucket"`
+	Dryrun         bool             `json:"dryrun"`
+	Listed         int64            `json:"listed"`
+	EstimatedTotal int64            `json:"estimated_total,omitempty"`
+	Queued         int64            `json:"queued"`
+	Deleted        int64            `json:"deleted"`
+	Rate           int64            `json:"rate"`
+	RecentRate     int64            `json:"recent_rate"`
+	StalledSeconds int64            `json:"stalled_seconds,omitempty"`
+	Workers        int              `json:"workers"`
+	Paused         bool             `json:"paused,omitempty"`
+	QueueDepth     int              `json:"queue_depth"`
+	Requests       map[string]int64 `json:"requests"`
+	Cost           float64          `json:"cost"`
+	HighWaterMark  string           `json:"high_water_mark,omitempty"`
+	LastError      string           `json:"last_error,omitempty"`
+	Preview        []PreviewKey     `json:"preview,omitempty"`
+	AuditBundle    string           `json:"audit_bundle,omitempty"`
+	StartedAt      time.Time        `json:"started_at"`
+	UpdatedAt      time.Time        `json:"updated_at"`
+}
+
+func progressSnapshot() *ProgressSnapshot {
+	stats := Snapshot()
+	snapshot := &ProgressSnapshot{
+		Phase:          stats.Phase,
+		Bucket:         flagBucket,
+		Dryrun:         flagDryrun,
+		Listed:         stats.Listed,
+		EstimatedTotal: stats.EstimatedTotal,
+		Queued:         stats.Queued,
+		Deleted:        stats.Deleted,
+		Rate:           stats.Rate(),
+		RecentRate:     stats.RecentRate,
+		StalledSeconds: int64(stats.Stalled.Seconds()),
+		Workers:        stats.Workers,
+		Paused:         stats.Paused,
+		QueueDepth:     stats.QueueDepth,
+		Requests:       requestCounter.Counts(),
+		Cost:           requestCounter.Cost(pricing()),
+		HighWaterMark:  tracker.HighWaterMark(),
+		LastError:      stats.LastError,
+		AuditBundle:    flagAuditBundle,
+		StartedAt:      stats.StartedAt,
+		UpdatedAt:      stats.TakenAt,
+	}
+	if preview != nil {
+		snapshot.Preview = preview.Sample()
+	}
+	return snapshot
+}
+
+// writeProgressFile atomically replaces path with the current snapshot, so
+// readers never see a partially written file.
+func writeProgressFile(path string) error {
+	return writeJSONFile(path, progressSnapshot())
+}
+
+// writeJSONFile atomically replaces path with v encoded as JSON.
+func writeJSONFile(path string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
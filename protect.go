@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// ProtectedKeys are keys and prefixes that must never be deleted.
+type ProtectedKeys struct {
+	keys map[string]bool
+	// prefixes is sorted and holds no prefix of another, so the only one
+	// a key can be under is the last one sorting before it
+	prefixes []string
+}
+
+// ReadProtectFile reads keys that must never be deleted, one per line.
+// Lines ending with / or * protect every key under them, the * being
+// dropped. Empty lines and lines starting with # are skipped.
+func ReadProtectFile(path string) (*ProtectedKeys, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	p := &ProtectedKeys{keys: make(map[string]bool)}
+	var prefixes []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasSuffix(line, "*") || strings.HasSuffix(line, "/") {
+			prefixes = append(prefixes, strings.TrimSuffix(line, "*"))
+		} else {
+			p.keys[line] = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(p.keys) == 0 && len(prefixes) == 0 {
+		return nil, fmt.Errorf("%s lists no keys or prefixes", path)
+	}
+	p.addPrefixes(prefixes)
+	return p, nil
+}
+
+// ProtectedPrefixes returns the keys under any of the prefixes.
+func ProtectedPrefixes(prefixes []string) *ProtectedKeys {
+	p := &ProtectedKeys{keys: make(map[string]bool)}
+	p.addPrefixes(prefixes)
+	return p
+}
+
+// addPrefixes sorts the prefixes, leaving out those under another one.
+func (p *ProtectedKeys) addPrefixes(prefixes []string) {
+	prefixes = append([]string(nil), prefixes...)
+	sort.Strings(prefixes)
+	for _, prefix := range prefixes {
+		if n := len(p.prefixes); n > 0 && strings.HasPrefix(prefix, p.prefixes[n-1]) {
+			continue
+		}
+		p.prefixes = append(p.prefixes, prefix)
+	}
+}
+
+// Protects reports whether the key is protected.
+func (p *ProtectedKeys) Protects(key string) bool {
+	if p.keys[key] {
+		return true
+	}
+	i := sort.SearchStrings(p.prefixes, key)
+	if i < len(p.prefixes) && p.prefixes[i] == key {
+		return true
+	}
+	return i > 0 && strings.HasPrefix(key, p.prefixes[i-1])
+}
+
+// protectFilter spares the protected keys.
+func protectFilter(protected *ProtectedKeys) Filter {
+	return FilterFunc(func(object *s3.ObjectIdentifier) bool {
+		return protected.Protects(aws.StringValue(object.Key))
+	})
+}
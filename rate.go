@@ -0,0 +1,89 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultRateWindow is the period recent rates are measured over.
+	DefaultRateWindow = 10
+
+	// StallThreshold is how long tasks can execute without any delete
+	// completing before the run is reported stalled.
+	StallThreshold = 30 * time.Second
+)
+
+// RateWindow counts events in one second buckets, to measure their rate
+// over the last few seconds rather than since the start of the run.
+type RateWindow struct {
+	mu      sync.Mutex
+	counts  []int64
+	seconds []int64
+	last    time.Time
+}
+
+func NewRateWindow(seconds int) *RateWindow {
+	return &RateWindow{counts: make([]int64, seconds), seconds: make([]int64, seconds)}
+}
+
+// Add counts n events now.
+func (w *RateWindow) Add(n int64) {
+	at := time.Now()
+	now := at.Unix()
+	i := now % int64(len(w.counts))
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.last = at
+	if w.seconds[i] != now {
+		w.seconds[i] = now
+		w.counts[i] = 0
+	}
+	w.counts[i] += n
+}
+
+// Rate returns the events per second over the complete seconds of the
+// window that are not before start.
+func (w *RateWindow) Rate(start time.Time) int64 {
+	now := time.Now().Unix()
+	from := now - int64(len(w.counts))
+	if s := start.Unix(); s > from {
+		from = s
+	}
+	if from >= now {
+		return 0
+	}
+	var total int64
+	w.mu.Lock()
+	for i, second := range w.seconds {
+		if second >= from && second < now {
+			total += w.counts[i]
+		}
+	}
+	w.mu.Unlock()
+	return total / (now - from)
+}
+
+// Idle returns how long it has been since the last event, or since start if
+// there was none since.
+func (w *RateWindow) Idle(start time.Time) time.Duration {
+	w.mu.Lock()
+	last := w.last
+	w.mu.Unlock()
+	if last.Before(start) {
+		last = start
+	}
+	return time.Since(last)
+}
+
+// Stalled returns how long it has been since the last event, as long as
+// it is at least threshold and work is executing; otherwise zero.
+func (w *RateWindow) Stalled(start time.Time, executing bool, threshold time.Duration) time.Duration {
+	if !executing {
+		return 0
+	}
+	if idle := w.Idle(start); idle >= threshold {
+		return idle
+	}
+	return 0
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// watchDeletes runs the task, returning every count of deleted keys seen
+// while it ran, and the longest stall reported with the threshold.
+func watchDeletes(t *testing.T, task *DeleteTask, threshold time.Duration) (counts []int64, stalled time.Duration) {
+	t.Helper()
+	saved := recentDeletes
+	recentDeletes = NewRateWindow(DefaultRateWindow)
+	t.Cleanup(func() { recentDeletes = saved })
+
+	start := time.Now()
+	before := atomic.LoadInt64(&totalDeletedObjects)
+	done := make(chan error)
+	go func() { done <- task.execute() }()
+	seen := map[int64]bool{}
+	for {
+		if n := atomic.LoadInt64(&totalDeletedObjects) - before; !seen[n] {
+			seen[n] = true
+			counts = append(counts, n)
+		}
+		if s := recentDeletes.Stalled(start, true, threshold); s > stalled {
+			stalled = s
+		}
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n := atomic.LoadInt64(&totalDeletedObjects) - before; !seen[n] {
+				counts = append(counts, n)
+			}
+			return counts, stalled
+		case <-time.After(time.Millisecond):
+		}
+	}
+}
+
+func TestDeleteProgressGranularity(t *testing.T) {
+	const keys = 4 * SingleDeleteConcurrency
+	tests := []struct {
+		mode string
+		// perKey is set if deletes are counted as each key completes
+		perKey bool
+	}{
+		{DeleteModeBatch, false},
+		{DeleteModeSingle, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			var objects []*s3.ObjectIdentifier
+			var names []string
+			for i := 0; i < keys; i++ {
+				names = append(names, fmt.Sprintf("k/%02d", i))
+				objects = append(objects, &s3.ObjectIdentifier{Key: aws.String(names[i])})
+			}
+			m, svc := newMockS3(t, names...)
+			m.delay = 20 * time.Millisecond
+			task := &DeleteTask{client: svc, mode: tt.mode, Bucket: mockBucket, Objects: objects}
+
+			counts, _ := watchDeletes(t, task, time.Hour)
+			if last := counts[len(counts)-1]; last != keys {
+				t.Fatalf("counted %d keys as deleted, want %d", last, keys)
+			}
+			for i := 1; i < len(counts); i++ {
+				if counts[i] < counts[i-1] {
+					t.Errorf("count went back from %d to %d", counts[i-1], counts[i])
+				}
+			}
+			midway := len(counts) > 2
+			if tt.perKey && !midway {
+				t.Errorf("got counts %v, want keys counted as they are deleted", counts)
+			}
+			if !tt.perKey && midway {
+				t.Errorf("got counts %v, want the batch counted at once", counts)
+			}
+		})
+	}
+}
+
+func TestStallDetection(t *testing.T) {
+	const threshold = 60 * time.Millisecond
+	tests := []struct {
+		name  string
+		mode  string
+		keys  int
+		delay time.Duration
+		// stall is set if the task must be reported stalled
+		stall bool
+	}{
+		{
+			name:  "slow batch",
+			mode:  DeleteModeBatch,
+			keys:  SingleDeleteConcurrency,
+			delay: 3 * threshold,
+			stall: true,
+		},
+		{
+			// the whole task takes longer than the threshold, but each
+			// key completes well within it
+			name:  "keys deleted one at a time",
+			mode:  DeleteModeSingle,
+			keys:  8 * SingleDeleteConcurrency,
+			delay: threshold / 4,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var objects []*s3.ObjectIdentifier
+			var names []string
+			for i := 0; i < tt.keys; i++ {
+				names = append(names, fmt.Sprintf("k/%02d", i))
+				objects = append(objects, &s3.ObjectIdentifier{Key: aws.String(names[i])})
+			}
+			m, svc := newMockS3(t, names...)
+			m.delay = tt.delay
+			task := &DeleteTask{client: svc, mode: tt.mode, Bucket: mockBucket, Objects: objects}
+
+			start := time.Now()
+			_, stalled := watchDeletes(t, task, threshold)
+			if elapsed := time.Since(start); elapsed < threshold {
+				t.Fatalf("task took %s, want it longer than the threshold", elapsed)
+			}
+			if tt.stall && stalled == 0 {
+				t.Error("not reported stalled")
+			}
+			if !tt.stall && stalled != 0 {
+				t.Errorf("reported stalled for %s", stalled)
+			}
+		})
+	}
+}
+
+func TestStalledOnlyWhileExecuting(t *testing.T) {
+	w := NewRateWindow(DefaultRateWindow)
+	start := time.Now().Add(-time.Minute)
+	if stalled := w.Stalled(start, false, time.Second); stalled != 0 {
+		t.Errorf("idle run reported stalled for %s", stalled)
+	}
+	if stalled := w.Stalled(start, true, time.Second); stalled < time.Minute {
+		t.Errorf("reported stalled for %s, want since the start", stalled)
+	}
+	w.Add(1)
+	if stalled := w.Stalled(start, true, time.Second); stalled != 0 {
+		t.Errorf("reported stalled for %s right after a delete", stalled)
+	}
+}
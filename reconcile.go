@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Reconciliation classifies the objects left under the deleted prefixes
+// once a run is over.
+type Reconciliation struct {
+	// Created were written after the run started, and so were never listed.
+	Created int64
+	// Failed existed before the run started but are still there.
+	Failed int64
+	// Replicated are replicas written back by bucket replication after
+	// they were deleted.
+	Replicated int64
+	// Gone were listed, but had disappeared when checked again.
+	Gone int64
+	// Spared were excluded from deletion by a filter.
+	Spared int64
+}
+
+// Reconcile lists the prefixes again and classifies every object found.
+// Leftovers are checked with HeadObject for their replication status, after
+// waiting for reverify if it isn't zero, so objects that were still listed
+// but already deleted aren't counted as failures.
+func Reconcile(svc *s3.S3, bucket string, prefixes []string, since time.Time, reverify time.Duration) (*Reconciliation, error) {
+	r := &Reconciliation{}
+	var leftovers []*string
+	err := listLeftovers(svc, bucket, prefixes, func(object *s3.Object, spared bool) {
+		if spared {
+			r.Spared++
+		} else {
+			leftovers = append(leftovers, object.Key)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(leftovers) > 0 && reverify > 0 {
+		time.Sleep(reverify)
+	}
+	for _, key := range leftovers {
+		class, err := classifyLeftover(svc, bucket, &s3.ObjectIdentifier{Key: key}, since)
+		if err != nil {
+			return nil, err
+		}
+		switch class {
+		case leftoverGone:
+			r.Gone++
+		case leftoverReplicated:
+			r.Replicated++
+		case leftoverCreated:
+			r.Created++
+		default:
+			r.Failed++
+		}
+	}
+	return r, nil
+}
+
+// leftoverClass is why an object is still there once a run is over.
+type leftoverClass int
+
+const (
+	// leftoverFailed existed before the run started.
+	leftoverFailed leftoverClass = iota
+	// leftoverCreated was written after the run started.
+	leftoverCreated
+	// leftoverReplicated is a replica written back by bucket replication.
+	leftoverReplicated
+	// leftoverGone had disappeared when checked.
+	leftoverGone
+)
+
+// classifyLeftover checks an object left once the run is over with
+// HeadObject, to tell why it is still there.
+func classifyLeftover(svc *s3.S3, bucket string, object *s3.ObjectIdentifier, since time.Time) (leftoverClass, error) {
+	var head *s3.HeadObjectOutput
+	err := withCredentials(func() (err error) {
+		head, err = svc.HeadObject(&s3.HeadObjectInput{
+			Bucket:    aws.String(bucket),
+			Key:       object.Key,
+			VersionId: object.VersionId,
+		})
+		return err
+	})
+	switch {
+	case isNotFound(err):
+		return leftoverGone, nil
+	case err != nil:
+		return leftoverFailed, err
+	case aws.StringValue(head.ReplicationStatus) == s3.ReplicationStatusReplica:
+		return leftoverReplicated, nil
+	case aws.TimeValue(head.LastModified).After(since):
+		return leftoverCreated, nil
+	}
+	return leftoverFailed, nil
+}
+
+// listLeftovers lists the prefixes again once the run is over, calling fn
+// with every object found and whether a filter spares it. Pages are listed
+// through withCredentials, so expired credentials are renewed like during
+// the run.
+func listLeftovers(svc *s3.S3, bucket string, prefixes []string, fn func(object *s3.Object, spared bool)) error {
+	for _, prefix := range prefixes {
+		params := &s3.ListObjectsV2Input{
+			Bucket: aws.String(bucket),
+			Prefix: aws.String(prefix),
+		}
+		if fetchOwner {
+			params.FetchOwner = aws.Bool(true)
+		}
+		for {
+			var resp *s3.ListObjectsV2Output
+			err := withCredentials(func() (err error) {
+				resp, err = svc.ListObjectsV2(params)
+				return err
+			})
+			if err != nil {
+				return err
+			}
+			for _, object := range resp.Contents {
+				fn(object, filters.Spares(&s3.ObjectIdentifier{Key: object.Key}, object))
+			}
+			if !aws.BoolValue(resp.IsTruncated) || resp.NextContinuationToken == nil {
+				break
+			}
+			params.ContinuationToken = resp.NextContinuationToken
+		}
+	}
+	return nil
+}
+
+// replicaHint explains leftovers replicated back.
+const replicaHint = "  replicas are written back by replication from the source bucket: delete them at the source, or enable delete marker replication"
+
+func (r *Reconciliation) WriteSummary(w io.Writer) {
+	fmt.Fprintf(w, "reconcile: %d objects left (%d created during the run, %d failed to delete, %d replicated back, %d spared)",
+		r.Created+r.Failed+r.Replicated+r.Spared, r.Created, r.Failed, r.Replicated, r.Spared)
+	if r.Gone > 0 {
+		fmt.Fprintf(w, ", %d more gone when checked", r.Gone)
+	}
+	fmt.Fprintln(w)
+	if r.Replicated > 0 {
+		fmt.Fprintln(w, replicaHint)
+	}
+}
+
+// isNotFound reports whether a HeadObject request found no object.
+func isNotFound(err error) bool {
+	if reqerr, ok := err.(awserr.RequestFailure); ok {
+		return reqerr.StatusCode() == http.StatusNotFound
+	}
+	return false
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func TestReconcileClassifiesLeftovers(t *testing.T) {
+	since := time.Now().Add(-time.Minute)
+	before, after := since.Add(-time.Hour), since.Add(time.Second)
+	tests := []struct {
+		name    string
+		objects map[string]*mockObject
+		gone    []string
+		want    Reconciliation
+	}{
+		{
+			name: "nothing left",
+		},
+		{
+			name: "delete failed",
+			objects: map[string]*mockObject{
+				"p/a": {lastModified: before},
+				"p/b": {lastModified: before},
+			},
+			want: Reconciliation{Failed: 2},
+		},
+		{
+			name: "created during the run",
+			objects: map[string]*mockObject{
+				"p/a": {lastModified: after},
+			},
+			want: Reconciliation{Created: 1},
+		},
+		{
+			name: "replicated back",
+			objects: map[string]*mockObject{
+				"p/a": {lastModified: after, replication: s3.ReplicationStatusReplica},
+				"p/b": {lastModified: before, replication: s3.ReplicationStatusReplica},
+			},
+			want: Reconciliation{Replicated: 2},
+		},
+		{
+			name: "replication source isn't a replica",
+			objects: map[string]*mockObject{
+				"p/a": {lastModified: before, replication: s3.ReplicationStatusCompleted},
+			},
+			want: Reconciliation{Failed: 1},
+		},
+		{
+			name: "gone when checked",
+			objects: map[string]*mockObject{
+				"p/a": {lastModified: before},
+				"p/b": {lastModified: before},
+			},
+			gone: []string{"p/b"},
+			want: Reconciliation{Failed: 1, Gone: 1},
+		},
+		{
+			name: "mixed",
+			objects: map[string]*mockObject{
+				"p/a": {lastModified: before},
+				"p/b": {lastModified: after},
+				"p/c": {lastModified: after, replication: s3.ReplicationStatusReplica},
+				"p/d": {lastModified: before},
+				"q/e": {lastModified: before},
+			},
+			gone: []string{"p/d"},
+			want: Reconciliation{Failed: 1, Created: 1, Replicated: 1, Gone: 1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, svc := newMockS3(t)
+			for key, object := range tt.objects {
+				m.put(key, object)
+			}
+			m.gone = make(map[string]bool)
+			for _, key := range tt.gone {
+				m.gone[key] = true
+			}
+			r, err := Reconcile(svc, mockBucket, []string{"p/"}, since, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *r != tt.want {
+				t.Errorf("got %+v, want %+v", *r, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"sync/atomic"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+
+	// registers the pure Go "sqlite" database/sql driver
+	_ "modernc.org/sqlite"
+)
+
+// CSVScanner reads keys from a column of a CSV file with a header row, or
+// from the first column if none is named. The file is opened like any key
+// file, so it may be compressed, in S3 or stdin.
+type CSVScanner struct {
+	Column  string
+	file    *FileScanner
+	reader  *csv.Reader
+	read    *countingReader
+	index   int
+	buf     []*s3.ObjectIdentifier
+	err     error
+	emitted int64
+	done    int32
+}
+
+func NewCSVScanner(file *FileScanner, column string) (*CSVScanner, error) {
+	read := &countingReader{r: file.reader}
+	reader := csv.NewReader(read)
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", file.name, err)
+	}
+	for i, name := range header {
+		if column == "" || name == column {
+			return &CSVScanner{Column: column, file: file, reader: reader, read: read, index: i}, nil
+		}
+	}
+	return nil, fmt.Errorf("%s: no %s column in the header", file.name, column)
+}
+
+func (s *CSVScanner) Scan(count int) bool {
+	s.buf = nil
+	for s.err == nil && len(s.buf) < count {
+		record, err := s.reader.Read()
+		if err == io.EOF {
+			atomic.StoreInt32(&s.done, 1)
+			break
+		}
+		if err != nil {
+			s.err = fmt.Errorf("%s: %s", s.file.name, err)
+			break
+		}
+		if s.index < len(record) && record[s.index] != "" {
+			s.buf = append(s.buf, &s3.ObjectIdentifier{Key: aws.String(record[s.index])})
+		}
+	}
+	if len(s.buf) == 0 {
+		return false
+	}
+	atomic.AddInt64(&s.emitted, int64(len(s.buf)))
+	return true
+}
+
+func (s *CSVScanner) Err() error {
+	return s.err
+}
+
+func (s *CSVScanner) Objects() []*s3.ObjectIdentifier {
+	return s.buf
+}
+
+func (s *CSVScanner) EmittedKeys() int64 {
+	return atomic.LoadInt64(&s.emitted)
+}
+
+// EstimatedTotal extrapolates the number of rows in the file from the
+// average row length seen so far.
+func (s *CSVScanner) EstimatedTotal() (int64, bool) {
+	emitted := atomic.LoadInt64(&s.emitted)
+	if atomic.LoadInt32(&s.done) == 1 {
+		return emitted, true
+	}
+	read := s.read.Count()
+	if s.file.compressed != nil {
+		read = s.file.compressed.Count()
+	}
+	if emitted == 0 || read == 0 || s.file.size == 0 {
+		return 0, false
+	}
+	return emitted * s.file.size / read, true
+}
+
+// SQLiteScanner reads keys from a column of the rows a query returns from a
+// SQLite database.
+type SQLiteScanner struct {
+	db      *sql.DB
+	rows    *sql.Rows
+	index   int
+	values  []interface{}
+	buf     []*s3.ObjectIdentifier
+	err     error
+	emitted int64
+}
+
+// NewSQLiteScanner runs the query on the database file. Keys are read from
+// the named column of the result, or from the first one if column is empty.
+func NewSQLiteScanner(file string, query string, column string) (*SQLiteScanner, error) {
+	db, err := sql.Open("sqlite", "file:"+file+"?mode=ro")
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", file, err)
+	}
+	rows, err := db.Query(query)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("%s: %s", file, err)
+	}
+	columns, err := rows.Columns()
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("%s: %s", file, err)
+	}
+	s := &SQLiteScanner{db: db, rows: rows, index: -1, values: make([]interface{}, len(columns))}
+	for i, name := range columns {
+		if s.index < 0 && (column == "" || name == column) {
+			s.index = i
+		}
+		s.values[i] = new(sql.NullString)
+	}
+	if s.index < 0 {
+		db.Close()
+		return nil, fmt.Errorf("%s: the query returns no %s column", file, column)
+	}
+	return s, nil
+}
+
+func (s *SQLiteScanner) Scan(count int) bool {
+	s.buf = nil
+	for s.rows != nil && len(s.buf) < count {
+		if !s.rows.Next() {
+			s.err = s.rows.Err()
+			s.rows.Close()
+			s.db.Close()
+			s.rows = nil
+			break
+		}
+		if err := s.rows.Scan(s.values...); err != nil {
+			s.err = err
+			return false
+		}
+		if key := s.values[s.index].(*sql.NullString); key.Valid && key.String != "" {
+			s.buf = append(s.buf, &s3.ObjectIdentifier{Key: aws.String(key.String)})
+		}
+	}
+	if len(s.buf) == 0 {
+		return false
+	}
+	atomic.AddInt64(&s.emitted, int64(len(s.buf)))
+	return true
+}
+
+func (s *SQLiteScanner) Err() error {
+	return s.err
+}
+
+func (s *SQLiteScanner) Objects() []*s3.ObjectIdentifier {
+	return s.buf
+}
+
+func (s *SQLiteScanner) EmittedKeys() int64 {
+	return atomic.LoadInt64(&s.emitted)
+}
+
+// EstimatedTotal is unknown, counting the rows would run the query twice.
+func (s *SQLiteScanner) EstimatedTotal() (int64, bool) {
+	return 0, false
+}
+
+func init() {
+	RegisterSource(&Source{
+		Name:     "sqlite",
+		KeyList:  true,
+		Selected: func(*SourceEnv) bool { return flagSQLite != "" },
+		New: func(env *SourceEnv) (Scanner, error) {
+			if flagSQLite == "" || flagSQLiteQuery == "" {
+				return nil, UsageError("Please provide both a SQLite database and a query")
+			}
+			return NewSQLiteScanner(flagSQLite, flagSQLiteQuery, flagColumn)
+		},
+	})
+}
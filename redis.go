@@ -0,0 +1,344 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// DefaultRedisGroup is the consumer group streams are read as.
+	DefaultRedisGroup = "s3rm"
+
+	// DefaultRedisField is the stream entry field holding the key.
+	DefaultRedisField = "key"
+
+	// redisBlock is the longest a stream read waits for new entries, so a
+	// stopped scanner doesn't wait long.
+	redisBlock = 5 * time.Second
+)
+
+var (
+	flagRedisURL   string
+	flagRedisKey   string
+	flagRedisGroup string
+	flagRedisField string
+	flagRedisIdle  time.Duration
+)
+
+// RedisScanner reads keys from a Redis set or stream, such as the soft
+// delete queue of an application, and removes them from Redis only once
+// they were deleted or spared by a filter. Set members are keys, and are
+// read with SSCAN until the whole set was read. Stream entries hold a key
+// in Field, and are read as a member of a consumer group until the stream
+// stays empty for Idle, or the run is stopped; done entries are
+// acknowledged and removed from the stream. Keys that failed to delete stay
+// in the set, or pending in the group. The consumer is named after the host,
+// and starts with the entries left pending by its previous runs.
+type RedisScanner struct {
+	Key   string
+	Group string
+	Field string
+	// Idle stops reading a stream once it had no new entries for this
+	// long. When zero, the stream is read until the run is stopped.
+	Idle     time.Duration
+	client   *redis.Client
+	stream   bool
+	consumer string
+	// history is the ID after which entries pending from previous runs are
+	// read, until there are none left
+	history  string
+	cursor   uint64
+	started  bool
+	ctx      context.Context
+	stop     context.CancelFunc
+	buf      []*s3.ObjectIdentifier
+	err      error
+	emitted  int64
+	ignored  int64
+	removed  int64
+	lastSeen time.Time
+	size     int64
+
+	mu sync.Mutex
+	// pending maps each key to the members or entry IDs waiting for it to
+	// be deleted
+	pending map[string][]string
+}
+
+// NewRedisScanner connects to the Redis server of a redis:// URL, and finds
+// whether key is a set or a stream.
+func NewRedisScanner(url string, key string, group string, field string) (*RedisScanner, error) {
+	options, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, err
+	}
+	ctx, stop := context.WithCancel(context.Background())
+	s := &RedisScanner{
+		Key:      key,
+		Group:    group,
+		Field:    field,
+		client:   redis.NewClient(options),
+		ctx:      ctx,
+		stop:     stop,
+		consumer: "s3rm",
+		history:  "0",
+		lastSeen: time.Now(),
+		pending:  make(map[string][]string),
+	}
+	if hostname, err := os.Hostname(); err == nil {
+		s.consumer = "s3rm-" + hostname
+	}
+
+	kind, err := s.client.Type(ctx, key).Result()
+	if err != nil {
+		return nil, fmt.Errorf("redis: %s", err)
+	}
+	switch kind {
+	case "set":
+		s.size, err = s.client.SCard(ctx, key).Result()
+	case "stream":
+		s.stream = true
+		s.size, err = s.client.XLen(ctx, key).Result()
+		if err == nil {
+			// a group created now reads the stream from its start
+			err = s.client.XGroupCreate(ctx, key, group, "0").Err()
+			if err != nil && strings.HasPrefix(err.Error(), "BUSYGROUP") {
+				err = nil
+			}
+		}
+	case "none":
+		return nil, fmt.Errorf("redis: %s doesn't exist", key)
+	default:
+		return nil, fmt.Errorf("redis: %s is a %s, not a set or a stream", key, kind)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("redis: %s", err)
+	}
+	return s, nil
+}
+
+func (s *RedisScanner) Scan(count int) bool {
+	s.buf = nil
+	if s.stream {
+		s.readStream(count)
+	} else {
+		s.readSet(count)
+	}
+	if s.err != nil || len(s.buf) == 0 {
+		return false
+	}
+	atomic.AddInt64(&s.emitted, int64(len(s.buf)))
+	return true
+}
+
+// readSet reads the next members of the set. SSCAN may return a member more
+// than once, which is only read again if it isn't pending already.
+func (s *RedisScanner) readSet(count int) {
+	for len(s.buf) == 0 && (!s.started || s.cursor != 0) && s.ctx.Err() == nil {
+		s.started = true
+		members, cursor, err := s.client.SScan(s.ctx, s.Key, s.cursor, "", int64(count)).Result()
+		if err != nil {
+			s.fail(err)
+			return
+		}
+		s.cursor = cursor
+		s.mu.Lock()
+		for _, member := range members {
+			if len(s.pending[member]) == 0 {
+				s.buf = append(s.buf, &s3.ObjectIdentifier{Key: aws.String(member)})
+				s.pending[member] = []string{member}
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+// readStream reads new entries of the stream, waiting for some to arrive if
+// there are none yet.
+func (s *RedisScanner) readStream(count int) {
+	for len(s.buf) == 0 && s.ctx.Err() == nil {
+		block := redisBlock
+		if s.Idle > 0 {
+			left := s.Idle - time.Since(s.lastSeen)
+			if left < time.Millisecond {
+				return
+			}
+			if left < block {
+				block = left
+			}
+		}
+		args := &redis.XReadGroupArgs{
+			Group:    s.Group,
+			Consumer: s.consumer,
+			Streams:  []string{s.Key, ">"},
+			Count:    int64(count),
+			Block:    block,
+		}
+		if s.history != "" {
+			args.Streams[1], args.Block = s.history, -1
+		}
+		streams, err := s.client.XReadGroup(s.ctx, args).Result()
+		if errors.Is(err, redis.Nil) {
+			continue
+		}
+		if err != nil {
+			s.fail(err)
+			return
+		}
+		if s.history != "" {
+			s.history = ""
+			if len(streams) > 0 && len(streams[0].Messages) > 0 {
+				messages := streams[0].Messages
+				s.history = messages[len(messages)-1].ID
+			}
+		}
+		s.lastSeen = time.Now()
+		var ignored []string
+		s.mu.Lock()
+		for _, stream := range streams {
+			for _, message := range stream.Messages {
+				key, ok := message.Values[s.Field].(string)
+				if !ok || key == "" {
+					ignored = append(ignored, message.ID)
+					continue
+				}
+				if len(s.pending[key]) == 0 {
+					s.buf = append(s.buf, &s3.ObjectIdentifier{Key: aws.String(key)})
+				}
+				s.pending[key] = append(s.pending[key], message.ID)
+			}
+		}
+		s.mu.Unlock()
+		// entries without a key are never going to be deleted
+		if len(ignored) > 0 {
+			fmt.Fprintf(os.Stderr, "\nredis: ignoring %d entries without a %s field\n", len(ignored), s.Field)
+			atomic.AddInt64(&s.ignored, int64(len(ignored)))
+			s.remove(ignored)
+		}
+	}
+}
+
+// fail records an error, unless the scanner was stopped.
+func (s *RedisScanner) fail(err error) {
+	if s.ctx.Err() == nil {
+		s.err = fmt.Errorf("redis: %s", err)
+	}
+}
+
+// Ack removes deleted keys from Redis.
+func (s *RedisScanner) Ack(objects []*s3.ObjectIdentifier) {
+	var done []string
+	s.mu.Lock()
+	for _, object := range objects {
+		key := aws.StringValue(object.Key)
+		done = append(done, s.pending[key]...)
+		delete(s.pending, key)
+	}
+	s.mu.Unlock()
+	s.remove(done)
+}
+
+// Nack forgets keys that failed to delete, leaving them in Redis.
+func (s *RedisScanner) Nack(objects []*s3.ObjectIdentifier) {
+	s.mu.Lock()
+	for _, object := range objects {
+		delete(s.pending, aws.StringValue(object.Key))
+	}
+	s.mu.Unlock()
+}
+
+// remove removes members from the set, or acknowledges and deletes entries
+// of the stream. Errors are only reported, as the keys will be read again
+// and deleted again.
+func (s *RedisScanner) remove(ids []string) {
+	if len(ids) == 0 {
+		return
+	}
+	ctx := context.Background()
+	var err error
+	if s.stream {
+		_, err = s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.XAck(ctx, s.Key, s.Group, ids...)
+			pipe.XDel(ctx, s.Key, ids...)
+			return nil
+		})
+	} else {
+		members := make([]interface{}, len(ids))
+		for i, id := range ids {
+			members[i] = id
+		}
+		err = s.client.SRem(ctx, s.Key, members...).Err()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "\nredis: %s\n", err)
+		return
+	}
+	atomic.AddInt64(&s.removed, int64(len(ids)))
+}
+
+// Stop makes the scanner stop reading, ending the scan once the keys
+// already read are returned.
+func (s *RedisScanner) Stop() {
+	s.stop()
+}
+
+func (s *RedisScanner) Err() error {
+	return s.err
+}
+
+func (s *RedisScanner) Objects() []*s3.ObjectIdentifier {
+	return s.buf
+}
+
+func (s *RedisScanner) EmittedKeys() int64 {
+	return atomic.LoadInt64(&s.emitted)
+}
+
+// EstimatedTotal is the size of the set or stream when the scan started.
+func (s *RedisScanner) EstimatedTotal() (int64, bool) {
+	return s.size, s.size > 0
+}
+
+// WriteSummary writes the number of members or entries removed and ignored.
+func (s *RedisScanner) WriteSummary(w io.Writer) {
+	fmt.Fprintf(w, "redis: %d removed from %s, %d ignored\n", atomic.LoadInt64(&s.removed), s.Key, atomic.LoadInt64(&s.ignored))
+}
+
+func init() {
+	RegisterSource(&Source{
+		Name:     "redis",
+		KeyList:  true,
+		Selected: func(*SourceEnv) bool { return flagRedisKey != "" },
+		Flags: func(flags *flag.FlagSet) {
+			flags.StringVar(&flagRedisField, "redis-field", DefaultRedisField, "")
+			flags.StringVar(&flagRedisGroup, "redis-group", DefaultRedisGroup, "")
+			flags.DurationVar(&flagRedisIdle, "redis-idle", 0, "")
+			flags.StringVar(&flagRedisKey, "redis-key", "", "")
+			flags.StringVar(&flagRedisURL, "redis-url", "redis://localhost:6379/0", "")
+		},
+		New: func(env *SourceEnv) (Scanner, error) {
+			if flagRedisKey == "" {
+				return nil, UsageError("Please provide the -redis-key of the set or stream to read the keys from")
+			}
+			rs, err := NewRedisScanner(flagRedisURL, flagRedisKey, flagRedisGroup, flagRedisField)
+			if err != nil {
+				return nil, err
+			}
+			rs.Idle = flagRedisIdle
+			queue = rs
+			return rs, nil
+		},
+	})
+}
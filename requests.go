@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+// Default prices in USD per 1000 requests, taken from the S3 Standard
+// pricing of the us-east-1 region.
+const (
+	DefaultPriceTier1  float64 = 0.005
+	DefaultPriceTier2  float64 = 0.0004
+	DefaultPriceDelete float64 = 0
+)
+
+// tier1Operations are billed at the PUT, COPY, POST, LIST request rate.
+// Everything not listed here or in deleteOperations is billed as tier 2.
+var tier1Operations = map[string]bool{
+	"CompleteMultipartUpload": true,
+	"CopyObject":              true,
+	"CreateMultipartUpload":   true,
+	"ListBuckets":             true,
+	"ListObjectVersions":      true,
+	"ListObjects":             true,
+	"ListObjectsV2":           true,
+	"PutObject":               true,
+	"PutObjectLegalHold":      true,
+	"PutObjectTagging":        true,
+	"UploadPart":              true,
+}
+
+var deleteOperations = map[string]bool{
+	"DeleteObject":  true,
+	"DeleteObjects": true,
+}
+
+// Pricing holds per-1000-request prices for each request tier.
+type Pricing struct {
+	Tier1  float64
+	Tier2  float64
+	Delete float64
+}
+
+// Price returns the price of a single request of the given operation.
+func (p Pricing) Price(operation string) float64 {
+	switch {
+	case deleteOperations[operation]:
+		return p.Delete / 1000
+	case tier1Operations[operation]:
+		return p.Tier1 / 1000
+	default:
+		return p.Tier2 / 1000
+	}
+}
+
+// RequestCounter counts API requests per operation, including retries.
+type RequestCounter struct {
+	mu     sync.Mutex
+	counts map[string]int64
+}
+
+func NewRequestCounter() *RequestCounter {
+	return &RequestCounter{counts: make(map[string]int64)}
+}
+
+// requestCounterHandler names the handler of the request counter.
+const requestCounterHandler = "s3rm.RequestCounter"
+
+// Handler returns a request handler suitable for the Send handler list, which
+// runs once for every attempt of a request.
+func (c *RequestCounter) Handler() request.NamedHandler {
+	return request.NamedHandler{
+		Name: requestCounterHandler,
+		Fn: func(r *request.Request) {
+			c.Add(r.Operation.Name)
+		},
+	}
+}
+
+// uncounted leaves the requests of a client of another service than S3 out
+// of the request counts and cost estimate.
+func uncounted(handlers *request.Handlers) {
+	handlers.Send.RemoveByName(requestCounterHandler)
+}
+
+func (c *RequestCounter) Add(operation string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.counts[operation]++
+}
+
+// Counts returns a copy of the per-operation request counts.
+func (c *RequestCounter) Counts() map[string]int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	counts := make(map[string]int64, len(c.counts))
+	for op, n := range c.counts {
+		counts[op] = n
+	}
+	return counts
+}
+
+func (c *RequestCounter) Total() int64 {
+	var total int64
+	for _, n := range c.Counts() {
+		total += n
+	}
+	return total
+}
+
+// Cost returns the estimated cost in USD of all counted requests.
+func (c *RequestCounter) Cost(pricing Pricing) float64 {
+	var cost float64
+	for op, n := range c.Counts() {
+		cost += float64(n) * pricing.Price(op)
+	}
+	return cost
+}
+
+// WriteSummary writes the per-operation request totals and the cost estimate.
+func (c *RequestCounter) WriteSummary(w io.Writer, pricing Pricing) {
+	counts := c.Counts()
+	ops := make([]string, 0, len(counts))
+	for op := range counts {
+		ops = append(ops, op)
+	}
+	sort.Strings(ops)
+
+	fmt.Fprintf(w, "requests: %d (estimated cost: $%.4f)\n", c.Total(), c.Cost(pricing))
+	for _, op := range ops {
+		fmt.Fprintf(w, "  %-20s %d\n", op, counts[op])
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"container/heap"
+	"fmt"
+	"io"
+	"sync/atomic"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// RetentionScanner lists every immediate sub-prefix of Prefix and emits all
+// but the newest Keep objects of each. Objects directly under Prefix, outside
+// of any sub-prefix, are never emitted. Only the newest Keep objects of the
+// sub-prefix being listed are held in memory.
+type RetentionScanner struct {
+	Bucket      string
+	Prefix      string
+	Keep        int
+	client      *s3.S3
+	err         error
+	buf         []*s3.ObjectIdentifier
+	pending     []*s3.ObjectIdentifier
+	details     map[*s3.ObjectIdentifier]*s3.Object
+	subprefixes []string
+	discovered  bool
+	current     int
+	marker      *string
+	newest      objectHeap
+	kept        []int64
+	deleted     []int64
+	emitted     int64
+}
+
+func NewRetentionScanner(bucket string, prefix string, keep int, client *s3.S3) *RetentionScanner {
+	return &RetentionScanner{
+		Bucket:  bucket,
+		Prefix:  prefix,
+		Keep:    keep,
+		client:  client,
+		details: make(map[*s3.ObjectIdentifier]*s3.Object),
+	}
+}
+
+// discover lists the immediate sub-prefixes of Prefix.
+func (s *RetentionScanner) discover() error {
+	err := s.client.ListObjectsPages(&s3.ListObjectsInput{
+		Bucket:    aws.String(s.Bucket),
+		Delimiter: aws.String("/"),
+		Prefix:    aws.String(s.Prefix),
+	}, func(page *s3.ListObjectsOutput, last bool) bool {
+		for _, prefix := range page.CommonPrefixes {
+			s.subprefixes = append(s.subprefixes, aws.StringValue(prefix.Prefix))
+		}
+		return true
+	})
+	s.kept = make([]int64, len(s.subprefixes))
+	s.deleted = make([]int64, len(s.subprefixes))
+	s.discovered = true
+	return err
+}
+
+func (s *RetentionScanner) Scan(count int) bool {
+	for _, id := range s.buf {
+		delete(s.details, id)
+	}
+	s.buf = nil
+	if !s.discovered {
+		if err := s.discover(); err != nil {
+			s.err = err
+			return false
+		}
+	}
+
+	for len(s.pending) < count && s.current < len(s.subprefixes) {
+		if err := s.listPage(); err != nil {
+			s.err = err
+			return false
+		}
+	}
+
+	n := count
+	if n > len(s.pending) {
+		n = len(s.pending)
+	}
+	if n == 0 {
+		return false
+	}
+	s.buf = s.pending[:n:n]
+	s.pending = s.pending[n:]
+	atomic.AddInt64(&s.emitted, int64(n))
+	return true
+}
+
+// listPage lists the next page of the current sub-prefix. Objects pushed
+// out of the newest Keep are queued for deletion.
+func (s *RetentionScanner) listPage() error {
+	resp, err := s.client.ListObjects(&s3.ListObjectsInput{
+		Bucket: aws.String(s.Bucket),
+		Marker: s.marker,
+		Prefix: aws.String(s.subprefixes[s.current]),
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, object := range resp.Contents {
+		heap.Push(&s.newest, object)
+		if s.newest.Len() > s.Keep {
+			oldest := heap.Pop(&s.newest).(*s3.Object)
+			id := &s3.ObjectIdentifier{Key: oldest.Key}
+			s.pending = append(s.pending, id)
+			s.details[id] = oldest
+			atomic.AddInt64(&s.deleted[s.current], 1)
+		}
+	}
+
+	if aws.BoolValue(resp.IsTruncated) && len(resp.Contents) > 0 {
+		s.marker = resp.Contents[len(resp.Contents)-1].Key
+		return nil
+	}
+
+	// the sub-prefix is done, whatever is left is kept
+	atomic.StoreInt64(&s.kept[s.current], int64(s.newest.Len()))
+	s.newest = nil
+	s.marker = nil
+	s.current++
+	return nil
+}
+
+func (s *RetentionScanner) Err() error {
+	return s.err
+}
+
+func (s *RetentionScanner) Objects() []*s3.ObjectIdentifier {
+	return s.buf
+}
+
+// Details maps the objects of the last batch, and those still pending, to
+// their listed objects.
+func (s *RetentionScanner) Details() map[*s3.ObjectIdentifier]*s3.Object {
+	return s.details
+}
+
+func (s *RetentionScanner) EmittedKeys() int64 {
+	return atomic.LoadInt64(&s.emitted)
+}
+
+// EstimatedTotal always returns false, listing gives no hint of the total.
+func (s *RetentionScanner) EstimatedTotal() (int64, bool) {
+	return 0, false
+}
+
+// WriteSummary writes the number of objects kept and deleted in each
+// sub-prefix.
+func (s *RetentionScanner) WriteSummary(w io.Writer) {
+	fmt.Fprintln(w, "retention:")
+	for i, prefix := range s.subprefixes {
+		fmt.Fprintf(w, "  %-40s kept %d, deleted %d\n", prefix,
+			atomic.LoadInt64(&s.kept[i]), atomic.LoadInt64(&s.deleted[i]))
+	}
+}
+
+// objectHeap is a min-heap of objects ordered by LastModified, so the
+// oldest object is popped first. Ties are broken by key, the smaller key
+// counting as older.
+type objectHeap []*s3.Object
+
+func (h objectHeap) Len() int { return len(h) }
+
+func (h objectHeap) Less(i, j int) bool {
+	ti, tj := aws.TimeValue(h[i].LastModified), aws.TimeValue(h[j].LastModified)
+	if ti.Equal(tj) {
+		return aws.StringValue(h[i].Key) < aws.StringValue(h[j].Key)
+	}
+	return ti.Before(tj)
+}
+
+func (h objectHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *objectHeap) Push(x interface{}) {
+	*h = append(*h, x.(*s3.Object))
+}
+
+func (h *objectHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[:n-1]
+	return x
+}
+
+func init() {
+	RegisterSource(&Source{
+		Name:     "keep-newest",
+		Details:  true,
+		Selected: func(*SourceEnv) bool { return flagKeepNewest > 0 },
+		New: func(env *SourceEnv) (Scanner, error) {
+			if len(env.Prefixes) != 1 || flagKeepNewest < 1 {
+				return nil, UsageError("Please provide a single s3 prefix to keep the newest objects under")
+			}
+			return NewRetentionScanner(env.Bucket, env.Prefixes[0], flagKeepNewest, env.Client), nil
+		},
+	})
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// RetryQueue holds the keys that failed to delete in a temporary file, so
+// memory use doesn't grow with the number of failures. The file is only
+// created once the first key is added.
+//
+// When Versions is set, each line holds a key and its version ID, if any,
+// separated by a tab, as read by a FileScanner with Versions set.
+//
+// When Header is set, the file starts with the run metadata it returns, and
+// keys added with AddFailed are written with the error code they failed
+// with, so the file can be read back by -file as it is.
+type RetryQueue struct {
+	Versions bool
+	Header   func() []string
+	mu       sync.Mutex
+	dir      string
+	file     *os.File
+	w        *bufio.Writer
+	count    int64
+}
+
+func NewRetryQueue(dir string) *RetryQueue {
+	return &RetryQueue{dir: dir}
+}
+
+func (q *RetryQueue) Add(objects []*s3.ObjectIdentifier) error {
+	return q.add(objects, nil)
+}
+
+// AddFailed adds the objects that failed to delete with err, each with its
+// own error code when err is a KeyErrors.
+func (q *RetryQueue) AddFailed(objects []*s3.ObjectIdentifier, err error) error {
+	codes := make(map[*s3.ObjectIdentifier]string, len(objects))
+	errs, _ := err.(KeyErrors)
+	for _, e := range errs {
+		codes[e.Object] = errorCode(e.Err)
+	}
+	for _, object := range objects {
+		if _, ok := codes[object]; !ok {
+			codes[object] = errorCode(err)
+		}
+	}
+	return q.add(objects, codes)
+}
+
+func (q *RetryQueue) add(objects []*s3.ObjectIdentifier, codes map[*s3.ObjectIdentifier]string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.file == nil {
+		f, err := ioutil.TempFile(q.dir, "s3rm-retry-")
+		if err != nil {
+			return err
+		}
+		q.file = f
+		q.w = bufio.NewWriter(f)
+		if q.Header != nil {
+			for _, line := range q.Header() {
+				if _, err := fmt.Fprintln(q.w, line); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	for _, obj := range objects {
+		if code, ok := codes[obj]; ok && q.Header != nil {
+			if _, err := fmt.Fprintf(q.w, "%s%s: ", failedKeyPrefix, code); err != nil {
+				return err
+			}
+		}
+		var err error
+		if q.Versions {
+			_, err = fmt.Fprintf(q.w, "%s\t%s\n", *obj.Key, aws.StringValue(obj.VersionId))
+		} else {
+			_, err = fmt.Fprintln(q.w, *obj.Key)
+		}
+		if err != nil {
+			return err
+		}
+		q.count++
+	}
+	return nil
+}
+
+// Len returns the number of keys in the queue.
+func (q *RetryQueue) Len() int64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.count
+}
+
+// Path returns the path of the queue file, or an empty string if no key
+// was ever added.
+func (q *RetryQueue) Path() string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.file == nil {
+		return ""
+	}
+	return q.file.Name()
+}
+
+// Close flushes the queued keys to disk and closes the file.
+func (q *RetryQueue) Close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.file == nil {
+		return nil
+	}
+	if err := q.w.Flush(); err != nil {
+		q.file.Close()
+		return err
+	}
+	return q.file.Close()
+}
+
+// Take moves the queued keys to a new queue and empties this one, which can
+// then be added to again.
+func (q *RetryQueue) Take() *RetryQueue {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	taken := &RetryQueue{Versions: q.Versions, Header: q.Header, dir: q.dir, file: q.file, w: q.w, count: q.count}
+	q.file, q.w, q.count = nil, nil, 0
+	return taken
+}
+
+// Scanner closes the queue and returns a scanner over its keys.
+func (q *RetryQueue) Scanner() (*FileScanner, error) {
+	if err := q.Close(); err != nil {
+		return nil, err
+	}
+	scanner, err := NewFileScanner(q.Path())
+	if err != nil {
+		return nil, err
+	}
+	scanner.Versions = q.Versions
+	return scanner, nil
+}
+
+// Remove deletes the queue file.
+func (q *RetryQueue) Remove() error {
+	if path := q.Path(); path != "" {
+		return os.Remove(path)
+	}
+	return nil
+}
+
+// SaveTo closes the queue and moves its file to path, or with no key
+// queued, writes just the header there.
+func (q *RetryQueue) SaveTo(path string) error {
+	if err := q.Close(); err != nil {
+		return err
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.file == nil {
+		var header []string
+		if q.Header != nil {
+			header = q.Header()
+		}
+		return ioutil.WriteFile(path, []byte(strings.Join(append(header, ""), "\n")), 0644)
+	}
+	if err := os.Rename(q.file.Name(), path); err == nil {
+		return nil
+	}
+	// the temporary directory may be on another device
+	data, err := ioutil.ReadFile(q.file.Name())
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Percent is a flag holding a percentage, such as 10% or 2.5, as a fraction
+// of 1.
+type Percent float64
+
+func (p *Percent) String() string {
+	return strconv.FormatFloat(float64(*p)*100, 'g', -1, 64) + "%"
+}
+
+func (p *Percent) Set(value string) error {
+	n, err := strconv.ParseFloat(strings.TrimSuffix(value, "%"), 64)
+	if err != nil || n <= 0 || n > 100 {
+		return fmt.Errorf("invalid percentage %q, it must be above 0 and at most 100", value)
+	}
+	*p = Percent(n / 100)
+	return nil
+}
+
+// sampleFilter deletes each object with the given probability, sparing the
+// rest, so a run deletes a random subset of the objects left by the other
+// filters.
+func sampleFilter(fraction float64) Filter {
+	var mu sync.Mutex
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+	return FilterFunc(func(object *s3.ObjectIdentifier) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return r.Float64() >= fraction
+	})
+}
@@ -2,94 +2,429 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
 	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/klauspost/compress/zstd"
 )
 
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// Compressions of a key file. Auto detects gzip and zstd from the file name
+// or its leading magic bytes, the others read the file as they say whatever
+// its name.
+const (
+	CompressionAuto = "auto"
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+	CompressionNone = "none"
+)
+
+// fetchOwner makes listings return the owner of objects, for the owner
+// filters.
+var fetchOwner bool
+
 type Scanner interface {
 	Err() error
 	Scan(count int) bool
 	Objects() []*s3.ObjectIdentifier
 }
 
+// ProgressScanner is implemented by scanners that can report how far along
+// they are. EstimatedTotal returns false when the total is unknown.
+type ProgressScanner interface {
+	EmittedKeys() int64
+	EstimatedTotal() (int64, bool)
+}
+
+// DetailScanner is implemented by scanners that list objects, and so know
+// more about them than their keys. Details maps each identifier of the last
+// batch to the object it was listed as.
+type DetailScanner interface {
+	Details() map[*s3.ObjectIdentifier]*s3.Object
+}
+
+// MarkerScanner is implemented by scanners listing versions. Markers holds
+// the identifiers of the last batch that are delete markers.
+type MarkerScanner interface {
+	Markers() map[*s3.ObjectIdentifier]bool
+}
+
+// ShardScanner is implemented by scanners listing versions by shard, whose
+// marks a ShardCheckpoint keeps. Shard returns the shard of the last batch,
+// and Mark where the shard resumes from once the batch was dealt with.
+type ShardScanner interface {
+	Shard() string
+	Mark() *ShardMark
+}
+
+// Queue is implemented by scanners reading keys from a queue, which are told
+// when keys are done with, so their messages can be acknowledged: Ack once
+// the keys were deleted or spared, Nack when they failed to delete.
+type Queue interface {
+	Scanner
+	Ack(objects []*s3.ObjectIdentifier)
+	Nack(objects []*s3.ObjectIdentifier)
+	// Stop ends the scan once the keys already received are returned.
+	Stop()
+}
+
+// unwrapScanner returns the scanner wrapped scanners, such as the
+// SortedScanner, read their keys from in the end.
+func unwrapScanner(scanner Scanner) Scanner {
+	for {
+		w, ok := scanner.(interface{ Unwrap() Scanner })
+		if !ok {
+			return scanner
+		}
+		scanner = w.Unwrap()
+	}
+}
+
 type FileScanner struct {
+	// Versions reads a version ID after the last tab of each line. Lines
+	// without a tab, or with nothing after it, have no version ID.
+	Versions bool
+	// Skip is the number of keys to read past before the first one returned,
+	// which still count as emitted.
+	Skip    int64
 	buf     []*s3.ObjectIdentifier
+	name    string
 	scanner *bufio.Scanner
+	size    int64
+	read    int64
+	emitted int64
+	done    int32
+	// output is set once a metadata line shows the file is an s3rm output,
+	// whose keys are prefixed with "delete: "
+	output bool
+	// compressed counts the bytes read from a compressed file
+	compressed *countingReader
+	// reader is the decompressed content of the file
+	reader io.Reader
 }
 
 type BucketScanner struct {
 	Bucket string
 	Prefix string
-	client *s3.S3
-	err    error
-	buf    []*s3.ObjectIdentifier
+	// StartAfter starts the listing after this key.
+	StartAfter string
+	// StopAt ends the listing at this key, included.
+	StopAt string
+	// Directory lists a directory bucket, which only lists prefixes ending
+	// in a /: the enclosing directory is listed, and the keys outside the
+	// prefix are dropped.
+	Directory bool
+	// Estimate is an approximate object count for the listing, if known.
+	Estimate int64
+	client   *s3.S3
+	err      error
+	buf      []*s3.ObjectIdentifier
+	details  map[*s3.ObjectIdentifier]*s3.Object
+	emitted  int64
+	token    *string
+	done     bool
 }
 
 func (s *FileScanner) Scan(count int) bool {
 	s.buf = nil
-	for i := 0; i < count; i++ {
-		if s.scanner.Scan() {
-			obj := &s3.ObjectIdentifier{Key: aws.String(s.scanner.Text())}
-			s.buf = append(s.buf, obj)
-		} else {
-			// return if this is the first read and the scanner is empty
-			if len(s.buf) == 0 {
-				return false
+	for len(s.buf) < count {
+		if !s.scanner.Scan() {
+			atomic.StoreInt32(&s.done, 1)
+			break
+		}
+		atomic.AddInt64(&s.read, int64(len(s.scanner.Bytes())+1))
+		// skip run metadata of files written by s3rm
+		line := s.scanner.Text()
+		if isMetadataLine(line) {
+			s.output = true
+			continue
+		}
+		if s.output {
+			line = trimKeyPrefix(line)
+		}
+		if s.Skip > 0 {
+			s.Skip--
+			atomic.AddInt64(&s.emitted, 1)
+			continue
+		}
+		obj := &s3.ObjectIdentifier{Key: aws.String(line)}
+		if i := strings.LastIndexByte(line, '\t'); s.Versions && i >= 0 {
+			obj.Key = aws.String(line[:i])
+			if version := line[i+1:]; version != "" {
+				obj.VersionId = aws.String(version)
 			}
 		}
+		s.buf = append(s.buf, obj)
 	}
+	// return if the scanner is empty
+	if len(s.buf) == 0 {
+		return false
+	}
+	atomic.AddInt64(&s.emitted, int64(len(s.buf)))
 	return true
 }
 
+// trimKeyPrefix returns the key of a line of a file written by s3rm, without
+// the prefix of -output files, or of -failed files with the error code.
+func trimKeyPrefix(line string) string {
+	if key := strings.TrimPrefix(line, outputKeyPrefix); key != line {
+		return key
+	}
+	if strings.HasPrefix(line, failedKeyPrefix) {
+		if i := strings.Index(line, ": "); i > len(failedKeyPrefix) && !strings.Contains(line[len(failedKeyPrefix):i], " ") {
+			return line[i+2:]
+		}
+	}
+	return line
+}
+
 func (s *FileScanner) Err() error {
-	return nil
+	if s.scanner == nil {
+		return nil
+	}
+	err := s.scanner.Err()
+	if err != nil && s.compressed != nil {
+		return fmt.Errorf("%s: %s (near compressed byte offset %d)", s.name, err, s.compressed.Count())
+	}
+	return err
 }
 
 func (s *FileScanner) Objects() []*s3.ObjectIdentifier {
 	return s.buf
 }
 
+func (s *FileScanner) EmittedKeys() int64 {
+	return atomic.LoadInt64(&s.emitted)
+}
+
+// EstimatedTotal extrapolates the number of keys in the file from the average
+// line length seen so far.
+func (s *FileScanner) EstimatedTotal() (int64, bool) {
+	emitted := atomic.LoadInt64(&s.emitted)
+	if atomic.LoadInt32(&s.done) == 1 {
+		return emitted, true
+	}
+	read := atomic.LoadInt64(&s.read)
+	if s.compressed != nil {
+		read = s.compressed.Count()
+	}
+	if emitted == 0 || read == 0 || s.size == 0 {
+		return 0, false
+	}
+	return emitted * s.size / read, true
+}
+
+// StdinFile is the file name that reads keys from the standard input.
+const StdinFile = "-"
+
 func NewFileScanner(file string) (*FileScanner, error) {
-	fd, err := os.Open(file)
+	return NewCompressedFileScanner(file, CompressionAuto)
+}
+
+// NewCompressedFileScanner reads keys from a file compressed as compression
+// says, which is detected with CompressionAuto.
+func NewCompressedFileScanner(file string, compression string) (*FileScanner, error) {
+	fd := os.Stdin
+	if file == StdinFile {
+		file = "stdin"
+	} else {
+		var err error
+		if fd, err = os.Open(file); err != nil {
+			return &FileScanner{}, err
+		}
+	}
+	// pipes have no size, the total is then unknown until the end
+	var size int64
+	if info, err := fd.Stat(); err == nil && info.Mode().IsRegular() {
+		size = info.Size()
+	}
+	return newReaderScanner(file, fd, size, compression)
+}
+
+// NewS3FileScanner streams a key file from S3, given its s3:// URI, without
+// downloading it first.
+func NewS3FileScanner(uri string, client *s3.S3) (*FileScanner, error) {
+	return NewCompressedS3FileScanner(uri, CompressionAuto, client)
+}
+
+// NewCompressedS3FileScanner streams a key file from S3 compressed as
+// compression says.
+func NewCompressedS3FileScanner(uri string, compression string, client *s3.S3) (*FileScanner, error) {
+	bucket, key, err := ParseS3URI(uri)
 	if err != nil {
 		return &FileScanner{}, err
 	}
-	list := &FileScanner{
-		scanner: bufio.NewScanner(fd),
+	var resp *s3.GetObjectOutput
+	err = withCredentials(func() (err error) {
+		resp, err = client.GetObject(&s3.GetObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(key),
+		})
+		return err
+	})
+	if err != nil {
+		return &FileScanner{}, fmt.Errorf("%s: %s", uri, err)
 	}
-	return list, nil
+	return newReaderScanner(uri, resp.Body, aws.Int64Value(resp.ContentLength), compression)
 }
 
-func (s *BucketScanner) Scan(count int) bool {
-	var marker *string
-	if len(s.buf) > 0 {
-		marker = s.buf[len(s.buf)-1].Key
+// newReaderScanner reads keys from r, of the given size if known.
+func newReaderScanner(name string, r io.Reader, size int64, compression string) (*FileScanner, error) {
+	list := &FileScanner{name: name, size: size}
+	r, err := list.decompress(r, compression)
+	if err != nil {
+		return &FileScanner{}, fmt.Errorf("%s: %s", name, err)
 	}
+	list.reader = r
+	list.scanner = bufio.NewScanner(r)
+	return list, nil
+}
 
-	s.buf = nil
-	params := &s3.ListObjectsInput{
-		Bucket:  aws.String(s.Bucket),
-		Marker:  marker,
-		MaxKeys: aws.Int64(int64(count)),
-		Prefix:  aws.String(s.Prefix),
+// SplitNull makes the scanner split keys on NUL bytes instead of newlines,
+// so keys may contain newlines. It must be called before Scan.
+func (s *FileScanner) SplitNull() {
+	s.scanner.Split(scanNull)
+}
+
+// scanNull is a bufio.SplitFunc returning NUL terminated records. The last
+// record may have no terminator.
+func scanNull(data []byte, atEOF bool) (int, []byte, error) {
+	if atEOF && len(data) == 0 {
+		return 0, nil, nil
 	}
-	resp, err := s.client.ListObjects(params)
-	if err != nil {
-		s.err = err
-		return false
+	if i := bytes.IndexByte(data, 0); i >= 0 {
+		return i + 1, data[:i], nil
+	}
+	if atEOF {
+		return len(data), data, nil
 	}
+	return 0, nil, nil
+}
 
-	if len(resp.Contents) < 1 {
-		return false
+// decompress wraps r in a gzip or zstd decompressor as compression says,
+// or with CompressionAuto, if the file name or its leading magic bytes say
+// the file is compressed. The file is decompressed as it is read, never as
+// a whole.
+func (s *FileScanner) decompress(r io.Reader, compression string) (io.Reader, error) {
+	counter := &countingReader{r: r}
+	buf := bufio.NewReader(counter)
+	if compression == CompressionAuto {
+		magic, _ := buf.Peek(len(zstdMagic))
+		switch {
+		case strings.HasSuffix(s.name, ".gz") || bytes.HasPrefix(magic, gzipMagic):
+			compression = CompressionGzip
+		case strings.HasSuffix(s.name, ".zst") || bytes.HasPrefix(magic, zstdMagic):
+			compression = CompressionZstd
+		}
+	}
+
+	switch compression {
+	case CompressionGzip:
+		s.compressed = counter
+		return gzip.NewReader(buf)
+	case CompressionZstd:
+		s.compressed = counter
+		return zstd.NewReader(buf)
 	}
-	for _, object := range resp.Contents {
-		s.buf = append(s.buf, &s3.ObjectIdentifier{Key: object.Key})
+	return buf, nil
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	atomic.AddInt64(&c.n, int64(n))
+	return n, err
+}
+
+func (c *countingReader) Count() int64 {
+	return atomic.LoadInt64(&c.n)
+}
+
+// Scan lists the next page of objects with ListObjectsV2, following
+// continuation tokens rather than using the last key as a marker: directory
+// buckets and some S3-compatible stores don't list keys in lexicographic
+// order. Pages can be empty without being the last one. StartAfter and
+// StopAt rely on the order, and must not be set for directory buckets.
+func (s *BucketScanner) Scan(count int) bool {
+	s.buf = nil
+	for len(s.buf) == 0 {
+		if s.done {
+			return false
+		}
+		prefix := s.Prefix
+		if s.Directory {
+			prefix = directoryPrefix(prefix)
+		}
+		params := &s3.ListObjectsV2Input{
+			Bucket:            aws.String(s.Bucket),
+			ContinuationToken: s.token,
+			MaxKeys:           aws.Int64(int64(count)),
+			Prefix:            aws.String(prefix),
+		}
+		if fetchOwner {
+			params.FetchOwner = aws.Bool(true)
+		}
+		if s.token == nil && s.StartAfter != "" {
+			params.StartAfter = aws.String(s.StartAfter)
+		}
+		var resp *s3.ListObjectsV2Output
+		err := withCredentials(func() (err error) {
+			resp, err = s.client.ListObjectsV2(params)
+			return err
+		})
+		if err != nil {
+			s.err = err
+			return false
+		}
+		contents := resp.Contents
+		if prefix != s.Prefix {
+			contents = objectsUnder(contents, s.Prefix)
+		}
+		s.token = resp.NextContinuationToken
+		s.done = !aws.BoolValue(resp.IsTruncated) || s.token == nil
+		if s.StopAt != "" {
+			i := sort.Search(len(contents), func(i int) bool {
+				return aws.StringValue(contents[i].Key) > s.StopAt
+			})
+			if i < len(contents) {
+				contents, s.done = contents[:i], true
+			}
+		}
+		s.add(contents)
 	}
+	atomic.AddInt64(&s.emitted, int64(len(s.buf)))
 	return true
 }
 
+// add appends listed objects to the batch.
+func (s *BucketScanner) add(objects []*s3.Object) {
+	if s.details == nil || len(s.buf) == 0 {
+		s.details = make(map[*s3.ObjectIdentifier]*s3.Object, len(objects))
+	}
+	for _, object := range objects {
+		id := &s3.ObjectIdentifier{Key: object.Key}
+		s.buf = append(s.buf, id)
+		s.details[id] = object
+	}
+}
+
 func (s *BucketScanner) Err() error {
 	return s.err
 }
@@ -98,6 +433,286 @@ func (s *BucketScanner) Objects() []*s3.ObjectIdentifier {
 	return s.buf
 }
 
+func (s *BucketScanner) Details() map[*s3.ObjectIdentifier]*s3.Object {
+	return s.details
+}
+
+func (s *BucketScanner) EmittedKeys() int64 {
+	return atomic.LoadInt64(&s.emitted)
+}
+
+// EstimatedTotal returns the Estimate, if one was set. Listing itself gives
+// no hint of the total.
+func (s *BucketScanner) EstimatedTotal() (int64, bool) {
+	if s.Estimate <= 0 {
+		return 0, false
+	}
+	if emitted := s.EmittedKeys(); emitted > s.Estimate {
+		return emitted, true
+	}
+	return s.Estimate, true
+}
+
+// directoryPrefix returns the directory a prefix is in, up to its last /,
+// the longest prefix a directory bucket can list.
+func directoryPrefix(prefix string) string {
+	return prefix[:strings.LastIndex(prefix, "/")+1]
+}
+
+// objectsUnder returns the objects whose keys start with prefix.
+func objectsUnder(objects []*s3.Object, prefix string) []*s3.Object {
+	var under []*s3.Object
+	for _, object := range objects {
+		if strings.HasPrefix(aws.StringValue(object.Key), prefix) {
+			under = append(under, object)
+		}
+	}
+	return under
+}
+
 func NewBucketScanner(bucket string, prefix string, client *s3.S3) (*BucketScanner, error) {
 	return &BucketScanner{Bucket: bucket, Prefix: prefix, client: client}, nil
 }
+
+// MultiScanner reads from several scanners in turn. Each scanner is labeled,
+// usually with its prefix, and the number of keys read from it is counted.
+type MultiScanner struct {
+	Labels   []string
+	scanners []Scanner
+	counts   []int64
+	current  int
+	buf      []*s3.ObjectIdentifier
+	err      error
+}
+
+func (s *MultiScanner) Scan(count int) bool {
+	s.buf = nil
+	for s.current < len(s.scanners) {
+		scanner := s.scanners[s.current]
+		if scanner.Scan(count) {
+			s.buf = scanner.Objects()
+			atomic.AddInt64(&s.counts[s.current], int64(len(s.buf)))
+			return true
+		}
+		if err := scanner.Err(); err != nil {
+			s.err = err
+			return false
+		}
+		s.current++
+	}
+	return false
+}
+
+// Label returns the label of the scanner the last batch was read from.
+func (s *MultiScanner) Label() string {
+	if s.current < len(s.Labels) {
+		return s.Labels[s.current]
+	}
+	return ""
+}
+
+func (s *MultiScanner) Err() error {
+	return s.err
+}
+
+func (s *MultiScanner) Objects() []*s3.ObjectIdentifier {
+	return s.buf
+}
+
+// Details returns the details of the last batch, if its scanner has any.
+func (s *MultiScanner) Details() map[*s3.ObjectIdentifier]*s3.Object {
+	if s.current < len(s.scanners) {
+		if ds, ok := s.scanners[s.current].(DetailScanner); ok {
+			return ds.Details()
+		}
+	}
+	return nil
+}
+
+// Markers returns the delete markers of the last batch, if its scanner
+// lists versions.
+func (s *MultiScanner) Markers() map[*s3.ObjectIdentifier]bool {
+	if s.current < len(s.scanners) {
+		if ms, ok := s.scanners[s.current].(MarkerScanner); ok {
+			return ms.Markers()
+		}
+	}
+	return nil
+}
+
+// Shard returns the shard of the last batch, if its scanner lists by shard.
+func (s *MultiScanner) Shard() string {
+	if s.current < len(s.scanners) {
+		if ss, ok := s.scanners[s.current].(ShardScanner); ok {
+			return ss.Shard()
+		}
+	}
+	return ""
+}
+
+// Mark returns where the shard of the last batch resumes from, if its
+// scanner lists by shard.
+func (s *MultiScanner) Mark() *ShardMark {
+	if s.current < len(s.scanners) {
+		if ss, ok := s.scanners[s.current].(ShardScanner); ok {
+			return ss.Mark()
+		}
+	}
+	return nil
+}
+
+func (s *MultiScanner) EmittedKeys() int64 {
+	var emitted int64
+	for i := range s.counts {
+		emitted += atomic.LoadInt64(&s.counts[i])
+	}
+	return emitted
+}
+
+// EstimatedTotal sums the estimates of the underlying scanners, and is only
+// known when every scanner has an estimate.
+func (s *MultiScanner) EstimatedTotal() (int64, bool) {
+	var total int64
+	for _, scanner := range s.scanners {
+		ps, ok := scanner.(ProgressScanner)
+		if !ok {
+			return 0, false
+		}
+		estimate, ok := ps.EstimatedTotal()
+		if !ok {
+			return 0, false
+		}
+		total += estimate
+	}
+	return total, true
+}
+
+// WriteSummary writes the number of keys read from each scanner.
+func (s *MultiScanner) WriteSummary(w io.Writer) {
+	fmt.Fprintln(w, "prefixes:")
+	for i, label := range s.Labels {
+		fmt.Fprintf(w, "  %-40s %d\n", label, atomic.LoadInt64(&s.counts[i]))
+	}
+}
+
+func NewMultiScanner(labels []string, scanners []Scanner) *MultiScanner {
+	return &MultiScanner{
+		Labels:   labels,
+		scanners: scanners,
+		counts:   make([]int64, len(scanners)),
+	}
+}
+
+func init() {
+	RegisterSource(&Source{
+		Name:     "file",
+		KeyList:  true,
+		Selected: func(*SourceEnv) bool { return flagFile != "" },
+		New:      newFileSource,
+	})
+	RegisterSource(&Source{
+		Name:    "prefix",
+		Details: true,
+		Selected: func(env *SourceEnv) bool {
+			return len(env.Prefixes) > 0 && flagKeepNewest == 0
+		},
+		New: newPrefixSource,
+	})
+}
+
+// newFileSource reads the keys of -file, which may be a local file, stdin
+// or an s3:// URI, and with -column, a CSV file.
+func newFileSource(env *SourceEnv) (Scanner, error) {
+	if flagFile == "" {
+		return nil, UsageError("Please provide a -file to read the keys from")
+	}
+	var fs *FileScanner
+	var err error
+	if strings.HasPrefix(flagFile, "s3://") {
+		fs, err = NewCompressedS3FileScanner(flagFile, flagCompression, env.Client)
+	} else {
+		fs, err = NewCompressedFileScanner(flagFile, flagCompression)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if flagNull {
+		fs.SplitNull()
+	}
+	fs.Versions = flagFileVersions
+	fs.Skip = env.SkipKeys
+	if flagColumn != "" {
+		return NewCSVScanner(fs, flagColumn)
+	}
+	return fs, nil
+}
+
+// newPrefixSource lists the objects, or their versions, under each prefix.
+// Version listings are resumed from the marks of the env's Checkpoint,
+// leaving out the prefixes done with.
+func newPrefixSource(env *SourceEnv) (Scanner, error) {
+	if len(env.Prefixes) == 0 {
+		return nil, UsageError("Please provide an s3 prefix to list")
+	}
+	versions := flagVersions || flagMarkers || flagNoncurrent || flagKeepVersions > 0
+	var (
+		labels   []string
+		scanners []Scanner
+	)
+	for i, prefix := range env.Prefixes {
+		if versions {
+			vs := NewVersionScanner(env.Bucket, prefix, env.Client)
+			vs.Versions = !flagMarkers
+			vs.Noncurrent = flagNoncurrent
+			vs.NoncurrentFor = flagNoncurrentFor
+			vs.KeepVersions = flagKeepVersions
+			if flagListWorkers > 1 {
+				ss := NewShardedScanner(env.Bucket, prefix, flagListWorkers, env.Client)
+				ss.Versions = vs
+				ss.Checkpoint = env.Checkpoint
+				labels, scanners = append(labels, prefix), append(scanners, ss)
+				continue
+			}
+			if env.Checkpoint != nil && !env.Checkpoint.Resume(vs) {
+				continue
+			}
+			vs.Checkpoint = env.Checkpoint
+			labels, scanners = append(labels, prefix), append(scanners, vs)
+			continue
+		}
+		// the bucket metrics are only a useful total when deleting everything
+		var estimate int64
+		if prefix == "" && !flagNoEstimate {
+			if e, err := EstimateBucket(env.Session, env.Bucket); err == nil {
+				estimate = e.Objects
+			}
+		}
+		// a diff needs the keys in order, and directory buckets can only
+		// list the sub-prefixes of a directory
+		if flagListWorkers > 1 && flagDiff == "" && (!env.Directory || directoryPrefix(prefix) == prefix) {
+			ss := NewShardedScanner(env.Bucket, prefix, flagListWorkers, env.Client)
+			ss.Estimate = estimate
+			labels, scanners = append(labels, prefix), append(scanners, ss)
+			continue
+		}
+		bs, err := NewBucketScanner(env.Bucket, prefix, env.Client)
+		if err != nil {
+			return nil, err
+		}
+		bs.Estimate = estimate
+		bs.Directory = env.Directory
+		// directory buckets don't list keys in order
+		if !env.Directory {
+			bs.StartAfter = flagStartAfter
+			bs.StopAt = flagStopAt
+		}
+		if i == 0 && env.ResumeAfter > bs.StartAfter {
+			bs.StartAfter = env.ResumeAfter
+		}
+		labels, scanners = append(labels, prefix), append(scanners, bs)
+	}
+	if len(scanners) == 1 {
+		return scanners[0], nil
+	}
+	return NewMultiScanner(labels, scanners), nil
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+func TestDirectoryBucketListsEnclosingDirectory(t *testing.T) {
+	m, svc := newMockS3(t, "logs/2023-12-31", "logs/2024-01-01", "logs/2024-01-02", "logs/2024/x", "logs2024-01-03", "other")
+	m.directory = true
+	m.pageSize = 2
+
+	bs, err := NewBucketScanner(mockBucket, "logs/2024-", svc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs.Directory = true
+	var keys []string
+	for bs.Scan(2) {
+		for _, object := range bs.Objects() {
+			keys = append(keys, aws.StringValue(object.Key))
+		}
+	}
+	if err := bs.Err(); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"logs/2024-01-01", "logs/2024-01-02"}
+	if !reflect.DeepEqual(keys, want) {
+		t.Errorf("listed %v, want %v", keys, want)
+	}
+
+	// without Directory, the prefix is listed as is and rejected
+	bs, _ = NewBucketScanner(mockBucket, "logs/2024-", svc)
+	for bs.Scan(2) {
+	}
+	if bs.Err() == nil {
+		t.Error("listing a prefix not ending in / succeeded, want it rejected")
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sync/atomic"
+)
+
+// ServeMetrics serves the metrics of the run on /metrics at addr, in the
+// Prometheus text format, until the process exits. It returns once the
+// address is listened on, so a taken address fails the run early.
+func ServeMetrics(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", writeMetrics)
+	go func() {
+		if err := http.Serve(listener, mux); err != nil {
+			fmt.Fprintf(os.Stderr, "\nwarning: metrics endpoint stopped: %s\n", err)
+		}
+	}()
+	return nil
+}
+
+func writeMetrics(w http.ResponseWriter, r *http.Request) {
+	stats := Snapshot()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	metric := func(name string, kind string, help string, value int64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s{bucket=%q} %d\n", name, help, name, kind, name, flagBucket, value)
+	}
+	metric("s3rm_objects_listed_total", "counter", "Keys read from the input.", stats.Listed)
+	metric("s3rm_objects_queued_total", "counter", "Keys queued for deletion.", stats.Queued)
+	metric("s3rm_objects_deleted_total", "counter", "Objects deleted.", stats.Deleted)
+	metric("s3rm_objects_failed_total", "counter", "Objects that failed to delete.", atomic.LoadInt64(&totalFailedObjects))
+	metric("s3rm_objects_skipped_total", "counter", "Keys spared by filters.", stats.Skipped)
+	metric("s3rm_bytes_deleted_total", "counter", "Bytes deleted, for objects of known size.", stats.DeletedBytes)
+	metric("s3rm_throttles_total", "counter", "Throttled requests.", stats.Throttles)
+	metric("s3rm_workers", "gauge", "Workers deleting objects.", int64(stats.Workers))
+	var paused int64
+	if stats.Paused {
+		paused = 1
+	}
+	metric("s3rm_paused", "gauge", "Whether SIGUSR1 paused the run.", paused)
+	metric("s3rm_queue_depth", "gauge", "Batches waiting for a worker.", int64(stats.QueueDepth))
+	if qs, ok := queue.(*QueueScanner); ok {
+		metric("s3rm_sqs_messages_acked_total", "counter", "Messages deleted from the queue.", qs.Acked())
+	}
+}
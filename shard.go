@@ -0,0 +1,266 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// shardDelimiter splits a prefix into the shards listed concurrently.
+const shardDelimiter = "/"
+
+// ShardedScanner lists a prefix with several concurrent listings. The
+// common prefixes directly under the prefix, up to the next "/", are found
+// with a delimiter listing, which also returns the objects directly under
+// the prefix, and each of them is then listed as a shard by one of
+// Concurrency workers. Keys are returned in no particular order.
+//
+// With Versions set, the versions of the shards are listed as Versions is
+// set up to, rather than their objects. A Checkpoint then resumes each
+// shard from its mark, the shards found by the run it resumes first, and
+// is told of the shards found and listed.
+type ShardedScanner struct {
+	Bucket      string
+	Prefix      string
+	Concurrency int
+	// Estimate is an approximate object count for the listing, if known.
+	Estimate   int64
+	Versions   *VersionScanner
+	Checkpoint *ShardCheckpoint
+	client     *s3.S3
+	batches    chan shardBatch
+	once       sync.Once
+	mu         sync.Mutex
+	err        error
+	buf        []*s3.ObjectIdentifier
+	details    map[*s3.ObjectIdentifier]*s3.Object
+	markers    map[*s3.ObjectIdentifier]bool
+	shard      string
+	mark       *ShardMark
+	emitted    int64
+	shards     int64
+}
+
+// shardBatch is a batch listed under a shard and where the shard resumes
+// from after it, or the end of the shard once listed is set.
+type shardBatch struct {
+	shard   string
+	objects []*s3.ObjectIdentifier
+	details map[*s3.ObjectIdentifier]*s3.Object
+	markers map[*s3.ObjectIdentifier]bool
+	mark    *ShardMark
+	listed  bool
+}
+
+func NewShardedScanner(bucket string, prefix string, concurrency int, client *s3.S3) *ShardedScanner {
+	return &ShardedScanner{
+		Bucket:      bucket,
+		Prefix:      prefix,
+		Concurrency: concurrency,
+		client:      client,
+		batches:     make(chan shardBatch, concurrency),
+	}
+}
+
+func (s *ShardedScanner) Scan(count int) bool {
+	s.once.Do(func() { go s.list(count) })
+	for batch := range s.batches {
+		// the batches of the shard were all dispatched before its end
+		if batch.listed {
+			s.Checkpoint.Listed(batch.shard)
+			continue
+		}
+		s.buf, s.details, s.markers, s.shard, s.mark = batch.objects, batch.details, batch.markers, batch.shard, batch.mark
+		atomic.AddInt64(&s.emitted, int64(len(s.buf)))
+		return true
+	}
+	s.buf, s.details, s.markers, s.mark = nil, nil, nil, nil
+	return false
+}
+
+// list finds the shards and lists them, until they are all listed or one
+// of the listings fails.
+func (s *ShardedScanner) list(count int) {
+	defer close(s.batches)
+
+	shards := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < s.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for shard := range shards {
+				if s.Versions != nil {
+					s.listVersionShard(shard, count)
+				} else {
+					s.listShard(shard, count)
+				}
+			}
+		}()
+	}
+
+	if s.Versions != nil {
+		s.findVersionShards(shards, count)
+	} else {
+		s.findShards(shards, count)
+	}
+	close(shards)
+	wg.Wait()
+}
+
+// findShards sends the shards of the prefix, and the objects directly
+// under it.
+func (s *ShardedScanner) findShards(shards chan<- string, count int) {
+	var token *string
+	for s.Err() == nil {
+		var resp *s3.ListObjectsV2Output
+		err := withCredentials(func() (err error) {
+			params := &s3.ListObjectsV2Input{
+				Bucket:            aws.String(s.Bucket),
+				ContinuationToken: token,
+				Delimiter:         aws.String(shardDelimiter),
+				MaxKeys:           aws.Int64(int64(count)),
+				Prefix:            aws.String(s.Prefix),
+			}
+			if fetchOwner {
+				params.FetchOwner = aws.Bool(true)
+			}
+			resp, err = s.client.ListObjectsV2(params)
+			return err
+		})
+		if err != nil {
+			s.fail(err)
+			return
+		}
+		if len(resp.Contents) > 0 {
+			bs := &BucketScanner{}
+			bs.add(resp.Contents)
+			s.batches <- shardBatch{shard: s.Prefix, objects: bs.buf, details: bs.details}
+		}
+		for _, prefix := range resp.CommonPrefixes {
+			atomic.AddInt64(&s.shards, 1)
+			shards <- aws.StringValue(prefix.Prefix)
+		}
+		token = resp.NextContinuationToken
+		if !aws.BoolValue(resp.IsTruncated) || token == nil {
+			return
+		}
+	}
+}
+
+// findVersionShards sends the shards of the prefix, and lists the versions
+// directly under it as a shard of its own. When resuming, the listing
+// starts after their mark, past the shards found before, which are sent
+// first.
+func (s *ShardedScanner) findVersionShards(shards chan<- string, count int) {
+	found := func(shard string) {
+		atomic.AddInt64(&s.shards, 1)
+		shards <- shard
+	}
+	vs := s.Versions.under(s.Prefix)
+	vs.Delimiter = shardDelimiter
+	vs.Found = found
+	if s.Checkpoint != nil {
+		for _, shard := range s.Checkpoint.Pending(s.Prefix) {
+			found(shard)
+		}
+		vs.Found = func(shard string) {
+			if s.Checkpoint.Found(shard) {
+				found(shard)
+			}
+		}
+		if !s.Checkpoint.Resume(vs) {
+			return
+		}
+	}
+	s.listVersions(vs, count)
+}
+
+func (s *ShardedScanner) listShard(shard string, count int) {
+	bs, _ := NewBucketScanner(s.Bucket, shard, s.client)
+	for s.Err() == nil && bs.Scan(count) {
+		s.batches <- shardBatch{shard: shard, objects: bs.Objects(), details: bs.Details()}
+	}
+	if err := bs.Err(); err != nil {
+		s.fail(err)
+	}
+}
+
+// listVersionShard lists the versions of a shard, resuming from its mark.
+func (s *ShardedScanner) listVersionShard(shard string, count int) {
+	vs := s.Versions.under(shard)
+	if s.Checkpoint != nil && !s.Checkpoint.Resume(vs) {
+		return
+	}
+	s.listVersions(vs, count)
+}
+
+// listVersions sends the versions listed by the scanner, then the end of
+// its shard.
+func (s *ShardedScanner) listVersions(vs *VersionScanner, count int) {
+	for s.Err() == nil && vs.Scan(count) {
+		s.batches <- shardBatch{shard: vs.Prefix, objects: vs.Objects(), details: vs.Details(), markers: vs.Markers(), mark: vs.Mark()}
+	}
+	if err := vs.Err(); err != nil {
+		s.fail(err)
+		return
+	}
+	if s.Checkpoint != nil && s.Err() == nil {
+		s.batches <- shardBatch{shard: vs.Prefix, listed: true}
+	}
+}
+
+// fail records the first listing error, which stops the other listings.
+func (s *ShardedScanner) fail(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err == nil {
+		s.err = err
+	}
+}
+
+func (s *ShardedScanner) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+func (s *ShardedScanner) Objects() []*s3.ObjectIdentifier {
+	return s.buf
+}
+
+func (s *ShardedScanner) Details() map[*s3.ObjectIdentifier]*s3.Object {
+	return s.details
+}
+
+func (s *ShardedScanner) Markers() map[*s3.ObjectIdentifier]bool {
+	return s.markers
+}
+
+// Shard returns the shard the last batch was listed under.
+func (s *ShardedScanner) Shard() string {
+	return s.shard
+}
+
+// Mark returns where the shard of the last batch resumes from after it.
+func (s *ShardedScanner) Mark() *ShardMark {
+	return s.mark
+}
+
+func (s *ShardedScanner) EmittedKeys() int64 {
+	return atomic.LoadInt64(&s.emitted)
+}
+
+// EstimatedTotal returns the Estimate, if one was set.
+func (s *ShardedScanner) EstimatedTotal() (int64, bool) {
+	return s.Estimate, s.Estimate > 0
+}
+
+// WriteSummary writes the number of shards listed.
+func (s *ShardedScanner) WriteSummary(w io.Writer) {
+	fmt.Fprintf(w, "listing: %d shards under %q\n", atomic.LoadInt64(&s.shards), s.Prefix)
+}
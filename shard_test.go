@@ -0,0 +1,173 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// listedBatch is a batch read from a scanner listing versions by shard.
+type listedBatch struct {
+	shard    string
+	versions []string
+	markers  int
+}
+
+// readShards reads every batch of the scanner, dispatching each to the
+// checkpoint, if any, before reading the next one as a run does.
+func readShards(t *testing.T, s *ShardedScanner) []listedBatch {
+	t.Helper()
+	var batches []listedBatch
+	for s.Scan(2) {
+		batch := listedBatch{shard: s.Shard()}
+		for _, object := range s.Objects() {
+			batch.versions = append(batch.versions, aws.StringValue(object.Key)+"@"+aws.StringValue(object.VersionId))
+			if s.Markers()[object] {
+				batch.markers++
+			}
+		}
+		if s.Checkpoint != nil {
+			s.Checkpoint.Dispatch(uint64(len(batches)), batch.shard, s.Mark())
+		}
+		batches = append(batches, batch)
+	}
+	if err := s.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return batches
+}
+
+// newVersionBucket returns a mock S3 holding versions directly under the
+// prefix and under several shards, and the versions and delete markers
+// stored.
+func newVersionBucket(t *testing.T) (*mockS3, *s3.S3, []string, int) {
+	m, svc := newMockS3(t)
+	m.pageSize = 3
+	m.putVersions("p/top", 2, true)
+	m.putVersions("p/a/1", 3, false)
+	m.putVersions("p/a/2", 1, true)
+	m.putVersions("p/b/c/1", 4, false)
+	m.putVersions("p/c/1", 1, false)
+	m.putVersions("p/d/1", 0, true)
+	m.putVersions("q/1", 2, false)
+	var all []string
+	markers := 0
+	for _, v := range m.versions {
+		if strings.HasPrefix(v.key, "p/") {
+			all = append(all, v.key+"@"+v.id)
+		}
+		if strings.HasPrefix(v.key, "p/") && v.marker {
+			markers++
+		}
+	}
+	sort.Strings(all)
+	return m, svc, all, markers
+}
+
+func newShardedVersionScanner(svc *s3.S3, concurrency int) *ShardedScanner {
+	ss := NewShardedScanner(mockBucket, "p/", concurrency, svc)
+	ss.Versions = NewVersionScanner(mockBucket, "p/", svc)
+	return ss
+}
+
+func TestShardedVersionListing(t *testing.T) {
+	for _, concurrency := range []int{1, 2, 8} {
+		_, svc, all, markers := newVersionBucket(t)
+		ss := newShardedVersionScanner(svc, concurrency)
+		var listed []string
+		var listedMarkers int
+		for _, batch := range readShards(t, ss) {
+			for _, version := range batch.versions {
+				if !strings.HasPrefix(version, batch.shard) {
+					t.Errorf("%s listed under shard %s", version, batch.shard)
+				}
+			}
+			listed = append(listed, batch.versions...)
+			listedMarkers += batch.markers
+		}
+		sort.Strings(listed)
+		if strings.Join(listed, " ") != strings.Join(all, " ") {
+			t.Errorf("concurrency %d: listed %q, want %q", concurrency, listed, all)
+		}
+		if listedMarkers != markers {
+			t.Errorf("concurrency %d: listed %d delete markers, want %d", concurrency, listedMarkers, markers)
+		}
+	}
+}
+
+func TestShardedVersionListingResumes(t *testing.T) {
+	tests := []struct {
+		name string
+		// complete reports whether the batch of the first run completes
+		complete func(seq int) bool
+	}{
+		{"nothing completed", func(int) bool { return false }},
+		{"everything completed", func(int) bool { return true }},
+		{"every other batch completed", func(seq int) bool { return seq%2 == 0 }},
+		{"first batches completed", func(seq int) bool { return seq < 4 }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, svc, all, _ := newVersionBucket(t)
+			checkpoint := NewShardCheckpoint(nil)
+			ss := newShardedVersionScanner(svc, 4)
+			ss.Checkpoint = checkpoint
+
+			// the batches of each shard, in the order they were dispatched
+			batches := readShards(t, ss)
+			byShard := make(map[string][]int)
+			for seq, batch := range batches {
+				byShard[batch.shard] = append(byShard[batch.shard], seq)
+			}
+			for seq := range batches {
+				if tt.complete(seq) {
+					checkpoint.Complete(uint64(seq))
+				}
+			}
+
+			// the versions dealt with are those of the first batches of each
+			// shard that all completed, the rest are listed again
+			dealt := make(map[string]bool)
+			done := make(map[string]bool)
+			for shard, seqs := range byShard {
+				done[shard] = true
+				for _, seq := range seqs {
+					if !tt.complete(seq) {
+						done[shard] = false
+						break
+					}
+					for _, version := range batches[seq].versions {
+						dealt[version] = true
+					}
+				}
+			}
+			var want []string
+			for _, version := range all {
+				if !dealt[version] {
+					want = append(want, version)
+				}
+			}
+
+			before := len(m.requested())
+			ss = newShardedVersionScanner(svc, 4)
+			ss.Checkpoint = NewShardCheckpoint(checkpoint.Marks())
+			var listed []string
+			for _, batch := range readShards(t, ss) {
+				listed = append(listed, batch.versions...)
+			}
+			sort.Strings(listed)
+			if strings.Join(listed, " ") != strings.Join(want, " ") {
+				t.Errorf("listed %q when resuming, want %q", listed, want)
+			}
+			// shards done with aren't listed again
+			for _, request := range m.requested()[before:] {
+				if shard := strings.TrimPrefix(request, "ListObjectVersions "); shard != "p/" && done[shard] {
+					t.Errorf("shard %s listed again once done with", shard)
+				}
+			}
+		})
+	}
+}
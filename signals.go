@@ -0,0 +1,85 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+var (
+	interruptMu    sync.Mutex
+	interruptHooks []func()
+	interruptOnce  sync.Once
+	shutdownHooks  []func(os.Signal)
+)
+
+// OnInterrupt registers a function to run when the process is interrupted
+// or terminated, before it exits. Hooks run in reverse order of
+// registration, like deferred calls.
+func OnInterrupt(hook func()) {
+	watchSignals()
+	interruptMu.Lock()
+	defer interruptMu.Unlock()
+	interruptHooks = append(interruptHooks, hook)
+}
+
+// OnShutdown makes the first interrupt call stop, with the signal received,
+// rather than exit, so the run can wind down on its own. A second interrupt
+// exits as usual. Stop functions run in order of registration.
+func OnShutdown(stop func(os.Signal)) {
+	watchSignals()
+	interruptMu.Lock()
+	defer interruptMu.Unlock()
+	shutdownHooks = append(shutdownHooks, stop)
+}
+
+// OnPause calls pause when the process receives SIGUSR1, and resume when it
+// receives SIGUSR2.
+func OnPause(pause func(), resume func()) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1, syscall.SIGUSR2)
+	go func() {
+		for sig := range signals {
+			if sig == syscall.SIGUSR1 {
+				pause()
+			} else {
+				resume()
+			}
+		}
+	}()
+}
+
+// signalName returns the conventional name of the signals s3rm watches.
+func signalName(sig os.Signal) string {
+	if sig == syscall.SIGTERM {
+		return "SIGTERM"
+	}
+	return "SIGINT"
+}
+
+func watchSignals() {
+	interruptOnce.Do(func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		go func() {
+			for sig := range signals {
+				interruptMu.Lock()
+				stops := shutdownHooks
+				shutdownHooks = nil
+				hooks := interruptHooks
+				interruptMu.Unlock()
+				if len(stops) > 0 {
+					for _, stop := range stops {
+						stop(sig)
+					}
+					continue
+				}
+				for i := len(hooks) - 1; i >= 0; i-- {
+					hooks[i]()
+				}
+				os.Exit(ExitCodeError)
+			}
+		}()
+	})
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// sizeUnits are the units sizes can be given in, longest suffixes first.
+var sizeUnits = []struct {
+	suffix string
+	bytes  int64
+}{
+	{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30}, {"TiB", 1 << 40},
+	{"KB", 1e3}, {"MB", 1e6}, {"GB", 1e9}, {"TB", 1e12},
+	{"K", 1 << 10}, {"M", 1 << 20}, {"G", 1 << 30}, {"T", 1 << 40},
+	{"B", 1},
+}
+
+// ByteSize is a flag holding a size in bytes, optionally with a unit, such
+// as 512, 10MB or 1GiB. Negative sizes mean no size was given.
+type ByteSize int64
+
+func (b *ByteSize) String() string {
+	if *b < 0 {
+		return ""
+	}
+	return strconv.FormatInt(int64(*b), 10)
+}
+
+func (b *ByteSize) Set(value string) error {
+	number, unit := value, int64(1)
+	for _, u := range sizeUnits {
+		if strings.HasSuffix(value, u.suffix) {
+			number, unit = strings.TrimSpace(strings.TrimSuffix(value, u.suffix)), u.bytes
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(number, 64)
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid size %q", value)
+	}
+	*b = ByteSize(n * float64(unit))
+	return nil
+}
+
+// minSizeFilter spares objects smaller than size.
+func minSizeFilter(size int64) Filter {
+	return DetailFilterFunc(func(detail *s3.Object) bool {
+		return detail.Size == nil || aws.Int64Value(detail.Size) < size
+	})
+}
+
+// maxSizeFilter spares objects larger than size.
+func maxSizeFilter(size int64) Filter {
+	return DetailFilterFunc(func(detail *s3.Object) bool {
+		return detail.Size == nil || aws.Int64Value(detail.Size) > size
+	})
+}
+
+// directoryMarkerFilter spares everything but directory markers, the empty
+// objects with a key ending in / that consoles and some SDKs create as
+// folder placeholders.
+func directoryMarkerFilter() Filter {
+	return DetailFilterFunc(func(detail *s3.Object) bool {
+		return detail.Size == nil || aws.Int64Value(detail.Size) != 0 || !strings.HasSuffix(aws.StringValue(detail.Key), "/")
+	})
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// ReadDeletedKeys reads the keys recorded as deleted in the output of an
+// earlier run on bucket, in the text or CSV format, the metadata of a CSV
+// output being read from its metadata file. Keys of its -failed lines
+// weren't deleted and are left out. A file without s3rm metadata is read as
+// a plain list of keys, one per line.
+func ReadDeletedKeys(path string, bucket string) (map[string]bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	// a CSV output keeps its metadata in a file of its own
+	meta, err := readMetadataFile(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range meta {
+		if err := checkDeletedMetadata(path, bucket, line); err != nil {
+			return nil, err
+		}
+	}
+
+	keys := make(map[string]bool)
+	output := len(meta) > 0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if isMetadataLine(line) {
+			output = true
+			if err := checkDeletedMetadata(path, bucket, line); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if key, ok := deletedKey(line, output); ok {
+			keys[key] = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// checkDeletedMetadata checks that a metadata line of the output at path
+// doesn't rule out reading it as the keys deleted from bucket.
+func checkDeletedMetadata(path string, bucket string, line string) error {
+	switch strings.TrimPrefix(line, metadataPrefix) {
+	case "dryrun=true":
+		return fmt.Errorf("%s is the output of a dry run, nothing was deleted", path)
+	case "bucket=" + bucket:
+	default:
+		if strings.HasPrefix(line, metadataPrefix+"bucket=") {
+			return fmt.Errorf("%s is the output of a run on another bucket than %s", path, bucket)
+		}
+	}
+	return nil
+}
+
+// deletedKey returns the key of a line of an output file: a text line
+// starting with outputKeyPrefix, or a CSV row of the key and the time it was
+// deleted.
+func deletedKey(line string, output bool) (string, bool) {
+	if !output {
+		return line, line != ""
+	}
+	if key := strings.TrimPrefix(line, outputKeyPrefix); key != line {
+		return key, true
+	}
+	if strings.HasPrefix(line, failedKeyPrefix) {
+		return "", false
+	}
+	record, err := csv.NewReader(strings.NewReader(line)).Read()
+	if err != nil || len(record) != 2 {
+		return "", false
+	}
+	if _, err := time.Parse(time.RFC3339, record[1]); err != nil {
+		return "", false
+	}
+	return record[0], true
+}
+
+// skipFromFilter spares the keys an earlier run already deleted.
+func skipFromFilter(deleted map[string]bool) Filter {
+	return FilterFunc(func(object *s3.ObjectIdentifier) bool {
+		return deleted[aws.StringValue(object.Key)]
+	})
+}
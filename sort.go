@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bufio"
+	"container/heap"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync/atomic"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// DefaultSortRunKeys is how many keys are sorted in memory before they are
+// written to a temporary file, to be merged with the other runs.
+const DefaultSortRunKeys = 1000000
+
+// SortedScanner reads every key of another scanner, then returns them
+// sorted and without duplicates, so keys listed twice are deleted once and
+// batches cover neighbouring keys. Lists too large to sort in memory are
+// sorted in runs of RunKeys keys, spilled to temporary files in Dir and
+// merged. Version IDs are kept, and a key is only a duplicate of the same
+// key with the same version.
+type SortedScanner struct {
+	Scanner Scanner
+	Dir     string
+	RunKeys int
+	started bool
+	keys    []sortKey
+	runs    []*sortRun
+	merge   sortHeap
+	last    *sortKey
+	buf     []*s3.ObjectIdentifier
+	err     error
+	read    int64
+	emitted int64
+	dropped int64
+	spilled int64
+}
+
+type sortKey struct {
+	key     string
+	version string
+}
+
+func (k sortKey) less(o sortKey) bool {
+	if k.key != o.key {
+		return k.key < o.key
+	}
+	return k.version < o.version
+}
+
+func NewSortedScanner(scanner Scanner, dir string) *SortedScanner {
+	return &SortedScanner{
+		Scanner: scanner,
+		Dir:     dir,
+		RunKeys: DefaultSortRunKeys,
+	}
+}
+
+func (s *SortedScanner) Scan(count int) bool {
+	if !s.started {
+		s.started = true
+		if err := s.load(); err != nil {
+			s.err = err
+			s.close()
+			return false
+		}
+	}
+
+	s.buf = nil
+	for len(s.buf) < count {
+		k, ok, err := s.next()
+		if err != nil {
+			s.err = err
+			s.close()
+			return false
+		}
+		if !ok {
+			break
+		}
+		if s.last != nil && *s.last == k {
+			atomic.AddInt64(&s.dropped, 1)
+			continue
+		}
+		s.last = &k
+		object := &s3.ObjectIdentifier{Key: aws.String(k.key)}
+		if k.version != "" {
+			object.VersionId = aws.String(k.version)
+		}
+		s.buf = append(s.buf, object)
+	}
+	if len(s.buf) == 0 {
+		s.close()
+		return false
+	}
+	atomic.AddInt64(&s.emitted, int64(len(s.buf)))
+	return true
+}
+
+// load reads the keys of the scanner, spilling them to runs when there are
+// too many to keep in memory.
+func (s *SortedScanner) load() error {
+	for s.Scanner.Scan(DefaultBatchSize) {
+		objects := s.Scanner.Objects()
+		for _, object := range objects {
+			s.keys = append(s.keys, sortKey{aws.StringValue(object.Key), aws.StringValue(object.VersionId)})
+		}
+		atomic.AddInt64(&s.read, int64(len(objects)))
+		if len(s.keys) >= s.RunKeys {
+			if err := s.spill(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := s.Scanner.Err(); err != nil {
+		return err
+	}
+
+	sort.Slice(s.keys, func(i, j int) bool { return s.keys[i].less(s.keys[j]) })
+	if len(s.runs) == 0 {
+		return nil
+	}
+	if len(s.keys) > 0 {
+		if err := s.spill(); err != nil {
+			return err
+		}
+	}
+	for _, run := range s.runs {
+		if _, err := run.f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		run.r = bufio.NewReader(run.f)
+		ok, err := run.advance()
+		if err != nil {
+			return err
+		}
+		if ok {
+			s.merge = append(s.merge, run)
+		}
+	}
+	heap.Init(&s.merge)
+	return nil
+}
+
+// spill sorts the keys in memory and writes them to a new run, as a key and
+// a version ID per record, each ended by a NUL byte.
+func (s *SortedScanner) spill() error {
+	sort.Slice(s.keys, func(i, j int) bool { return s.keys[i].less(s.keys[j]) })
+	f, err := ioutil.TempFile(s.Dir, "s3rm-sort-")
+	if err != nil {
+		return err
+	}
+	s.runs = append(s.runs, &sortRun{f: f})
+	w := bufio.NewWriter(f)
+	for _, k := range s.keys {
+		w.WriteString(k.key)
+		w.WriteByte(0)
+		w.WriteString(k.version)
+		w.WriteByte(0)
+	}
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("sort: %s", err)
+	}
+	atomic.AddInt64(&s.spilled, 1)
+	s.keys = s.keys[:0]
+	return nil
+}
+
+// next returns the smallest key left, from memory or from the runs.
+func (s *SortedScanner) next() (sortKey, bool, error) {
+	if len(s.runs) == 0 {
+		if len(s.keys) == 0 {
+			return sortKey{}, false, nil
+		}
+		k := s.keys[0]
+		s.keys = s.keys[1:]
+		return k, true, nil
+	}
+
+	if len(s.merge) == 0 {
+		return sortKey{}, false, nil
+	}
+	run := s.merge[0]
+	k := run.head
+	ok, err := run.advance()
+	if err != nil {
+		return k, false, err
+	}
+	if ok {
+		heap.Fix(&s.merge, 0)
+	} else {
+		heap.Pop(&s.merge)
+	}
+	return k, true, nil
+}
+
+// close removes the runs.
+func (s *SortedScanner) close() {
+	for _, run := range s.runs {
+		run.f.Close()
+		os.Remove(run.f.Name())
+	}
+	s.runs, s.merge, s.keys = nil, nil, nil
+}
+
+// Unwrap returns the scanner the keys are read from.
+func (s *SortedScanner) Unwrap() Scanner {
+	return s.Scanner
+}
+
+func (s *SortedScanner) Err() error {
+	return s.err
+}
+
+func (s *SortedScanner) Objects() []*s3.ObjectIdentifier {
+	return s.buf
+}
+
+func (s *SortedScanner) EmittedKeys() int64 {
+	return atomic.LoadInt64(&s.emitted)
+}
+
+// EstimatedTotal is the number of keys read, less the duplicates dropped so
+// far, once every key was read.
+func (s *SortedScanner) EstimatedTotal() (int64, bool) {
+	if !s.started {
+		return 0, false
+	}
+	total := atomic.LoadInt64(&s.read) - atomic.LoadInt64(&s.dropped)
+	return total, total > 0
+}
+
+// WriteSummary writes the number of duplicates dropped and runs spilled.
+func (s *SortedScanner) WriteSummary(w io.Writer) {
+	fmt.Fprintf(w, "sort: %d keys read, %d duplicates dropped, %d runs spilled to disk\n", atomic.LoadInt64(&s.read), atomic.LoadInt64(&s.dropped), atomic.LoadInt64(&s.spilled))
+}
+
+// sortRun is a sorted run spilled to a temporary file.
+type sortRun struct {
+	f    *os.File
+	r    *bufio.Reader
+	head sortKey
+}
+
+// advance reads the next record of the run into head. It returns false at
+// the end of the run.
+func (r *sortRun) advance() (bool, error) {
+	key, err := r.r.ReadString(0)
+	if err == io.EOF && key == "" {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("sort: %s", err)
+	}
+	version, err := r.r.ReadString(0)
+	if err != nil {
+		return false, fmt.Errorf("sort: %s: truncated run", r.f.Name())
+	}
+	r.head = sortKey{key[:len(key)-1], version[:len(version)-1]}
+	return true, nil
+}
+
+// sortHeap merges runs, with the run holding the smallest key on top.
+type sortHeap []*sortRun
+
+func (h sortHeap) Len() int           { return len(h) }
+func (h sortHeap) Less(i, j int) bool { return h[i].head.less(h[j].head) }
+func (h sortHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+func (h *sortHeap) Push(x interface{}) {
+	*h = append(*h, x.(*sortRun))
+}
+
+func (h *sortHeap) Pop() interface{} {
+	old := *h
+	run := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return run
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Source is an input source of the keys to delete. Sources register
+// themselves with RegisterSource from an init function, and are selected by
+// name with -source, or by their own flags.
+type Source struct {
+	Name string
+	// KeyList is set for sources reading a list of keys, rather than
+	// listing the prefixes. Their keys are then only deleted if they are
+	// under one of the prefixes, if any.
+	KeyList bool
+	// Details is set for sources listing objects along with their size,
+	// age and storage class, which some filters need.
+	Details bool
+	// Selected reports whether the flags ask for the source, for runs
+	// without -source.
+	Selected func(env *SourceEnv) bool
+	// Flags registers the flags of the source, if it has its own.
+	Flags func(flags *flag.FlagSet)
+	// New creates the scanner of the source.
+	New func(env *SourceEnv) (Scanner, error)
+}
+
+// SourceEnv is what sources are created with.
+type SourceEnv struct {
+	Bucket   string
+	Prefixes []string
+	// Directory is set for S3 Express One Zone directory buckets.
+	Directory bool
+	Session   *session.Session
+	Client    *s3.S3
+	// ResumeAfter resumes the listing of the first prefix after this key,
+	// SkipKeys resumes a key file after this many keys.
+	ResumeAfter string
+	SkipKeys    int64
+	// Checkpoint resumes version listings from the marks of their shards.
+	Checkpoint *ShardCheckpoint
+}
+
+// UsageError is returned by sources for flags that can't be used as given.
+type UsageError string
+
+func (e UsageError) Error() string {
+	return string(e)
+}
+
+var sources = make(map[string]*Source)
+
+// RegisterSource makes a source available. It panics if a source with the
+// same name is already registered.
+func RegisterSource(source *Source) {
+	if _, ok := sources[source.Name]; ok {
+		panic("source " + source.Name + " is registered twice")
+	}
+	sources[source.Name] = source
+}
+
+// SourceNames returns the names of the registered sources, sorted.
+func SourceNames() []string {
+	var names []string
+	for name := range sources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// SelectSource returns the named source, or without a name, the source the
+// flags ask for. Key lists are given precedence over prefix listings, as
+// prefixes then restrict the keys of the list.
+func SelectSource(name string, env *SourceEnv) (*Source, error) {
+	if name != "" {
+		source, ok := sources[name]
+		if !ok {
+			return nil, UsageError(fmt.Sprintf("unknown source %q, use one of %s", name, strings.Join(SourceNames(), ", ")))
+		}
+		return source, nil
+	}
+
+	var lists, listings []*Source
+	for _, name := range SourceNames() {
+		source := sources[name]
+		switch {
+		case !source.Selected(env):
+		case source.KeyList:
+			lists = append(lists, source)
+		default:
+			listings = append(listings, source)
+		}
+	}
+	if len(lists) == 0 {
+		lists = listings
+	}
+	switch len(lists) {
+	case 0:
+		return nil, UsageError("Please provide an s3 prefix, an objects file or another -source")
+	case 1:
+		return lists[0], nil
+	}
+	var names []string
+	for _, source := range lists {
+		names = append(names, source.Name)
+	}
+	return nil, UsageError("Please provide only one input source, not " + strings.Join(names, " and "))
+}
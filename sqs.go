@@ -0,0 +1,402 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// DefaultQueueWait is how long a receive waits for messages, the longest
+// SQS allows.
+const DefaultQueueWait int64 = 20
+
+// maxQueueMessages is the most messages a receive or batch delete handles.
+const maxQueueMessages = 10
+
+// maxQueueVisibility is the longest SQS lets a message stay invisible.
+const maxQueueVisibility = 12 * time.Hour
+
+// QueueScanner reads keys from the messages of an SQS queue. A message body
+// is either an S3 event notification, optionally wrapped in an SNS
+// notification, or a list of keys, one per line. A message is deleted from
+// the queue, acknowledging it, only once every key it holds was deleted or
+// spared by a filter. Messages with keys that failed to delete become
+// visible again after the visibility timeout of the queue, and are retried.
+type QueueScanner struct {
+	URL    string
+	Bucket string
+	// Idle stops the scanner once the queue stayed empty this long. When
+	// zero, the queue is read until the run is interrupted.
+	Idle time.Duration
+	// MinAge holds back the messages of objects younger than this, by
+	// making them invisible until the objects are old enough. The age of an
+	// object is taken from the event time of its notification, or for lists
+	// of keys, from the time the message was sent.
+	MinAge   time.Duration
+	client   *sqs.SQS
+	ctx      context.Context
+	stop     context.CancelFunc
+	buf      []*s3.ObjectIdentifier
+	err      error
+	emitted  int64
+	ignored  int64
+	acked    int64
+	held     int64
+	lastSeen time.Time
+
+	mu sync.Mutex
+	// pending maps each key to the messages waiting for it to be deleted
+	pending map[string][]*queueMessage
+}
+
+type queueMessage struct {
+	handle *string
+	keys   int
+}
+
+func NewQueueScanner(url string, bucket string, client *sqs.SQS) *QueueScanner {
+	ctx, stop := context.WithCancel(context.Background())
+	return &QueueScanner{
+		URL:      url,
+		Bucket:   bucket,
+		client:   client,
+		ctx:      ctx,
+		stop:     stop,
+		lastSeen: time.Now(),
+		pending:  make(map[string][]*queueMessage),
+	}
+}
+
+// QueueRegion returns the region in the host name of a queue URL, such as
+// https://sqs.us-east-1.amazonaws.com/123456789012/queue, if any.
+func QueueRegion(queueURL string) string {
+	u, err := url.Parse(queueURL)
+	if err != nil {
+		return ""
+	}
+	parts := strings.Split(u.Hostname(), ".")
+	if len(parts) > 2 && parts[0] == "sqs" {
+		return parts[1]
+	}
+	return ""
+}
+
+func (s *QueueScanner) Scan(count int) bool {
+	s.buf = nil
+	wait := DefaultQueueWait
+	for len(s.buf) < count && s.ctx.Err() == nil {
+		resp, err := s.client.ReceiveMessageWithContext(s.ctx, &sqs.ReceiveMessageInput{
+			QueueUrl:                    aws.String(s.URL),
+			MessageSystemAttributeNames: []*string{aws.String(sqs.MessageSystemAttributeNameSentTimestamp)},
+			MaxNumberOfMessages:         aws.Int64(maxQueueMessages),
+			WaitTimeSeconds:             aws.Int64(wait),
+		})
+		// a stopped scanner returns what it already received
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == request.CanceledErrorCode {
+			break
+		}
+		if err != nil {
+			s.err = err
+			return false
+		}
+		if len(resp.Messages) == 0 {
+			// don't hold back a batch waiting for it to fill up
+			if len(s.buf) > 0 {
+				break
+			}
+			if s.Idle > 0 && time.Since(s.lastSeen) >= s.Idle {
+				return false
+			}
+			wait = DefaultQueueWait
+			continue
+		}
+		s.lastSeen = time.Now()
+		for _, message := range resp.Messages {
+			s.add(message)
+		}
+		wait = 0
+	}
+	if len(s.buf) == 0 {
+		return false
+	}
+	atomic.AddInt64(&s.emitted, int64(len(s.buf)))
+	return true
+}
+
+// Stop makes the scanner stop reading the queue, ending the scan once the
+// keys already received are returned. Messages received and not yet
+// acknowledged are received again after the visibility timeout.
+func (s *QueueScanner) Stop() {
+	s.stop()
+}
+
+// add reads the keys of a message. Messages without keys to delete are
+// acknowledged right away.
+func (s *QueueScanner) add(message *sqs.Message) {
+	keys, created, err := parseMessage(aws.StringValue(message.Body), s.Bucket)
+	if _, ok := err.(recordErrors); ok && len(keys) > 0 {
+		// the keys of the other records are deleted and the message acked
+		fmt.Fprintf(os.Stderr, "\nsqs: skipping records of message %s: %s\n", aws.StringValue(message.MessageId), err)
+	} else if err != nil {
+		fmt.Fprintf(os.Stderr, "\nsqs: ignoring message %s: %s\n", aws.StringValue(message.MessageId), err)
+		atomic.AddInt64(&s.ignored, 1)
+	}
+	if len(keys) == 0 {
+		s.delete([]*string{message.ReceiptHandle})
+		return
+	}
+	if created.IsZero() {
+		if sent, err := strconv.ParseInt(aws.StringValue(message.Attributes[sqs.MessageSystemAttributeNameSentTimestamp]), 10, 64); err == nil {
+			created = time.Unix(0, sent*int64(time.Millisecond))
+		}
+	}
+	if age := time.Since(created); s.MinAge > 0 && !created.IsZero() && age < s.MinAge {
+		s.hold(message, s.MinAge-age)
+		return
+	}
+
+	m := &queueMessage{handle: message.ReceiptHandle, keys: len(keys)}
+	s.mu.Lock()
+	for _, key := range keys {
+		if len(s.pending[key]) == 0 {
+			s.buf = append(s.buf, &s3.ObjectIdentifier{Key: aws.String(key)})
+		}
+		s.pending[key] = append(s.pending[key], m)
+	}
+	s.mu.Unlock()
+}
+
+// hold makes a message invisible for as long as it takes its objects to be
+// old enough, or as long as SQS allows, after which it is received again.
+func (s *QueueScanner) hold(message *sqs.Message, wait time.Duration) {
+	if wait > maxQueueVisibility {
+		wait = maxQueueVisibility
+	}
+	_, err := s.client.ChangeMessageVisibility(&sqs.ChangeMessageVisibilityInput{
+		QueueUrl:          aws.String(s.URL),
+		ReceiptHandle:     message.ReceiptHandle,
+		VisibilityTimeout: aws.Int64(int64(wait/time.Second) + 1),
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "\nsqs: %s\n", err)
+		return
+	}
+	atomic.AddInt64(&s.held, 1)
+}
+
+// s3Event is the part of an S3 event notification holding the keys.
+type s3Event struct {
+	Event   string `json:"Event"`
+	Records []struct {
+		EventTime time.Time `json:"eventTime"`
+		S3        struct {
+			Bucket struct {
+				Name string `json:"name"`
+			} `json:"bucket"`
+			Object struct {
+				Key string `json:"key"`
+			} `json:"object"`
+		} `json:"s3"`
+	} `json:"Records"`
+}
+
+// snsNotification wraps S3 event notifications delivered through SNS.
+type snsNotification struct {
+	Type    string `json:"Type"`
+	Message string `json:"Message"`
+}
+
+// recordErrors are the problems with the event records of a message that
+// were skipped, while its other records were read.
+type recordErrors []error
+
+func (e recordErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// parseMessage returns the keys of a message body, and for event
+// notifications, the time of the latest event. Records of other buckets
+// than bucket, or with keys that can't be decoded, are skipped and returned
+// as recordErrors, along with the keys of the other records.
+func parseMessage(body string, bucket string) ([]string, time.Time, error) {
+	var latest time.Time
+	if !strings.HasPrefix(strings.TrimSpace(body), "{") {
+		var keys []string
+		for _, line := range strings.Split(body, "\n") {
+			if line = strings.TrimSuffix(line, "\r"); line != "" {
+				keys = append(keys, line)
+			}
+		}
+		return keys, latest, nil
+	}
+
+	var notification snsNotification
+	if err := json.Unmarshal([]byte(body), &notification); err != nil {
+		return nil, latest, err
+	}
+	if notification.Type == "Notification" {
+		body = notification.Message
+	}
+	var event s3Event
+	if err := json.Unmarshal([]byte(body), &event); err != nil {
+		return nil, latest, err
+	}
+	// sent once when notifications are set up
+	if event.Event == "s3:TestEvent" {
+		return nil, latest, nil
+	}
+	var (
+		keys    []string
+		skipped recordErrors
+	)
+	for i, record := range event.Records {
+		if name := record.S3.Bucket.Name; name != bucket {
+			skipped = append(skipped, fmt.Errorf("record %d is about bucket %s", i, name))
+			continue
+		}
+		// keys of event notifications are URL encoded
+		key, err := url.QueryUnescape(record.S3.Object.Key)
+		if err != nil {
+			skipped = append(skipped, fmt.Errorf("record %d: %s", i, err))
+			continue
+		}
+		keys = append(keys, key)
+		if record.EventTime.After(latest) {
+			latest = record.EventTime
+		}
+	}
+	if len(skipped) > 0 {
+		return keys, latest, skipped
+	}
+	return keys, latest, nil
+}
+
+// Ack acknowledges the messages whose keys have all been deleted.
+func (s *QueueScanner) Ack(objects []*s3.ObjectIdentifier) {
+	var done []*string
+	s.mu.Lock()
+	for _, object := range objects {
+		key := aws.StringValue(object.Key)
+		for _, m := range s.pending[key] {
+			m.keys--
+			if m.keys == 0 {
+				done = append(done, m.handle)
+			}
+		}
+		delete(s.pending, key)
+	}
+	s.mu.Unlock()
+	s.delete(done)
+}
+
+// Nack forgets keys that failed to delete. Their messages aren't
+// acknowledged, and their keys are read again once they are redelivered.
+func (s *QueueScanner) Nack(objects []*s3.ObjectIdentifier) {
+	s.mu.Lock()
+	for _, object := range objects {
+		delete(s.pending, aws.StringValue(object.Key))
+	}
+	s.mu.Unlock()
+}
+
+// delete removes messages from the queue. Errors are only reported, as the
+// messages will be received again and their keys deleted again.
+func (s *QueueScanner) delete(handles []*string) {
+	for len(handles) > 0 {
+		n := len(handles)
+		if n > maxQueueMessages {
+			n = maxQueueMessages
+		}
+		var entries []*sqs.DeleteMessageBatchRequestEntry
+		for i, handle := range handles[:n] {
+			entries = append(entries, &sqs.DeleteMessageBatchRequestEntry{
+				Id:            aws.String(strconv.Itoa(i)),
+				ReceiptHandle: handle,
+			})
+		}
+		handles = handles[n:]
+
+		resp, err := s.client.DeleteMessageBatch(&sqs.DeleteMessageBatchInput{
+			QueueUrl: aws.String(s.URL),
+			Entries:  entries,
+		})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "\nsqs: %s\n", err)
+			continue
+		}
+		for _, failed := range resp.Failed {
+			fmt.Fprintf(os.Stderr, "\nsqs: %s\n", aws.StringValue(failed.Message))
+		}
+		atomic.AddInt64(&s.acked, int64(len(resp.Successful)))
+	}
+}
+
+func (s *QueueScanner) Err() error {
+	return s.err
+}
+
+func (s *QueueScanner) Objects() []*s3.ObjectIdentifier {
+	return s.buf
+}
+
+func (s *QueueScanner) EmittedKeys() int64 {
+	return atomic.LoadInt64(&s.emitted)
+}
+
+// EstimatedTotal is never known, as messages keep arriving.
+func (s *QueueScanner) EstimatedTotal() (int64, bool) {
+	return 0, false
+}
+
+// WriteSummary writes the number of messages acknowledged, ignored and held
+// back.
+func (s *QueueScanner) WriteSummary(w io.Writer) {
+	fmt.Fprintf(w, "sqs: %d messages acknowledged, %d ignored, %d held back\n", atomic.LoadInt64(&s.acked), atomic.LoadInt64(&s.ignored), atomic.LoadInt64(&s.held))
+}
+
+// Acked returns the number of messages acknowledged so far.
+func (s *QueueScanner) Acked() int64 {
+	return atomic.LoadInt64(&s.acked)
+}
+
+func init() {
+	RegisterSource(&Source{
+		Name:     "sqs",
+		KeyList:  true,
+		Selected: func(*SourceEnv) bool { return flagSQS != "" },
+		New: func(env *SourceEnv) (Scanner, error) {
+			if flagSQS == "" {
+				return nil, UsageError("Please provide the -sqs-queue to read the keys from")
+			}
+			config := &aws.Config{}
+			if region := QueueRegion(flagSQS); region != "" {
+				config.Region = aws.String(region)
+			}
+			client := sqs.New(env.Session, config)
+			uncounted(&client.Handlers)
+			qs := NewQueueScanner(flagSQS, env.Bucket, client)
+			qs.Idle = flagSQSIdle
+			qs.MinAge = flagMinAge
+			queue = qs
+			return qs, nil
+		},
+	})
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseMessageSkipsBadRecords(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		keys     []string
+		skipped  int
+		rejected bool
+	}{
+		{
+			name: "list of keys",
+			body: "a\r\nb\n\nc",
+			keys: []string{"a", "b", "c"},
+		},
+		{
+			name: "event",
+			body: `{"Records":[{"s3":{"bucket":{"name":"bucket"},"object":{"key":"a%2Fb+c"}}}]}`,
+			keys: []string{"a/b c"},
+		},
+		{
+			name:    "record of another bucket",
+			body:    `{"Records":[{"s3":{"bucket":{"name":"other"},"object":{"key":"x"}}},{"s3":{"bucket":{"name":"bucket"},"object":{"key":"a"}}}]}`,
+			keys:    []string{"a"},
+			skipped: 1,
+		},
+		{
+			name:    "key that can't be decoded",
+			body:    `{"Records":[{"s3":{"bucket":{"name":"bucket"},"object":{"key":"%zz"}}},{"s3":{"bucket":{"name":"bucket"},"object":{"key":"a"}}}]}`,
+			keys:    []string{"a"},
+			skipped: 1,
+		},
+		{
+			name:    "every record skipped",
+			body:    `{"Records":[{"s3":{"bucket":{"name":"other"},"object":{"key":"x"}}}]}`,
+			skipped: 1,
+		},
+		{
+			name:     "not JSON",
+			body:     `{"Records":`,
+			rejected: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keys, _, err := parseMessage(tt.body, mockBucket)
+			if !reflect.DeepEqual(keys, tt.keys) {
+				t.Errorf("got keys %q, want %q", keys, tt.keys)
+			}
+			skipped, ok := err.(recordErrors)
+			switch {
+			case tt.rejected && (err == nil || ok):
+				t.Errorf("got %v, want the message rejected", err)
+			case !tt.rejected && len(skipped) != tt.skipped:
+				t.Errorf("got %v, want %d records skipped", err, tt.skipped)
+			}
+		})
+	}
+}
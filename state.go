@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+)
+
+// StateSaveInterval is how often the -state-file is rewritten during a run.
+const StateSaveInterval = 5 * time.Second
+
+// RunState is the JSON document written to the -state-file, recording how
+// far a run got so -resume can continue it. Listings are resumed after the
+// high-water mark, key files after the offset of the mark: every key up to
+// there has been dealt with. Version listings are resumed from the mark of
+// each of their Shards instead.
+type RunState struct {
+	Bucket   string   `json:"bucket"`
+	Source   string   `json:"source"`
+	Prefixes []string `json:"prefixes,omitempty"`
+	File     string   `json:"file,omitempty"`
+	Dryrun   bool     `json:"dryrun"`
+	// Versions is the flag versions are listed with, if any, and Sharded
+	// is set when their prefixes are split into shards.
+	Versions string `json:"versions,omitempty"`
+	Sharded  bool   `json:"sharded,omitempty"`
+	// HighWaterMark and Offset are where the next run starts from, or the
+	// mark of each of the Shards of a version listing.
+	HighWaterMark string                `json:"high_water_mark,omitempty"`
+	Offset        int64                 `json:"offset,omitempty"`
+	Shards        map[string]*ShardMark `json:"shards,omitempty"`
+	// Deleted adds up the runs since the first one, Failed counts the keys
+	// of the last run that failed to delete, listed in the FailedFile if
+	// -failed was given. They are dealt with again when resuming, as they
+	// hold the mark back.
+	Deleted    int64     `json:"deleted"`
+	Failed     int64     `json:"failed"`
+	FailedFile string    `json:"failed_file,omitempty"`
+	Runs       int       `json:"runs"`
+	Complete   bool      `json:"complete"`
+	StartedAt  time.Time `json:"started_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+var (
+	// currentRun describes the run for its state, resumedState is the
+	// state of the run it resumes, if any
+	currentRun   *RunState
+	resumedState *RunState
+)
+
+// ReadRunState reads the state written by an earlier run.
+func ReadRunState(path string) (*RunState, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	state := &RunState{}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("%s is not a state file: %s", path, err)
+	}
+	return state, nil
+}
+
+// CheckResume returns an error if the state is of a different run than the
+// one described by current, which would make the resume point meaningless.
+func (s *RunState) CheckResume(current *RunState) error {
+	switch {
+	case s.Bucket != current.Bucket:
+		return fmt.Errorf("the state is of a run on bucket %s, not %s", s.Bucket, current.Bucket)
+	case s.Source != current.Source:
+		return fmt.Errorf("the state is of a run reading keys from %s, not %s", s.Source, current.Source)
+	case strings.Join(s.Prefixes, "\n") != strings.Join(current.Prefixes, "\n"):
+		return fmt.Errorf("the state is of a run under prefixes %q, not %q", s.Prefixes, current.Prefixes)
+	case s.File != current.File:
+		return fmt.Errorf("the state is of a run reading keys from %s, not %s", s.File, current.File)
+	case s.Versions != current.Versions:
+		return fmt.Errorf("the state is of a run listing versions with %q, not %q", s.Versions, current.Versions)
+	case s.Sharded && !current.Sharded:
+		return fmt.Errorf("the state is of a run with a -list-workers over 1, please resume it the same way")
+	case !s.Sharded && current.Sharded:
+		return fmt.Errorf("the state is of a run with a -list-workers of 1, please resume it the same way")
+	case s.Dryrun != current.Dryrun:
+		return fmt.Errorf("the state is of a run with -dryrun=%t, please resume it the same way", s.Dryrun)
+	}
+	return nil
+}
+
+// resumePoint describes where the run is resumed from.
+func (s *RunState) resumePoint() string {
+	if s.Source == "file" && s.Offset > 0 {
+		return fmt.Sprintf("key %d of %s", s.Offset, s.File)
+	}
+	if s.Source == "file" {
+		return "the start of " + s.File
+	}
+	if len(s.Shards) > 0 {
+		done := 0
+		for _, mark := range s.Shards {
+			if mark.Done {
+				done++
+			}
+		}
+		return fmt.Sprintf("the marks of %d prefixes, %d of them done with", len(s.Shards), done)
+	}
+	if s.HighWaterMark == "" {
+		return "the start of the listing"
+	}
+	return s.HighWaterMark
+}
+
+// ResumePrefixes returns the prefixes left to list after the mark, given
+// the prefixes listed in turn: those before the one the mark is under are
+// done with.
+func ResumePrefixes(prefixes []string, mark string) []string {
+	for i, prefix := range prefixes {
+		if strings.HasPrefix(mark, prefix) {
+			return prefixes[i:]
+		}
+	}
+	return prefixes
+}
+
+// runState is the state of the run so far, on top of the state of the run
+// it resumes, if any.
+func runState(complete bool) *RunState {
+	stats := Snapshot()
+	state := *currentRun
+	state.HighWaterMark = tracker.HighWaterMark()
+	if state.Source == "file" {
+		state.Offset = tracker.Offset()
+	}
+	// the marks start from those of the run resumed
+	if shardCheckpoint != nil {
+		state.Shards = shardCheckpoint.Marks()
+	}
+	state.Deleted = stats.Deleted
+	state.Failed = int64(retries.Len())
+	state.Runs = 1
+	state.Complete = complete
+	state.StartedAt = stats.StartedAt
+	state.UpdatedAt = stats.TakenAt
+	if state.Failed > 0 {
+		state.FailedFile = flagFailed
+	}
+	if resumed := resumedState; resumed != nil {
+		if state.HighWaterMark == "" {
+			state.HighWaterMark = resumed.HighWaterMark
+		}
+		if state.Offset == 0 {
+			state.Offset = resumed.Offset
+		}
+		state.Deleted += resumed.Deleted
+		state.Runs += resumed.Runs
+		state.StartedAt = resumed.StartedAt
+	}
+	return &state
+}
+
+// updateStateFile writes the state of the run if -state-file is set.
+func updateStateFile(complete bool) {
+	if flagStateFile == "" {
+		return
+	}
+	if err := writeJSONFile(flagStateFile, runState(complete)); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Stats is a point in time view of a run. Both the progress line and the
+// -progress-file snapshots are built from it.
+type Stats struct {
+	Phase          string
+	LastError      string
+	Listed         int64
+	EstimatedTotal int64 // zero when unknown
+	Queued         int64
+	Deleted        int64
+	DeletedBytes   int64         // only known for listed objects
+	RecentRate     int64         // objects deleted per second over the last seconds
+	Stalled        time.Duration // time without a delete completing, past StallThreshold
+	Failed         int64         // keys waiting to be retried
+	Skipped        int64         // keys spared by filters
+	Workers        int
+	Paused         bool
+	QueueDepth     int
+	QueueSize      int
+	Throttles      int64
+	Partitions     []PartitionRate
+	StartedAt      time.Time
+	TakenAt        time.Time
+}
+
+// Snapshot gathers the current Stats of the run. It is safe to call from any
+// goroutine while the run is going.
+func Snapshot() *Stats {
+	statusMu.Lock()
+	s := &Stats{
+		Phase:     phase,
+		LastError: lastError,
+	}
+	statusMu.Unlock()
+
+	s.Queued = atomic.LoadInt64(&totalObjects)
+	s.Deleted = atomic.LoadInt64(&totalDeletedObjects)
+	s.DeletedBytes = atomic.LoadInt64(&totalDeletedBytes)
+	s.RecentRate = recentDeletes.Rate(jobStart)
+	s.Stalled = recentDeletes.Stalled(jobStart, pool.Executing() > 0 && !pool.Paused(), StallThreshold)
+	s.Failed = retries.Len()
+	s.Skipped = filters.Spared()
+	s.Workers = pool.Workers()
+	s.Paused = pool.Paused()
+	s.QueueDepth = pool.Queued()
+	s.QueueSize = pool.QueueSize()
+	s.Throttles = pool.Throttles()
+	s.Partitions = pool.Rates()
+	s.StartedAt = jobStart
+	s.TakenAt = time.Now()
+	if ps, ok := scanner.(ProgressScanner); ok {
+		s.Listed = ps.EmittedKeys()
+		if total, ok := ps.EstimatedTotal(); ok {
+			s.EstimatedTotal = total
+		}
+	}
+	return s
+}
+
+// Rate returns the average number of objects deleted per second.
+func (s *Stats) Rate() int64 {
+	if seconds := int64(s.TakenAt.Sub(s.StartedAt).Seconds()); seconds > 0 {
+		return s.Deleted / seconds
+	}
+	return 0
+}
+
+// ETA returns the expected time left at the recent rate, if the total is
+// known.
+func (s *Stats) ETA() (time.Duration, bool) {
+	rate := s.RecentRate
+	if rate == 0 || s.EstimatedTotal <= s.Deleted {
+		return 0, false
+	}
+	return time.Duration((s.EstimatedTotal-s.Deleted)/rate) * time.Second, true
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSnapshotProgressIsMonotonic(t *testing.T) {
+	const total = 5000
+	keys := make([]string, total)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("k/%05d", i)
+	}
+	m, svc := newMockS3(t, keys...)
+	m.pageSize = 500
+	m.delay = 2 * time.Millisecond
+
+	// a run sets these up before dispatching
+	savedPool, savedScanner, savedRetries := pool, scanner, retries
+	savedBucket := flagBucket
+	t.Cleanup(func() {
+		pool, scanner, retries = savedPool, savedScanner, savedRetries
+		flagBucket = savedBucket
+	})
+	atomic.StoreInt64(&totalObjects, 0)
+	atomic.StoreInt64(&totalDeletedObjects, 0)
+	pool = NewPartitionPool(4, 8)
+	retries = NewRetryQueue(t.TempDir())
+	flagBucket = mockBucket
+	jobStart = time.Now()
+	bs, err := NewBucketScanner(mockBucket, "k/", svc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	scanner = bs
+	go func() {
+		for err := range pool.errors {
+			t.Error(err)
+		}
+	}()
+
+	// poll from another goroutine while the run is going
+	done := make(chan struct{})
+	polled := make(chan int)
+	go func() {
+		var prev Stats
+		midway := 0
+		for {
+			s := Snapshot()
+			if s.Listed < prev.Listed || s.Queued < prev.Queued || s.Deleted < prev.Deleted {
+				t.Errorf("progress went back: listed %d, queued %d, deleted %d after listed %d, queued %d, deleted %d",
+					s.Listed, s.Queued, s.Deleted, prev.Listed, prev.Queued, prev.Deleted)
+			}
+			if s.Deleted > s.Queued || s.Queued > s.Listed {
+				t.Errorf("deleted %d of %d queued out of %d listed", s.Deleted, s.Queued, s.Listed)
+			}
+			if s.Deleted > 0 && s.Deleted < total {
+				midway++
+			}
+			prev = *s
+			select {
+			case <-done:
+				polled <- midway
+				return
+			case <-time.After(time.Millisecond):
+			}
+		}
+	}()
+
+	dispatch(svc, bs, DefaultBatchSize, false)
+	pool.WaitIdle()
+	pool.Close()
+	pool.Wait()
+	close(done)
+	if midway := <-polled; midway == 0 {
+		t.Error("no snapshot was taken while deleting")
+	}
+
+	s := Snapshot()
+	if s.Listed != total || s.Queued != total || s.Deleted != total {
+		t.Errorf("got listed %d, queued %d, deleted %d, want %d each", s.Listed, s.Queued, s.Deleted, total)
+	}
+	if s.Failed != 0 {
+		t.Errorf("got %d failed keys", s.Failed)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// StorageClasses adds up the objects and bytes deleted by storage class, for
+// objects whose details are known.
+type StorageClasses struct {
+	mu      sync.Mutex
+	objects map[string]int64
+	bytes   map[string]int64
+}
+
+func NewStorageClasses() *StorageClasses {
+	return &StorageClasses{objects: make(map[string]int64), bytes: make(map[string]int64)}
+}
+
+// Add records a deleted object. Objects without a storage class are in the
+// STANDARD class, as S3 leaves it out of some listings.
+func (c *StorageClasses) Add(detail *s3.Object) {
+	class := aws.StringValue(detail.StorageClass)
+	if class == "" {
+		class = s3.ObjectStorageClassStandard
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.objects[class]++
+	c.bytes[class] += aws.Int64Value(detail.Size)
+}
+
+// WriteSummary writes the objects and bytes deleted, with the bytes of each
+// storage class, largest first. Nothing is written if no details were known.
+func (c *StorageClasses) WriteSummary(w io.Writer, dryrun bool, objects int64, bytes int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.objects) == 0 {
+		return
+	}
+	classes := make([]string, 0, len(c.bytes))
+	for class := range c.bytes {
+		classes = append(classes, class)
+	}
+	sort.Slice(classes, func(i, j int) bool {
+		if c.bytes[classes[i]] != c.bytes[classes[j]] {
+			return c.bytes[classes[i]] > c.bytes[classes[j]]
+		}
+		return classes[i] < classes[j]
+	})
+	parts := make([]string, len(classes))
+	for i, class := range classes {
+		parts[i] = fmt.Sprintf("%s: %s", class, formatBytes(c.bytes[class]))
+	}
+	verb := "deleted"
+	if dryrun {
+		verb = "would delete"
+	}
+	fmt.Fprintf(w, "size: %s %s objects, %s (%s)\n", verb, formatCount(objects), formatBytes(bytes), strings.Join(parts, ", "))
+}
+
+// formatCount formats a count with decimal units, such as 1.2M.
+func formatCount(n int64) string {
+	const unit = 1000
+	if n < unit {
+		return fmt.Sprintf("%d", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%c", float64(n)/float64(div), "kMGTPE"[exp])
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MaxTemplatePrefixes limits how many prefixes a template may expand to.
+const MaxTemplatePrefixes = 100000
+
+const templateDateLayout = "2006-01-02"
+
+var templateRange = regexp.MustCompile(`\{([^{}]*)\.\.([^{}]*)\}`)
+
+// ExpandPrefixTemplate expands every {start..end} range in the template into
+// the list of prefixes it describes. Ranges are either dates in YYYY-MM-DD
+// form, expanded day by day, or integers, which keep the zero padding of the
+// start value:
+//
+//	events/dt={2021-01-01..2021-01-03}/  => events/dt=2021-01-01/, ...
+//	shard={00..99}/                      => shard=00/, shard=01/, ...
+//
+// Dates can be written in another form with a strftime-like format after
+// the end date. Days giving the same prefix are only expanded once, so a
+// format without the day expands month by month:
+//
+//	logs/{2020-01-01..2020-03-31:%Y/%m/%d}/  => logs/2020/01/01/, ...
+//	logs/{2020-01-01..2020-03-31:%Y/%m}/     => logs/2020/01/, ...
+func ExpandPrefixTemplate(template string) ([]string, error) {
+	loc := templateRange.FindStringSubmatchIndex(template)
+	if loc == nil {
+		if strings.ContainsAny(template, "{}") {
+			return nil, fmt.Errorf("invalid prefix template %q: expected {start..end}", template)
+		}
+		return []string{template}, nil
+	}
+
+	values, err := expandRange(template[loc[2]:loc[3]], template[loc[4]:loc[5]])
+	if err != nil {
+		return nil, fmt.Errorf("invalid prefix template %q: %s", template, err)
+	}
+
+	// expand the remaining ranges of the template
+	rest, err := ExpandPrefixTemplate(template[loc[1]:])
+	if err != nil {
+		return nil, err
+	}
+	if len(values)*len(rest) > MaxTemplatePrefixes {
+		return nil, fmt.Errorf("prefix template %q expands to more than %d prefixes", template, MaxTemplatePrefixes)
+	}
+
+	var prefixes []string
+	for _, value := range values {
+		for _, suffix := range rest {
+			prefixes = append(prefixes, template[:loc[0]]+value+suffix)
+		}
+	}
+	return prefixes, nil
+}
+
+func expandRange(start, end string) ([]string, error) {
+	if from, err := time.Parse(templateDateLayout, start); err == nil {
+		format := "%Y-%m-%d"
+		if i := strings.IndexByte(end, ':'); i >= 0 {
+			end, format = end[:i], end[i+1:]
+			if err := checkDateFormat(format); err != nil {
+				return nil, err
+			}
+		}
+		to, err := time.Parse(templateDateLayout, end)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a date", end)
+		}
+		if to.Before(from) {
+			return nil, fmt.Errorf("range %s..%s is reversed", start, end)
+		}
+		var values []string
+		for day := from; !day.After(to); day = day.AddDate(0, 0, 1) {
+			if len(values) == MaxTemplatePrefixes {
+				return nil, fmt.Errorf("range %s..%s is too large", start, end)
+			}
+			value := formatDate(day, format)
+			if len(values) == 0 || values[len(values)-1] != value {
+				values = append(values, value)
+			}
+		}
+		return values, nil
+	}
+
+	if strings.ContainsRune(end, ':') {
+		return nil, fmt.Errorf("only date ranges can have a format")
+	}
+	from, err := strconv.Atoi(start)
+	if err != nil {
+		return nil, fmt.Errorf("%q is neither a date nor a number", start)
+	}
+	to, err := strconv.Atoi(end)
+	if err != nil {
+		return nil, fmt.Errorf("%q is not a number", end)
+	}
+	if to < from {
+		return nil, fmt.Errorf("range %s..%s is reversed", start, end)
+	}
+	if to-from >= MaxTemplatePrefixes {
+		return nil, fmt.Errorf("range %s..%s is too large", start, end)
+	}
+	format := "%d"
+	if len(start) > 1 && start[0] == '0' {
+		format = fmt.Sprintf("%%0%dd", len(start))
+	}
+	var values []string
+	for i := from; i <= to; i++ {
+		values = append(values, fmt.Sprintf(format, i))
+	}
+	return values, nil
+}
+
+// dateDirectives are the strftime directives date formats may use.
+var dateDirectives = map[byte]func(time.Time) string{
+	'Y': func(t time.Time) string { return t.Format("2006") },
+	'y': func(t time.Time) string { return t.Format("06") },
+	'm': func(t time.Time) string { return t.Format("01") },
+	'd': func(t time.Time) string { return t.Format("02") },
+	'j': func(t time.Time) string { return fmt.Sprintf("%03d", t.YearDay()) },
+	'%': func(time.Time) string { return "%" },
+}
+
+func checkDateFormat(format string) error {
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' {
+			continue
+		}
+		i++
+		if i == len(format) {
+			return fmt.Errorf("date format %q ends with %%", format)
+		}
+		if _, ok := dateDirectives[format[i]]; !ok {
+			return fmt.Errorf("date format %q has unknown directive %%%c, use %%Y, %%y, %%m, %%d or %%j", format, format[i])
+		}
+	}
+	return nil
+}
+
+// formatDate formats a day with a format checked by checkDateFormat.
+func formatDate(day time.Time, format string) string {
+	var b strings.Builder
+	for i := 0; i < len(format); i++ {
+		if format[i] == '%' {
+			i++
+			b.WriteString(dateDirectives[format[i]](day))
+			continue
+		}
+		b.WriteByte(format[i])
+	}
+	return b.String()
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const (
+	// DefaultVerifySample is the number of deleted keys -verify checks when
+	// it can't list them again.
+	DefaultVerifySample int = 1000
+
+	// VerifyExamples is the number of keys still present shown in the
+	// summary.
+	VerifyExamples int = 10
+)
+
+// KeySample keeps a uniform random sample of the keys deleted, using
+// reservoir sampling like the Preview.
+type KeySample struct {
+	mu     sync.Mutex
+	size   int
+	seen   int64
+	sample []*s3.ObjectIdentifier
+	rand   *rand.Rand
+}
+
+func NewKeySample(size int) *KeySample {
+	return &KeySample{size: size, rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+}
+
+// Add offers deleted objects to the sample.
+func (s *KeySample) Add(objects []*s3.ObjectIdentifier) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, object := range objects {
+		s.seen++
+		i := len(s.sample)
+		if i >= s.size {
+			i = int(s.rand.Int63n(s.seen))
+			if i >= s.size {
+				continue
+			}
+		}
+		if i == len(s.sample) {
+			s.sample = append(s.sample, object)
+		} else {
+			s.sample[i] = object
+		}
+	}
+}
+
+// Sample returns a copy of the current sample.
+func (s *KeySample) Sample() []*s3.ObjectIdentifier {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*s3.ObjectIdentifier(nil), s.sample...)
+}
+
+// Verification is what -verify found once the deletes were done.
+type Verification struct {
+	// Listed is set when the prefixes were listed again, rather than a
+	// sample of the deleted keys checked.
+	Listed  bool
+	Checked int64
+	// Present counts the objects still there, classified like Reconcile
+	// does: Failed existed before the run started, Created were written
+	// during it, and Replicated are replicas written back.
+	Present    int64
+	Failed     int64
+	Created    int64
+	Replicated int64
+	// Gone were listed again, but had disappeared when checked.
+	Gone     int64
+	Examples []string
+}
+
+// add records an object found again once the deletes were done.
+func (v *Verification) add(key string, class leftoverClass) {
+	switch class {
+	case leftoverGone:
+		v.Gone++
+		return
+	case leftoverReplicated:
+		v.Replicated++
+	case leftoverCreated:
+		v.Created++
+	default:
+		v.Failed++
+	}
+	v.Present++
+	if len(v.Examples) < VerifyExamples {
+		v.Examples = append(v.Examples, key)
+	}
+}
+
+// VerifyListing lists the prefixes again, like Reconcile, and classifies
+// the objects left that the filters don't spare.
+func VerifyListing(svc *s3.S3, bucket string, prefixes []string, since time.Time) (*Verification, error) {
+	v := &Verification{Listed: true}
+	var leftovers []*s3.ObjectIdentifier
+	err := listLeftovers(svc, bucket, prefixes, func(object *s3.Object, spared bool) {
+		v.Checked++
+		if !spared {
+			leftovers = append(leftovers, &s3.ObjectIdentifier{Key: object.Key})
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, object := range leftovers {
+		class, err := classifyLeftover(svc, bucket, object, since)
+		if err != nil {
+			return nil, err
+		}
+		v.add(aws.StringValue(object.Key), class)
+	}
+	return v, nil
+}
+
+// VerifySample checks that each of a sample of deleted objects is gone with
+// HeadObject, up to workers at a time, and classifies those still there.
+func VerifySample(svc *s3.S3, bucket string, sample []*s3.ObjectIdentifier, since time.Time, workers int) (*Verification, error) {
+	v := &Verification{Checked: int64(len(sample))}
+	var (
+		mu       sync.Mutex
+		wg       sync.WaitGroup
+		firstErr error
+	)
+	sem := make(chan struct{}, workers)
+	for _, object := range sample {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(object *s3.ObjectIdentifier) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			class, err := classifyLeftover(svc, bucket, object, since)
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case err != nil:
+				if firstErr == nil {
+					firstErr = err
+				}
+			case class != leftoverGone:
+				// a sampled key being gone is what was expected
+				v.add(aws.StringValue(object.Key), class)
+			}
+		}(object)
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return v, nil
+}
+
+func (v *Verification) WriteSummary(w io.Writer) {
+	if v.Listed {
+		fmt.Fprintf(w, "verify: listed %d objects again, %d left that should be gone", v.Checked, v.Present)
+	} else {
+		fmt.Fprintf(w, "verify: checked a sample of %d deleted keys, %d left that should be gone", v.Checked, v.Present)
+	}
+	if v.Present > 0 {
+		fmt.Fprintf(w, " (%d failed to delete, %d created during the run, %d replicated back)", v.Failed, v.Created, v.Replicated)
+	}
+	if v.Gone > 0 {
+		fmt.Fprintf(w, ", %d more gone when checked", v.Gone)
+	}
+	fmt.Fprintln(w)
+	if v.Replicated > 0 {
+		fmt.Fprintln(w, replicaHint)
+	}
+	for _, key := range v.Examples {
+		fmt.Fprintf(w, "  %s\n", key)
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func TestVerifyClassifiesLeftovers(t *testing.T) {
+	since := time.Now().Add(-time.Minute)
+	before, after := since.Add(-time.Hour), since.Add(time.Second)
+	objects := map[string]*mockObject{
+		"p/a": {lastModified: before},
+		"p/b": {lastModified: after},
+		"p/c": {lastModified: after, replication: s3.ReplicationStatusReplica},
+		"p/d": {lastModified: before},
+	}
+	setup := func(t *testing.T) *s3.S3 {
+		m, svc := newMockS3(t)
+		for key, object := range objects {
+			m.put(key, object)
+		}
+		m.gone = map[string]bool{"p/d": true}
+		return svc
+	}
+
+	t.Run("listing", func(t *testing.T) {
+		v, err := VerifyListing(setup(t), mockBucket, []string{"p/"}, since)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := Verification{Listed: true, Checked: 4, Present: 3, Failed: 1, Created: 1, Replicated: 1, Gone: 1}
+		if v.Checked != want.Checked || v.Present != want.Present || v.Failed != want.Failed ||
+			v.Created != want.Created || v.Replicated != want.Replicated || v.Gone != want.Gone {
+			t.Errorf("got %+v, want %+v", *v, want)
+		}
+		if len(v.Examples) != 3 {
+			t.Errorf("got examples %q, want the 3 objects left", v.Examples)
+		}
+	})
+
+	t.Run("sample", func(t *testing.T) {
+		var sample []*s3.ObjectIdentifier
+		for _, key := range []string{"p/a", "p/b", "p/c", "p/d", "p/e"} {
+			sample = append(sample, &s3.ObjectIdentifier{Key: aws.String(key)})
+		}
+		v, err := VerifySample(setup(t), mockBucket, sample, since, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := Verification{Checked: 5, Present: 3, Failed: 1, Created: 1, Replicated: 1}
+		if v.Checked != want.Checked || v.Present != want.Present || v.Failed != want.Failed ||
+			v.Created != want.Created || v.Replicated != want.Replicated || v.Gone != want.Gone {
+			t.Errorf("got %+v, want %+v", *v, want)
+		}
+	})
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// VersionScanner lists every version and delete marker under a prefix with
+// ListObjectVersions, so that deleting them frees the storage of a
+// versioned bucket instead of adding delete markers. Versions and
+// DeleteMarkers select what is emitted.
+//
+// With Noncurrent set, only noncurrent versions are emitted, leaving the
+// current version of each object, and delete markers, in place. A version
+// became noncurrent when the next newer version or delete marker of its key
+// was created; versions that have been noncurrent for less than
+// NoncurrentFor are kept too.
+//
+// With KeepVersions set, the newest KeepVersions versions of each key are
+// kept, whether current or not, and only older versions are emitted, again
+// leaving delete markers in place. NoncurrentFor applies to them as well.
+//
+// With a Delimiter, only the versions of the keys directly under the prefix
+// are listed, and Found is called with each common prefix beyond, as a
+// ShardedScanner splits a listing. A Checkpoint is told once the prefix was
+// listed, as long as the listing is read on the goroutine dispatching it.
+type VersionScanner struct {
+	Bucket          string
+	Prefix          string
+	Versions        bool
+	DeleteMarkers   bool
+	Noncurrent      bool
+	NoncurrentFor   time.Duration
+	KeepVersions    int
+	Delimiter       string
+	Found           func(prefix string)
+	Checkpoint      *ShardCheckpoint
+	client          *s3.S3
+	err             error
+	buf             []*s3.ObjectIdentifier
+	details         map[*s3.ObjectIdentifier]*s3.Object
+	markers         map[*s3.ObjectIdentifier]bool
+	emitted         int64
+	keyMarker       *string
+	versionIDMarker *string
+	done            bool
+	// the key and creation time of the last version or marker seen, carried
+	// over pages to know when the next version became noncurrent, and how
+	// many versions of that key were newer
+	lastKey  string
+	replaced time.Time
+	newer    int
+}
+
+// listedVersion is a version or delete marker of a page.
+type listedVersion struct {
+	id     *s3.ObjectIdentifier
+	detail *s3.Object
+	latest bool
+	marker bool
+}
+
+func NewVersionScanner(bucket string, prefix string, client *s3.S3) *VersionScanner {
+	return &VersionScanner{
+		Bucket:        bucket,
+		Prefix:        prefix,
+		Versions:      true,
+		DeleteMarkers: true,
+		client:        client,
+	}
+}
+
+// under returns a scanner listing the versions under prefix as s is set up
+// to.
+func (s *VersionScanner) under(prefix string) *VersionScanner {
+	return &VersionScanner{
+		Bucket:        s.Bucket,
+		Prefix:        prefix,
+		Versions:      s.Versions,
+		DeleteMarkers: s.DeleteMarkers,
+		Noncurrent:    s.Noncurrent,
+		NoncurrentFor: s.NoncurrentFor,
+		KeepVersions:  s.KeepVersions,
+		client:        s.client,
+	}
+}
+
+// ResumeAfter starts the listing after the version of the key, or at the
+// start if the key is empty.
+func (s *VersionScanner) ResumeAfter(key string, versionID string) {
+	s.keyMarker, s.versionIDMarker = nil, nil
+	if key != "" {
+		s.keyMarker = aws.String(key)
+	}
+	if key != "" && versionID != "" {
+		s.versionIDMarker = aws.String(versionID)
+	}
+}
+
+func (s *VersionScanner) Scan(count int) bool {
+	s.buf = nil
+	s.details = make(map[*s3.ObjectIdentifier]*s3.Object)
+	s.markers = make(map[*s3.ObjectIdentifier]bool)
+	for len(s.buf) == 0 {
+		if s.done {
+			if s.Checkpoint != nil {
+				s.Checkpoint.Listed(s.Prefix)
+			}
+			return false
+		}
+		var resp *s3.ListObjectVersionsOutput
+		err := withCredentials(func() (err error) {
+			params := &s3.ListObjectVersionsInput{
+				Bucket:          aws.String(s.Bucket),
+				KeyMarker:       s.keyMarker,
+				MaxKeys:         aws.Int64(int64(count)),
+				Prefix:          aws.String(s.Prefix),
+				VersionIdMarker: s.versionIDMarker,
+			}
+			if s.Delimiter != "" {
+				params.Delimiter = aws.String(s.Delimiter)
+			}
+			resp, err = s.client.ListObjectVersions(params)
+			return err
+		})
+		if err != nil {
+			s.err = err
+			return false
+		}
+		// shards are found before the versions next to them are deleted
+		if s.Found != nil {
+			for _, prefix := range resp.CommonPrefixes {
+				s.Found(aws.StringValue(prefix.Prefix))
+			}
+		}
+		var listed []listedVersion
+		for _, version := range resp.Versions {
+			listed = append(listed, listedVersion{
+				id: &s3.ObjectIdentifier{Key: version.Key, VersionId: version.VersionId},
+				detail: &s3.Object{
+					ETag:         version.ETag,
+					Key:          version.Key,
+					LastModified: version.LastModified,
+					Owner:        version.Owner,
+					Size:         version.Size,
+					StorageClass: version.StorageClass,
+				},
+				latest: aws.BoolValue(version.IsLatest),
+			})
+		}
+		for _, marker := range resp.DeleteMarkers {
+			listed = append(listed, listedVersion{
+				id: &s3.ObjectIdentifier{Key: marker.Key, VersionId: marker.VersionId},
+				detail: &s3.Object{
+					Key:          marker.Key,
+					LastModified: marker.LastModified,
+					Owner:        marker.Owner,
+					Size:         aws.Int64(0),
+				},
+				latest: aws.BoolValue(marker.IsLatest),
+				marker: true,
+			})
+		}
+		if s.Noncurrent || s.KeepVersions > 0 {
+			s.addNoncurrent(listed)
+		} else {
+			for _, v := range listed {
+				if (v.marker && s.DeleteMarkers) || (!v.marker && s.Versions) {
+					s.add(v)
+				}
+			}
+		}
+		s.keyMarker = resp.NextKeyMarker
+		s.versionIDMarker = resp.NextVersionIdMarker
+		s.done = !aws.BoolValue(resp.IsTruncated)
+	}
+	atomic.AddInt64(&s.emitted, int64(len(s.buf)))
+	return true
+}
+
+func (s *VersionScanner) add(v listedVersion) {
+	s.buf = append(s.buf, v.id)
+	s.details[v.id] = v.detail
+	if v.marker {
+		s.markers[v.id] = true
+	}
+}
+
+// addNoncurrent adds the versions of a page that have been noncurrent for
+// long enough, and that have at least KeepVersions newer versions. Versions
+// and delete markers are merged, each key's newest first, as the order S3
+// lists them in. Creation times only have a second's precision, so ties may
+// be merged out of order, which can only make a version look replaced later
+// than it was, and keep it.
+func (s *VersionScanner) addNoncurrent(listed []listedVersion) {
+	sort.SliceStable(listed, func(i, j int) bool {
+		ki, kj := aws.StringValue(listed[i].id.Key), aws.StringValue(listed[j].id.Key)
+		if ki != kj {
+			return ki < kj
+		}
+		return aws.TimeValue(listed[i].detail.LastModified).After(aws.TimeValue(listed[j].detail.LastModified))
+	})
+	now := time.Now()
+	for _, v := range listed {
+		key := aws.StringValue(v.id.Key)
+		if key != s.lastKey {
+			s.lastKey, s.replaced, s.newer = key, time.Time{}, 0
+		}
+		if !v.latest && !v.marker && !s.replaced.IsZero() && now.Sub(s.replaced) >= s.NoncurrentFor && s.newer >= s.KeepVersions {
+			s.add(v)
+		}
+		s.replaced = aws.TimeValue(v.detail.LastModified)
+		if !v.marker {
+			s.newer++
+		}
+	}
+}
+
+func (s *VersionScanner) Err() error {
+	return s.err
+}
+
+func (s *VersionScanner) Objects() []*s3.ObjectIdentifier {
+	return s.buf
+}
+
+func (s *VersionScanner) Details() map[*s3.ObjectIdentifier]*s3.Object {
+	return s.details
+}
+
+func (s *VersionScanner) Markers() map[*s3.ObjectIdentifier]bool {
+	return s.markers
+}
+
+// Shard returns the prefix listed, which the marks of a ShardCheckpoint are
+// kept by.
+func (s *VersionScanner) Shard() string {
+	return s.Prefix
+}
+
+// Mark returns where the listing resumes from once the last batch was dealt
+// with, taken from the markers S3 returned with its page rather than from
+// the versions in it: versions and delete markers are listed apart, and
+// their creation times are too coarse to merge them back in listing order.
+// It is nil once the listing is done.
+func (s *VersionScanner) Mark() *ShardMark {
+	if s.done {
+		return nil
+	}
+	return &ShardMark{KeyMarker: aws.StringValue(s.keyMarker), VersionIdMarker: aws.StringValue(s.versionIDMarker)}
+}
+
+func (s *VersionScanner) EmittedKeys() int64 {
+	return atomic.LoadInt64(&s.emitted)
+}
+
+// EstimatedTotal always returns false, listing gives no hint of the total.
+func (s *VersionScanner) EstimatedTotal() (int64, bool) {
+	return 0, false
+}
+
+// VersionCounts adds up the versions and delete markers deleted.
+type VersionCounts struct {
+	versions int64
+	markers  int64
+}
+
+// Add counts the objects deleted, markers being the delete markers among
+// them.
+func (c *VersionCounts) Add(objects []*s3.ObjectIdentifier, markers map[*s3.ObjectIdentifier]bool) {
+	var n int64
+	for _, object := range objects {
+		if markers[object] {
+			n++
+		}
+	}
+	atomic.AddInt64(&c.markers, n)
+	atomic.AddInt64(&c.versions, int64(len(objects))-n)
+}
+
+// WriteSummary writes the number of versions and delete markers deleted.
+func (c *VersionCounts) WriteSummary(w io.Writer, dryrun bool) {
+	verb := "deleted"
+	if dryrun {
+		verb = "would delete"
+	}
+	fmt.Fprintf(w, "versions: %s %d versions and %d delete markers\n", verb, atomic.LoadInt64(&c.versions), atomic.LoadInt64(&c.markers))
+}